@@ -119,15 +119,59 @@ type GenerateResponse struct {
 	CreatedAt time.Time `json:"created_at"`
 	Response  string    `json:"response,omitempty"`
 
+	// PromptProcessed is set on a single response sent once the prompt is evaluated, before the
+	// first generated token
+	PromptProcessed bool `json:"prompt_processed,omitempty"`
+
+	// PromptProgress reports how much of a long prompt has been evaluated, on responses sent
+	// before the first generated token when the server provides it
+	PromptProgress *PromptProgress `json:"prompt_progress,omitempty"`
+
+	// Tokens are the ids of the tokens generated since the previous response, only set when
+	// the want_tokens option is
+	Tokens []int `json:"tokens,omitempty"`
+
 	Done    bool  `json:"done"`
 	Context []int `json:"context,omitempty"`
 
+	// StopReason says why generation ended, on the final response, and StopWord is the stop
+	// sequence that ended it when the reason is StopReasonStopWord
+	StopReason StopReason `json:"stop_reason,omitempty"`
+	StopWord   string     `json:"stop_word,omitempty"`
+
 	TotalDuration      time.Duration `json:"total_duration,omitempty"`
 	LoadDuration       time.Duration `json:"load_duration,omitempty"`
 	PromptEvalCount    int           `json:"prompt_eval_count,omitempty"`
 	PromptEvalDuration time.Duration `json:"prompt_eval_duration,omitempty"`
 	EvalCount          int           `json:"eval_count,omitempty"`
 	EvalDuration       time.Duration `json:"eval_duration,omitempty"`
+
+	// DraftTotal is the number of tokens the draft model proposed with speculative decoding and
+	// DraftAccepted how many of them the model kept; a low ratio means the draft model slows
+	// generation down. Both are 0 without a draft model.
+	DraftTotal    int `json:"draft_total,omitempty"`
+	DraftAccepted int `json:"draft_accepted,omitempty"`
+}
+
+// StopReason is why a generation ended
+type StopReason string
+
+const (
+	// StopReasonEOS means the model emitted its end of sequence token and finished naturally
+	StopReasonEOS StopReason = "eos"
+	// StopReasonStopWord means the response matched one of the stop sequences
+	StopReasonStopWord StopReason = "stop_word"
+	// StopReasonLimit means num_predict tokens were generated, the response can be continued
+	StopReasonLimit StopReason = "limit"
+	// StopReasonContext means the context window filled up
+	StopReasonContext StopReason = "context"
+	// StopReasonStopped means the generation was stopped early, by a stop request or max_duration
+	StopReasonStopped StopReason = "stopped"
+)
+
+type PromptProgress struct {
+	Processed int `json:"processed"`
+	Total     int `json:"total"`
 }
 
 func (r *GenerateResponse) Summary() {
@@ -162,43 +206,132 @@ type Options struct {
 	Seed int `json:"seed,omitempty"`
 
 	// Backend options
-	UseNUMA bool `json:"numa,omitempty"`
+	UseNUMA      bool   `json:"numa,omitempty"`
+	NUMAStrategy string `json:"numa_strategy,omitempty"` // distribute, isolate or numactl; UseNUMA alone means distribute
 
 	// Model options
-	NumCtx             int     `json:"num_ctx,omitempty"`
-	NumKeep            int     `json:"num_keep,omitempty"`
-	NumBatch           int     `json:"num_batch,omitempty"`
-	NumGQA             int     `json:"num_gqa,omitempty"`
-	NumGPU             int     `json:"num_gpu,omitempty"`
-	MainGPU            int     `json:"main_gpu,omitempty"`
+	NumCtx      int       `json:"num_ctx,omitempty"`
+	NumKeep     int       `json:"num_keep,omitempty"`
+	NumBatch    int       `json:"num_batch,omitempty"`
+	NumUBatch   int       `json:"num_ubatch,omitempty"` // tokens computed at once within a batch, see the faq; defaults to num_batch
+	NumGQA      int       `json:"num_gqa,omitempty"`
+	NumGPU      int       `json:"num_gpu,omitempty"`
+	MainGPU     int       `json:"main_gpu,omitempty"`
+	TensorSplit []float32 `json:"tensor_split,omitempty"` // proportion of the model to offload to each gpu, e.g. [3, 1]
+
+	// SplitMode is how a model is spread over several gpus: layer (the default) puts whole layers on
+	// each gpu by tensor_split, row splits each layer's rows by tensor_split with main_gpu holding
+	// the intermediate results, and none keeps everything on main_gpu.
+	SplitMode string `json:"split_mode,omitempty"`
+	KVOffload bool   `json:"kv_offload,omitempty"` // disabling keeps the kv cache in system memory, which can avoid pcie traffic between gpus
+
+	// DefragThreshold defragments the kv cache when more than this fraction of it is fragmented.
+	// Long-lived servers running parallel requests fragment the cache over time, slowing prompt
+	// processing; defragmenting costs a short pause, so values around 0.1 suit most servers.
+	DefragThreshold float32 `json:"defrag_threshold,omitempty"`
+
 	LowVRAM            bool    `json:"low_vram,omitempty"`
 	F16KV              bool    `json:"f16_kv,omitempty"`
+	CacheTypeK         string  `json:"cache_type_k,omitempty"` // kv cache quantization, e.g. q8_0; takes precedence over f16_kv
+	CacheTypeV         string  `json:"cache_type_v,omitempty"`
 	LogitsAll          bool    `json:"logits_all,omitempty"`
 	VocabOnly          bool    `json:"vocab_only,omitempty"`
 	UseMMap            bool    `json:"use_mmap,omitempty"`
 	UseMLock           bool    `json:"use_mlock,omitempty"`
+	ForceMMap          bool    `json:"force_mmap,omitempty"` // keep mmap for models on network file systems, or over 4 GiB on windows, where it's disabled by default
 	EmbeddingOnly      bool    `json:"embedding_only,omitempty"`
+	EmbeddingEnabled   bool    `json:"embedding_enabled,omitempty"` // disabling skips the embedding output buffers, leaving more vram for context
+	PoolingType        string  `json:"pooling_type,omitempty"`      // how token embeddings are combined: none, mean, cls or last; empty uses the model's default
 	RopeFrequencyBase  float32 `json:"rope_frequency_base,omitempty"`
 	RopeFrequencyScale float32 `json:"rope_frequency_scale,omitempty"`
-
-	// Predict options
-	NumPredict       int      `json:"num_predict,omitempty"`
-	TopK             int      `json:"top_k,omitempty"`
-	TopP             float32  `json:"top_p,omitempty"`
-	TFSZ             float32  `json:"tfs_z,omitempty"`
-	TypicalP         float32  `json:"typical_p,omitempty"`
-	RepeatLastN      int      `json:"repeat_last_n,omitempty"`
-	Temperature      float32  `json:"temperature,omitempty"`
-	RepeatPenalty    float32  `json:"repeat_penalty,omitempty"`
-	PresencePenalty  float32  `json:"presence_penalty,omitempty"`
-	FrequencyPenalty float32  `json:"frequency_penalty,omitempty"`
-	Mirostat         int      `json:"mirostat,omitempty"`
-	MirostatTau      float32  `json:"mirostat_tau,omitempty"`
-	MirostatEta      float32  `json:"mirostat_eta,omitempty"`
-	PenalizeNewline  bool     `json:"penalize_newline,omitempty"`
+	MMProjPath         string  `json:"mmproj_path,omitempty"`       // multimodal projector for LLaVA-style models
+	SkipMemoryCheck    bool    `json:"skip_memory_check,omitempty"` // load cpu-only models even when they look too big for available memory
+	DraftModelPath     string  `json:"draft_model_path,omitempty"`  // smaller model with the same vocabulary for speculative decoding
+	DraftTokens        int     `json:"draft_tokens,omitempty"`      // tokens the draft model proposes per step, defaults to 16
+
+	// ChatTemplate overrides the chat template in the model file, for models without one or with a
+	// wrong one. It's either chatml or llama2, or an inline Jinja template in one of those formats.
+	ChatTemplate string `json:"chat_template,omitempty"`
+
+	// Self-extend stretches the context past the trained length by grouping attention positions.
+	// Set the factor to num_ctx divided by the trained context and the width to about half the
+	// trained context, e.g. a 4096 model at 16384: group_attn_factor 4, group_attn_width 2048.
+	GroupAttnFactor int `json:"group_attn_factor,omitempty"`
+	GroupAttnWidth  int `json:"group_attn_width,omitempty"` // must be a multiple of group_attn_factor, defaults to 512
+
+	// StrictContext fails loading when num_ctx exceeds the context length the model was trained
+	// with and no rope scaling or self-extend is configured, instead of lowering num_ctx to it. Only
+	// gguf files record that length, so it has no effect with the bundled llama.cpp, which can't
+	// load them.
+	StrictContext bool `json:"strict_context,omitempty"`
+
+	// Predict options, Validate checks the sampler ranges noted here
+	NumPredict       int      `json:"num_predict,omitempty"`       // -1 generates until stopped, -2 until the context is full
+	NumPredictLimit  int      `json:"num_predict_limit,omitempty"` // caps the generated tokens, including for the NumPredict sentinels
+	TopK             int      `json:"top_k,omitempty"`             // at least 0, 0 disables
+	TopP             float32  `json:"top_p,omitempty"`             // 0 to 1, 1 disables and 0 uses the default
+	TFSZ             float32  `json:"tfs_z,omitempty"`             // at least 0, 1 or more disables and 0 uses the default
+	TypicalP         float32  `json:"typical_p,omitempty"`         // at least 0, 1 or more disables and 0 uses the default
+	RepeatLastN      int      `json:"repeat_last_n,omitempty"`     // at least -1, 0 disables and -1 is num_ctx
+	Temperature      float32  `json:"temperature,omitempty"`       // at least 0, 0 always picks the likeliest token
+	RepeatPenalty    float32  `json:"repeat_penalty,omitempty"`    // at least 0, 1 disables and 0 uses the default
+	PresencePenalty  float32  `json:"presence_penalty,omitempty"`  // -2 to 2, 0 disables
+	FrequencyPenalty float32  `json:"frequency_penalty,omitempty"` // -2 to 2, 0 disables
+	Mirostat         int      `json:"mirostat,omitempty"`          // 0 disables, 1 is Mirostat and 2 Mirostat 2.0
+	MirostatTau      float32  `json:"mirostat_tau,omitempty"`      // at least 0
+	MirostatEta      float32  `json:"mirostat_eta,omitempty"`      // more than 0 when mirostat is enabled
+	PenalizeNewline  bool     `json:"penalize_newline,omitempty"`  // whether repeat_penalty applies to newlines
 	Stop             []string `json:"stop,omitempty"`
-
-	NumThread int `json:"num_thread,omitempty"`
+	StopTokens       []int    `json:"stop_tokens,omitempty"` // token ids that end generation, e.g. a custom end of turn token
+
+	// NumCompletions is how many completions GenerateN samples for the prompt, defaults to 1 and at
+	// most MaxNumCompletions
+	NumCompletions int `json:"num_completions,omitempty"`
+
+	// MaxDurationMs stops generating after this many milliseconds, counted from the start of the
+	// request, and returns what was generated so far as a finished response rather than an error.
+	// It's milliseconds rather than a time.Duration, which json would take as nanoseconds, like the
+	// other delays set in requests.
+	MaxDurationMs int `json:"max_duration,omitempty"`
+
+	// ResponseSchema constrains generation to json matching a JSON Schema
+	ResponseSchema json.RawMessage `json:"response_schema,omitempty"`
+	Format         string          `json:"format,omitempty"` // json constrains generation to any json object
+
+	WantTokens bool `json:"want_tokens,omitempty"` // include generated token ids in each response
+	Echo       bool `json:"echo,omitempty"`        // send the prompt as the first response, before the generated text
+
+	// CachePrompt keeps the evaluated prompt in the server's kv cache so the next request only
+	// evaluates the tokens after the prefix it shares with this one. Chat requests resend the whole
+	// conversation, so with a long system prompt most of each prompt is skipped; the generated text
+	// can differ slightly from an uncached request since the batch sizes change.
+	CachePrompt bool `json:"cache_prompt,omitempty"`
+
+	NumThread   int `json:"num_thread,omitempty"`
+	NumParallel int `json:"num_parallel,omitempty"` // concurrent requests served by one llama.cpp server, each with its own num_ctx
+
+	// Runner options
+	ExtraRunnerArgs  []string `json:"extra_runner_args,omitempty"`  // escape hatch for llama.cpp server flags without a dedicated option
+	RunnerPort       int      `json:"runner_port,omitempty"`        // pins the llama.cpp server to a port instead of picking one from the range
+	RunnerPortMin    int      `json:"runner_port_min,omitempty"`    // defaults to the start of the ephemeral range, 49152
+	RunnerPortMax    int      `json:"runner_port_max,omitempty"`    // defaults to the end of the ephemeral range, 65535
+	RunnerRetries    int      `json:"runner_retries,omitempty"`     // attempts at starting the llama.cpp server, defaults to 3
+	RunnerRetryDelay int      `json:"runner_retry_delay,omitempty"` // base delay in milliseconds between attempts, doubled for each retry
+
+	// Detach keeps the llama.cpp server running after Close and after this process exits, and
+	// reuses it when the same model is next loaded with the same options, which saves reloading
+	// the model on each restart during development. Its pid and port are recorded, and its output
+	// written, under ollama/detached in the user cache directory.
+	Detach bool `json:"detach,omitempty"`
+
+	RequestRetries    int `json:"request_retries,omitempty"`     // attempts at a request while the server is loading the model, defaults to 6
+	RequestRetryDelay int `json:"request_retry_delay,omitempty"` // base delay in milliseconds between them, doubled for each retry
+	RetryMaxDelay     int `json:"retry_max_delay,omitempty"`     // caps the delay in milliseconds between any retries, defaults to 10000
+
+	// CPUFallback loads the model with the cpu runner when the gpu runner fails to initialize CUDA,
+	// e.g. with a driver that's too old or a gpu held exclusively by another process. The model
+	// still loads but runs much slower.
+	CPUFallback bool `json:"cpu_fallback,omitempty"`
 }
 
 func (opts *Options) FromMap(m map[string]interface{}) error {
@@ -256,23 +389,61 @@ func (opts *Options) FromMap(m map[string]interface{}) error {
 					}
 					field.SetString(val)
 				case reflect.Slice:
+					if field.Type() == reflect.TypeOf(json.RawMessage{}) {
+						// raw json options keep the value as it was given
+						data, err := json.Marshal(val)
+						if err != nil {
+							log.Printf("could not convert model parameter %v to json, skipped", key)
+							continue
+						}
+						field.SetBytes(data)
+						continue
+					}
+
 					// JSON unmarshals to []interface{}, not []string
 					val, ok := val.([]interface{})
 					if !ok {
 						log.Printf("could not convert model parameter %v to slice, skipped", key)
 						continue
 					}
-					// convert []interface{} to []string
-					slice := make([]string, len(val))
-					for i, item := range val {
-						str, ok := item.(string)
-						if !ok {
-							log.Printf("could not convert model parameter %v to slice of strings, skipped", key)
-							continue
+
+					switch field.Type().Elem().Kind() {
+					case reflect.Float32:
+						// convert []interface{} to []float32
+						slice := make([]float32, len(val))
+						for i, item := range val {
+							f, ok := item.(float64)
+							if !ok {
+								log.Printf("could not convert model parameter %v to slice of floats, skipped", key)
+								continue
+							}
+							slice[i] = float32(f)
 						}
-						slice[i] = str
+						field.Set(reflect.ValueOf(slice))
+					case reflect.Int:
+						// JSON unmarshals numbers to float64, which must be whole to be ints
+						slice := make([]int, len(val))
+						for i, item := range val {
+							f, ok := item.(float64)
+							if !ok || f != math.Trunc(f) || math.IsInf(f, 0) {
+								return fmt.Errorf("invalid %s: %v is not an integer", key, item)
+							}
+							slice[i] = int(f)
+						}
+						field.Set(reflect.ValueOf(slice))
+					default:
+						// convert []interface{} to []string
+						slice := make([]string, len(val))
+						for i, item := range val {
+							str, ok := item.(string)
+							if !ok {
+								log.Printf("could not convert model parameter %v to slice of strings, skipped", key)
+								continue
+							}
+							slice[i] = str
+						}
+						field.Set(reflect.ValueOf(slice))
 					}
-					field.Set(reflect.ValueOf(slice))
 				default:
 					return fmt.Errorf("unknown type loading config params: %v", field.Kind())
 				}
@@ -282,6 +453,72 @@ func (opts *Options) FromMap(m map[string]interface{}) error {
 	return nil
 }
 
+// Validate checks the sampler options are within their ranges, which are noted on each field. Out
+// of range values are otherwise passed to llama.cpp, which either clamps them or samples nonsense.
+func (opts *Options) Validate() error {
+	between := func(name string, v, min, max float32) error {
+		// written so NaN fails too
+		if !(v >= min && v <= max) {
+			return fmt.Errorf("invalid %s %g, must be between %g and %g", name, v, min, max)
+		}
+		return nil
+	}
+
+	atLeast := func(name string, v, min float32) error {
+		if !(v >= min) || math.IsInf(float64(v), 1) {
+			return fmt.Errorf("invalid %s %g, must be at least %g", name, v, min)
+		}
+		return nil
+	}
+
+	checks := []error{
+		atLeast("temperature", opts.Temperature, 0),
+		between("top_p", opts.TopP, 0, 1),
+		// 0 leaves these to the server's default
+		atLeast("tfs_z", opts.TFSZ, 0),
+		atLeast("typical_p", opts.TypicalP, 0),
+		atLeast("repeat_penalty", opts.RepeatPenalty, 0),
+		between("presence_penalty", opts.PresencePenalty, -2, 2),
+		between("frequency_penalty", opts.FrequencyPenalty, -2, 2),
+		atLeast("mirostat_tau", opts.MirostatTau, 0),
+		atLeast("mirostat_eta", opts.MirostatEta, 0),
+	}
+
+	for _, err := range checks {
+		if err != nil {
+			return err
+		}
+	}
+
+	if opts.TopK < 0 {
+		return fmt.Errorf("invalid top_k %d, must be at least 0", opts.TopK)
+	}
+
+	if opts.NumCompletions < 0 || opts.NumCompletions > MaxNumCompletions {
+		return fmt.Errorf("invalid num_completions %d, must be between 0 and %d", opts.NumCompletions, MaxNumCompletions)
+	}
+
+	if opts.RepeatLastN < -1 {
+		return fmt.Errorf("invalid repeat_last_n %d, must be at least -1", opts.RepeatLastN)
+	}
+
+	switch opts.Mirostat {
+	case 0:
+	case 1, 2:
+		if opts.MirostatEta == 0 {
+			return fmt.Errorf("invalid mirostat_eta 0, must be more than 0 when mirostat is enabled")
+		}
+	default:
+		return fmt.Errorf("invalid mirostat %d, must be 0, 1 or 2", opts.Mirostat)
+	}
+
+	return nil
+}
+
+// MaxNumCompletions caps num_completions, since each completion is a request to the server of its
+// own
+const MaxNumCompletions = 16
+
 func DefaultOptions() Options {
 	return Options{
 		Seed: -1,
@@ -300,6 +537,8 @@ func DefaultOptions() Options {
 		RopeFrequencyBase:  10000.0,
 		RopeFrequencyScale: 1.0,
 		EmbeddingOnly:      true,
+		EmbeddingEnabled:   true,
+		KVOffload:          true,
 
 		RepeatLastN:      64,
 		RepeatPenalty:    1.1,
@@ -0,0 +1,104 @@
+package api
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestOptionsValidate(t *testing.T) {
+	nan := float32(math.NaN())
+
+	tests := []struct {
+		name    string
+		set     func(*Options)
+		wantErr string
+	}{
+		{"defaults", func(*Options) {}, ""},
+		{"greedy", func(o *Options) { o.Temperature = 0 }, ""},
+		{"negative temperature", func(o *Options) { o.Temperature = -0.1 }, "temperature"},
+		{"nan temperature", func(o *Options) { o.Temperature = nan }, "temperature"},
+		{"top_k disabled", func(o *Options) { o.TopK = 0 }, ""},
+		{"negative top_k", func(o *Options) { o.TopK = -1 }, "top_k"},
+		{"num_completions", func(o *Options) { o.NumCompletions = MaxNumCompletions }, ""},
+		{"too many num_completions", func(o *Options) { o.NumCompletions = MaxNumCompletions + 1 }, "num_completions"},
+		{"negative num_completions", func(o *Options) { o.NumCompletions = -1 }, "num_completions"},
+		{"top_p disabled", func(o *Options) { o.TopP = 1 }, ""},
+		{"top_p zero", func(o *Options) { o.TopP = 0 }, ""},
+		{"top_p over 1", func(o *Options) { o.TopP = 1.5 }, "top_p"},
+		{"negative top_p", func(o *Options) { o.TopP = -0.5 }, "top_p"},
+		{"tfs_z", func(o *Options) { o.TFSZ = 0.95 }, ""},
+		{"tfs_z over 1", func(o *Options) { o.TFSZ = 2 }, ""},
+		{"tfs_z default", func(o *Options) { o.TFSZ = 0 }, ""},
+		{"negative tfs_z", func(o *Options) { o.TFSZ = -1 }, "tfs_z"},
+		{"tfs_z infinite", func(o *Options) { o.TFSZ = float32(math.Inf(1)) }, "tfs_z"},
+		{"typical_p", func(o *Options) { o.TypicalP = 0.2 }, ""},
+		{"negative typical_p", func(o *Options) { o.TypicalP = -1 }, "typical_p"},
+		{"repeat_last_n num_ctx", func(o *Options) { o.RepeatLastN = -1 }, ""},
+		{"repeat_last_n disabled", func(o *Options) { o.RepeatLastN = 0 }, ""},
+		{"repeat_last_n below -1", func(o *Options) { o.RepeatLastN = -2 }, "repeat_last_n"},
+		{"repeat_penalty disabled", func(o *Options) { o.RepeatPenalty = 1 }, ""},
+		{"repeat_penalty default", func(o *Options) { o.RepeatPenalty = 0 }, ""},
+		{"negative repeat_penalty", func(o *Options) { o.RepeatPenalty = -1 }, "repeat_penalty"},
+		{"presence_penalty", func(o *Options) { o.PresencePenalty = -2 }, ""},
+		{"presence_penalty over 2", func(o *Options) { o.PresencePenalty = 2.5 }, "presence_penalty"},
+		{"frequency_penalty", func(o *Options) { o.FrequencyPenalty = 1.2 }, ""},
+		{"frequency_penalty under -2", func(o *Options) { o.FrequencyPenalty = -3 }, "frequency_penalty"},
+		{"nan frequency_penalty", func(o *Options) { o.FrequencyPenalty = nan }, "frequency_penalty"},
+		{"mirostat 2", func(o *Options) { o.Mirostat = 2 }, ""},
+		{"mirostat 3", func(o *Options) { o.Mirostat = 3 }, "mirostat"},
+		{"negative mirostat", func(o *Options) { o.Mirostat = -1 }, "mirostat"},
+		{"negative mirostat_tau", func(o *Options) { o.MirostatTau = -1 }, "mirostat_tau"},
+		{"negative mirostat_eta", func(o *Options) { o.MirostatEta = -0.1 }, "mirostat_eta"},
+		{"mirostat_eta zero disabled", func(o *Options) { o.MirostatEta = 0 }, ""},
+		{"mirostat_eta zero enabled", func(o *Options) { o.Mirostat, o.MirostatEta = 1, 0 }, "mirostat_eta"},
+		{"penalize_newline off", func(o *Options) { o.PenalizeNewline = false }, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			tt.set(&opts)
+
+			err := opts.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("got error %v, want none", err)
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %v, want one about %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestOptionsFromMapStopTokens(t *testing.T) {
+	tests := []struct {
+		name    string
+		val     interface{}
+		want    []int
+		wantErr bool
+	}{
+		{"json numbers", []interface{}{float64(2), float64(32000)}, []int{2, 32000}, false},
+		{"fraction", []interface{}{float64(2), 1.5}, nil, true},
+		{"string", []interface{}{"2"}, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var opts Options
+			err := opts.FromMap(map[string]interface{}{"stop_tokens": tt.val})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+
+			if !tt.wantErr && !reflect.DeepEqual(opts.StopTokens, tt.want) {
+				t.Errorf("got stop tokens %v, want %v", opts.StopTokens, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package llm
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+var (
+	// vramMu serializes load decisions so two loads can't both see the same free memory
+	vramMu sync.Mutex
+	// vramCommitted is the VRAM in MiB reserved by loaded and loading models
+	vramCommitted int
+)
+
+// Acquire reserves estimatedMiB of VRAM for a model about to be loaded and returns a function
+// that releases it, to be called when the load fails or the model is unloaded. It returns
+// ErrInsufficientMemory if the reservation doesn't fit.
+//
+// Memory a model has finished loading shows up as used in the free memory the driver reports,
+// while memory it is about to load doesn't yet, so a reservation must fit both in the free memory
+// and in the total memory less what is already reserved. Without a GPU nothing is tracked.
+func Acquire(estimatedMiB int) (release func(), err error) {
+	vramMu.Lock()
+	defer vramMu.Unlock()
+
+	gpus, err := CheckVRAM()
+	if err != nil {
+		return func() {}, nil
+	}
+
+	var free, total int
+	for _, gpu := range gpus {
+		free += gpu.FreeMiB
+		total += gpu.TotalMiB
+	}
+
+	available := free
+	if uncommitted := total - vramCommitted; uncommitted < available {
+		available = uncommitted
+	}
+
+	if estimatedMiB > available {
+		return nil, fmt.Errorf("%w: model needs about %d MiB of vram, %d MiB available", ErrInsufficientMemory, estimatedMiB, available)
+	}
+
+	vramCommitted += estimatedMiB
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			vramMu.Lock()
+			defer vramMu.Unlock()
+
+			vramCommitted -= estimatedMiB
+		})
+	}, nil
+}
+
+// gpuComputeMiB is set aside for the server's compute buffers on the gpu, which EstimateMemory
+// leaves out
+const gpuComputeMiB = 512
+
+// estimateVRAM returns the VRAM in MiB that model, with the decoded header ggml, takes when loaded
+// with opts: the layers offloaded with num_gpu, their share of the kv cache and the compute
+// buffers. It's 0 when nothing is offloaded.
+func estimateVRAM(model string, ggml *GGML, opts api.Options) (int, error) {
+	fi, err := os.Stat(model)
+	if err != nil {
+		return 0, err
+	}
+
+	est, err := estimateMemory(ggml, uint64(fi.Size()), opts)
+	if err != nil || est.GPU == 0 {
+		return 0, err
+	}
+
+	return int(est.GPU>>20) + gpuComputeMiB, nil
+}
@@ -0,0 +1,183 @@
+package llm
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+// mockVRAM makes CheckVRAM report the nvidia-smi output out
+func mockVRAM(t *testing.T, out string) {
+	t.Helper()
+
+	if _, err := nvmlCheckVRAM(); err == nil {
+		t.Skip("nvml is available, the gpus can't be mocked")
+	}
+
+	orig := nvidiaSMI
+	t.Cleanup(func() { nvidiaSMI = orig })
+	nvidiaSMI = func(args ...string) ([]byte, error) {
+		if out == "" {
+			return nil, errors.New("nvidia-smi: executable file not found")
+		}
+
+		return []byte(out), nil
+	}
+}
+
+func TestAcquire(t *testing.T) {
+	mockVRAM(t, "0, 8192, 8192\n")
+
+	release, err := Acquire(5000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the driver still reports the memory as free while the first model loads
+	if _, err := Acquire(5000); !errors.Is(err, ErrInsufficientMemory) {
+		t.Errorf("got error %v, want %v", err, ErrInsufficientMemory)
+	}
+
+	release()
+	release()
+
+	if vramCommitted != 0 {
+		t.Errorf("got %d MiB committed after release, want 0", vramCommitted)
+	}
+
+	release, err = Acquire(5000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+}
+
+func TestAcquireFreeMemory(t *testing.T) {
+	// another process uses most of the gpu
+	mockVRAM(t, "0, 2000, 8192\n")
+
+	if _, err := Acquire(3000); !errors.Is(err, ErrInsufficientMemory) {
+		t.Errorf("got error %v, want %v", err, ErrInsufficientMemory)
+	}
+}
+
+func TestAcquireNoGPU(t *testing.T) {
+	mockVRAM(t, "")
+
+	release, err := Acquire(1 << 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+}
+
+func TestAcquireConcurrent(t *testing.T) {
+	mockVRAM(t, "0, 8192, 8192\n")
+
+	var mu sync.Mutex
+	var releases []func()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if release, err := Acquire(1000); err == nil {
+				mu.Lock()
+				releases = append(releases, release)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(releases) != 8 {
+		t.Errorf("got %d loads admitted, want 8", len(releases))
+	}
+
+	for _, release := range releases {
+		release()
+	}
+}
+
+func TestNewLlamaReleasesVRAM(t *testing.T) {
+	runner, err := exec.LookPath("false")
+	if err != nil {
+		t.Skip("false is not available")
+	}
+
+	mockVRAM(t, "0, 8192, 8192\n")
+
+	defer func(orig func(time.Duration)) { sleep = orig }(sleep)
+	sleep = func(time.Duration) {}
+
+	opts := api.DefaultOptions()
+	opts.NumGPU = 32
+	opts.RunnerRetries = 1
+
+	if _, err := newLlama(writeGGJT(t, 32, llamaFileTypeQ4_0), nil, ModelRunner{Path: runner}, opts); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	if vramCommitted != 0 {
+		t.Errorf("got %d MiB committed after a failed load, want 0", vramCommitted)
+	}
+
+	// the kv cache of 40 layers with an 8192 token context, 5 GiB, doesn't fit in 4 GiB
+	mockVRAM(t, "0, 4096, 4096\n")
+	opts.NumGPU = 40
+	opts.NumCtx = 8192
+	if _, err := newLlama(writeGGJT(t, 40, llamaFileTypeQ4_0), nil, ModelRunner{Path: runner}, opts); !errors.Is(err, ErrInsufficientMemory) {
+		t.Errorf("got error %v, want %v", err, ErrInsufficientMemory)
+	}
+}
+
+func TestEstimateVRAM(t *testing.T) {
+	tests := []struct {
+		name     string
+		numLayer uint32
+		numGPU   int
+		numCtx   int
+		want     int
+	}{
+		// the kv cache takes 16 KiB per layer and token, the header-only files' weights round to 0
+		{"nothing offloaded", 32, 0, 2048, 0},
+		{"all layers", 32, 32, 2048, 1024 + gpuComputeMiB},
+		{"half the layers", 32, 16, 2048, 512 + gpuComputeMiB},
+		{"unnamed layer count", 36, 36, 2048, 1152 + gpuComputeMiB},
+		{"large context", 60, 99, 8192, 7680 + gpuComputeMiB},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			model := writeGGJT(t, tt.numLayer, llamaFileTypeQ4_0)
+			f, err := os.Open(model)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			ggml, err := DecodeGGML(f, ModelFamilyLlama)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			opts := api.DefaultOptions()
+			opts.NumGPU = tt.numGPU
+			opts.NumCtx = tt.numCtx
+
+			got, err := estimateVRAM(model, ggml, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got != tt.want {
+				t.Errorf("got %d MiB, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package llm
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ChatMessage is a turn of a conversation. Role is system, user or assistant.
+type ChatMessage struct {
+	Role    string
+	Content string
+}
+
+// chatFormats format messages as a prompt asking the model for the next assistant turn
+var chatFormats = map[string]func([]ChatMessage) (string, error){
+	"llama2": formatLlama2,
+	"chatml": formatChatML,
+}
+
+// checkChatTemplate validates the chat_template option, which names one of chatFormats or is an
+// inline Jinja template in one of their formats. Other templates llama.cpp knows are rejected, as
+// FormatChat couldn't format prompts with them.
+func checkChatTemplate(template string) error {
+	if strings.TrimSpace(template) == "" {
+		return errors.New("invalid chat_template: must not be blank")
+	}
+
+	names := make([]string, 0, len(chatFormats))
+	for name := range chatFormats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if strings.Contains(template, "{{") || strings.Contains(template, "{%") {
+		if _, err := chatFormat("", template); err != nil {
+			return fmt.Errorf("invalid chat_template: the inline template isn't in a supported format, %s", strings.Join(names, " or "))
+		}
+
+		return nil
+	}
+
+	if _, ok := chatFormats[template]; ok {
+		return nil
+	}
+
+	return fmt.Errorf("unknown chat_template %q, must be an inline Jinja template or one of %s", template, strings.Join(names, ", "))
+}
+
+// chatFormat picks the chat format for a model. The template in the model's metadata is a Jinja
+// template that can't be evaluated here, it's matched against the formats that are known instead.
+// Models without one get their family's format.
+func chatFormat(family ModelFamily, template string) (string, error) {
+	switch {
+	case template == "chatml" || template == "llama2":
+		// a builtin template named by the chat_template option
+		return template, nil
+	case strings.Contains(template, "<|im_start|>"):
+		return "chatml", nil
+	case strings.Contains(template, "[INST]"):
+		return "llama2", nil
+	case template != "":
+		return "", errors.New("the model's chat template is not supported")
+	case family == ModelFamilyLlama || family == "":
+		return "llama2", nil
+	default:
+		return "", fmt.Errorf("chat formatting is not supported for %s models", family)
+	}
+}
+
+// FormatChat formats messages as the prompt the model was trained to answer as the assistant,
+// using the chat_template option, the chat template in the model file or its family's format
+func (llm *llama) FormatChat(messages []ChatMessage) (string, error) {
+	if len(messages) == 0 {
+		return "", errors.New("format chat: no messages")
+	}
+
+	template := llm.chatTemplate
+	if llm.ChatTemplate != "" {
+		template = llm.ChatTemplate
+	}
+
+	name, err := chatFormat(llm.family, template)
+	if err != nil {
+		return "", fmt.Errorf("format chat: %w", err)
+	}
+
+	prompt, err := chatFormats[name](messages)
+	if err != nil {
+		return "", fmt.Errorf("format chat: %w", err)
+	}
+
+	return prompt, nil
+}
+
+// formatLlama2 wraps each user turn in [INST] tags, with system messages inside the next one. The
+// server adds the first <s>.
+func formatLlama2(messages []ChatMessage) (string, error) {
+	var sb strings.Builder
+	var system []string
+	last := ""
+	for i, m := range messages {
+		switch m.Role {
+		case "system":
+			system = append(system, m.Content)
+			continue
+		case "user":
+			if last == "user" {
+				return "", fmt.Errorf("message %d: user messages must alternate with assistant messages", i)
+			}
+
+			if sb.Len() > 0 {
+				sb.WriteString("<s>")
+			}
+
+			sb.WriteString("[INST] ")
+			if len(system) > 0 {
+				sb.WriteString("<<SYS>>\n" + strings.Join(system, "\n") + "\n<</SYS>>\n\n")
+				system = nil
+			}
+
+			sb.WriteString(strings.TrimSpace(m.Content) + " [/INST]")
+		case "assistant":
+			if last != "user" {
+				return "", fmt.Errorf("message %d: assistant messages must follow a user message", i)
+			}
+
+			sb.WriteString(" " + strings.TrimSpace(m.Content) + " </s>")
+		default:
+			return "", fmt.Errorf("message %d: unknown role %q", i, m.Role)
+		}
+
+		last = m.Role
+	}
+
+	if last != "user" {
+		return "", errors.New("the last message must be from the user")
+	}
+
+	return sb.String(), nil
+}
+
+// formatChatML wraps each message in <|im_start|> and <|im_end|> tags
+func formatChatML(messages []ChatMessage) (string, error) {
+	var sb strings.Builder
+	for i, m := range messages {
+		switch m.Role {
+		case "system", "user", "assistant":
+		default:
+			return "", fmt.Errorf("message %d: unknown role %q", i, m.Role)
+		}
+
+		sb.WriteString("<|im_start|>" + m.Role + "\n" + m.Content + "<|im_end|>\n")
+	}
+
+	sb.WriteString("<|im_start|>assistant\n")
+	return sb.String(), nil
+}
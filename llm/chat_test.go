@@ -0,0 +1,80 @@
+package llm
+
+import (
+	"testing"
+)
+
+func TestFormatChat(t *testing.T) {
+	chatMLTemplate := "{% for message in messages %}{{'<|im_start|>' + message['role'] + '\n' + message['content'] + '<|im_end|>' + '\n'}}{% endfor %}"
+
+	conversation := []ChatMessage{
+		{Role: "system", Content: "You are terse."},
+		{Role: "user", Content: "Hi"},
+		{Role: "assistant", Content: "Hello."},
+		{Role: "user", Content: "Why is the sky blue?"},
+	}
+
+	tests := []struct {
+		name     string
+		family   ModelFamily
+		template string
+		messages []ChatMessage
+		want     string
+		wantErr  bool
+	}{
+		{
+			"llama-2", ModelFamilyLlama, "", conversation,
+			"[INST] <<SYS>>\nYou are terse.\n<</SYS>>\n\nHi [/INST] Hello. </s><s>[INST] Why is the sky blue? [/INST]",
+			false,
+		},
+		{
+			"chatml metadata", ModelFamilyLlama, chatMLTemplate, conversation,
+			"<|im_start|>system\nYou are terse.<|im_end|>\n<|im_start|>user\nHi<|im_end|>\n<|im_start|>assistant\nHello.<|im_end|>\n<|im_start|>user\nWhy is the sky blue?<|im_end|>\n<|im_start|>assistant\n",
+			false,
+		},
+		{
+			"llama-2 metadata", "mistral", "{{ bos_token }}{% for message in messages %}{{ '[INST] ' + message['content'] + ' [/INST]' }}{% endfor %}", conversation[1:2],
+			"[INST] Hi [/INST]",
+			false,
+		},
+		{"unknown template", ModelFamilyLlama, "{{ messages | tojson }}", conversation, "", true},
+		{"unknown family", "falcon", "", conversation, "", true},
+		{"no messages", ModelFamilyLlama, "", nil, "", true},
+		{"ends with assistant", ModelFamilyLlama, "", conversation[:3], "", true},
+		{"unknown role", ModelFamilyLlama, chatMLTemplate, []ChatMessage{{Role: "tool", Content: "42"}}, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			llm := &llama{family: tt.family, chatTemplate: tt.template}
+
+			got, err := llm.FormatChat(tt.messages)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatChatOverride(t *testing.T) {
+	llm := &llama{family: ModelFamilyLlama, chatTemplate: "{{ bos_token }}[INST] {{ messages[0]['content'] }} [/INST]"}
+	llm.ChatTemplate = "chatml"
+
+	got, err := llm.FormatChat([]ChatMessage{{Role: "user", Content: "Hi"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := "<|im_start|>user\nHi<|im_end|>\n<|im_start|>assistant\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,101 @@
+package llm
+
+import (
+	"io/fs"
+	"math"
+	"os"
+	"path"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/cpu"
+)
+
+// cgroupCPUMax is the cgroup v2 file holding the cpu quota and period of the current container
+var cgroupCPUMax = "/sys/fs/cgroup/cpu.max"
+
+// defaultNumThread returns the number of threads to run llama.cpp with when num_thread is unset. Left
+// to itself llama.cpp uses every core on the host, which oversubscribes a cpu-limited container.
+func defaultNumThread() int {
+	n := runtime.GOMAXPROCS(0)
+	if quota := cgroupCPUQuota(); quota > 0 && quota < n {
+		n = quota
+	}
+
+	return n
+}
+
+// cgroupCPUQuota returns the number of cpus the cgroup v2 quota allows, rounded up, or 0 if unlimited
+func cgroupCPUQuota() int {
+	data, err := os.ReadFile(cgroupCPUMax)
+	if err != nil {
+		return 0
+	}
+
+	// the file holds "$MAX $PERIOD" where $MAX may be "max" for no limit
+	fields := strings.Fields(string(data))
+	if len(fields) != 2 || fields[0] == "max" {
+		return 0
+	}
+
+	quota, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		logWarnf("could not parse cgroup cpu quota %q: %v", fields[0], err)
+		return 0
+	}
+
+	period, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil || period <= 0 {
+		logWarnf("could not parse cgroup cpu period %q: %v", fields[1], err)
+		return 0
+	}
+
+	return int(math.Ceil(quota / period))
+}
+
+// cpuVariants are the cpu builds of the runner from the most to the least demanding. The cpu
+// build runs on any cpu, the others crash with an illegal instruction on cpus without their
+// instruction set.
+var cpuVariants = []string{"cpu_avx2", "cpu_avx", "cpu"}
+
+// cpuFeatures reports the instruction sets the cpu variants need; tests replace it
+var cpuFeatures = map[string]bool{
+	"avx2": cpu.X86.HasAVX2 && cpu.X86.HasFMA, // the avx2 build also uses fma, but not f16c
+	"avx":  cpu.X86.HasAVX,
+}
+
+// RunnerVariants returns the builds of the runner in fsys, e.g. gpu, cpu and cpu_avx2
+func RunnerVariants(fsys fs.FS) ([]string, error) {
+	dir := path.Join("llama.cpp", "ggml", "build")
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var variants []string
+	for _, e := range entries {
+		if _, err := fs.Stat(fsys, osPath(path.Join(dir, e.Name(), "bin"))); e.IsDir() && err == nil {
+			variants = append(variants, e.Name())
+		}
+	}
+
+	return variants, nil
+}
+
+// cpuVariant returns the most optimized cpu build in variants this cpu can run, or "" if there's
+// none
+func cpuVariant(variants []string) string {
+	available := make(map[string]bool, len(variants))
+	for _, v := range variants {
+		available[v] = true
+	}
+
+	for _, v := range cpuVariants {
+		if feature, ok := strings.CutPrefix(v, "cpu_"); available[v] && (!ok || cpuFeatures[feature]) {
+			return v
+		}
+	}
+
+	return ""
+}
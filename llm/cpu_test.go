@@ -0,0 +1,113 @@
+package llm
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+	"testing/fstest"
+)
+
+func TestCgroupCPUQuota(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    int
+	}{
+		{"unlimited", "max 100000\n", 0},
+		{"whole cpus", "400000 100000\n", 4},
+		{"fractional cpus", "150000 100000\n", 2},
+		{"malformed", "garbage\n", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := filepath.Join(t.TempDir(), "cpu.max")
+			if err := os.WriteFile(p, []byte(tt.content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			defer func(orig string) { cgroupCPUMax = orig }(cgroupCPUMax)
+			cgroupCPUMax = p
+
+			if got := cgroupCPUQuota(); got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDefaultNumThread(t *testing.T) {
+	defer func(orig string) { cgroupCPUMax = orig }(cgroupCPUMax)
+
+	cgroupCPUMax = filepath.Join(t.TempDir(), "missing")
+	if got := defaultNumThread(); got != runtime.GOMAXPROCS(0) {
+		t.Errorf("got %d, want GOMAXPROCS %d", got, runtime.GOMAXPROCS(0))
+	}
+
+	p := filepath.Join(t.TempDir(), "cpu.max")
+	if err := os.WriteFile(p, []byte("100000 100000\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cgroupCPUMax = p
+	if got := defaultNumThread(); got != 1 {
+		t.Errorf("got %d, want 1", got)
+	}
+}
+
+func TestCPUVariant(t *testing.T) {
+	all := []string{"cpu", "cpu_avx", "cpu_avx2", "gpu"}
+
+	tests := []struct {
+		name     string
+		variants []string
+		features map[string]bool
+		want     string
+	}{
+		{"no avx", all, map[string]bool{}, "cpu"},
+		{"avx", all, map[string]bool{"avx": true}, "cpu_avx"},
+		{"avx2", all, map[string]bool{"avx": true, "avx2": true}, "cpu_avx2"},
+		{"avx512", all, map[string]bool{"avx": true, "avx2": true, "avx512": true}, "cpu_avx2"},
+		{"best available", []string{"cpu", "cpu_avx"}, map[string]bool{"avx": true, "avx2": true}, "cpu_avx"},
+		{"unsupported only", []string{"cpu_avx2", "gpu"}, map[string]bool{"avx": true}, ""},
+		{"none", nil, map[string]bool{"avx": true}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(orig map[string]bool) { cpuFeatures = orig }(cpuFeatures)
+			cpuFeatures = tt.features
+
+			if got := cpuVariant(tt.variants); got != tt.want {
+				t.Errorf("got variant %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunnerVariants(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("runner layout differs on this platform")
+	}
+
+	build := path.Join("llama.cpp", "ggml", "build")
+	fsys := fstest.MapFS{
+		path.Join(build, "cpu", "bin", "server"):      &fstest.MapFile{},
+		path.Join(build, "cpu_avx2", "bin", "server"): &fstest.MapFile{},
+		path.Join(build, "gpu", "bin", "server"):      &fstest.MapFile{},
+		path.Join(build, "CMakeCache.txt"):            &fstest.MapFile{},
+		path.Join(build, "empty", "CMakeCache.txt"):   &fstest.MapFile{},
+	}
+
+	got, err := RunnerVariants(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"cpu", "cpu_avx2", "gpu"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got variants %v, want %v", got, want)
+	}
+}
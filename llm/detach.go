@@ -0,0 +1,209 @@
+package llm
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// detachedServer is the record of a server launched with the detach option, kept in a file named
+// by its arguments so a later load of the same model with the same options finds it
+type detachedServer struct {
+	PID  int      `json:"pid"`
+	Port int      `json:"port"`
+	Args []string `json:"args"` // the server's arguments apart from --port
+}
+
+// detachedPingTimeout is how long a recorded server has to answer before it's launched again
+var detachedPingTimeout = 2 * time.Second
+
+// userCacheDir returns the user's cache directory, tests replace it
+var userCacheDir = os.UserCacheDir
+
+// detachedDir returns where the records of detached servers and their logs are kept, creating it.
+// It's in the user's cache directory, not the shared temp directory, and private to the user, so
+// another user can't plant a record that points a load at their own server.
+func detachedDir() (string, error) {
+	cache, err := userCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("detached servers: %w", err)
+	}
+
+	dir := filepath.Join(cache, "ollama", "detached")
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", fmt.Errorf("detached servers: %w", err)
+	}
+
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return "", fmt.Errorf("detached servers: %w", err)
+	}
+
+	if !info.IsDir() {
+		return "", fmt.Errorf("detached servers: %s is not a directory", dir)
+	}
+
+	if err := checkPrivate(info); err != nil {
+		return "", fmt.Errorf("detached servers: %s %w", dir, err)
+	}
+
+	return dir, nil
+}
+
+// detachedPath returns the path of the record for a server launched with params, and of its log
+// when ext is .log
+func detachedPath(params []string, ext string) (string, error) {
+	dir, err := detachedDir()
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256([]byte(strings.Join(params, "\x00")))
+	return filepath.Join(dir, hex.EncodeToString(sum[:8])+ext), nil
+}
+
+// readDetached returns the record of the server launched with params, if there is one
+func readDetached(params []string) (detachedServer, error) {
+	var rec detachedServer
+	path, err := detachedPath(params, ".json")
+	if err != nil {
+		return rec, err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return rec, err
+	}
+
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return rec, fmt.Errorf("detached server record: %w", err)
+	}
+
+	// the name is a hash, so check it's not a collision
+	if !reflect.DeepEqual(rec.Args, params) {
+		return rec, errors.New("detached server record is for other arguments")
+	}
+
+	return rec, nil
+}
+
+// writeDetached records the server launched with params on port
+func writeDetached(params []string, pid, port int) error {
+	path, err := detachedPath(params, ".json")
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(detachedServer{PID: pid, Port: port, Args: params})
+	if err != nil {
+		return fmt.Errorf("detached server record: %w", err)
+	}
+
+	// written whole and renamed so a load reading it concurrently never sees part of it
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("detached server record: %w", err)
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// openDetachedLog opens the log of the server launched with params. A detached server writes to a
+// file instead of this process's stderr, which it outlives.
+func openDetachedLog(params []string) (*os.File, error) {
+	path, err := detachedPath(params, ".log")
+	if err != nil {
+		return nil, err
+	}
+
+	return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+}
+
+// verifyDetached checks the server llm is connected to is the one rec describes and is serving
+// model: it must answer a ping and report model in its props, or on servers without props the
+// process recorded must still have been launched with the recorded arguments on the port.
+func verifyDetached(ctx context.Context, llm *llama, rec detachedServer, model string) error {
+	if !processAlive(rec.PID) {
+		return fmt.Errorf("process %d has exited", rec.PID)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, detachedPingTimeout)
+	defer cancel()
+
+	if err := llm.Ping(ctx); err != nil {
+		return err
+	}
+
+	var props propsResponse
+	err := llm.getJSON(ctx, "/props", &props)
+	var serr *ServerError
+	switch {
+	case err == nil:
+		if props.DefaultGenerationSettings.Model != model {
+			return fmt.Errorf("the server on port %d is serving %s", rec.Port, props.DefaultGenerationSettings.Model)
+		}
+
+		return nil
+	case errors.As(err, &serr) && serr.StatusCode == http.StatusNotFound:
+		args, err := processArgs(rec.PID)
+		if err != nil {
+			return fmt.Errorf("can't check which model the server on port %d is serving: %w", rec.Port, err)
+		}
+
+		want := append(append([]string(nil), rec.Args...), "--port", strconv.Itoa(rec.Port))
+		if len(args) == 0 || !reflect.DeepEqual(args[1:], want) {
+			return fmt.Errorf("process %d isn't the server recorded for the model", rec.PID)
+		}
+
+		return nil
+	default:
+		return err
+	}
+}
+
+// reconnectDetached connects to the server recorded for params by an earlier load with the detach
+// option, if it's still running and serving model. connect returns the client for a port.
+func reconnectDetached(ctx context.Context, model string, params []string, connect func(int, *exec.Cmd, context.CancelFunc) *llama) (*llama, error) {
+	rec, err := readDetached(params)
+	if err != nil {
+		return nil, err
+	}
+
+	if !reservePort(rec.Port) {
+		return nil, fmt.Errorf("port %d is in use by another model", rec.Port)
+	}
+
+	llm := connect(rec.Port, nil, nil)
+	if err := verifyDetached(ctx, llm, rec, model); err != nil {
+		releasePort(rec.Port)
+		if path, err := detachedPath(params, ".json"); err == nil {
+			os.Remove(path)
+		}
+		return nil, err
+	}
+
+	llm.detached = true
+	return llm, nil
+}
+
+// processArgs returns the command line of the process pid, which is only read on linux
+func processArgs(pid int) ([]string, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return nil, err
+	}
+
+	return strings.Split(string(bytes.TrimSuffix(data, []byte{0})), "\x00"), nil
+}
@@ -0,0 +1,145 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+func TestReconnectDetached(t *testing.T) {
+	defer func(orig func() (string, error)) { userCacheDir = orig }(userCacheDir)
+
+	exited := exec.Command("true")
+	if err := exited.Run(); err != nil {
+		t.Skip("true is not available")
+	}
+
+	const model = "/models/llama2.gguf"
+	params := []string{"--model", model, "--ctx-size", "2048"}
+
+	tests := []struct {
+		name    string
+		pid     int
+		props   any // nil serves no /props
+		record  bool
+		wantErr bool
+	}{
+		{"no record", os.Getpid(), nil, false, true},
+		{"same model", os.Getpid(), propsFor(model), true, false},
+		{"other model", os.Getpid(), propsFor("/models/mistral.gguf"), true, true},
+		{"process exited", exited.Process.Pid, propsFor(model), true, true},
+		{"no props", os.Getpid(), nil, true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := t.TempDir()
+			userCacheDir = func() (string, error) { return cache, nil }
+
+			mux := http.NewServeMux()
+			mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {})
+			if tt.props != nil {
+				mux.HandleFunc("/props", func(w http.ResponseWriter, r *http.Request) {
+					json.NewEncoder(w).Encode(tt.props)
+				})
+			}
+			srv := newTestLlama(t, mux)
+
+			if tt.record {
+				if err := writeDetached(params, tt.pid, srv.Running.Port); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			connect := func(port int, cmd *exec.Cmd, cancel context.CancelFunc) *llama {
+				return &llama{Options: api.DefaultOptions(), Running: Running{Port: port, Cmd: cmd, Cancel: cancel}}
+			}
+
+			llm, err := reconnectDetached(context.Background(), model, params, connect)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+
+				if !tt.record && !errors.Is(err, fs.ErrNotExist) {
+					t.Errorf("got error %v, want %v", err, fs.ErrNotExist)
+				}
+
+				// a record that doesn't check out is dropped so the next load launches a server
+				if _, err := readDetached(params); !errors.Is(err, fs.ErrNotExist) {
+					t.Errorf("got record error %v, want the record removed", err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer llm.Close()
+
+			if !llm.detached || llm.Running.Port != srv.Running.Port {
+				t.Errorf("got detached %t on port %d, want a detached server on %d", llm.detached, llm.Running.Port, srv.Running.Port)
+			}
+		})
+	}
+}
+
+func TestDetachedDirPrivate(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("permissions aren't checked on windows")
+	}
+
+	defer func(orig func() (string, error)) { userCacheDir = orig }(userCacheDir)
+	cache := t.TempDir()
+	userCacheDir = func() (string, error) { return cache, nil }
+
+	params := []string{"--model", "/models/llama2.gguf"}
+	if err := writeDetached(params, os.Getpid(), 50000); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := filepath.Join(cache, "ollama", "detached")
+	info, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if perm := info.Mode().Perm(); perm != 0o700 {
+		t.Errorf("got permissions %s, want 0700", perm)
+	}
+
+	// a directory others can write to may hold records planted by them
+	if err := os.Chmod(dir, 0o777); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := readDetached(params); err == nil {
+		t.Error("read a record from a directory others can write to")
+	}
+}
+
+func propsFor(model string) propsResponse {
+	var props propsResponse
+	props.DefaultGenerationSettings.Model = model
+	return props
+}
+
+func TestCloseDetached(t *testing.T) {
+	var cancelled bool
+	llm := &llama{Running: Running{Cancel: func() { cancelled = true }}, detached: true}
+	llm.Close()
+
+	if cancelled {
+		t.Error("closing a detached server stopped it")
+	}
+}
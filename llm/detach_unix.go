@@ -0,0 +1,42 @@
+//go:build !windows
+
+package llm
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"syscall"
+)
+
+// detachAttr starts the server in a session of its own, so it isn't sent the signals meant for
+// this process, such as the interrupt from ctrl-c
+func detachAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setsid: true}
+}
+
+// processAlive reports whether a process with id pid is running
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// checkPrivate returns an error unless the directory info describes is owned by this user and
+// can't be accessed by anyone else
+func checkPrivate(info fs.FileInfo) error {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok && int(st.Uid) != os.Getuid() {
+		return fmt.Errorf("is owned by uid %d, not this user", st.Uid)
+	}
+
+	if perm := info.Mode().Perm(); perm&0o077 != 0 {
+		return fmt.Errorf("has permissions %s, want it private to this user", perm)
+	}
+
+	return nil
+}
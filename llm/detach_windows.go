@@ -0,0 +1,33 @@
+package llm
+
+import (
+	"io/fs"
+	"os"
+	"syscall"
+)
+
+// detachedProcess is the DETACHED_PROCESS creation flag, which syscall doesn't define
+const detachedProcess = 0x00000008
+
+// detachAttr starts the server without a console and in a process group of its own, so it isn't
+// sent the ctrl-c meant for this process
+func detachAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{CreationFlags: detachedProcess | syscall.CREATE_NEW_PROCESS_GROUP}
+}
+
+// processAlive reports whether a process with id pid is running
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+
+	p.Release()
+	return true
+}
+
+// checkPrivate returns nil, the user's cache directory is in their profile, which only they can
+// access
+func checkPrivate(fs.FileInfo) error {
+	return nil
+}
@@ -0,0 +1,101 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// BatchMode is how EmbeddingBatch handles an input that fails to embed
+type BatchMode int
+
+const (
+	// BatchFailFast fails the whole batch on the first error, canceling the inputs still in flight
+	BatchFailFast BatchMode = iota
+	// BatchCollectErrors embeds every input it can and reports each failure in its result
+	BatchCollectErrors
+)
+
+// EmbeddingBatch embeds inputs, returning their results in the order of inputs. Up to num_parallel
+// inputs are embedded at a time, one at a time without it. With BatchFailFast the first input to
+// fail cancels the rest and its error is returned. With BatchCollectErrors every input gets a
+// result, carrying either its embedding or its error, and an error is only returned when ctx ends
+// first. PromptTokens is only set when the server reports it.
+func (llm *llama) EmbeddingBatch(ctx context.Context, inputs []string, mode BatchMode) ([]EmbeddingResult, error) {
+	if !llm.EmbeddingEnabled {
+		return nil, ErrEmbeddingDisabled
+	}
+
+	if mode != BatchFailFast && mode != BatchCollectErrors {
+		return nil, fmt.Errorf("unknown batch mode %d", mode)
+	}
+
+	workers := llm.NumParallel
+	if workers < 1 {
+		workers = 1
+	}
+
+	batchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make([]EmbeddingResult, len(inputs))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers && w < len(inputs); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				results[i].Index = i
+				embedding, err := llm.embedding(batchCtx, inputs[i])
+				if err != nil {
+					results[i].Err = err
+					if mode == BatchFailFast {
+						cancel()
+					}
+					continue
+				}
+
+				results[i].Embedding = embedding.Embedding
+				results[i].PromptTokens = embedding.TokensEvaluated
+			}
+		}()
+	}
+
+feed:
+	for i := range inputs {
+		select {
+		case next <- i:
+		case <-batchCtx.Done():
+			// the inputs not yet started are left to the checks below
+			break feed
+		}
+	}
+	close(next)
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("embed batch: %w: %w", ErrContextCanceled, ctx.Err())
+	}
+
+	if mode == BatchFailFast {
+		// report the input that failed, not the ones canceled because of it
+		var canceled error
+		for i, r := range results {
+			if r.Err == nil {
+				continue
+			} else if !errors.Is(r.Err, ErrContextCanceled) {
+				return nil, fmt.Errorf("embed input %d: %w", i, r.Err)
+			} else if canceled == nil {
+				canceled = fmt.Errorf("embed input %d: %w", i, r.Err)
+			}
+		}
+
+		if canceled != nil {
+			return nil, canceled
+		}
+	}
+
+	return results, nil
+}
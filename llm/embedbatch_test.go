@@ -0,0 +1,126 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// embedBatchHandler embeds each input as its length, failing the inputs starting with "bad" like a
+// server rejects inputs longer than its context, and holding the ones starting with "slow" until
+// their request is canceled
+func embedBatchHandler(requests *atomic.Int32) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+
+		var req EmbeddingRequest
+		json.NewDecoder(r.Body).Decode(&req)
+
+		switch {
+		case strings.HasPrefix(req.Content, "bad"):
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"input is too large to process"}`))
+		case strings.HasPrefix(req.Content, "slow"):
+			<-r.Context().Done()
+		default:
+			json.NewEncoder(w).Encode(EmbeddingResponse{Embedding: []float64{float64(len(req.Content))}, TokensEvaluated: 1})
+		}
+	})
+}
+
+func TestEmbeddingBatchCollectErrors(t *testing.T) {
+	var requests atomic.Int32
+	llm := newTestLlama(t, embedBatchHandler(&requests))
+	llm.NumParallel = 2
+
+	inputs := []string{"a", "bad one", "abc", "bad two", "abcde"}
+	results, err := llm.EmbeddingBatch(context.Background(), inputs, BatchCollectErrors)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != len(inputs) {
+		t.Fatalf("got %d results, want %d", len(results), len(inputs))
+	}
+
+	for i, r := range results {
+		if r.Index != i {
+			t.Errorf("result %d: got index %d", i, r.Index)
+		}
+
+		if strings.HasPrefix(inputs[i], "bad") {
+			var serr *ServerError
+			if !errors.As(r.Err, &serr) || serr.StatusCode != http.StatusBadRequest {
+				t.Errorf("result %d: got error %v, want a 400 server error", i, r.Err)
+			}
+
+			if r.Embedding != nil {
+				t.Errorf("result %d: got embedding %v for a failed input", i, r.Embedding)
+			}
+			continue
+		}
+
+		if r.Err != nil {
+			t.Errorf("result %d: got error %v", i, r.Err)
+		}
+
+		if len(r.Embedding) != 1 || r.Embedding[0] != float64(len(inputs[i])) || r.PromptTokens != 1 {
+			t.Errorf("result %d: got embedding %v, %d tokens", i, r.Embedding, r.PromptTokens)
+		}
+	}
+
+	if n := requests.Load(); n != int32(len(inputs)) {
+		t.Errorf("got %d requests, want %d", n, len(inputs))
+	}
+}
+
+func TestEmbeddingBatchFailFast(t *testing.T) {
+	tests := []struct {
+		name         string
+		parallel     int
+		inputs       []string
+		maxRequests  int32
+		wantErrIndex string
+	}{
+		{"sequential", 1, []string{"a", "bad", "abc", "abcd"}, 2, "embed input 1:"},
+		{"cancels in flight", 2, []string{"slow", "bad", "abc", "abcd"}, 2, "embed input 1:"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests atomic.Int32
+			llm := newTestLlama(t, embedBatchHandler(&requests))
+			llm.NumParallel = tt.parallel
+
+			errc := make(chan error, 1)
+			go func() {
+				results, err := llm.EmbeddingBatch(context.Background(), tt.inputs, BatchFailFast)
+				if results != nil {
+					t.Errorf("got results %v from a failed batch", results)
+				}
+				errc <- err
+			}()
+
+			var err error
+			select {
+			case err = <-errc:
+			case <-time.After(5 * time.Second):
+				t.Fatal("the batch didn't fail fast")
+			}
+
+			var serr *ServerError
+			if !errors.As(err, &serr) || !strings.HasPrefix(err.Error(), tt.wantErrIndex) {
+				t.Errorf("got error %v, want the server error for %q", err, tt.wantErrIndex)
+			}
+
+			if n := requests.Load(); n > tt.maxRequests {
+				t.Errorf("got %d requests, want at most %d", n, tt.maxRequests)
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"strings"
+)
+
+var (
+	// ErrServerUnavailable is returned when the llama.cpp server can't be reached
+	ErrServerUnavailable = errors.New("llama.cpp server unavailable")
+	// ErrModelNotFound is returned when the model file does not exist
+	ErrModelNotFound = errors.New("model not found")
+	// ErrContextCanceled is returned when the caller's context ends before a request completes,
+	// it wraps the context's error as well
+	ErrContextCanceled = errors.New("request canceled")
+	// ErrServerError is returned when the llama.cpp server responds with an error status
+	ErrServerError = errors.New("llama.cpp server error")
+	// ErrServerCrashed is returned when the llama.cpp server process exits while handling a request
+	ErrServerCrashed = errors.New("llama.cpp server crashed")
+	// ErrInsufficientMemory is returned when a model won't fit in the memory available to it
+	ErrInsufficientMemory = errors.New("insufficient memory")
+	// ErrEmbeddingDisabled is returned by Embedding when the model was loaded with embedding_enabled
+	// set to false
+	ErrEmbeddingDisabled = errors.New("embeddings are disabled for this model, load it with embedding_enabled")
+	// ErrServerClosed is returned by requests made after the model was closed
+	ErrServerClosed = errors.New("llama.cpp server closed")
+	// ErrIncompatibleAdapter is returned when a lora adapter isn't one or wasn't trained for the
+	// base model
+	ErrIncompatibleAdapter = errors.New("incompatible lora adapter")
+	// ErrRunnerMismatch is returned when the llama.cpp runner was built for a different os or
+	// architecture than the host
+	ErrRunnerMismatch = errors.New("embedded llama.cpp binary architecture mismatch")
+	// ErrContextExceedsModelMax is returned when num_ctx is larger than the context the model was
+	// trained with and strict_context is set
+	ErrContextExceedsModelMax = errors.New("num_ctx exceeds the model's trained context length")
+	// ErrResponseTooLarge is returned when a server response is larger than MaxResponseSize
+	ErrResponseTooLarge = errors.New("llama.cpp server response too large")
+	// ErrUnknownSpecialTokens is returned by SpecialTokens when the model file doesn't record the
+	// model's bos and eos tokens
+	ErrUnknownSpecialTokens = errors.New("the model's special tokens are unknown")
+	// ErrAdapterSwapUnsupported is returned by SetAdapter and ClearAdapters when the server was built
+	// without runtime lora adapter support; changing adapters then needs a reload
+	ErrAdapterSwapUnsupported = errors.New("llama.cpp server can't change lora adapters at runtime")
+)
+
+// requestError classifies a failure to get a response from the server
+func requestError(ctx context.Context, op string, err error) error {
+	if ctx.Err() != nil {
+		return fmt.Errorf("%s: %w: %w", op, ErrContextCanceled, ctx.Err())
+	}
+
+	return fmt.Errorf("%s: %w: %w", op, ErrServerUnavailable, err)
+}
+
+// ServerError is returned when the llama.cpp server responds with an error status. It matches
+// ErrServerError with errors.Is.
+type ServerError struct {
+	StatusCode int
+	Body       string
+	Endpoint   string
+}
+
+func (e *ServerError) Error() string {
+	body := strings.TrimSpace(e.Body)
+	if body == "" {
+		body = http.StatusText(e.StatusCode)
+	}
+
+	return fmt.Sprintf("%s: %s %d: %s", ErrServerError, e.Endpoint, e.StatusCode, body)
+}
+
+func (e *ServerError) Is(target error) bool {
+	return target == ErrServerError
+}
+
+// statModel checks the model file exists
+func statModel(model string) error {
+	if _, err := os.Stat(model); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("%w: %w", ErrModelNotFound, err)
+		}
+
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,156 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+func TestErrors(t *testing.T) {
+	failing := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "slot unavailable", http.StatusServiceUnavailable)
+	})
+
+	t.Run("server error", func(t *testing.T) {
+		llm := newTestLlama(t, failing)
+
+		if _, err := llm.Encode(context.Background(), "hello"); !errors.Is(err, ErrServerError) {
+			t.Errorf("encode: got %v, want %v", err, ErrServerError)
+		}
+
+		if _, err := llm.Decode(context.Background(), []int{1}); !errors.Is(err, ErrServerError) {
+			t.Errorf("decode: got %v, want %v", err, ErrServerError)
+		}
+
+		if _, err := llm.Embedding(context.Background(), "hello"); !errors.Is(err, ErrServerError) {
+			t.Errorf("embedding: got %v, want %v", err, ErrServerError)
+		}
+
+		if err := llm.Predict(context.Background(), nil, "hello", func(api.GenerateResponse) {}); !errors.Is(err, ErrServerError) {
+			t.Errorf("predict: got %v, want %v", err, ErrServerError)
+		}
+	})
+
+	t.Run("server error status", func(t *testing.T) {
+		llm := newTestLlama(t, failing)
+
+		calls := []struct {
+			endpoint string
+			call     func() error
+		}{
+			{"/tokenize", func() error { _, err := llm.Encode(context.Background(), "hello"); return err }},
+			{"/detokenize", func() error { _, err := llm.Decode(context.Background(), []int{1}); return err }},
+			{"/embedding", func() error { _, err := llm.Embedding(context.Background(), "hello"); return err }},
+			{"/completion", func() error {
+				return llm.Predict(context.Background(), nil, "hello", func(api.GenerateResponse) {})
+			}},
+		}
+
+		for _, c := range calls {
+			var serverErr *ServerError
+			if err := c.call(); !errors.As(err, &serverErr) {
+				t.Errorf("%s: got %v, want a ServerError", c.endpoint, err)
+				continue
+			}
+
+			if serverErr.StatusCode != http.StatusServiceUnavailable {
+				t.Errorf("%s: got status %d, want %d", c.endpoint, serverErr.StatusCode, http.StatusServiceUnavailable)
+			}
+
+			if serverErr.Endpoint != c.endpoint {
+				t.Errorf("got endpoint %s, want %s", serverErr.Endpoint, c.endpoint)
+			}
+
+			if !strings.Contains(serverErr.Body, "slot unavailable") {
+				t.Errorf("%s: got body %q, want it to contain the server's message", c.endpoint, serverErr.Body)
+			}
+		}
+	})
+
+	t.Run("server unavailable", func(t *testing.T) {
+		llm := newTestLlama(t, failing)
+		llm.Running.Port = 1 // nothing listens here
+
+		if _, err := llm.Encode(context.Background(), "hello"); !errors.Is(err, ErrServerUnavailable) {
+			t.Errorf("got %v, want %v", err, ErrServerUnavailable)
+		}
+	})
+
+	t.Run("context canceled", func(t *testing.T) {
+		llm := newTestLlama(t, failing)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_, err := llm.Encode(ctx, "hello")
+		if !errors.Is(err, ErrContextCanceled) || !errors.Is(err, context.Canceled) {
+			t.Errorf("got %v, want %v wrapping %v", err, ErrContextCanceled, context.Canceled)
+		}
+	})
+
+	t.Run("model not found", func(t *testing.T) {
+		_, err := newLlama(filepath.Join(t.TempDir(), "missing.bin"), nil, ModelRunner{}, api.DefaultOptions())
+		if !errors.Is(err, ErrModelNotFound) {
+			t.Errorf("got %v, want %v", err, ErrModelNotFound)
+		}
+	})
+}
+
+func TestPredictServerCrashed(t *testing.T) {
+	// write part of the stream and then drop the connection, as when the server is killed
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeEvents(w, Prediction{Content: "once upon"})
+
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conn.Close()
+	})
+
+	t.Run("exited", func(t *testing.T) {
+		llm := newTestLlama(t, handler)
+		llm.stderr = &tailBuffer{}
+		llm.stderr.Write([]byte("llama.cpp loading model\nGGML_ASSERT: ggml.c:4785: false\n"))
+		llm.exitErr = errors.New("signal: aborted")
+		llm.exited = make(chan struct{})
+		close(llm.exited)
+
+		err := llm.Predict(context.Background(), nil, "hello", func(api.GenerateResponse) {})
+		if !errors.Is(err, ErrServerCrashed) {
+			t.Fatalf("got error %v, want %v", err, ErrServerCrashed)
+		}
+
+		for _, want := range []string{"signal: aborted", "GGML_ASSERT"} {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("got error %q, want it to contain %q", err, want)
+			}
+		}
+	})
+
+	t.Run("still running", func(t *testing.T) {
+		llm := newTestLlama(t, handler)
+
+		err := llm.Predict(context.Background(), nil, "hello", func(api.GenerateResponse) {})
+		if errors.Is(err, ErrServerCrashed) || !errors.Is(err, ErrServerUnavailable) {
+			t.Errorf("got error %v, want %v", err, ErrServerUnavailable)
+		}
+	})
+}
+
+func TestTailBuffer(t *testing.T) {
+	var b tailBuffer
+	b.Write([]byte(strings.Repeat("a", stderrTailSize)))
+	b.Write([]byte("the end"))
+
+	got := b.String()
+	if len(got) != stderrTailSize || !strings.HasSuffix(got, "the end") {
+		t.Errorf("got %d bytes ending %q", len(got), got[len(got)-10:])
+	}
+}
@@ -0,0 +1,38 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+// fimPrompt assembles a fill-in-the-middle prompt asking the model to generate the code between
+// prefix and suffix, using the special tokens the model was trained with. Models that share an
+// architecture can use different tokens, so the model name is checked as well as the family.
+func fimPrompt(family ModelFamily, name, prefix, suffix string) (string, error) {
+	name = strings.ToLower(name)
+	switch {
+	case strings.Contains(name, "deepseek"):
+		return "<｜fim▁begin｜>" + prefix + "<｜fim▁hole｜>" + suffix + "<｜fim▁end｜>", nil
+	case family == "starcoder" || strings.Contains(name, "starcoder"):
+		return "<fim_prefix>" + prefix + "<fim_suffix>" + suffix + "<fim_middle>", nil
+	case family == ModelFamilyLlama || family == "":
+		// code llama
+		return "<PRE> " + prefix + " <SUF>" + suffix + " <MID>", nil
+	default:
+		return "", fmt.Errorf("fill-in-the-middle is not supported for %s models", family)
+	}
+}
+
+// PredictFIM generates the code that goes between prefix and suffix, for code models trained for
+// fill-in-the-middle such as Code Llama, DeepSeek Coder and StarCoder
+func (llm *llama) PredictFIM(ctx context.Context, prefix, suffix string, fn func(api.GenerateResponse)) error {
+	prompt, err := fimPrompt(llm.family, llm.modelName, prefix, suffix)
+	if err != nil {
+		return err
+	}
+
+	return llm.predict(ctx, predictInput{opts: llm.Options, prompt: prompt}, fn)
+}
@@ -0,0 +1,75 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+func TestFIMPrompt(t *testing.T) {
+	prefix, suffix := "def add(a, b):\n    ", "\n\nprint(add(1, 2))"
+
+	tests := []struct {
+		name      string
+		family    ModelFamily
+		modelName string
+		want      string
+		wantErr   bool
+	}{
+		{"code llama", ModelFamilyLlama, "codellama_codellama-7b-instruct-hf", "<PRE> " + prefix + " <SUF>" + suffix + " <MID>", false},
+		{"ggml llama", ModelFamilyLlama, "", "<PRE> " + prefix + " <SUF>" + suffix + " <MID>", false},
+		{"deepseek coder", ModelFamilyLlama, "deepseek-ai_deepseek-coder-6.7b-base", "<｜fim▁begin｜>" + prefix + "<｜fim▁hole｜>" + suffix + "<｜fim▁end｜>", false},
+		{"starcoder", "starcoder", "StarCoder", "<fim_prefix>" + prefix + "<fim_suffix>" + suffix + "<fim_middle>", false},
+		{"unsupported", "falcon", "Falcon", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := fimPrompt(tt.family, tt.modelName, prefix, suffix)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPredictFIM(t *testing.T) {
+	var got PredictRequest
+	mux := http.NewServeMux()
+	mux.Handle("/tokenize", completionHandler())
+	mux.HandleFunc("/completion", func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&got)
+		writeEvents(w, Prediction{Content: "return a + b"}, Prediction{Stop: true})
+	})
+
+	llm := newTestLlama(t, mux)
+	llm.family = ModelFamilyLlama
+
+	var sb strings.Builder
+	if err := llm.PredictFIM(context.Background(), "def add(a, b):\n    ", "\n", func(resp api.GenerateResponse) {
+		sb.WriteString(resp.Response)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := "<PRE> def add(a, b):\n     <SUF>\n <MID>"; got.Prompt != want {
+		t.Errorf("got prompt %q, want %q", got.Prompt, want)
+	}
+
+	if sb.String() != "return a + b" {
+		t.Errorf("got response %q", sb.String())
+	}
+}
@@ -0,0 +1,211 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+// GenerateResult is the complete output of a prediction
+type GenerateResult struct {
+	Response string
+	Context  []int
+
+	StopReason api.StopReason
+	StopWord   string
+
+	PromptEvalCount    int
+	PromptEvalDuration time.Duration
+	EvalCount          int
+	EvalDuration       time.Duration
+
+	DraftTotal    int
+	DraftAccepted int
+}
+
+// resultCollector accumulates streamed responses into a GenerateResult
+type resultCollector struct {
+	sb     strings.Builder
+	result GenerateResult
+}
+
+func (c *resultCollector) collect(resp api.GenerateResponse) {
+	c.sb.WriteString(resp.Response)
+	if resp.Done {
+		c.result.Context = resp.Context
+		c.result.StopReason = resp.StopReason
+		c.result.StopWord = resp.StopWord
+		c.result.PromptEvalCount = resp.PromptEvalCount
+		c.result.PromptEvalDuration = resp.PromptEvalDuration
+		c.result.EvalCount = resp.EvalCount
+		c.result.EvalDuration = resp.EvalDuration
+		c.result.DraftTotal = resp.DraftTotal
+		c.result.DraftAccepted = resp.DraftAccepted
+	}
+}
+
+func (c *resultCollector) Result() GenerateResult {
+	c.result.Response = c.sb.String()
+	return c.result
+}
+
+// Generate runs a prediction to completion and returns the full response with its context and
+// timings, for callers that don't need to stream
+func (llm *llama) Generate(ctx context.Context, prevContext []int, prompt string) (GenerateResult, error) {
+	var c resultCollector
+	if err := llm.Predict(ctx, prevContext, prompt, c.collect); err != nil {
+		return GenerateResult{}, err
+	}
+
+	return c.Result(), nil
+}
+
+// GenerateN samples num_completions completions of prompt and returns them in order, for best-of-n
+// sampling or checking answers agree. The server samples one completion per request, so each is a
+// request of its own with its own seed; with num_parallel slots they run side by side, otherwise the
+// server runs them one after another. The seeds count up from the seed option, or from a random
+// one when it's -1, so the completions differ unless the temperature is 0.
+func (llm *llama) GenerateN(ctx context.Context, prevContext []int, prompt string) ([]GenerateResult, error) {
+	opts := llm.Options
+	n := opts.NumCompletions
+	if n < 0 || n > api.MaxNumCompletions {
+		return nil, fmt.Errorf("num_completions must be between 0 and %d, got %d", api.MaxNumCompletions, n)
+	} else if n == 0 {
+		n = 1
+	}
+
+	seed := opts.Seed
+	if seed < 0 {
+		seed = rand.Intn(1 << 30)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make([]GenerateResult, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			var c resultCollector
+			in := predictInput{opts: opts, prevContext: prevContext, prompt: prompt, seed: seed + i}
+			if errs[i] = llm.predict(ctx, in, c.collect); errs[i] != nil {
+				// the results are returned together, so one failing fails them all
+				cancel()
+				return
+			}
+
+			results[i] = c.Result()
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil && !errors.Is(err, ErrContextCanceled) {
+			return nil, fmt.Errorf("completion %d: %w", i, err)
+		}
+	}
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return results, nil
+}
+
+// PredictTo runs a prediction writing the response to w as it streams, flushing after each chunk
+// when w is an http.Flusher, and returns the result once it's done. A failed write stops the
+// prediction and its error is returned.
+func (llm *llama) PredictTo(ctx context.Context, prevContext []int, prompt string, w io.Writer) (GenerateResult, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var c resultCollector
+	var werr error
+	err := llm.Predict(ctx, prevContext, prompt, func(resp api.GenerateResponse) {
+		if werr != nil {
+			return
+		}
+
+		c.collect(resp)
+		if resp.Response == "" {
+			return
+		}
+
+		if _, werr = io.WriteString(w, resp.Response); werr != nil {
+			cancel()
+			return
+		}
+
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	})
+
+	if werr != nil {
+		return GenerateResult{}, fmt.Errorf("write response: %w", werr)
+	} else if err != nil {
+		return GenerateResult{}, err
+	}
+
+	return c.Result(), nil
+}
+
+// PredictNDJSON runs a prediction writing each response to w as a JSON object on a line of its
+// own, the newline delimited JSON the generate endpoint streams, and flushes after each line when
+// w is an http.Flusher. It's for passing the stream on to consumers that aren't written in Go,
+// e.g. over a pipe. The last line is the final response with done set. A failed write stops the
+// prediction and its error is returned.
+func (llm *llama) PredictNDJSON(ctx context.Context, prevContext []int, prompt string, w io.Writer) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	enc := json.NewEncoder(w)
+	var werr error
+	err := llm.Predict(ctx, prevContext, prompt, func(resp api.GenerateResponse) {
+		if werr != nil {
+			return
+		}
+
+		resp.CreatedAt = time.Now().UTC()
+		if werr = enc.Encode(resp); werr != nil {
+			cancel()
+			return
+		}
+
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	})
+
+	if werr != nil {
+		return fmt.Errorf("write response: %w", werr)
+	}
+
+	return err
+}
+
+// Warmup evaluates systemPrompt without generating any tokens so the server has it cached, and
+// returns its context to pass as prevContext to later predictions that start with it
+func (llm *llama) Warmup(ctx context.Context, systemPrompt string) ([]int, error) {
+	var c resultCollector
+	if err := llm.predict(ctx, predictInput{opts: llm.Options, prompt: systemPrompt, evalOnly: true}, c.collect); err != nil {
+		return nil, err
+	}
+
+	return c.Result().Context, nil
+}
@@ -0,0 +1,560 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+func TestGenerate(t *testing.T) {
+	llm := newTestLlama(t, completionHandler(
+		Prediction{Content: "why"},
+		Prediction{Content: " is the sky"},
+		Prediction{Content: " blue"},
+		Prediction{Stop: true, Timings: Timings{PromptN: 2, PromptMS: 5, PredictedN: 3, PredictedMS: 30}},
+	))
+
+	got, err := llm.Generate(context.Background(), nil, "hello there ")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := GenerateResult{
+		Response:           "why is the sky blue",
+		Context:            []int{0, 1, 2, 3, 4, 5, 6},
+		PromptEvalCount:    2,
+		PromptEvalDuration: 5 * time.Millisecond,
+		EvalCount:          3,
+		EvalDuration:       30 * time.Millisecond,
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestGenerateDraftStats(t *testing.T) {
+	tests := []struct {
+		name                string
+		timings             Timings
+		wantTotal, wantKept int
+	}{
+		{name: "speculative", timings: Timings{PredictedN: 12, DraftN: 10, DraftNAccepted: 7}, wantTotal: 10, wantKept: 7},
+		{name: "no draft model", timings: Timings{PredictedN: 12}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			llm := newTestLlama(t, completionHandler(
+				Prediction{Content: "hi"},
+				Prediction{Stop: true, Timings: tt.timings},
+			))
+
+			var final api.GenerateResponse
+			err := llm.Predict(context.Background(), nil, "hello", func(r api.GenerateResponse) {
+				if r.Done {
+					final = r
+				}
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if final.DraftTotal != tt.wantTotal || final.DraftAccepted != tt.wantKept {
+				t.Errorf("got draft %d/%d, want %d/%d", final.DraftAccepted, final.DraftTotal, tt.wantKept, tt.wantTotal)
+			}
+		})
+	}
+}
+
+func TestPredictStopReason(t *testing.T) {
+	tests := []struct {
+		name       string
+		numPredict int
+		final      Prediction
+		wantReason api.StopReason
+		wantWord   string
+	}{
+		{name: "eos", final: Prediction{Stop: true, StoppedEOS: true}, wantReason: api.StopReasonEOS},
+		{name: "stop word", final: Prediction{Stop: true, StoppedWord: true, StoppingWord: "</s>"}, wantReason: api.StopReasonStopWord, wantWord: "</s>"},
+		{name: "limit", numPredict: 8, final: Prediction{Stop: true, StoppedLimit: true}, wantReason: api.StopReasonLimit},
+		{name: "context full", numPredict: NumPredictFillContext, final: Prediction{Stop: true, StoppedLimit: true}, wantReason: api.StopReasonContext},
+		{name: "stop type", final: Prediction{Stop: true, StopType: "word", StoppingWord: "\n"}, wantReason: api.StopReasonStopWord, wantWord: "\n"},
+		{name: "unreported", final: Prediction{Stop: true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			llm := newTestLlama(t, completionHandler(Prediction{Content: "hi"}, tt.final))
+			llm.NumPredict = tt.numPredict
+
+			var final api.GenerateResponse
+			err := llm.Predict(context.Background(), nil, "hello", func(r api.GenerateResponse) {
+				if r.Done {
+					final = r
+				} else if r.StopReason != "" {
+					t.Errorf("got stop reason %q before the final response", r.StopReason)
+				}
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if final.StopReason != tt.wantReason || final.StopWord != tt.wantWord {
+				t.Errorf("got stop reason %q word %q, want %q word %q", final.StopReason, final.StopWord, tt.wantReason, tt.wantWord)
+			}
+		})
+	}
+}
+
+func TestGenerateN(t *testing.T) {
+	tests := []struct {
+		name string
+		seed int
+		want []string
+	}{
+		{"seed", 10, []string{"seed 10", "seed 11", "seed 12"}},
+		{"random seed", -1, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mux := http.NewServeMux()
+			mux.Handle("/tokenize", completionHandler())
+			mux.HandleFunc("/completion", func(w http.ResponseWriter, r *http.Request) {
+				var req PredictRequest
+				if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+					t.Error(err)
+					return
+				}
+
+				// the sampled text depends on the seed
+				writeEvents(w, Prediction{Content: fmt.Sprintf("seed %d", req.Seed)}, Prediction{Stop: true})
+			})
+
+			llm := newTestLlama(t, mux)
+			llm.slots = newSlots(3)
+			llm.NumCompletions = 3
+			llm.Seed = tt.seed
+
+			results, err := llm.GenerateN(context.Background(), nil, "hello")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(results) != 3 {
+				t.Fatalf("got %d results, want 3", len(results))
+			}
+
+			seen := make(map[string]bool)
+			for i, r := range results {
+				if seen[r.Response] {
+					t.Errorf("completion %q was sampled twice", r.Response)
+				}
+				seen[r.Response] = true
+
+				if tt.want != nil && r.Response != tt.want[i] {
+					t.Errorf("completion %d: got %q, want %q", i, r.Response, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestGenerateNTooMany(t *testing.T) {
+	llm := newTestLlama(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected request to %s", r.URL.Path)
+	}))
+	llm.NumCompletions = api.MaxNumCompletions + 1
+
+	if _, err := llm.GenerateN(context.Background(), nil, "hello"); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestGenerateEcho(t *testing.T) {
+	tests := []struct {
+		echo      bool
+		wantFirst string
+		want      string
+	}{
+		{true, "hello there ", "hello there why is the sky"},
+		{false, "why", "why is the sky"},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("echo %v", tt.echo), func(t *testing.T) {
+			llm := newTestLlama(t, completionHandler(
+				Prediction{Content: "why"},
+				Prediction{Content: " is the sky"},
+				Prediction{Stop: true},
+			))
+			llm.Echo = tt.echo
+
+			var first string
+			err := llm.Predict(context.Background(), nil, "hello there ", func(r api.GenerateResponse) {
+				if first == "" {
+					first = r.Response
+				}
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if first != tt.wantFirst {
+				t.Errorf("got first response %q, want %q", first, tt.wantFirst)
+			}
+
+			got, err := llm.Generate(context.Background(), nil, "hello there ")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got.Response != tt.want {
+				t.Errorf("got %q, want %q", got.Response, tt.want)
+			}
+
+			// the prompt is in the context once, however it's echoed
+			if len(got.Context) != 6 {
+				t.Errorf("got context %v, want 6 tokens", got.Context)
+			}
+		})
+	}
+}
+
+// flushRecorder records each write it's flushed after
+type flushRecorder struct {
+	strings.Builder
+	flushed []string
+}
+
+func (r *flushRecorder) Flush() {
+	r.flushed = append(r.flushed, r.String())
+}
+
+// failingWriter fails every write after the first n
+type failingWriter struct {
+	n int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.n == 0 {
+		return 0, errors.New("broken pipe")
+	}
+
+	w.n--
+	return len(p), nil
+}
+
+func TestPredictTo(t *testing.T) {
+	llm := newTestLlama(t, completionHandler(
+		Prediction{Content: "why"},
+		Prediction{Content: " is the sky"},
+		Prediction{Content: " blue"},
+		Prediction{Stop: true, Timings: Timings{PromptN: 2, PredictedN: 3}},
+	))
+
+	var w flushRecorder
+	got, err := llm.PredictTo(context.Background(), nil, "hello there ", &w)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if w.String() != "why is the sky blue" {
+		t.Errorf("got written %q", w.String())
+	}
+
+	wantFlushed := []string{"why", "why is the sky", "why is the sky blue"}
+	if !reflect.DeepEqual(w.flushed, wantFlushed) {
+		t.Errorf("got flushed %q, want %q", w.flushed, wantFlushed)
+	}
+
+	if got.EvalCount != 3 || got.PromptEvalCount != 2 {
+		t.Errorf("got counts %d, %d, want 3, 2", got.EvalCount, got.PromptEvalCount)
+	}
+}
+
+func TestPredictToWriteError(t *testing.T) {
+	done := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.Handle("/tokenize", completionHandler())
+	mux.HandleFunc("/completion", func(w http.ResponseWriter, r *http.Request) {
+		defer close(done)
+		writeEvents(w, Prediction{Content: "why"}, Prediction{Content: " is"})
+
+		// keep streaming until the client goes away
+		<-r.Context().Done()
+	})
+
+	llm := newTestLlama(t, mux)
+	_, err := llm.PredictTo(context.Background(), nil, "hello", &failingWriter{n: 1})
+	if err == nil || !strings.Contains(err.Error(), "broken pipe") {
+		t.Errorf("got error %v, want the write error", err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("generation wasn't cancelled after the write failed")
+	}
+}
+
+func TestPredictNDJSON(t *testing.T) {
+	llm := newTestLlama(t, completionHandler(
+		Prediction{Content: "why"},
+		Prediction{Content: " is"},
+		Prediction{Stop: true, Timings: Timings{PromptN: 2, PredictedN: 2}},
+	))
+
+	var w flushRecorder
+	if err := llm.PredictNDJSON(context.Background(), nil, "hello there ", &w); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasSuffix(w.String(), "\n") {
+		t.Errorf("got output %q, want it to end with a newline", w.String())
+	}
+
+	lines := strings.Split(strings.TrimSuffix(w.String(), "\n"), "\n")
+	if len(lines) != 4 || len(w.flushed) != 4 {
+		t.Fatalf("got %d lines and %d flushes, want 4: %q", len(lines), len(w.flushed), w.String())
+	}
+
+	want := []api.GenerateResponse{
+		{PromptProcessed: true},
+		{Response: "why"},
+		{Response: " is"},
+		{Done: true, PromptEvalCount: 2, EvalCount: 2},
+	}
+
+	for i, line := range lines {
+		var got api.GenerateResponse
+		if err := json.Unmarshal([]byte(line), &got); err != nil {
+			t.Fatalf("line %d: %v: %q", i, err, line)
+		}
+
+		if got.Response != want[i].Response || got.PromptProcessed != want[i].PromptProcessed || got.Done != want[i].Done {
+			t.Errorf("line %d: got %q, want %+v", i, line, want[i])
+		}
+
+		if got.CreatedAt.IsZero() {
+			t.Errorf("line %d: created_at isn't set", i)
+		}
+
+		if got.Done && (got.EvalCount != 2 || got.PromptEvalCount != 2 || len(got.Context) == 0) {
+			t.Errorf("got final response %+v", got)
+		}
+	}
+}
+
+func TestWarmup(t *testing.T) {
+	var got PredictRequest
+	mux := http.NewServeMux()
+	mux.Handle("/tokenize", completionHandler())
+	mux.HandleFunc("/completion", func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&got)
+		writeEvents(w, Prediction{Stop: true, Timings: Timings{PromptN: 4}})
+	})
+
+	llm := newTestLlama(t, mux)
+
+	tokens, err := llm.Warmup(context.Background(), "you are a helpful assistant")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got.NPredict != 0 {
+		t.Errorf("got n_predict %d, want 0", got.NPredict)
+	}
+
+	if !reflect.DeepEqual(tokens, []int{0, 1, 2, 3, 4}) {
+		t.Errorf("got context %v", tokens)
+	}
+}
+
+// BenchmarkWarmup compares prompt evaluation with and without a warmed up system prompt. It needs
+// a real model, set OLLAMA_TEST_MODEL to its path to run it.
+func BenchmarkWarmup(b *testing.B) {
+	model := os.Getenv("OLLAMA_TEST_MODEL")
+	if model == "" {
+		b.Skip("OLLAMA_TEST_MODEL is not set")
+	}
+
+	opts := api.DefaultOptions()
+	opts.NumPredict = 1
+
+	m, err := New(model, nil, opts)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer m.Close()
+
+	llm := m.(*llama)
+	system := strings.Repeat("You are a helpful assistant who answers questions concisely. ", 20)
+
+	b.Run("cold", func(b *testing.B) {
+		var promptEval time.Duration
+		for i := 0; i < b.N; i++ {
+			result, err := llm.Generate(context.Background(), nil, system+fmt.Sprintf("Question %d?", i))
+			if err != nil {
+				b.Fatal(err)
+			}
+			promptEval += result.PromptEvalDuration
+		}
+		b.ReportMetric(float64(promptEval.Milliseconds())/float64(b.N), "prompt-ms/op")
+	})
+
+	b.Run("warm", func(b *testing.B) {
+		tokens, err := llm.Warmup(context.Background(), system)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		var promptEval time.Duration
+		for i := 0; i < b.N; i++ {
+			result, err := llm.Generate(context.Background(), tokens, fmt.Sprintf("Question %d?", i))
+			if err != nil {
+				b.Fatal(err)
+			}
+			promptEval += result.PromptEvalDuration
+		}
+		b.ReportMetric(float64(promptEval.Milliseconds())/float64(b.N), "prompt-ms/op")
+	})
+}
+
+func TestPredictWithOptions(t *testing.T) {
+	var mu sync.Mutex
+	got := make(map[string]PredictRequest)
+	mux := http.NewServeMux()
+	mux.Handle("/tokenize", completionHandler())
+	mux.HandleFunc("/completion", func(w http.ResponseWriter, r *http.Request) {
+		var req PredictRequest
+		json.NewDecoder(r.Body).Decode(&req)
+
+		mu.Lock()
+		got[req.Prompt] = req
+		mu.Unlock()
+
+		writeEvents(w, Prediction{Content: "hi"}, Prediction{Stop: true})
+	})
+
+	llm := newTestLlama(t, mux)
+	loaded := llm.Options
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			opts := api.DefaultOptions()
+			opts.Temperature = float32(i) / 10
+			opts.TopP = 0.5
+
+			if err := llm.PredictWithOptions(context.Background(), nil, fmt.Sprintf("prompt %d", i), opts, func(api.GenerateResponse) {}); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < 10; i++ {
+		req, ok := got[fmt.Sprintf("prompt %d", i)]
+		if !ok {
+			t.Fatalf("no request for prompt %d", i)
+		}
+
+		if req.Temperature != float32(i)/10 || req.TopP != 0.5 {
+			t.Errorf("prompt %d: got temperature %f top_p %f, want %f and 0.5", i, req.Temperature, req.TopP, float32(i)/10)
+		}
+	}
+
+	if !reflect.DeepEqual(llm.Options, loaded) {
+		t.Error("the model's options changed")
+	}
+}
+
+func TestPredictSamplers(t *testing.T) {
+	tests := []struct {
+		name     string
+		set      func(*api.Options)
+		want     map[string]any
+		wantLeft []string
+	}{
+		{
+			"defaults",
+			func(*api.Options) {},
+			map[string]any{"temperature": 0.8, "top_k": 40.0, "repeat_last_n": 64.0, "penalize_nl": true},
+			[]string{"tfs_z", "typical_p", "mirostat", "mirostat_tau", "mirostat_eta", "presence_penalty"},
+		},
+		{
+			"zero values that mean something",
+			func(o *api.Options) { o.Temperature, o.TopK = 0, 0 },
+			map[string]any{"temperature": 0.0, "top_k": 0.0},
+			nil,
+		},
+		{
+			"zero values for the server default",
+			func(o *api.Options) {
+				o.TopP, o.TFSZ, o.TypicalP, o.RepeatPenalty, o.RepeatLastN, o.PenalizeNewline = 0, 0, 0, 0, 0, false
+			},
+			nil,
+			[]string{"top_p", "tfs_z", "typical_p", "repeat_penalty", "repeat_last_n", "penalize_nl"},
+		},
+		{
+			"enabled samplers",
+			func(o *api.Options) { o.TFSZ, o.TypicalP, o.Mirostat = 0.5, 0.25, 2 },
+			map[string]any{"tfs_z": 0.5, "typical_p": 0.25, "mirostat": 2.0, "mirostat_tau": 5.0},
+			nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got map[string]any
+			mux := http.NewServeMux()
+			mux.Handle("/tokenize", completionHandler())
+			mux.HandleFunc("/completion", func(w http.ResponseWriter, r *http.Request) {
+				json.NewDecoder(r.Body).Decode(&got)
+				writeEvents(w, Prediction{Stop: true})
+			})
+
+			llm := newTestLlama(t, mux)
+			opts := api.DefaultOptions()
+			tt.set(&opts)
+
+			err := llm.PredictWithOptions(context.Background(), nil, "hello", opts, func(api.GenerateResponse) {})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for k, v := range tt.want {
+				if f, ok := got[k].(float64); ok {
+					// float32 options don't round trip exactly
+					got[k] = float64(float32(f))
+					v = float64(float32(v.(float64)))
+				}
+
+				if got[k] != v {
+					t.Errorf("got %s %v, want %v", k, got[k], v)
+				}
+			}
+
+			for _, k := range tt.wantLeft {
+				if v, ok := got[k]; ok {
+					t.Errorf("got %s %v, want it left out", k, v)
+				}
+			}
+		})
+	}
+}
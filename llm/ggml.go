@@ -53,6 +53,10 @@ type model interface {
 	ModelFamily() ModelFamily
 	ModelType() ModelType
 	FileType() FileType
+	NumEmbd() uint32
+
+	// ModelName is the name recorded in the model file, if the format has one
+	ModelName() string
 }
 
 type container interface {
@@ -146,11 +150,19 @@ const (
 	FILE_MAGIC_GGJT = 0x67676a74
 	// / Magic constant for `ggla` files (LoRA adapter).
 	FILE_MAGIC_GGLA = 0x67676C61
+	// / Magic constant for `gguf` files (versioned, gguf)
+	FILE_MAGIC_GGUF = 0x46554747
 )
 
+// ErrUnsupportedModelFormat is returned when a model file does not start with
+// a known GGML or GGUF magic.
+var ErrUnsupportedModelFormat = errors.New("unsupported model format")
+
 func DecodeGGML(r io.ReadSeeker, hint ModelFamily) (*GGML, error) {
 	var ggml GGML
-	binary.Read(r, binary.LittleEndian, &ggml.magic)
+	if err := binary.Read(r, binary.LittleEndian, &ggml.magic); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnsupportedModelFormat, err)
+	}
 
 	switch ggml.magic {
 	case FILE_MAGIC_GGML:
@@ -161,12 +173,20 @@ func DecodeGGML(r io.ReadSeeker, hint ModelFamily) (*GGML, error) {
 		ggml.container = &containerGGJT{}
 	case FILE_MAGIC_GGLA:
 		ggml.container = &containerLORA{}
+	case FILE_MAGIC_GGUF:
+		ggml.container = &containerGGUF{}
 	default:
-		return nil, errors.New("invalid file magic")
+		return nil, fmt.Errorf("%w: invalid file magic %#x", ErrUnsupportedModelFormat, ggml.magic)
 	}
 
 	if err := ggml.Decode(r); err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %s: %v", ErrUnsupportedModelFormat, ggml.Name(), err)
+	}
+
+	// gguf records the architecture in its metadata, so the hint isn't needed
+	if c, ok := ggml.container.(*containerGGUF); ok {
+		ggml.model = &ggufModel{kv: c.kv}
+		return &ggml, nil
 	}
 
 	// different model types may have different layouts for hyperparameters
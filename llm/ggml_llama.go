@@ -4,23 +4,26 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/rand"
 	"embed"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/fs"
-	"log"
-	"math/rand"
+	"math/big"
 	"net/http"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
+	"reflect"
 	"runtime"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/jmorganca/ollama/api"
@@ -36,9 +39,27 @@ var (
 	ggmlCPU = path.Join("llama.cpp", "ggml", "build", "cpu", "bin")
 )
 
+// RunnerFS is the file system the llama.cpp runner is extracted from. It defaults to the binaries
+// embedded at build time. It may be replaced before the first model is loaded, e.g. with os.DirFS
+// over a directory downloaded at runtime, as long as it follows the same llama.cpp/ggml/build layout.
+var RunnerFS fs.FS = llamaCppEmbed
+
+// RunnerTmpDir is the directory the runner is extracted to. When it's empty OLLAMA_TMPDIR is used,
+// then the system temporary directory, which hardened hosts may mount noexec.
+var RunnerTmpDir string
+
+func runnerTmpDir() string {
+	if RunnerTmpDir != "" {
+		return RunnerTmpDir
+	}
+
+	return os.Getenv("OLLAMA_TMPDIR")
+}
+
 var (
-	ggmlInit       sync.Once
-	ggmlRunnerPath string
+	ggmlInit   sync.Once
+	ggmlRunner ModelRunner
+	ggmlErr    error
 )
 
 func osPath(llamaPath string) string {
@@ -49,66 +70,151 @@ func osPath(llamaPath string) string {
 	return llamaPath
 }
 
-func initGGML() {
-	ggmlInit.Do(func() {
-		tmpDir, err := os.MkdirTemp("", "llama-*")
-		if err != nil {
-			log.Fatalf("llama.cpp: failed to create temp dir: %v", err)
-		}
+// chooseRunner picks the gpu runner from fsys if available, falling back to the best cpu runner
+// this cpu supports, and extracts it to a temporary directory so it can be executed
+func chooseRunner(fsys fs.FS) (ModelRunner, error) {
+	variants, _ := RunnerVariants(fsys)
 
-		llamaPath := osPath(ggmlGPU)
-		if _, err := fs.Stat(llamaCppEmbed, llamaPath); err != nil {
-			llamaPath = osPath(ggmlCPU)
-			if _, err := fs.Stat(llamaCppEmbed, llamaPath); err != nil {
-				log.Fatalf("llama.cpp executable not found")
-			}
+	var cpuPath string
+	variant := cpuVariant(variants)
+	if variant != "" {
+		cpuPath = osPath(path.Join("llama.cpp", "ggml", "build", variant, "bin"))
+	}
+
+	llamaPath := osPath(ggmlGPU)
+	if _, err := fs.Stat(fsys, llamaPath); err != nil {
+		llamaPath = cpuPath
+		if llamaPath == "" {
+			return ModelRunner{}, errors.New("llama.cpp executable not found")
 		}
 
-		files := []string{"server"}
-		switch runtime.GOOS {
-		case "windows":
-			files = []string{"server.exe"}
-		case "darwin":
-			if llamaPath == osPath(ggmlGPU) {
-				files = append(files, "ggml-metal.metal")
-			}
+		logInfof("using the %s runner", variant)
+	}
+
+	files := []string{"server"}
+	switch runtime.GOOS {
+	case "windows":
+		files = []string{"server.exe"}
+		if llamaPath == osPath(ggmlGPU) && cpuPath != "" && missingCUDAGPU(runtime.GOOS) {
+			logInfof("no nvidia gpu detected, using the %s runner", variant)
+			llamaPath = cpuPath
 		}
+	case "darwin":
+		if llamaPath == osPath(ggmlGPU) {
+			files = append(files, "ggml-metal.metal")
+		}
+	}
 
-		for _, f := range files {
-			srcPath := path.Join(llamaPath, f)
-			destPath := filepath.Join(tmpDir, f)
+	tmpDir, err := os.MkdirTemp(runnerTmpDir(), "llama-*")
+	if err != nil {
+		return ModelRunner{}, fmt.Errorf("llama.cpp: failed to create temp dir: %w", err)
+	}
 
-			srcFile, err := llamaCppEmbed.Open(srcPath)
-			if err != nil {
-				log.Fatalf("read llama.cpp %s: %v", f, err)
-			}
-			defer srcFile.Close()
+	if isNoExec(tmpDir) {
+		os.RemoveAll(tmpDir)
+		return ModelRunner{}, fmt.Errorf("llama.cpp: %s is on a file system mounted noexec, set OLLAMA_TMPDIR to a directory the runner can be executed from", filepath.Dir(tmpDir))
+	}
 
-			destFile, err := os.OpenFile(destPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o755)
-			if err != nil {
-				log.Fatalf("write llama.cpp %s: %v", f, err)
-			}
-			defer destFile.Close()
+	for _, f := range files {
+		if err := extractFile(fsys, path.Join(llamaPath, f), filepath.Join(tmpDir, f)); err != nil {
+			return ModelRunner{}, err
+		}
+	}
 
-			if _, err := io.Copy(destFile, srcFile); err != nil {
-				log.Fatalf("copy llama.cpp %s: %v", f, err)
-			}
+	runner := ModelRunner{Path: filepath.Join(tmpDir, files[0])}
+
+	// extract the cpu runner as well for cpu_fallback
+	if cpuPath != "" && llamaPath != cpuPath {
+		cpuDir := filepath.Join(tmpDir, "cpu")
+		if err := os.Mkdir(cpuDir, 0o755); err != nil {
+			return ModelRunner{}, fmt.Errorf("llama.cpp: failed to create cpu runner dir: %w", err)
 		}
 
-		ggmlRunnerPath = filepath.Join(tmpDir, "server")
-		if runtime.GOOS == "windows" {
-			ggmlRunnerPath = filepath.Join(tmpDir, "server.exe")
+		if err := extractFile(fsys, path.Join(cpuPath, files[0]), filepath.Join(cpuDir, files[0])); err != nil {
+			return ModelRunner{}, err
 		}
-	})
+
+		runner.CPUPath = filepath.Join(cpuDir, files[0])
+	}
+
+	return runner, nil
+}
+
+// cudaInitErrors are written to stderr by a gpu runner that can't use CUDA
+var cudaInitErrors = []string{
+	"CUDA error",
+	"cudaGetDeviceCount",
+	"no CUDA-capable device",
+	"CUDA driver version is insufficient",
+	"ggml_cuda_init: failed",
+}
+
+// cudaInitFailed reports whether the server's stderr shows it failed to initialize CUDA
+func cudaInitFailed(stderr string) bool {
+	for _, s := range cudaInitErrors {
+		if strings.Contains(stderr, s) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func extractFile(fsys fs.FS, srcPath, destPath string) error {
+	srcFile, err := fsys.Open(srcPath)
+	if err != nil {
+		return fmt.Errorf("read llama.cpp %s: %w", srcPath, err)
+	}
+	defer srcFile.Close()
+
+	destFile, err := os.OpenFile(destPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o755)
+	if err != nil {
+		return fmt.Errorf("write llama.cpp %s: %w", destPath, err)
+	}
+	defer destFile.Close()
+
+	if _, err := io.Copy(destFile, srcFile); err != nil {
+		return fmt.Errorf("copy llama.cpp %s: %w", srcPath, err)
+	}
+
+	return nil
+}
+
+// checkRunner makes sure the runner at path looks runnable, an empty or non-executable file left by
+// an interrupted extraction otherwise fails with a confusing error from the os
+func checkRunner(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	if !info.Mode().IsRegular() || info.Size() == 0 {
+		return fmt.Errorf("llama.cpp runner %s is empty or not a file", path)
+	}
+
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0o111 == 0 {
+		return fmt.Errorf("llama.cpp runner %s is not executable", path)
+	}
+
+	return nil
 }
 
 type ModelRunner struct {
 	Path string // path to the model runner executable
+
+	// CPUPath is the cpu runner to fall back to when Path is a gpu runner that fails to initialize,
+	// empty when Path is the cpu runner
+	CPUPath string
 }
 
-func ggmlRunner() ModelRunner {
-	initGGML()
-	return ModelRunner{Path: ggmlRunnerPath}
+// defaultRunner extracts the runner from RunnerFS once and reuses it for subsequent models
+func defaultRunner() (ModelRunner, error) {
+	ggmlInit.Do(func() {
+		ggmlRunner, ggmlErr = chooseRunner(RunnerFS)
+		warnOldDriver()
+	})
+
+	return ggmlRunner, ggmlErr
 }
 
 type llamaModel struct {
@@ -119,8 +225,17 @@ func (llm *llamaModel) ModelFamily() ModelFamily {
 	return ModelFamilyLlama
 }
 
+func (llm *llamaModel) ModelName() string {
+	return ""
+}
+
 func (llm *llamaModel) ModelType() ModelType {
-	switch llm.hyperparameters.NumLayer {
+	return modelTypeFromLayers(llm.hyperparameters.NumLayer)
+}
+
+// modelTypeFromLayers guesses the parameter count of a llama-like model from its layer count
+func modelTypeFromLayers(numLayer uint32) ModelType {
+	switch numLayer {
 	case 26:
 		return ModelType3B
 	case 32:
@@ -143,6 +258,10 @@ func (llm *llamaModel) FileType() FileType {
 	return llm.hyperparameters.FileType
 }
 
+func (llm *llamaModel) NumEmbd() uint32 {
+	return llm.hyperparameters.NumEmbd
+}
+
 type llamaHyperparameters struct {
 	// NumVocab is the size of the model's vocabulary.
 	NumVocab uint32
@@ -162,24 +281,26 @@ type llamaHyperparameters struct {
 
 type llamaFileType uint32
 
+// llamaFileType values are llama.cpp's LLAMA_FTYPE_* ids as written to model files. They aren't
+// contiguous: 5 and 6 were Q4_2 and Q4_3, which llama.cpp removed, so their ids are never reused.
 const (
-	llamaFileTypeF32 llamaFileType = iota
-	llamaFileTypeF16
-	llamaFileTypeQ4_0
-	llamaFileTypeQ4_1
-	llamaFileTypeQ4_1_F16
-	llamaFileTypeQ8_0 llamaFileType = iota + 2
-	llamaFileTypeQ5_0
-	llamaFileTypeQ5_1
-	llamaFileTypeQ2_K
-	llamaFileTypeQ3_K_S
-	llamaFileTypeQ3_K_M
-	llamaFileTypeQ3_K_L
-	llamaFileTypeQ4_K_S
-	llamaFileTypeQ4_K_M
-	llamaFileTypeQ5_K_S
-	llamaFileTypeQ5_K_M
-	llamaFileTypeQ6_K
+	llamaFileTypeF32      llamaFileType = 0
+	llamaFileTypeF16      llamaFileType = 1
+	llamaFileTypeQ4_0     llamaFileType = 2
+	llamaFileTypeQ4_1     llamaFileType = 3
+	llamaFileTypeQ4_1_F16 llamaFileType = 4
+	llamaFileTypeQ8_0     llamaFileType = 7
+	llamaFileTypeQ5_0     llamaFileType = 8
+	llamaFileTypeQ5_1     llamaFileType = 9
+	llamaFileTypeQ2_K     llamaFileType = 10
+	llamaFileTypeQ3_K_S   llamaFileType = 11
+	llamaFileTypeQ3_K_M   llamaFileType = 12
+	llamaFileTypeQ3_K_L   llamaFileType = 13
+	llamaFileTypeQ4_K_S   llamaFileType = 14
+	llamaFileTypeQ4_K_M   llamaFileType = 15
+	llamaFileTypeQ5_K_S   llamaFileType = 16
+	llamaFileTypeQ5_K_M   llamaFileType = 17
+	llamaFileTypeQ6_K     llamaFileType = 18
 )
 
 func (ft llamaFileType) String() string {
@@ -227,35 +348,583 @@ type Running struct {
 	Port   int
 	Cmd    *exec.Cmd
 	Cancel context.CancelFunc
+
+	// BasePath prefixes the server's endpoints, e.g. /llama when a reverse proxy serves it under
+	// that path. It's empty for a server at the root.
+	BasePath string
+}
+
+// endpoint returns the url of path on the server, path starts with a slash and may have a query
+func (r Running) endpoint(path string) string {
+	base := strings.Trim(r.BasePath, "/")
+	if base != "" {
+		base = "/" + base
+	}
+
+	return fmt.Sprintf("http://127.0.0.1:%d%s%s", r.Port, base, path)
+}
+
+// LoadStatus describes the effective configuration a model was loaded with, including values
+// computed at load time when the corresponding options were left unset
+type LoadStatus struct {
+	NumThread   int
+	MainGPU     int
+	TensorSplit []float32
+
+	// NumGPU is the number of layers asked of the server, 0 when the gpu was disabled for the model
+	// or the host or the load fell back to the cpu
+	NumGPU int
+
+	// PoolingType is empty when the model's own default pooling is used
+	PoolingType string
+
+	// NumCtx is the context of each slot after clamping to NumCtxTrain, the context length the model
+	// was trained with or 0 when the model file doesn't record it
+	NumCtx      int
+	NumCtxTrain int
+
+	// NoMMap is set when mmap was disabled because the model's file system makes it unreliable
+	// or slow
+	NoMMap bool
+
+	// Offload is what the server logged about the layers and buffers it put on the gpu
+	Offload OffloadStatus
 }
 
 type llama struct {
 	api.Options
 	Running
+
+	// family, modelName and chatTemplate identify the model for behavior that depends on how it
+	// was trained
+	family       ModelFamily
+	modelName    string
+	chatTemplate string
+
+	// bos and eos are the model's special tokens, specialTokens is false when the model file doesn't say
+	bos, eos      specialToken
+	specialTokens bool
+
+	status      LoadStatus
+	metrics     metrics
+	activity    activity
+	generations generations
+
+	// ready holds the first requests until the server answers a ping
+	ready readyGate
+
+	// client sends requests to the server, it's nil in tests that build llama values directly
+	client *http.Client
+
+	// slots holds the ids of idle server slots when the server runs with more than one, and
+	// slotPrompts the text each slot last evaluated with cache_prompt set
+	slots       chan int
+	slotMu      sync.Mutex
+	slotPrompts map[int]string
+
+	// resets holds predictions while Reset erases the slots
+	resets resetGate
+
+	// releaseVRAM returns the vram reserved for the model by Acquire
+	releaseVRAM func()
+
+	// detached is set when the server was launched with the detach option, or reused from an
+	// earlier launch, so Close leaves it running. logFile is where a detached server writes its
+	// output while it's starting.
+	detached bool
+	logFile  *os.File
+
+	// stderr keeps the end of the server's output, and exited is closed with exitErr set once the
+	// server process exits
+	stderr  *tailBuffer
+	exited  chan struct{}
+	exitErr error
+
+	// numEmbd is the embedding dimension read from the model hyperparameters, or probed and cached
+	// by EmbeddingDim when the model file didn't provide one
+	numEmbdMu sync.Mutex
+	numEmbd   int
+
+	// closed is closed by the first call to Close, it's created on first use since tests build
+	// llama values directly
+	closeOnce sync.Once
+	closedMu  sync.Mutex
+	closed    chan struct{}
 }
 
 func newLlama(model string, adapters []string, runner ModelRunner, opts api.Options) (*llama, error) {
-	if _, err := os.Stat(model); err != nil {
+	return loadLlama(context.Background(), model, adapters, runner, opts)
+}
+
+// Load starts model with runner and returns once it passes SelfTest, so a server warming up
+// models before taking traffic knows each one works rather than finding out on the first request.
+// Cancelling ctx stops the load, which can otherwise take minutes for a large model.
+func Load(ctx context.Context, model string, adapters []string, runner ModelRunner, opts api.Options) (LLM, error) {
+	llm, err := loadLlama(ctx, model, adapters, runner, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := llm.SelfTest(ctx); err != nil {
+		llm.Close()
+		return nil, err
+	}
+
+	return llm, nil
+}
+
+func loadLlama(ctx context.Context, model string, adapters []string, runner ModelRunner, opts api.Options) (*llama, error) {
+	if err := statModel(model); err != nil {
+		return nil, err
+	}
+
+	// check the file magic before handing the model to the server, which fails cryptically on files it can't read
+	ggml, err := checkModelFormat(model)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, adapter := range adapters {
+		if err := checkAdapter(adapter, ggml); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := checkAvailableMemory(ggml, opts); err != nil {
+		return nil, err
+	}
+
+	if err := checkRunner(runner.Path); err != nil {
+		return nil, err
+	}
+
+	if opts.MMProjPath != "" {
+		if _, err := os.Stat(opts.MMProjPath); err != nil {
+			return nil, fmt.Errorf("multimodal projector: %w", err)
+		}
+	}
+
+	if opts.DraftModelPath != "" {
+		if err := statModel(opts.DraftModelPath); err != nil {
+			return nil, fmt.Errorf("draft model: %w", err)
+		}
+
+		if _, err := checkModelFormat(opts.DraftModelPath); err != nil {
+			return nil, fmt.Errorf("draft model: %w", err)
+		}
+	}
+
+	numCtxTrain := modelContextLength(ggml)
+	if opts, err = checkContextLength(opts, numCtxTrain); err != nil {
+		return nil, err
+	}
+
+	loadOpts := withLoadDefaults(model, opts)
+	noMMap := opts.UseMMap && !loadOpts.UseMMap
+	opts = loadOpts
+	params, err := runnerParams(model, adapters, opts)
+	if err != nil {
 		return nil, err
 	}
 
-	if _, err := os.Stat(runner.Path); err != nil {
+	portMin, portMax, err := runnerPorts(opts)
+	if err != nil {
 		return nil, err
 	}
 
+	retry := startupRetryPolicy(opts)
+
+	// connect returns the client for a server on port, cmd and cancel are nil when it wasn't
+	// launched by this load
+	connect := func(port int, cmd *exec.Cmd, cancel context.CancelFunc) *llama {
+		llm := &llama{
+			Options: opts,
+			Running: Running{Port: port, Cmd: cmd, Cancel: cancel},
+			client:  &http.Client{Transport: http.DefaultTransport.(*http.Transport).Clone()},
+			status: LoadStatus{
+				NumThread:   opts.NumThread,
+				MainGPU:     opts.MainGPU,
+				TensorSplit: opts.TensorSplit,
+				NumGPU:      opts.NumGPU,
+				PoolingType: opts.PoolingType,
+				NumCtx:      opts.NumCtx,
+				NumCtxTrain: int(numCtxTrain),
+				NoMMap:      noMMap,
+			},
+			numEmbd:      int(ggml.NumEmbd()),
+			family:       ggml.ModelFamily(),
+			modelName:    ggml.ModelName(),
+			chatTemplate: modelChatTemplate(ggml),
+		}
+		llm.bos, llm.eos, llm.specialTokens = modelSpecialTokens(ggml)
+
+		if opts.NumParallel > 1 {
+			llm.slots = newSlots(opts.NumParallel)
+		}
+		llm.ready.reset()
+		return llm
+	}
+
+	if opts.Detach {
+		// a server left running by an earlier process is already loaded, and holds its own vram
+		llm, err := reconnectDetached(ctx, model, params, connect)
+		if err == nil {
+			logInfof("reusing the detached llama.cpp server on port %d", llm.Running.Port)
+			track(llm)
+			return llm, nil
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			logInfof("launching a new llama.cpp server: %v", err)
+		}
+	}
+
+	// reserve vram up front so a concurrent load can't claim the same free memory
+	release := func() {}
+	if !opts.SkipMemoryCheck {
+		estimate, err := estimateVRAM(model, ggml, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		if estimate > 0 {
+			if release, err = Acquire(estimate); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// start the llama.cpp server with a retry in case the port is already in use
+	var stderr string
+	var lastErr error
+	for try := 0; try < retry.MaxAttempts; try++ {
+		if err := ctx.Err(); err != nil {
+			release()
+			return nil, fmt.Errorf("loading model: %w: %w", ErrContextCanceled, err)
+		}
+
+		if try > 0 {
+			// back off in case the failure was contention for the gpu or memory
+			sleep(retry.Delay(try))
+		}
+
+		port := opts.RunnerPort
+		if port == 0 {
+			port = pickPort(portMin, portMax)
+		}
+
+		// loads running in parallel can pick the same port, only one of them may launch on it
+		if !reservePort(port) {
+			logDebugf("port %d is in use by another model, retrying", port)
+			continue
+		}
+
+		// the server outlives the load, so it isn't stopped by ctx
+		cmdCtx, cancel := context.WithCancel(context.Background())
+		cmd := exec.CommandContext(
+			cmdCtx,
+			runner.Path,
+			append(params, "--port", strconv.Itoa(port))...,
+		)
+		cmd.Stdout = os.Stderr
+		cmd.Stderr = os.Stderr
+
+		llm := connect(port, cmd, cancel)
+		if opts.Detach {
+			cmd.SysProcAttr = detachAttr()
+			if llm.logFile, err = openDetachedLog(params); err != nil {
+				release()
+				releasePort(port)
+				cancel()
+				return nil, err
+			}
+		}
+
+		err := waitForServer(ctx, llm)
+		if llm.logFile != nil {
+			// the server has its own handle on the log
+			llm.logFile.Close()
+		}
+
+		if err != nil {
+			logErrorf("error starting llama.cpp server: %v", err)
+			lastErr = err
+			if llm.stderr != nil {
+				stderr = llm.stderr.String()
+			}
+
+			llm.Close()
+			if errors.Is(err, ErrRunnerMismatch) || ctx.Err() != nil {
+				// retrying runs the same binary, or the load was cancelled
+				release()
+				return nil, err
+			}
+
+			// try again
+			continue
+		}
+		// server started successfully
+		llm.releaseVRAM = release
+		if opts.Detach {
+			if err := writeDetached(params, cmd.Process.Pid, port); err != nil {
+				logWarnf("the llama.cpp server won't be reused after a restart: %v", err)
+			}
+
+			llm.detached = true
+		}
+
+		track(llm)
+		return llm, nil
+	}
+
+	release()
+
+	if opts.CPUFallback && runner.CPUPath != "" && cudaInitFailed(stderr) {
+		logWarnf("the gpu runner failed to initialize CUDA, loading %s on the cpu instead, it will run much slower", model)
+		opts.NumGPU = 0
+		return loadLlama(ctx, model, adapters, ModelRunner{Path: runner.CPUPath}, opts)
+	}
+
+	if lastErr != nil {
+		return nil, fmt.Errorf("max retry exceeded starting llama.cpp: %w", lastErr)
+	}
+
+	return nil, fmt.Errorf("max retry exceeded starting llama.cpp")
+}
+
+// modelContextLength returns the context length the model was trained with, or 0 if it's unknown.
+// Only gguf files record it, and checkModelFormat rejects them, so for now it's always 0 at load
+// and num_ctx is never clamped.
+func modelContextLength(ggml *GGML) uint32 {
+	if m, ok := ggml.model.(*ggufModel); ok {
+		return m.uint32(m.architecture() + ".context_length")
+	}
+
+	return 0
+}
+
+// modelChatTemplate returns the Jinja chat template recorded in the model file, if any. Only gguf
+// files have one, so loaded models don't yet and FormatChat uses the family's format.
+func modelChatTemplate(ggml *GGML) string {
+	if m, ok := ggml.model.(*ggufModel); ok {
+		s, _ := m.kv["tokenizer.chat_template"].(string)
+		return s
+	}
+
+	return ""
+}
+
+// specialToken is a token marking the beginning or end of a sequence
+type specialToken struct {
+	id   int
+	text string
+}
+
+// specialTokenDefaults are the bos and eos ids llama.cpp uses for each tokenizer when the model
+// file doesn't record them
+var specialTokenDefaults = map[string][2]int{
+	"llama": {1, 2},
+	"gpt2":  {11, 11},
+}
+
+// modelSpecialTokens returns the model's bos and eos tokens, ok is false if they're unknown. ggjt
+// files only hold llama models, which always use <s> and </s>. The gguf branch is unused at load
+// until the bundled llama.cpp supports gguf.
+func modelSpecialTokens(ggml *GGML) (bos, eos specialToken, ok bool) {
+	m, isGGUF := ggml.model.(*ggufModel)
+	if !isGGUF {
+		_, isLlama := ggml.model.(*llamaModel)
+		return specialToken{1, "<s>"}, specialToken{2, "</s>"}, isLlama
+	}
+
+	tokenizer, _ := m.kv["tokenizer.ggml.model"].(string)
+	defaults, known := specialTokenDefaults[tokenizer]
+	bos.id, eos.id = defaults[0], defaults[1]
+
+	if _, set := m.kv["tokenizer.ggml.bos_token_id"]; set {
+		bos.id, known = int(m.uint32("tokenizer.ggml.bos_token_id")), true
+	}
+
+	if _, set := m.kv["tokenizer.ggml.eos_token_id"]; set {
+		eos.id, known = int(m.uint32("tokenizer.ggml.eos_token_id")), true
+	}
+
+	if !known {
+		return specialToken{}, specialToken{}, false
+	}
+
+	tokens, _ := m.kv["tokenizer.ggml.tokens"].([]any)
+	for _, t := range []*specialToken{&bos, &eos} {
+		if t.id < len(tokens) {
+			t.text, _ = tokens[t.id].(string)
+		}
+	}
+
+	return bos, eos, true
+}
+
+// checkContextLength lowers num_ctx to the trained context length when it's larger and nothing is
+// configured to stretch the context, since positions past it degrade the output. With
+// strict_context set it returns ErrContextExceedsModelMax instead.
+func checkContextLength(opts api.Options, numCtxTrain uint32) (api.Options, error) {
+	if numCtxTrain == 0 || opts.NumCtx <= int(numCtxTrain) {
+		return opts, nil
+	}
+
+	defaults := api.DefaultOptions()
+	scaled := opts.GroupAttnFactor > 1 ||
+		(opts.RopeFrequencyScale > 0 && opts.RopeFrequencyScale != defaults.RopeFrequencyScale) ||
+		(opts.RopeFrequencyBase > 0 && opts.RopeFrequencyBase != defaults.RopeFrequencyBase)
+	if scaled {
+		return opts, nil
+	}
+
+	if opts.StrictContext {
+		return opts, fmt.Errorf("%w: num_ctx %d, trained with %d; set rope_frequency_scale or group_attn_factor to extend it", ErrContextExceedsModelMax, opts.NumCtx, numCtxTrain)
+	}
+
+	logWarnf("num_ctx %d exceeds the model's trained context length %d, using %d", opts.NumCtx, numCtxTrain, numCtxTrain)
+	opts.NumCtx = int(numCtxTrain)
+	return opts, nil
+}
+
+const (
+	defaultPortMin = 49152
+	defaultPortMax = 65535
+)
+
+// runnerPorts returns the port range for starting the server
+func runnerPorts(opts api.Options) (portMin, portMax int, err error) {
+	portMin, portMax = defaultPortMin, defaultPortMax
+	if opts.RunnerPortMin > 0 {
+		portMin = opts.RunnerPortMin
+	}
+
+	if opts.RunnerPortMax > 0 {
+		portMax = opts.RunnerPortMax
+	}
+
+	if portMin > portMax || portMax > 65535 {
+		return 0, 0, fmt.Errorf("invalid runner port range %d-%d", portMin, portMax)
+	}
+
+	if opts.RunnerPort < 0 || opts.RunnerPort > 65535 {
+		return 0, 0, fmt.Errorf("invalid runner port %d", opts.RunnerPort)
+	}
+
+	return portMin, portMax, nil
+}
+
+// sleep waits between retries; tests replace it to observe the delays without waiting
+var sleep = time.Sleep
+
+// pickPort selects a port in [min, max]; tests replace it to force a known port
+var pickPort = func(min, max int) int {
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(max-min+1)))
+	if err != nil {
+		// the system's random source is unavailable, fall back to the lowest port in range
+		return min
+	}
+
+	return min + int(n.Int64())
+}
+
+var (
+	portsMu    sync.Mutex
+	portsInUse = make(map[int]bool)
+)
+
+// reservePort marks port as used by a server launched from this process, returning false if it
+// already is
+func reservePort(port int) bool {
+	portsMu.Lock()
+	defer portsMu.Unlock()
+
+	if portsInUse[port] {
+		return false
+	}
+
+	portsInUse[port] = true
+	return true
+}
+
+func releasePort(port int) {
+	portsMu.Lock()
+	defer portsMu.Unlock()
+
+	delete(portsInUse, port)
+}
+
+// BuildRunnerArgs returns the llama.cpp server arguments ollama would launch model with, apart
+// from --port which is picked at launch. Defaults that depend on the host, such as the thread
+// count and the split across gpus, are filled in the same way as when loading.
+func BuildRunnerArgs(model string, adapters []string, opts api.Options) ([]string, error) {
+	return runnerParams(model, adapters, withLoadDefaults(model, opts))
+}
+
+// withLoadDefaults fills in the options left to be decided by the host when the model is loaded
+func withLoadDefaults(model string, opts api.Options) api.Options {
+	if opts.NumThread == 0 {
+		opts.NumThread = defaultNumThread()
+	}
+
+	opts = withMMapDefault(runtime.GOOS, model, opts)
+
+	if opts.NumGPU > 0 && len(opts.TensorSplit) == 0 {
+		// spread layers by free memory so a nearly full gpu isn't given an equal share
+		if gpus, err := CheckVRAM(); err == nil && len(gpus) > 1 {
+			split, emptiest := splitByFreeVRAM(gpus)
+			if split != nil {
+				opts.TensorSplit = split
+				if opts.MainGPU == 0 {
+					opts.MainGPU = emptiest
+				}
+				logInfof("splitting model across %d gpus by free memory: %v", len(gpus), split)
+			}
+		}
+	}
+
+	return opts
+}
+
+// runnerParams maps the model, adapters and options to llama.cpp server flags
+func runnerParams(model string, adapters []string, opts api.Options) ([]string, error) {
 	if len(adapters) > 1 {
 		return nil, errors.New("ollama supports only one lora adapter, but multiple were provided")
 	}
 
+	numCtx := opts.NumCtx
+	if opts.NumParallel > 1 {
+		// the server divides its context between slots, give each one the full num_ctx
+		numCtx *= opts.NumParallel
+	}
+
 	params := []string{
 		"--model", model,
-		"--ctx-size", fmt.Sprintf("%d", opts.NumCtx),
+		"--ctx-size", fmt.Sprintf("%d", numCtx),
 		"--gqa", fmt.Sprintf("%d", opts.NumGQA),
 		"--rope-freq-base", fmt.Sprintf("%f", opts.RopeFrequencyBase),
 		"--rope-freq-scale", fmt.Sprintf("%f", opts.RopeFrequencyScale),
 		"--batch-size", fmt.Sprintf("%d", opts.NumBatch),
 		"--n-gpu-layers", fmt.Sprintf("%d", opts.NumGPU),
-		"--embedding",
+	}
+
+	if opts.EmbeddingEnabled {
+		params = append(params, "--embedding")
+	}
+
+	if opts.PoolingType != "" {
+		if !validPoolingType(opts.PoolingType) {
+			return nil, fmt.Errorf("unknown pooling_type %q, must be one of %s", opts.PoolingType, strings.Join(poolingTypes, ", "))
+		}
+
+		params = append(params, "--pooling", opts.PoolingType)
+	}
+
+	if opts.ChatTemplate != "" {
+		if err := checkChatTemplate(opts.ChatTemplate); err != nil {
+			return nil, err
+		}
+
+		params = append(params, "--chat-template", opts.ChatTemplate)
 	}
 
 	if len(adapters) > 0 {
@@ -263,97 +932,576 @@ func newLlama(model string, adapters []string, runner ModelRunner, opts api.Opti
 		params = append(params, "--lora", adapters[0])
 	}
 
+	if opts.MMProjPath != "" {
+		params = append(params, "--mmproj", opts.MMProjPath)
+	}
+
+	if opts.DraftTokens < 0 {
+		return nil, fmt.Errorf("invalid draft_tokens %d", opts.DraftTokens)
+	}
+
+	if opts.DraftModelPath != "" {
+		params = append(params, "--model-draft", opts.DraftModelPath)
+		if opts.DraftTokens > 0 {
+			params = append(params, "--draft", strconv.Itoa(opts.DraftTokens))
+		}
+	} else if opts.DraftTokens > 0 {
+		return nil, errors.New("draft_tokens requires draft_model_path")
+	}
+
+	if opts.MainGPU < 0 {
+		return nil, fmt.Errorf("invalid main_gpu %d", opts.MainGPU)
+	} else if opts.MainGPU > 0 {
+		params = append(params, "--main-gpu", fmt.Sprintf("%d", opts.MainGPU))
+	}
+
+	switch opts.SplitMode {
+	case "", "layer", "row":
+	case "none":
+		if len(opts.TensorSplit) > 0 {
+			return nil, errors.New("tensor_split can't be used with split_mode none, which keeps the model on main_gpu")
+		}
+	default:
+		return nil, fmt.Errorf("invalid split_mode %q, must be one of layer, row or none", opts.SplitMode)
+	}
+
+	if opts.SplitMode != "" {
+		params = append(params, "--split-mode", opts.SplitMode)
+	}
+
+	if !opts.KVOffload {
+		params = append(params, "--no-kv-offload")
+	}
+
+	if opts.NumUBatch < 0 || (opts.NumUBatch > 0 && opts.NumBatch > 0 && opts.NumUBatch > opts.NumBatch) {
+		return nil, fmt.Errorf("invalid num_ubatch %d, must be between 1 and num_batch %d", opts.NumUBatch, opts.NumBatch)
+	} else if opts.NumUBatch > 0 {
+		params = append(params, "--ubatch-size", strconv.Itoa(opts.NumUBatch))
+	}
+
+	if opts.DefragThreshold < 0 || opts.DefragThreshold > 1 {
+		return nil, fmt.Errorf("invalid defrag_threshold %g, must be between 0 and 1", opts.DefragThreshold)
+	} else if opts.DefragThreshold > 0 {
+		params = append(params, "--defrag-thold", strconv.FormatFloat(float64(opts.DefragThreshold), 'f', -1, 32))
+	}
+
+	if len(opts.TensorSplit) > 0 {
+		split, err := tensorSplit(opts.TensorSplit)
+		if err != nil {
+			return nil, err
+		}
+
+		params = append(params, "--tensor-split", split)
+	}
+
 	if opts.NumThread > 0 {
 		params = append(params, "--threads", fmt.Sprintf("%d", opts.NumThread))
 	}
 
-	if !opts.F16KV {
+	if opts.NumParallel < 0 {
+		return nil, fmt.Errorf("invalid num_parallel %d", opts.NumParallel)
+	} else if opts.NumParallel > 1 {
+		params = append(params, "--parallel", fmt.Sprintf("%d", opts.NumParallel), "--cont-batching")
+	}
+
+	if opts.CacheTypeK != "" || opts.CacheTypeV != "" {
+		// the cache types replace f16_kv, which only chooses between f16 and f32 for both
+		for _, c := range []struct{ flag, value string }{
+			{"--cache-type-k", opts.CacheTypeK},
+			{"--cache-type-v", opts.CacheTypeV},
+		} {
+			if c.value == "" {
+				continue
+			}
+
+			if !validCacheType(c.value) {
+				return nil, fmt.Errorf("invalid %s %q, must be one of %s", strings.TrimPrefix(c.flag, "--"), c.value, strings.Join(cacheTypes, ", "))
+			}
+
+			params = append(params, c.flag, c.value)
+		}
+	} else if !opts.F16KV {
 		params = append(params, "--memory-f32")
 	}
+
+	groupAttn, err := groupAttnParams(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	params = append(params, groupAttn...)
+
 	if opts.UseMLock {
 		params = append(params, "--mlock")
 	}
 	if !opts.UseMMap {
 		params = append(params, "--no-mmap")
 	}
-	if opts.UseNUMA {
-		params = append(params, "--numa")
+
+	numa, err := numaStrategy(opts)
+	if err != nil {
+		return nil, err
 	}
 
-	// start the llama.cpp server with a retry in case the port is already in use
-	for try := 0; try < 3; try++ {
-		port := rand.Intn(65535-49152) + 49152 // get a random port in the ephemeral range
-		ctx, cancel := context.WithCancel(context.Background())
-		cmd := exec.CommandContext(
-			ctx,
-			runner.Path,
-			append(params, "--port", strconv.Itoa(port))...,
-		)
-		cmd.Stdout = os.Stderr
-		cmd.Stderr = os.Stderr
+	if numa != "" {
+		params = append(params, "--numa", numa)
+	}
 
-		llm := &llama{Options: opts, Running: Running{Port: port, Cmd: cmd, Cancel: cancel}}
+	if err := checkExtraRunnerArgs(params, opts.ExtraRunnerArgs); err != nil {
+		return nil, err
+	}
 
-		if err := waitForServer(llm); err != nil {
-			log.Printf("error starting llama.cpp server: %v", err)
-			llm.Close()
-			// try again
+	return append(params, opts.ExtraRunnerArgs...), nil
+}
+
+// cacheTypes are the kv cache types llama.cpp accepts
+var cacheTypes = []string{"f32", "f16", "q8_0", "q4_0", "q4_1", "q5_0", "q5_1"}
+
+func validCacheType(t string) bool {
+	for _, c := range cacheTypes {
+		if t == c {
+			return true
+		}
+	}
+
+	return false
+}
+
+// defaultGroupAttnWidth matches the llama.cpp server default for --grp-attn-w
+const defaultGroupAttnWidth = 512
+
+// groupAttnParams returns the self-extend flags, which are only passed when the factor is above 1
+func groupAttnParams(opts api.Options) ([]string, error) {
+	if opts.GroupAttnFactor < 0 {
+		return nil, fmt.Errorf("invalid group_attn_factor %d", opts.GroupAttnFactor)
+	}
+
+	if opts.GroupAttnWidth < 0 {
+		return nil, fmt.Errorf("invalid group_attn_width %d", opts.GroupAttnWidth)
+	}
+
+	if opts.GroupAttnFactor <= 1 {
+		return nil, nil
+	}
+
+	width := opts.GroupAttnWidth
+	if width == 0 {
+		width = defaultGroupAttnWidth
+	}
+
+	// llama.cpp asserts on this when the first sequence is shifted rather than at startup
+	if width%opts.GroupAttnFactor != 0 {
+		return nil, fmt.Errorf("invalid group_attn_width %d: must be a multiple of group_attn_factor %d", width, opts.GroupAttnFactor)
+	}
+
+	return []string{"--grp-attn-n", strconv.Itoa(opts.GroupAttnFactor), "--grp-attn-w", strconv.Itoa(width)}, nil
+}
+
+// reservedRunnerFlags are managed by ollama and can't be overridden with extra runner args
+var reservedRunnerFlags = map[string]bool{"--port": true, "--host": true, "--model": true, "-m": true}
+
+// runnerFlagAliases maps the short forms of flags ollama sets to their long forms
+var runnerFlagAliases = map[string]string{
+	"-c":    "--ctx-size",
+	"-b":    "--batch-size",
+	"-ngl":  "--n-gpu-layers",
+	"-t":    "--threads",
+	"-mg":   "--main-gpu",
+	"-ts":   "--tensor-split",
+	"-gan":  "--grp-attn-n",
+	"-gaw":  "--grp-attn-w",
+	"-md":   "--model-draft",
+	"-sm":   "--split-mode",
+	"-nkvo": "--no-kv-offload",
+}
+
+// checkExtraRunnerArgs rejects extra args that would conflict with flags ollama already passes
+func checkExtraRunnerArgs(params, extra []string) error {
+	set := make(map[string]bool)
+	for _, p := range params {
+		if strings.HasPrefix(p, "-") {
+			set[p] = true
+		}
+	}
+
+	for _, arg := range extra {
+		if !strings.HasPrefix(arg, "-") {
 			continue
 		}
-		// server started successfully
-		return llm, nil
+
+		flag, _, _ := strings.Cut(arg, "=")
+		if long, ok := runnerFlagAliases[flag]; ok {
+			flag = long
+		}
+
+		if reservedRunnerFlags[flag] || set[flag] {
+			return fmt.Errorf("extra runner arg %s conflicts with a flag set by ollama", arg)
+		}
 	}
 
-	return nil, fmt.Errorf("max retry exceeded starting llama.cpp")
+	return nil
+}
+
+// tensorSplit formats the per-gpu proportions for --tensor-split. The gpu count isn't checked here:
+// llama.cpp ignores proportions beyond the number of devices it finds and treats missing ones as 0.
+func tensorSplit(split []float32) (string, error) {
+	var total float32
+	parts := make([]string, len(split))
+	for i, f := range split {
+		if f < 0 {
+			return "", fmt.Errorf("invalid tensor_split %v: proportions must not be negative", split)
+		}
+
+		total += f
+		parts[i] = strconv.FormatFloat(float64(f), 'f', -1, 32)
+	}
+
+	if total == 0 {
+		return "", fmt.Errorf("invalid tensor_split %v: at least one proportion must be positive", split)
+	}
+
+	return strings.Join(parts, ","), nil
+}
+
+var poolingTypes = []string{"none", "mean", "cls", "last"}
+
+func validPoolingType(t string) bool {
+	for _, pooling := range poolingTypes {
+		if t == pooling {
+			return true
+		}
+	}
+
+	return false
+}
+
+const numaDistribute = "distribute"
+
+var numaStrategies = []string{numaDistribute, "isolate", "numactl"}
+
+// numaStrategy returns the --numa strategy for opts, or an empty string if NUMA is disabled
+func numaStrategy(opts api.Options) (string, error) {
+	if opts.NUMAStrategy == "" {
+		if opts.UseNUMA {
+			// a bare numa flag predates the strategies and distributes across all nodes
+			return numaDistribute, nil
+		}
+
+		return "", nil
+	}
+
+	for _, strategy := range numaStrategies {
+		if opts.NUMAStrategy == strategy {
+			return strategy, nil
+		}
+	}
+
+	return "", fmt.Errorf("unknown numa strategy %q, must be one of %s", opts.NUMAStrategy, strings.Join(numaStrategies, ", "))
 }
 
-func waitForServer(llm *llama) error {
-	log.Print("starting llama.cpp server")
+func checkModelFormat(model string) (*GGML, error) {
+	f, err := os.Open(model)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ggml, err := DecodeGGML(f, ModelFamilyLlama)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", model, err)
+	}
+
+	// the gguf readers in this package are ahead of the bundled llama.cpp: until it's updated, the
+	// behavior that depends on gguf metadata never applies to a model that's actually loaded
+	if ggml.Name() == "gguf" {
+		return nil, fmt.Errorf("%s: %w: gguf models are not supported by this version of llama.cpp", model, ErrUnsupportedModelFormat)
+	}
+
+	logInfof("loading %s model: family=%s type=%s file_type=%s", ggml.Name(), ggml.ModelFamily(), ggml.ModelType(), ggml.FileType())
+	return ggml, nil
+}
+
+// startupTimeout is how long waitForServer waits for a launched server to respond, pinging it
+// every startupPollInterval
+var (
+	startupTimeout      = 30 * time.Second
+	startupPollInterval = 100 * time.Millisecond
+)
+
+func waitForServer(ctx context.Context, llm *llama) error {
+	logInfof("starting llama.cpp server")
 	var stderr bytes.Buffer
-	llm.Cmd.Stderr = &stderr
+	llm.stderr = &tailBuffer{}
+	var offload offloadParser
+	if llm.logFile != nil {
+		// a pipe to this process would break when it exits
+		llm.Cmd.Stdout, llm.Cmd.Stderr = llm.logFile, llm.logFile
+	} else {
+		llm.Cmd.Stderr = io.MultiWriter(&stderr, llm.stderr, &offload)
+	}
 	err := llm.Cmd.Start()
-	if err != nil {
+	if errors.Is(err, syscall.ENOEXEC) {
+		return fmt.Errorf("%w for GOOS=%s GOARCH=%s, use an ollama build for this platform: %w", ErrRunnerMismatch, runtime.GOOS, runtime.GOARCH, err)
+	} else if err != nil {
 		return fmt.Errorf("error starting the external llama.cpp server: %w", err)
 	}
 
 	exitChan := make(chan error, 1)
+	llm.exited = make(chan struct{})
 
 	// the server is a long running process, watch for it exiting to keep track of something going wrong
 	go func() {
 		err := llm.Cmd.Wait()
-		log.Print(stderr.String())
+		logDebugf("%s", stderr.String())
+		llm.exitErr = err
+		close(llm.exited)
 		exitChan <- err
 	}()
 
 	// wait for the server to start responding
 	start := time.Now()
-	expiresAt := time.Now().Add(30 * time.Second)
-	ticker := time.NewTicker(100 * time.Millisecond)
+	startCtx, cancel := context.WithTimeout(ctx, startupTimeout)
+	defer cancel()
 
-	log.Print("waiting for llama.cpp server to start responding")
+	ticker := time.NewTicker(startupPollInterval)
+	defer ticker.Stop()
+
+	logDebugf("waiting for llama.cpp server to start responding")
 
 	for {
 		select {
 		case <-ticker.C:
-			if time.Now().After(expiresAt) {
-				return fmt.Errorf("llama.cpp server did not start responding within 30 seconds, retrying")
-			}
-			if err := llm.Ping(context.Background()); err == nil {
-				log.Printf("llama.cpp server started in %f seconds", time.Since(start).Seconds())
+			// a server that accepts the connection but hangs gets one interval to answer
+			pingCtx, cancelPing := context.WithTimeout(startCtx, startupPollInterval)
+			err := llm.Ping(pingCtx)
+			cancelPing()
+			if err == nil {
+				logInfof("llama.cpp server started in %f seconds", time.Since(start).Seconds())
+				if llm.logFile != nil {
+					if data, err := os.ReadFile(llm.logFile.Name()); err == nil {
+						offload.Write(data)
+					}
+				}
+
+				llm.status.Offload = offload.Status()
+				if o := llm.status.Offload; o.Partial() {
+					logInfof("offloaded %d of %d layers to the gpu, the rest run on the cpu", o.Layers, o.TotalLayers)
+				}
+
 				return nil
 			}
+		case <-startCtx.Done():
+			if ctx.Err() != nil {
+				return fmt.Errorf("waiting for the llama.cpp server to start: %w: %w", ErrContextCanceled, ctx.Err())
+			}
+
+			return fmt.Errorf("llama.cpp server did not start responding within %s, retrying", startupTimeout)
 		case err := <-exitChan:
+			// the server's output is only logged at debug level, it says why the server failed
+			if tail := strings.TrimSpace(llm.stderr.String()); tail != "" {
+				return fmt.Errorf("llama.cpp server exited unexpectedly: %w: %s", err, tail)
+			}
+
 			return fmt.Errorf("llama.cpp server exited unexpectedly: %w", err)
 		}
 	}
-}
+}
+
+// Close stops the server and releases its port and vram. Requests made afterwards fail with
+// ErrServerClosed. Only the first call has any effect, so the idle reaper and an explicit shutdown
+// can both close the same model.
+func (llm *llama) Close() {
+	llm.closeOnce.Do(func() {
+		llm.activity.close()
+		untrack(llm)
+
+		if llm.releaseVRAM != nil {
+			llm.releaseVRAM()
+		}
+
+		releasePort(llm.Running.Port)
+
+		// keep-alive connections to the server would otherwise linger until they time out
+		if llm.client != nil {
+			llm.client.CloseIdleConnections()
+		}
+
+		// cancelling the command's context kills the server, and unlike Cmd.Cancel is safe when
+		// the server failed to start
+		if llm.Running.Cancel != nil && !llm.detached {
+			llm.Running.Cancel()
+		}
+
+		close(llm.closedChan())
+	})
+}
+
+// Closed returns a channel that's closed once Close is called
+func (llm *llama) Closed() <-chan struct{} {
+	return llm.closedChan()
+}
+
+// IsClosed reports whether Close has been called
+func (llm *llama) IsClosed() bool {
+	select {
+	case <-llm.closedChan():
+		return true
+	default:
+		return false
+	}
+}
+
+func (llm *llama) closedChan() chan struct{} {
+	llm.closedMu.Lock()
+	defer llm.closedMu.Unlock()
+
+	if llm.closed == nil {
+		llm.closed = make(chan struct{})
+	}
+
+	return llm.closed
+}
+
+// Port returns the port the llama.cpp server listens on
+func (llm *llama) Port() int {
+	return llm.Running.Port
+}
+
+// Metrics returns a snapshot of the model's usage counters
+func (llm *llama) Metrics() Metrics {
+	return llm.metrics.snapshot()
+}
+
+func (llm *llama) LoadStatus() LoadStatus {
+	return llm.status
+}
+
+// ErrReloadRequired is returned by SetOptions when an option changed that only takes effect when
+// the llama.cpp server is launched
+var ErrReloadRequired = errors.New("model must be reloaded for these options to take effect")
+
+// launchOptions are the json names of options only read when the server is launched
+var launchOptions = map[string]bool{
+	"numa":                 true,
+	"numa_strategy":        true,
+	"num_ctx":              true,
+	"num_batch":            true,
+	"num_ubatch":           true,
+	"num_gqa":              true,
+	"num_gpu":              true,
+	"main_gpu":             true,
+	"tensor_split":         true,
+	"low_vram":             true,
+	"f16_kv":               true,
+	"logits_all":           true,
+	"vocab_only":           true,
+	"use_mmap":             true,
+	"detach":               true,
+	"force_mmap":           true,
+	"use_mlock":            true,
+	"embedding_only":       true,
+	"embedding_enabled":    true,
+	"draft_model_path":     true,
+	"draft_tokens":         true,
+	"split_mode":           true,
+	"pooling_type":         true,
+	"chat_template":        true,
+	"kv_offload":           true,
+	"defrag_threshold":     true,
+	"rope_frequency_base":  true,
+	"rope_frequency_scale": true,
+	"num_thread":           true,
+	"runner_port":          true,
+	"runner_port_min":      true,
+	"runner_port_max":      true,
+	"runner_retries":       true,
+	"runner_retry_delay":   true,
+	"extra_runner_args":    true,
+	"num_parallel":         true,
+	"mmproj_path":          true,
+	"cache_type_k":         true,
+	"cache_type_v":         true,
+	"group_attn_factor":    true,
+	"group_attn_width":     true,
+	"skip_memory_check":    true,
+	"cpu_fallback":         true,
+	"strict_context":       true,
+}
+
+// changedLaunchOptions returns the json names of launch options that differ between a and b
+func changedLaunchOptions(a, b api.Options) []string {
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+
+	var changed []string
+	for _, field := range reflect.VisibleFields(va.Type()) {
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if !launchOptions[name] {
+			continue
+		}
+
+		if !reflect.DeepEqual(va.FieldByIndex(field.Index).Interface(), vb.FieldByIndex(field.Index).Interface()) {
+			changed = append(changed, name)
+		}
+	}
+
+	return changed
+}
+
+// SetOptions updates the options used for subsequent requests. Sampling options take effect
+// immediately. Options the server only reads at launch are left unchanged and reported with
+// ErrReloadRequired, since the model has to be reloaded for them to apply.
+func (llm *llama) SetOptions(opts api.Options) error {
+	// fill in options that were defaulted at load time
+	if opts.NumThread == 0 {
+		opts.NumThread = llm.status.NumThread
+	}
+
+	if len(opts.TensorSplit) == 0 {
+		opts.TensorSplit = llm.status.TensorSplit
+		if opts.MainGPU == 0 {
+			opts.MainGPU = llm.status.MainGPU
+		}
+	}
+
+	if llm.status.NoMMap && !opts.ForceMMap {
+		opts.UseMMap = false
+	}
+
+	if llm.status.NumGPU == 0 && llm.Options.NumGPU == 0 {
+		// the server runs on the cpu, since the gpu was disabled for the model or the host or the
+		// load fell back to it, and loading again would too
+		opts.NumGPU = 0
+	}
+
+	if opts.NumCtx != llm.Options.NumCtx {
+		// clamp to the trained context length as loading again would
+		if clamped, err := checkContextLength(opts, uint32(llm.status.NumCtxTrain)); err == nil {
+			opts = clamped
+		}
+	}
 
-func (llm *llama) Close() {
-	llm.Running.Cmd.Cancel()
+	changed := changedLaunchOptions(llm.Options, opts)
+	if len(changed) == 0 {
+		llm.Options = opts
+		return nil
+	}
+
+	// keep the launch options the server is actually running with
+	llm.Options = withLaunchOptions(opts, llm.Options)
+	return fmt.Errorf("%w: %s", ErrReloadRequired, strings.Join(changed, ", "))
 }
 
-func (llm *llama) SetOptions(opts api.Options) {
-	llm.Options = opts
+// withLaunchOptions returns opts with its launch options replaced by those in loaded
+func withLaunchOptions(opts, loaded api.Options) api.Options {
+	current := reflect.ValueOf(&loaded).Elem()
+	next := reflect.ValueOf(&opts).Elem()
+	for _, field := range reflect.VisibleFields(next.Type()) {
+		if launchOptions[strings.Split(field.Tag.Get("json"), ",")[0]] {
+			next.FieldByIndex(field.Index).Set(current.FieldByIndex(field.Index))
+		}
+	}
+
+	return opts
 }
 
 type GenerationSettings struct {
@@ -387,6 +1535,11 @@ type Timings struct {
 	PredictedMS float64 `json:"predicted_ms"`
 	PromptN     int     `json:"prompt_n"`
 	PromptMS    float64 `json:"prompt_ms"`
+
+	// DraftN and DraftNAccepted count the tokens a draft model proposed and the ones that were
+	// kept, servers only report them for speculative decoding
+	DraftN         int `json:"draft_n,omitempty"`
+	DraftNAccepted int `json:"draft_n_accepted,omitempty"`
 }
 
 type Prediction struct {
@@ -394,19 +1547,86 @@ type Prediction struct {
 	Model   string `json:"model"`
 	Prompt  string `json:"prompt"`
 	Stop    bool   `json:"stop"`
+	Tokens  []int  `json:"tokens,omitempty"` // generated token ids, when requested with return_tokens
+
+	// the final event says why generation stopped, with the stop sequence matched for
+	// stopped_word; newer servers send stop_type instead of the flags
+	StoppedEOS   bool   `json:"stopped_eos,omitempty"`
+	StoppedWord  bool   `json:"stopped_word,omitempty"`
+	StoppedLimit bool   `json:"stopped_limit,omitempty"`
+	StopType     string `json:"stop_type,omitempty"`
+	StoppingWord string `json:"stopping_word,omitempty"`
+
+	// TokensCached is the number of prompt tokens reused from the slot's kv cache
+	TokensCached int `json:"tokens_cached,omitempty"`
+
+	// PromptProgress is sent while a prompt is evaluated, when requested with return_progress
+	PromptProgress *PromptProgress `json:"prompt_progress,omitempty"`
 
 	Timings `json:"timings"`
 }
 
+// stopReason returns why the final event p ended the generation, and the stop sequence that ended
+// it. A limit reached while filling the context means the context is full. It's empty for servers
+// that don't say.
+func (p Prediction) stopReason(nPredict int) (api.StopReason, string) {
+	switch {
+	case p.StoppedWord || p.StopType == "word":
+		return api.StopReasonStopWord, p.StoppingWord
+	case p.StoppedEOS || p.StopType == "eos":
+		return api.StopReasonEOS, ""
+	case (p.StoppedLimit || p.StopType == "limit") && nPredict == NumPredictFillContext:
+		return api.StopReasonContext, ""
+	case p.StoppedLimit || p.StopType == "limit":
+		return api.StopReasonLimit, ""
+	}
+
+	return "", ""
+}
+
+const (
+	// NumPredictInfinite generates tokens until the model emits a stop token or matches a stop sequence
+	NumPredictInfinite = -1
+	// NumPredictFillContext generates tokens until the context window is full
+	NumPredictFillContext = -2
+)
+
+// numPredict resolves the n_predict value sent to the server from NumPredict and NumPredictLimit
+func numPredict(opts api.Options) (int, error) {
+	n := opts.NumPredict
+	if n == 0 {
+		// unset, generate until stopped like the server's default
+		n = NumPredictInfinite
+	}
+
+	if n < NumPredictFillContext {
+		return 0, fmt.Errorf("invalid num_predict %d: must be positive, %d (infinite) or %d (fill context)", n, NumPredictInfinite, NumPredictFillContext)
+	}
+
+	if opts.NumPredictLimit > 0 {
+		switch {
+		case n == NumPredictFillContext && opts.NumPredictLimit >= opts.NumCtx:
+			// the context fills up before the limit is reached
+		case n < 0, n > opts.NumPredictLimit:
+			n = opts.NumPredictLimit
+		}
+	}
+
+	return n, nil
+}
+
+// PredictRequest is the body of a completion request. top_k and temperature are always sent, since
+// 0 means something to them; the other samplers are left out when they're zero or disabled, for
+// the server's default.
 type PredictRequest struct {
 	Stream           bool            `json:"stream"`
-	NPredict         int             `json:"n_predict,omitempty"`
-	TopK             int             `json:"top_k,omitempty"`
+	NPredict         int             `json:"n_predict"` // 0 only evaluates the prompt
+	TopK             int             `json:"top_k"`
 	TopP             float32         `json:"top_p,omitempty"`
 	TfsZ             float32         `json:"tfs_z,omitempty"`
 	TypicalP         float32         `json:"typical_p,omitempty"`
 	RepeatLastN      int             `json:"repeat_last_n,omitempty"`
-	Temperature      float32         `json:"temperature,omitempty"`
+	Temperature      float32         `json:"temperature"`
 	RepeatPenalty    float32         `json:"repeat_penalty,omitempty"`
 	PresencePenalty  float32         `json:"presence_penalty,omitempty"`
 	FrequencyPenalty float32         `json:"frequency_penalty,omitempty"`
@@ -421,10 +1641,166 @@ type PredictRequest struct {
 	LogitBias        map[int]float32 `json:"logit_bias,omitempty"`
 	IgnoreEos        bool            `json:"ignore_eos,omitempty"`
 	Stop             []string        `json:"stop,omitempty"`
+	SlotID           int             `json:"slot_id"` // -1 lets the server pick an idle slot
+	ImageData        []ImageData     `json:"image_data,omitempty"`
+	Grammar          string          `json:"grammar,omitempty"` // GBNF grammar the output must match
+	ReturnTokens     bool            `json:"return_tokens,omitempty"`
+	ReturnProgress   bool            `json:"return_progress,omitempty"` // servers that don't support it ignore it
+	CachePrompt      bool            `json:"cache_prompt,omitempty"`
+}
+
+type PromptProgress struct {
+	Total     int `json:"total"`
+	Cache     int `json:"cache"`
+	Processed int `json:"processed"`
+}
+
+// ImageData is an image referenced from the prompt as [img-ID]
+type ImageData struct {
+	Data string `json:"data"` // base64 encoded
+	ID   int    `json:"id"`
+}
+
+// enabledSampler returns the value of a sampler that 1 or more disables, such as tfs_z, or 0 to
+// leave it out of the request when it's disabled
+func enabledSampler(v float32) float32 {
+	if v >= 1 {
+		return 0
+	}
+
+	return v
+}
+
+// predictInput holds what a single prediction reads, so it can differ from the loaded options
+type predictInput struct {
+	opts        api.Options
+	prevContext []int
+	prompt      string
+	images      [][]byte
+
+	// evalOnly evaluates the prompt without generating any tokens
+	evalOnly bool
+
+	// seed reseeds the sampler for this request, 0 keeps the server's
+	seed int
 }
 
 func (llm *llama) Predict(ctx context.Context, prevContext []int, prompt string, fn func(api.GenerateResponse)) error {
-	prevConvo, err := llm.Decode(ctx, prevContext)
+	return llm.predict(ctx, predictInput{opts: llm.Options, prevContext: prevContext, prompt: prompt}, fn)
+}
+
+// PredictWithOptions runs a prediction with the sampling and predict options in opts instead of
+// the model's, leaving the model's options as they are so concurrent requests can each use their
+// own. Every field of opts is used, so start from the model's options or api.DefaultOptions
+// rather than a zero value. Launch options in opts are ignored, they need a reload to change.
+func (llm *llama) PredictWithOptions(ctx context.Context, prevContext []int, prompt string, opts api.Options, fn func(api.GenerateResponse)) error {
+	return llm.predict(ctx, predictInput{opts: withLaunchOptions(opts, llm.Options), prevContext: prevContext, prompt: prompt}, fn)
+}
+
+// PredictWithImages runs a prediction with images for a multimodal model loaded with a projector
+// (mmproj_path). Image i is referenced from the prompt as [img-i]; images the prompt doesn't
+// reference are placed at the start of the prompt.
+func (llm *llama) PredictWithImages(ctx context.Context, prevContext []int, prompt string, images [][]byte, fn func(api.GenerateResponse)) error {
+	return llm.predict(ctx, predictInput{opts: llm.Options, prevContext: prevContext, prompt: prompt, images: images}, fn)
+}
+
+// stopStrings returns the stop sequences for a prediction. The server only matches stop strings,
+// so each stop token is detokenized and matched as the text it generates; the text of special
+// tokens is unique to them.
+func (llm *llama) stopStrings(ctx context.Context, opts api.Options) ([]string, error) {
+	if len(opts.StopTokens) == 0 {
+		return opts.Stop, nil
+	}
+
+	stop := append([]string(nil), opts.Stop...)
+	for _, token := range opts.StopTokens {
+		s, err := llm.Decode(ctx, []int{token})
+		if err != nil {
+			return nil, fmt.Errorf("stop token %d: %w", token, err)
+		}
+
+		// tokens without text, like the model's own eos, already end generation
+		if s != "" {
+			stop = append(stop, s)
+		}
+	}
+
+	return stop, nil
+}
+
+// imagePrompt encodes images for the server and references any the prompt doesn't mention
+func imagePrompt(prompt string, images [][]byte) (string, []ImageData) {
+	var markers strings.Builder
+	data := make([]ImageData, len(images))
+	for i, image := range images {
+		data[i] = ImageData{Data: base64.StdEncoding.EncodeToString(image), ID: i}
+
+		marker := fmt.Sprintf("[img-%d]", i)
+		if !strings.Contains(prompt, marker) {
+			markers.WriteString(marker)
+		}
+	}
+
+	if markers.Len() > 0 {
+		prompt = markers.String() + prompt
+	}
+
+	return prompt, data
+}
+
+// predict runs a completion using the sampling parameters in in.opts rather than the loaded options
+func (llm *llama) predict(ctx context.Context, in predictInput, fn func(api.GenerateResponse)) (err error) {
+	defer func() {
+		// a cancelled request isn't a failure of the model
+		if err != nil && !errors.Is(err, context.Canceled) {
+			llm.metrics.errors.Add(1)
+		}
+	}()
+
+	if err := llm.activity.begin(); err != nil {
+		return err
+	}
+	defer llm.activity.end()
+
+	if err := llm.waitReady(ctx); err != nil {
+		return err
+	}
+
+	opts := in.opts
+	nPredict, err := numPredict(opts)
+	if err != nil {
+		return err
+	}
+
+	if opts.MaxDurationMs < 0 {
+		return fmt.Errorf("max_duration must not be negative, got %d milliseconds", opts.MaxDurationMs)
+	}
+
+	if in.evalOnly {
+		nPredict = 0
+	}
+
+	grammar, err := responseGrammar(opts)
+	if err != nil {
+		return err
+	}
+
+	stop, err := llm.stopStrings(ctx, opts)
+	if err != nil {
+		return err
+	}
+
+	prompt := in.prompt
+	var images []ImageData
+	if len(in.images) > 0 {
+		if llm.MMProjPath == "" {
+			return errors.New("images require a multimodal model loaded with a projector")
+		}
+
+		prompt, images = imagePrompt(prompt, in.images)
+	}
+
+	prevConvo, err := llm.Decode(ctx, in.prevContext)
 	if err != nil {
 		return err
 	}
@@ -433,51 +1809,162 @@ func (llm *llama) Predict(ctx context.Context, prevContext []int, prompt string,
 	nextContext.WriteString(prevConvo)
 	nextContext.WriteString(prompt)
 
-	endpoint := fmt.Sprintf("http://127.0.0.1:%d/completion", llm.Port)
+	if err := llm.resets.enter(ctx); err != nil {
+		return err
+	}
+	defer llm.resets.leave()
+
+	// with cached prompts the server only reuses the cache of the slot the request runs on
+	var slot int
+	if opts.CachePrompt {
+		slot, err = llm.acquireCachedSlot(ctx, nextContext.String())
+	} else {
+		slot, err = llm.acquireSlot(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	var gen *generation
+	defer func() {
+		// Stop and max_duration end the request to the server the same way cancelling ctx does
+		if ctx.Err() != nil || (gen != nil && gen.stopped()) {
+			llm.releaseCancelledSlot(slot)
+		} else {
+			llm.releaseSlot(slot)
+		}
+	}()
+
+	endpoint := llm.endpoint("/completion")
 	predReq := PredictRequest{
 		Prompt:           nextContext.String(),
 		Stream:           true,
-		NPredict:         llm.NumPredict,
-		NKeep:            llm.NumKeep,
-		Temperature:      llm.Temperature,
-		TopK:             llm.TopK,
-		TopP:             llm.TopP,
-		TfsZ:             llm.TFSZ,
-		TypicalP:         llm.TypicalP,
-		RepeatLastN:      llm.RepeatLastN,
-		RepeatPenalty:    llm.RepeatPenalty,
-		PresencePenalty:  llm.PresencePenalty,
-		FrequencyPenalty: llm.FrequencyPenalty,
-		Mirostat:         llm.Mirostat,
-		MirostatTau:      llm.MirostatTau,
-		MirostatEta:      llm.MirostatEta,
-		PenalizeNl:       llm.PenalizeNewline,
-		Stop:             llm.Stop,
+		NPredict:         nPredict,
+		NKeep:            opts.NumKeep,
+		Temperature:      opts.Temperature,
+		TopK:             opts.TopK,
+		TopP:             opts.TopP,
+		TfsZ:             enabledSampler(opts.TFSZ),
+		TypicalP:         enabledSampler(opts.TypicalP),
+		RepeatLastN:      opts.RepeatLastN,
+		RepeatPenalty:    opts.RepeatPenalty,
+		PresencePenalty:  opts.PresencePenalty,
+		FrequencyPenalty: opts.FrequencyPenalty,
+		Mirostat:         opts.Mirostat,
+
+		PenalizeNl:     opts.PenalizeNewline,
+		Stop:           stop,
+		SlotID:         slot,
+		ImageData:      images,
+		Grammar:        grammar,
+		ReturnTokens:   opts.WantTokens,
+		ReturnProgress: true,
+		CachePrompt:    opts.CachePrompt,
+		Seed:           in.seed,
+	}
+	if opts.Mirostat != 0 {
+		predReq.MirostatTau = opts.MirostatTau
+		predReq.MirostatEta = opts.MirostatEta
 	}
+
 	data, err := json.Marshal(predReq)
 	if err != nil {
 		return fmt.Errorf("error marshaling data: %v", err)
 	}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewBuffer(data))
+	gen = llm.generations.start()
+	defer llm.generations.finish(gen)
+
+	if opts.MaxDurationMs > 0 {
+		// running out of time ends the prediction the same way Stop does
+		timer := time.AfterFunc(time.Duration(opts.MaxDurationMs)*time.Millisecond, func() {
+			llm.generations.stopOne(gen)
+		})
+		defer timer.Stop()
+	}
+
+	// Stop ends the request to the server but not ctx, which is still needed to finish up
+	reqCtx, cancelReq := context.WithCancel(ctx)
+	defer cancelReq()
+	go func() {
+		select {
+		case <-gen.stop:
+			cancelReq()
+		case <-reqCtx.Done():
+		}
+	}()
+
+	var content utf8Buffer
+	var tokens []int
+	var promptProcessed bool
+	var promptN, predictedN int
+
+	// done sends the rest of the response and the final one with the context to continue from
+	done := func(p Prediction, reason api.StopReason, word string) error {
+		if s := content.flush(); s != "" || len(tokens) > 0 {
+			fn(api.GenerateResponse{Response: s, Tokens: tokens})
+			nextContext.WriteString(s)
+		}
+
+		llm.metrics.observe(p)
+		if opts.CachePrompt {
+			llm.setSlotPrompt(slot, nextContext.String())
+		}
+
+		embd, err := llm.Encode(ctx, nextContext.String())
+		if err != nil {
+			return fmt.Errorf("encoding context: %v", err)
+		}
+
+		fn(api.GenerateResponse{
+			Done:               true,
+			Context:            embd,
+			StopReason:         reason,
+			StopWord:           word,
+			PromptEvalCount:    p.PromptN,
+			PromptEvalDuration: parseDurationMs(p.PromptMS),
+			EvalCount:          p.PredictedN,
+			EvalDuration:       parseDurationMs(p.PredictedMS),
+			DraftTotal:         p.DraftN,
+			DraftAccepted:      p.DraftNAccepted,
+		})
+
+		return nil
+	}
+
+	// stopped finishes a prediction ended by Stop, the server didn't send its timings so only
+	// the counts seen so far are reported
+	stopped := func() error {
+		return done(Prediction{Timings: Timings{PromptN: promptN, PredictedN: predictedN}}, api.StopReasonStopped, "")
+	}
+
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodPost, endpoint, bytes.NewBuffer(data))
 	if err != nil {
 		return fmt.Errorf("error creating POST request: %v", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := llm.doRequest(reqCtx, req)
 	if err != nil {
-		return fmt.Errorf("POST predict: %v", err)
+		if gen.stopped() && ctx.Err() == nil {
+			return stopped()
+		}
+
+		return requestError(ctx, "POST predict", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode >= 400 {
-		bodyBytes, err := io.ReadAll(resp.Body)
+		bodyBytes, err := readBody(resp.Body)
 		if err != nil {
 			return fmt.Errorf("failed reading llm error response: %w", err)
 		}
-		log.Printf("llm predict error: %s", bodyBytes)
-		return fmt.Errorf("%s", bodyBytes)
+		logErrorf("llm predict error: %s", bodyBytes)
+		return &ServerError{StatusCode: resp.StatusCode, Body: string(bodyBytes), Endpoint: "/completion"}
+	}
+
+	if opts.Echo && !in.evalOnly && in.prompt != "" {
+		// the prompt is already in the context, it's only sent back
+		fn(api.GenerateResponse{Response: in.prompt})
 	}
 
 	scanner := bufio.NewScanner(resp.Body)
@@ -485,7 +1972,7 @@ func (llm *llama) Predict(ctx context.Context, prevContext []int, prompt string,
 		select {
 		case <-ctx.Done():
 			// This handles the request cancellation
-			return ctx.Err()
+			return fmt.Errorf("%w: %w", ErrContextCanceled, ctx.Err())
 		default:
 			line := scanner.Text()
 			if line == "" {
@@ -495,42 +1982,136 @@ func (llm *llama) Predict(ctx context.Context, prevContext []int, prompt string,
 			// Read data from the server-side event stream
 			if strings.HasPrefix(line, "data: ") {
 				evt := line[6:]
-				var p Prediction
-				if err := json.Unmarshal([]byte(evt), &p); err != nil {
+				p, err := decodePrediction([]byte(evt))
+				if err != nil {
 					return fmt.Errorf("error unmarshaling llm prediction response: %v", err)
 				}
 
-				if p.Content != "" {
-					fn(api.GenerateResponse{Response: p.Content})
-					nextContext.WriteString(p.Content)
+				if p.PromptProgress != nil && !promptProcessed {
+					fn(api.GenerateResponse{PromptProgress: &api.PromptProgress{
+						Processed: p.PromptProgress.Processed,
+						Total:     p.PromptProgress.Total,
+					}})
 				}
 
-				if p.Stop {
-					embd, err := llm.Encode(ctx, nextContext.String())
-					if err != nil {
-						return fmt.Errorf("encoding context: %v", err)
-					}
+				if p.Content != "" && !promptProcessed {
+					// the first generated token ends prompt evaluation
+					promptProcessed = true
+					promptN = p.PromptN
+					fn(api.GenerateResponse{PromptProcessed: true, PromptEvalCount: p.PromptN})
+				}
+
+				if p.Content != "" || len(p.Tokens) > 0 {
+					// each event carries one generated token
+					predictedN++
+				}
 
-					fn(api.GenerateResponse{
-						Done:               true,
-						Context:            embd,
-						PromptEvalCount:    p.PromptN,
-						PromptEvalDuration: parseDurationMs(p.PromptMS),
-						EvalCount:          p.PredictedN,
-						EvalDuration:       parseDurationMs(p.PredictedMS),
-					})
+				// tokens are sent along with the text they decode to, which can be held back
+				// until a split utf-8 sequence is complete
+				tokens = append(tokens, p.Tokens...)
+				if s := content.next(p.Content); s != "" {
+					fn(api.GenerateResponse{Response: s, Tokens: tokens})
+					nextContext.WriteString(s)
+					tokens = nil
+				}
 
-					return nil
+				if p.Stop {
+					reason, word := p.stopReason(nPredict)
+					return done(p, reason, word)
 				}
 			}
 		}
 	}
 
-	if err := scanner.Err(); err != nil {
-		return fmt.Errorf("error reading llm response: %v", err)
+	if gen.stopped() && ctx.Err() == nil {
+		return stopped()
 	}
 
-	return nil
+	if ctx.Err() != nil {
+		return fmt.Errorf("%w: %w", ErrContextCanceled, ctx.Err())
+	}
+
+	// the stream ended without a stop event, so the connection was closed part way through
+	return llm.truncatedError(scanner.Err())
+}
+
+// serverExitWait is how long a broken stream waits for the server process to exit, since the
+// connection usually drops before the exit is noticed
+const serverExitWait = time.Second
+
+// truncatedError describes a prediction stream that ended early, returning ErrServerCrashed with
+// the end of the server's stderr if the server process exited
+func (llm *llama) truncatedError(err error) error {
+	if err == nil {
+		err = io.ErrUnexpectedEOF
+	}
+
+	if llm.IsClosed() {
+		return fmt.Errorf("%w during prediction", ErrServerClosed)
+	}
+
+	if llm.exited != nil {
+		select {
+		case <-llm.exited:
+			msg := fmt.Sprintf("%v", llm.exitErr)
+			if llm.exitErr == nil {
+				msg = "exited"
+			}
+
+			if tail := strings.TrimSpace(llm.stderr.String()); tail != "" {
+				msg += ": " + tail
+			}
+
+			return fmt.Errorf("%w during prediction: %s", ErrServerCrashed, msg)
+		case <-time.After(serverExitWait):
+		}
+	}
+
+	return fmt.Errorf("%w: prediction stream ended early: %w", ErrServerUnavailable, err)
+}
+
+// selfTestTimeout bounds how long SelfTest waits for the model to generate its first few tokens
+const selfTestTimeout = 30 * time.Second
+
+// SelfTest generates a few tokens to confirm the model can run inference, not only that the server
+// is accepting connections. It returns the generation rate in tokens per second.
+func (llm *llama) SelfTest(ctx context.Context) (float64, error) {
+	ctx, cancel := context.WithTimeout(ctx, selfTestTimeout)
+	defer cancel()
+
+	opts := llm.Options
+	opts.NumPredict = 4
+	opts.NumPredictLimit = 0
+
+	var content bool
+	var final *api.GenerateResponse
+	fn := func(r api.GenerateResponse) {
+		if r.Response != "" {
+			content = true
+		}
+
+		if r.Done {
+			final = &r
+		}
+	}
+
+	if err := llm.predict(ctx, predictInput{opts: opts, prompt: "Hello"}, fn); err != nil {
+		return 0, fmt.Errorf("self test: %w", err)
+	}
+
+	if !content {
+		return 0, errors.New("self test: model did not generate any tokens")
+	}
+
+	if final == nil {
+		return 0, errors.New("self test: model did not finish generating")
+	}
+
+	if final.EvalDuration <= 0 {
+		return 0, nil
+	}
+
+	return float64(final.EvalCount) / final.EvalDuration.Seconds(), nil
 }
 
 type TokenizeRequest struct {
@@ -541,8 +2122,39 @@ type TokenizeResponse struct {
 	Tokens []int `json:"tokens"`
 }
 
+// SpecialTokens returns the ids of the model's beginning and end of sequence tokens, read from the
+// model file, e.g. for assembling prompts from tokens or ending generation at eos with
+// stop_tokens. It returns ErrUnknownSpecialTokens when the file doesn't record them.
+func (llm *llama) SpecialTokens() (bos, eos int, err error) {
+	if !llm.specialTokens {
+		return 0, 0, ErrUnknownSpecialTokens
+	}
+
+	return llm.bos.id, llm.eos.id, nil
+}
+
+// SpecialTokenText returns the text of the model's beginning and end of sequence tokens, e.g. <s>
+// and </s>, for prompt templates that spell them out. The text is empty when the model file has
+// no vocabulary to look it up in.
+func (llm *llama) SpecialTokenText() (bos, eos string, err error) {
+	if !llm.specialTokens {
+		return "", "", ErrUnknownSpecialTokens
+	}
+
+	return llm.bos.text, llm.eos.text, nil
+}
+
 func (llm *llama) Encode(ctx context.Context, prompt string) ([]int, error) {
-	endpoint := fmt.Sprintf("http://127.0.0.1:%d/tokenize", llm.Port)
+	if err := llm.activity.begin(); err != nil {
+		return nil, err
+	}
+	defer llm.activity.end()
+
+	if err := llm.waitReady(ctx); err != nil {
+		return nil, err
+	}
+
+	endpoint := llm.endpoint("/tokenize")
 	data, err := json.Marshal(TokenizeRequest{Content: prompt})
 	if err != nil {
 		return nil, fmt.Errorf("marshaling encode data: %w", err)
@@ -554,20 +2166,20 @@ func (llm *llama) Encode(ctx context.Context, prompt string) ([]int, error) {
 	}
 	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := llm.doRequest(ctx, req)
 	if err != nil {
-		return nil, fmt.Errorf("do encode request: %w", err)
+		return nil, requestError(ctx, "do encode request", err)
 	}
 	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	body, err := readBody(resp.Body)
 	if err != nil {
 		return nil, fmt.Errorf("read encode request: %w", err)
 	}
 
 	if resp.StatusCode >= 400 {
-		log.Printf("llm encode error: %s", body)
-		return nil, fmt.Errorf("%s", body)
+		logErrorf("llm encode error: %s", body)
+		return nil, &ServerError{StatusCode: resp.StatusCode, Body: string(body), Endpoint: "/tokenize"}
 	}
 
 	var encoded TokenizeResponse
@@ -587,10 +2199,19 @@ type DetokenizeResponse struct {
 }
 
 func (llm *llama) Decode(ctx context.Context, tokens []int) (string, error) {
+	if err := llm.activity.begin(); err != nil {
+		return "", err
+	}
+	defer llm.activity.end()
+
+	if err := llm.waitReady(ctx); err != nil {
+		return "", err
+	}
+
 	if len(tokens) == 0 {
 		return "", nil
 	}
-	endpoint := fmt.Sprintf("http://127.0.0.1:%d/detokenize", llm.Port)
+	endpoint := llm.endpoint("/detokenize")
 	data, err := json.Marshal(DetokenizeRequest{Tokens: tokens})
 	if err != nil {
 		return "", fmt.Errorf("marshaling decode data: %w", err)
@@ -602,20 +2223,20 @@ func (llm *llama) Decode(ctx context.Context, tokens []int) (string, error) {
 	}
 	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := llm.doRequest(ctx, req)
 	if err != nil {
-		return "", fmt.Errorf("do decode request: %w", err)
+		return "", requestError(ctx, "do decode request", err)
 	}
 	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	body, err := readBody(resp.Body)
 	if err != nil {
 		return "", fmt.Errorf("read decode request: %w", err)
 	}
 
 	if resp.StatusCode >= 400 {
-		log.Printf("llm decode error: %s", body)
-		return "", fmt.Errorf("%s", body)
+		logErrorf("llm decode error: %s", body)
+		return "", &ServerError{StatusCode: resp.StatusCode, Body: string(body), Endpoint: "/detokenize"}
 	}
 
 	var decoded DetokenizeResponse
@@ -629,17 +2250,142 @@ func (llm *llama) Decode(ctx context.Context, tokens []int) (string, error) {
 	return decoded.Content, nil
 }
 
+// FitContext returns the most recent turns that fit in the context window together with the
+// system prompt, leaving reserve tokens free for the response. The oldest turns are dropped
+// first. It's an error if the system prompt and the newest turn alone don't fit.
+func (llm *llama) FitContext(ctx context.Context, system string, turns []string, reserve int) ([]string, error) {
+	budget := llm.NumCtx - reserve
+	if system != "" {
+		tokens, err := llm.Encode(ctx, system)
+		if err != nil {
+			return nil, fmt.Errorf("fit context: %w", err)
+		}
+
+		budget -= len(tokens)
+	}
+
+	if budget < 0 {
+		return nil, fmt.Errorf("fit context: system prompt and reserve exceed num_ctx %d by %d tokens", llm.NumCtx, -budget)
+	}
+
+	// count from the newest turn back so turns that will be dropped anyway aren't tokenized
+	first := len(turns)
+	for first > 0 {
+		tokens, err := llm.Encode(ctx, turns[first-1])
+		if err != nil {
+			return nil, fmt.Errorf("fit context: %w", err)
+		}
+
+		if len(tokens) > budget {
+			break
+		}
+
+		budget -= len(tokens)
+		first--
+	}
+
+	if first == len(turns) && len(turns) > 0 {
+		return nil, fmt.Errorf("fit context: the newest turn doesn't fit in num_ctx %d", llm.NumCtx)
+	}
+
+	return turns[first:], nil
+}
+
 type EmbeddingRequest struct {
 	Content string `json:"content"`
 }
 
 type EmbeddingResponse struct {
-	Embedding []float64 `json:"embedding"`
+	Embedding       []float64 `json:"embedding"`
+	TokensEvaluated int       `json:"tokens_evaluated,omitempty"` // only reported by some servers
+}
+
+// EmbeddingResult is an embedding with the number of tokens its input was evaluated as. Results
+// from EmbeddingBatch also carry the index of their input, and the error embedding it failed with
+// in place of the embedding.
+type EmbeddingResult struct {
+	Embedding    []float64
+	PromptTokens int
+
+	Index int
+	Err   error
+}
+
+// EmbeddingDim returns the length of the vectors returned by Embedding. It comes from the model
+// hyperparameters when they have it, otherwise a one token embedding is requested once and its
+// length is cached. The lock isn't held while probing, so a slow probe doesn't hold up callers
+// whose context ends first; concurrent first calls may each probe.
+func (llm *llama) EmbeddingDim(ctx context.Context) (int, error) {
+	llm.numEmbdMu.Lock()
+	n := llm.numEmbd
+	llm.numEmbdMu.Unlock()
+
+	if n > 0 {
+		return n, nil
+	}
+
+	embedding, err := llm.Embedding(ctx, " ")
+	if err != nil {
+		return 0, fmt.Errorf("probe embedding dimension: %w", err)
+	}
+
+	llm.numEmbdMu.Lock()
+	defer llm.numEmbdMu.Unlock()
+
+	if llm.numEmbd == 0 {
+		llm.numEmbd = len(embedding)
+	}
+
+	return llm.numEmbd, nil
 }
 
 func (llm *llama) Embedding(ctx context.Context, input string) ([]float64, error) {
-	endpoint := fmt.Sprintf("http://127.0.0.1:%d/embedding", llm.Port)
-	data, err := json.Marshal(TokenizeRequest{Content: input})
+	embedding, err := llm.embedding(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+
+	return embedding.Embedding, nil
+}
+
+// EmbeddingWithUsage returns the embedding of input along with the number of tokens it was
+// evaluated as, for metering usage. When the server doesn't report the count, input is tokenized
+// to count them.
+func (llm *llama) EmbeddingWithUsage(ctx context.Context, input string) (EmbeddingResult, error) {
+	embedding, err := llm.embedding(ctx, input)
+	if err != nil {
+		return EmbeddingResult{}, err
+	}
+
+	n := embedding.TokensEvaluated
+	if n == 0 && input != "" {
+		tokens, err := llm.Encode(ctx, input)
+		if err != nil {
+			return EmbeddingResult{}, fmt.Errorf("count embedding tokens: %w", err)
+		}
+
+		n = len(tokens)
+	}
+
+	return EmbeddingResult{Embedding: embedding.Embedding, PromptTokens: n}, nil
+}
+
+func (llm *llama) embedding(ctx context.Context, input string) (*EmbeddingResponse, error) {
+	if !llm.EmbeddingEnabled {
+		return nil, ErrEmbeddingDisabled
+	}
+
+	if err := llm.activity.begin(); err != nil {
+		return nil, err
+	}
+	defer llm.activity.end()
+
+	if err := llm.waitReady(ctx); err != nil {
+		return nil, err
+	}
+
+	endpoint := llm.endpoint("/embedding")
+	data, err := json.Marshal(EmbeddingRequest{Content: input})
 	if err != nil {
 		return nil, fmt.Errorf("error marshaling embed data: %w", err)
 	}
@@ -650,20 +2396,20 @@ func (llm *llama) Embedding(ctx context.Context, input string) ([]float64, error
 	}
 	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := llm.doRequest(ctx, req)
 	if err != nil {
-		return nil, fmt.Errorf("POST embedding: %w", err)
+		return nil, requestError(ctx, "POST embedding", err)
 	}
 	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	body, err := readBody(resp.Body)
 	if err != nil {
 		return nil, fmt.Errorf("error reading embed response: %w", err)
 	}
 
 	if resp.StatusCode >= 400 {
-		log.Printf("llm encode error: %s", body)
-		return nil, fmt.Errorf("%s", body)
+		logErrorf("llm encode error: %s", body)
+		return nil, &ServerError{StatusCode: resp.StatusCode, Body: string(body), Endpoint: "/embedding"}
 	}
 
 	var embedding EmbeddingResponse
@@ -671,15 +2417,27 @@ func (llm *llama) Embedding(ctx context.Context, input string) ([]float64, error
 		return nil, fmt.Errorf("unmarshal tokenize response: %w", err)
 	}
 
-	return embedding.Embedding, nil
+	return &embedding, nil
 }
 
 // Ping checks that the server subprocess is still running and responding to requests
 func (llm *llama) Ping(ctx context.Context) error {
-	resp, err := http.Head(fmt.Sprintf("http://127.0.0.1:%d", llm.Running.Port))
+	if llm.IsClosed() {
+		return ErrServerClosed
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, llm.endpoint("/"), nil)
+	if err != nil {
+		return fmt.Errorf("ping request: %w", err)
+	}
+	setHeaders(req)
+
+	resp, err := llm.httpClient().Do(req)
 	if err != nil {
 		return fmt.Errorf("ping resp: %w", err)
 	}
+	resp.Body.Close()
+
 	if resp.StatusCode != http.StatusOK {
 		return fmt.Errorf("unexpected ping status: %s", resp.Status)
 	}
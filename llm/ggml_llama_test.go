@@ -0,0 +1,1689 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+func TestNumPredict(t *testing.T) {
+	tests := []struct {
+		name       string
+		numPredict int
+		limit      int
+		want       int
+		wantJSON   string
+	}{
+		{"default", 0, 0, -1, `"n_predict":-1`},
+		{"positive", 128, 0, 128, `"n_predict":128`},
+		{"infinite", NumPredictInfinite, 0, -1, `"n_predict":-1`},
+		{"fill context", NumPredictFillContext, 0, -2, `"n_predict":-2`},
+		{"infinite limited", NumPredictInfinite, 256, 256, `"n_predict":256`},
+		{"fill context limited", NumPredictFillContext, 256, 256, `"n_predict":256`},
+		{"fill context limit above context", NumPredictFillContext, 4096, -2, `"n_predict":-2`},
+		{"positive under limit", 128, 256, 128, `"n_predict":128`},
+		{"positive over limit", 512, 256, 256, `"n_predict":256`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := api.DefaultOptions()
+			opts.NumPredict = tt.numPredict
+			opts.NumPredictLimit = tt.limit
+
+			got, err := numPredict(opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+
+			data, err := json.Marshal(PredictRequest{NPredict: got})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !strings.Contains(string(data), tt.wantJSON) {
+				t.Errorf("got %s, want it to contain %s", data, tt.wantJSON)
+			}
+		})
+	}
+}
+
+func TestNumPredictInvalid(t *testing.T) {
+	opts := api.DefaultOptions()
+	opts.NumPredict = -3
+	if _, err := numPredict(opts); err == nil {
+		t.Error("expected an error for num_predict -3")
+	}
+}
+
+func TestChooseRunner(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("runner layout differs on this platform")
+	}
+
+	fsys := fstest.MapFS{
+		path.Join(ggmlCPU, "server"): &fstest.MapFile{Data: []byte("cpu runner")},
+	}
+
+	runner, err := chooseRunner(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(filepath.Dir(runner.Path)) })
+
+	data, err := os.ReadFile(runner.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != "cpu runner" {
+		t.Errorf("got runner %q, want %q", data, "cpu runner")
+	}
+
+	fsys[path.Join(ggmlGPU, "server")] = &fstest.MapFile{Data: []byte("gpu runner")}
+	if runner, err = chooseRunner(fsys); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(filepath.Dir(runner.Path)) })
+
+	if data, err = os.ReadFile(runner.Path); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != "gpu runner" {
+		t.Errorf("got runner %q, want %q", data, "gpu runner")
+	}
+
+	// the cpu runner is extracted alongside for cpu_fallback
+	if data, err = os.ReadFile(runner.CPUPath); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != "cpu runner" {
+		t.Errorf("got cpu runner %q, want %q", data, "cpu runner")
+	}
+}
+
+func TestChooseRunnerCPUVariant(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("runner layout differs on this platform")
+	}
+
+	defer func(orig map[string]bool) { cpuFeatures = orig }(cpuFeatures)
+	cpuFeatures = map[string]bool{"avx": true}
+
+	build := path.Join("llama.cpp", "ggml", "build")
+	fsys := fstest.MapFS{
+		path.Join(build, "cpu", "bin", "server"):      &fstest.MapFile{Data: []byte("cpu runner")},
+		path.Join(build, "cpu_avx", "bin", "server"):  &fstest.MapFile{Data: []byte("avx runner")},
+		path.Join(build, "cpu_avx2", "bin", "server"): &fstest.MapFile{Data: []byte("avx2 runner")},
+	}
+
+	runner, err := chooseRunner(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(filepath.Dir(runner.Path)) })
+
+	data, err := os.ReadFile(runner.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// avx2 would crash with an illegal instruction on this cpu
+	if string(data) != "avx runner" {
+		t.Errorf("got runner %q, want %q", data, "avx runner")
+	}
+}
+
+func TestChooseRunnerTmpDir(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("runner layout differs on this platform")
+	}
+
+	fsys := fstest.MapFS{
+		path.Join(ggmlCPU, "server"): &fstest.MapFile{Data: []byte("cpu runner")},
+	}
+
+	envDir, optDir := t.TempDir(), t.TempDir()
+	t.Setenv("OLLAMA_TMPDIR", envDir)
+
+	tests := []struct {
+		name   string
+		tmpDir string
+		want   string
+	}{
+		{"environment", "", envDir},
+		{"option", optDir, optDir},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(orig string) { RunnerTmpDir = orig }(RunnerTmpDir)
+			RunnerTmpDir = tt.tmpDir
+
+			runner, err := chooseRunner(fsys)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := filepath.Dir(filepath.Dir(runner.Path)); got != tt.want {
+				t.Errorf("got runner extracted to %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChooseRunnerNoExec(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("noexec is only detected on linux")
+	}
+
+	// /dev/shm is commonly mounted noexec, use it when it is
+	if !isNoExec("/dev/shm") {
+		t.Skip("no noexec file system available")
+	}
+
+	defer func(orig string) { RunnerTmpDir = orig }(RunnerTmpDir)
+	RunnerTmpDir = "/dev/shm"
+
+	fsys := fstest.MapFS{
+		path.Join(ggmlCPU, "server"): &fstest.MapFile{Data: []byte("cpu runner")},
+	}
+
+	if _, err := chooseRunner(fsys); err == nil || !strings.Contains(err.Error(), "noexec") {
+		t.Errorf("got error %v, want a noexec error", err)
+	}
+}
+
+func TestChooseRunnerNotFound(t *testing.T) {
+	if _, err := chooseRunner(fstest.MapFS{}); err == nil {
+		t.Error("expected an error when no runner is available")
+	}
+}
+
+// flagValue returns the value following flag in params and whether the flag was present
+func flagValue(params []string, flag string) (string, bool) {
+	for i, p := range params {
+		if p == flag {
+			if i+1 < len(params) && !strings.HasPrefix(params[i+1], "--") {
+				return params[i+1], true
+			}
+
+			return "", true
+		}
+	}
+
+	return "", false
+}
+
+func TestRunnerParamsNUMA(t *testing.T) {
+	tests := []struct {
+		name     string
+		useNUMA  bool
+		strategy string
+		want     string
+		wantFlag bool
+	}{
+		{"disabled", false, "", "", false},
+		{"legacy bool", true, "", "distribute", true},
+		{"distribute", false, "distribute", "distribute", true},
+		{"isolate", false, "isolate", "isolate", true},
+		{"numactl", false, "numactl", "numactl", true},
+		{"strategy overrides bool", true, "isolate", "isolate", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := api.DefaultOptions()
+			opts.UseNUMA = tt.useNUMA
+			opts.NUMAStrategy = tt.strategy
+
+			params, err := runnerParams("model.bin", nil, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, ok := flagValue(params, "--numa")
+			if ok != tt.wantFlag || got != tt.want {
+				t.Errorf("got --numa %q (present: %v), want %q (present: %v)", got, ok, tt.want, tt.wantFlag)
+			}
+		})
+	}
+
+	opts := api.DefaultOptions()
+	opts.NUMAStrategy = "interleave"
+	if _, err := runnerParams("model.bin", nil, opts); err == nil {
+		t.Error("expected an error for an unknown numa strategy")
+	}
+}
+
+func TestRunnerParamsMultiGPU(t *testing.T) {
+	tests := []struct {
+		name        string
+		mainGPU     int
+		tensorSplit []float32
+		wantMain    string
+		wantSplit   string
+		wantErr     bool
+	}{
+		{"default", 0, nil, "", "", false},
+		{"main gpu", 1, nil, "1", "", false},
+		{"even split", 0, []float32{1, 1}, "", "1,1", false},
+		{"uneven split", 1, []float32{3, 1.5, 0}, "1", "3,1.5,0", false},
+		{"negative main gpu", -1, nil, "", "", true},
+		{"negative split", 0, []float32{1, -1}, "", "", true},
+		{"zero split", 0, []float32{0, 0}, "", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := api.DefaultOptions()
+			opts.MainGPU = tt.mainGPU
+			opts.TensorSplit = tt.tensorSplit
+
+			params, err := runnerParams("model.bin", nil, opts)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if got, _ := flagValue(params, "--main-gpu"); got != tt.wantMain {
+				t.Errorf("got --main-gpu %q, want %q", got, tt.wantMain)
+			}
+
+			if got, _ := flagValue(params, "--tensor-split"); got != tt.wantSplit {
+				t.Errorf("got --tensor-split %q, want %q", got, tt.wantSplit)
+			}
+		})
+	}
+}
+
+// newTestLlama returns a llama backed by handler instead of a llama.cpp server
+func newTestLlama(t *testing.T, handler http.Handler) *llama {
+	t.Helper()
+
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	port, err := strconv.Atoi(u.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &llama{Options: api.DefaultOptions(), Running: Running{Port: port}}
+}
+
+// writeEvents writes each prediction to w as a server-sent event
+func writeEvents(w http.ResponseWriter, preds ...Prediction) {
+	for _, p := range preds {
+		data, _ := json.Marshal(p)
+		fmt.Fprintf(w, "data: %s\n\n", data)
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+}
+
+// completionHandler serves /completion with preds and /tokenize with one token per word
+func completionHandler(preds ...Prediction) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/completion", func(w http.ResponseWriter, r *http.Request) {
+		writeEvents(w, preds...)
+	})
+	mux.HandleFunc("/tokenize", func(w http.ResponseWriter, r *http.Request) {
+		var req TokenizeRequest
+		json.NewDecoder(r.Body).Decode(&req)
+
+		tokens := make([]int, len(strings.Fields(req.Content)))
+		for i := range tokens {
+			tokens[i] = i
+		}
+
+		json.NewEncoder(w).Encode(TokenizeResponse{Tokens: tokens})
+	})
+	return mux
+}
+
+func TestSelfTest(t *testing.T) {
+	llm := newTestLlama(t, completionHandler(
+		Prediction{Content: " there"},
+		Prediction{Content: " friend"},
+		Prediction{Stop: true, Timings: Timings{PredictedN: 2, PredictedMS: 500}},
+	))
+
+	rate, err := llm.SelfTest(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rate != 4 {
+		t.Errorf("got %f tokens/s, want 4", rate)
+	}
+}
+
+func TestSelfTestNoTokens(t *testing.T) {
+	llm := newTestLlama(t, completionHandler(Prediction{Stop: true}))
+	if _, err := llm.SelfTest(context.Background()); err == nil {
+		t.Error("expected an error when no tokens are generated")
+	}
+}
+
+func TestSetOptions(t *testing.T) {
+	llm := &llama{Options: api.DefaultOptions(), status: LoadStatus{NumThread: 4}}
+	llm.NumThread = 4
+
+	opts := api.DefaultOptions()
+	opts.Temperature = 0.1
+	opts.NumKeep = 12
+	if err := llm.SetOptions(opts); err != nil {
+		t.Fatalf("unexpected error changing sampling options: %v", err)
+	}
+
+	if llm.Temperature != 0.1 || llm.NumKeep != 12 {
+		t.Errorf("sampling options were not applied: temperature %f num_keep %d", llm.Temperature, llm.NumKeep)
+	}
+
+	opts.NumCtx = 4096
+	opts.TopK = 10
+	err := llm.SetOptions(opts)
+	if !errors.Is(err, ErrReloadRequired) {
+		t.Fatalf("got error %v, want %v", err, ErrReloadRequired)
+	}
+
+	if !strings.Contains(err.Error(), "num_ctx") {
+		t.Errorf("expected error to name num_ctx, got %v", err)
+	}
+
+	if llm.NumCtx != api.DefaultOptions().NumCtx {
+		t.Errorf("num_ctx changed to %d without a reload", llm.NumCtx)
+	}
+
+	if llm.TopK != 10 {
+		t.Errorf("got top_k %d, want 10", llm.TopK)
+	}
+}
+
+func TestNewLlamaRetriesExhausted(t *testing.T) {
+	runner, err := exec.LookPath("false")
+	if err != nil {
+		t.Skip("false is not available")
+	}
+
+	defer func(orig func(int, int) int) { pickPort = orig }(pickPort)
+	defer func(orig func(time.Duration)) { sleep = orig }(sleep)
+
+	var delays []time.Duration
+	sleep = func(d time.Duration) { delays = append(delays, d) }
+
+	var ports []int
+	pickPort = func(min, max int) int {
+		if min != 50000 || max != 50010 {
+			t.Errorf("got port range %d-%d, want 50000-50010", min, max)
+		}
+
+		port := min + len(ports)
+		ports = append(ports, port)
+		return port
+	}
+
+	opts := api.DefaultOptions()
+	opts.RunnerPortMin = 50000
+	opts.RunnerPortMax = 50010
+	opts.RunnerRetries = 4
+	opts.RunnerRetryDelay = 100
+
+	_, err = newLlama(writeGGJT(t, 32, llamaFileTypeQ4_0), nil, ModelRunner{Path: runner}, opts)
+	if err == nil || !strings.Contains(err.Error(), "max retry exceeded") {
+		t.Fatalf("got error %v, want max retry exceeded", err)
+	}
+
+	if len(ports) != 4 || ports[0] == ports[1] {
+		t.Errorf("got ports %v, want 4 distinct attempts", ports)
+	}
+
+	// no delay before the first attempt, then growing delays before each retry
+	if len(delays) != 3 {
+		t.Fatalf("got delays %v, want 3", delays)
+	}
+
+	for i, d := range delays {
+		base := 100 * time.Millisecond << i
+		if d < base/2 || d > base {
+			t.Errorf("got delay %s before retry %d, want between %s and %s", d, i+1, base/2, base)
+		}
+
+		if i > 0 && d <= delays[i-1] {
+			t.Errorf("delay %s before retry %d did not grow from %s", d, i+1, delays[i-1])
+		}
+	}
+}
+
+func TestNewLlamaStartupStderr(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the runner is a shell script")
+	}
+
+	// a runner that rejects its flags, as llama.cpp does with one it doesn't know
+	runner := filepath.Join(t.TempDir(), "server")
+	script := "#!/bin/sh\necho 'error: unknown argument: --bogus' >&2\nexit 1\n"
+	if err := os.WriteFile(runner, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(orig func(time.Duration)) { sleep = orig }(sleep)
+	sleep = func(time.Duration) {}
+
+	opts := api.DefaultOptions()
+	opts.RunnerRetries = 1
+
+	_, err := newLlama(writeGGJT(t, 32, llamaFileTypeQ4_0), nil, ModelRunner{Path: runner}, opts)
+	if err == nil || !strings.Contains(err.Error(), "unknown argument: --bogus") {
+		t.Errorf("got error %v, want it to include the server's stderr", err)
+	}
+}
+
+func TestRunnerPorts(t *testing.T) {
+	opts := api.DefaultOptions()
+	if min, max, err := runnerPorts(opts); err != nil || min != 49152 || max != 65535 {
+		t.Errorf("got %d-%d (%v), want the ephemeral range", min, max, err)
+	}
+
+	opts.RunnerPortMin = 60000
+	opts.RunnerPortMax = 50000
+	if _, _, err := runnerPorts(opts); err == nil {
+		t.Error("expected an error for an inverted port range")
+	}
+}
+
+func TestRunnerParamsExtraArgs(t *testing.T) {
+	tests := []struct {
+		name    string
+		extra   []string
+		wantErr bool
+	}{
+		{"none", nil, false},
+		{"new flags", []string{"--cont-batching", "--parallel", "4"}, false},
+		{"port", []string{"--port", "8080"}, true},
+		{"port with equals", []string{"--port=8080"}, true},
+		{"model", []string{"-m", "other.bin"}, true},
+		{"duplicate flag", []string{"--ctx-size", "4096"}, true},
+		{"duplicate short flag", []string{"-c", "4096"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := api.DefaultOptions()
+			opts.ExtraRunnerArgs = tt.extra
+
+			params, err := runnerParams("model.bin", nil, opts)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected an error for %v", tt.extra)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := params[len(params)-len(tt.extra):]; strings.Join(got, " ") != strings.Join(tt.extra, " ") {
+				t.Errorf("got trailing params %v, want %v", got, tt.extra)
+			}
+		})
+	}
+}
+
+func TestRunnerParamsCacheType(t *testing.T) {
+	tests := []struct {
+		name       string
+		f16KV      bool
+		cacheTypeK string
+		cacheTypeV string
+		wantK      string
+		wantV      string
+		wantF32    bool
+		wantErr    bool
+	}{
+		{"default", true, "", "", "", "", false, false},
+		{"legacy f32", false, "", "", "", "", true, false},
+		{"quantized", true, "q8_0", "q4_0", "q8_0", "q4_0", false, false},
+		{"k only", true, "q8_0", "", "q8_0", "", false, false},
+		{"overrides f16_kv", false, "f16", "f16", "f16", "f16", false, false},
+		{"invalid", true, "q3_k", "", "", "", false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := api.DefaultOptions()
+			opts.F16KV = tt.f16KV
+			opts.CacheTypeK = tt.cacheTypeK
+			opts.CacheTypeV = tt.cacheTypeV
+
+			params, err := runnerParams("model.bin", nil, opts)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if got, _ := flagValue(params, "--cache-type-k"); got != tt.wantK {
+				t.Errorf("got --cache-type-k %q, want %q", got, tt.wantK)
+			}
+
+			if got, _ := flagValue(params, "--cache-type-v"); got != tt.wantV {
+				t.Errorf("got --cache-type-v %q, want %q", got, tt.wantV)
+			}
+
+			if _, got := flagValue(params, "--memory-f32"); got != tt.wantF32 {
+				t.Errorf("got --memory-f32 %v, want %v", got, tt.wantF32)
+			}
+		})
+	}
+}
+
+func TestFitContext(t *testing.T) {
+	// one token per word
+	system := "you are a helpful assistant"
+	turns := []string{"why is the sky blue", "because of rayleigh scattering", "what is that", "light scattering by small particles", "thanks"}
+
+	tests := []struct {
+		name    string
+		numCtx  int
+		reserve int
+		system  string
+		want    []string
+		wantErr bool
+	}{
+		{"everything fits", 2048, 128, system, turns, false},
+		{"exact fit", 23, 0, system, turns, false},
+		{"drops oldest", 20, 0, system, turns[1:], false},
+		{"reserve drops more", 20, 5, system, turns[2:], false},
+		{"no system prompt", 10, 0, "", turns[2:], false},
+		{"only newest", 6, 0, system, turns[4:], false},
+		{"shorter older turn is dropped too", 9, 0, system, turns[4:], false},
+		{"newest doesn't fit", 5, 0, system, nil, true},
+		{"system doesn't fit", 4, 0, system, nil, true},
+		{"reserve exceeds context", 2048, 4096, "", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			llm := newTestLlama(t, completionHandler())
+			llm.NumCtx = tt.numCtx
+
+			got, err := llm.FitContext(context.Background(), tt.system, turns, tt.reserve)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected an error, got %q", got)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunnerParamsDefrag(t *testing.T) {
+	tests := []struct {
+		threshold float32
+		want      string
+		wantErr   bool
+	}{
+		{0, "", false},
+		{0.1, "0.1", false},
+		{1, "1", false},
+		{-0.1, "", true},
+		{1.5, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.threshold), func(t *testing.T) {
+			opts := api.DefaultOptions()
+			opts.DefragThreshold = tt.threshold
+
+			params, err := runnerParams("model.bin", nil, opts)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if got, _ := flagValue(params, "--defrag-thold"); got != tt.want {
+				t.Errorf("got --defrag-thold %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunnerParamsUBatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		batch   int
+		ubatch  int
+		want    string
+		wantErr bool
+	}{
+		{"default", 512, 0, "", false},
+		{"smaller", 2048, 512, "512", false},
+		{"equal", 512, 512, "512", false},
+		{"larger", 512, 1024, "", true},
+		{"negative", 512, -1, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := api.DefaultOptions()
+			opts.NumBatch = tt.batch
+			opts.NumUBatch = tt.ubatch
+
+			params, err := runnerParams("model.bin", nil, opts)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if got, _ := flagValue(params, "--batch-size"); got != strconv.Itoa(tt.batch) {
+				t.Errorf("got --batch-size %q, want %d", got, tt.batch)
+			}
+
+			if got, _ := flagValue(params, "--ubatch-size"); got != tt.want {
+				t.Errorf("got --ubatch-size %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunnerParamsChatTemplate(t *testing.T) {
+	inline := "{% for message in messages %}<|im_start|>{{ message['role'] }}\n{{ message['content'] }}<|im_end|>\n{% endfor %}"
+
+	tests := []struct {
+		name     string
+		template string
+		want     string
+		wantErr  bool
+	}{
+		{"unset", "", "", false},
+		{"builtin", "chatml", "chatml", false},
+		{"inline", inline, inline, false},
+		{"blank", "  \n", "", true},
+		{"unknown builtin", "alpaca", "", true},
+		{"builtin without a chat format", "llama3", "", true},
+		{"inline without a chat format", "{% for message in messages %}{{ message['content'] }}{% endfor %}", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := api.DefaultOptions()
+			opts.ChatTemplate = tt.template
+
+			params, err := runnerParams("model.bin", nil, opts)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if got, _ := flagValue(params, "--chat-template"); got != tt.want {
+				t.Errorf("got --chat-template %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunnerParamsPooling(t *testing.T) {
+	tests := []struct {
+		pooling string
+		want    string
+		wantErr bool
+	}{
+		{"", "", false},
+		{"none", "none", false},
+		{"mean", "mean", false},
+		{"cls", "cls", false},
+		{"last", "last", false},
+		{"max", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pooling, func(t *testing.T) {
+			opts := api.DefaultOptions()
+			opts.PoolingType = tt.pooling
+
+			params, err := runnerParams("model.bin", nil, opts)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if got, _ := flagValue(params, "--pooling"); got != tt.want {
+				t.Errorf("got --pooling %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEmbedding(t *testing.T) {
+	llm := newTestLlama(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/embedding" {
+			t.Errorf("got request to %s, want /embedding", r.URL.Path)
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if want := `{"content":"why is the sky blue"}`; string(body) != want {
+			t.Errorf("got request body %s, want %s", body, want)
+		}
+
+		json.NewEncoder(w).Encode(EmbeddingResponse{Embedding: []float64{0.1, 0.2, 0.3}})
+	}))
+
+	embedding, err := llm.Embedding(context.Background(), "why is the sky blue")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(embedding, []float64{0.1, 0.2, 0.3}) {
+		t.Errorf("got embedding %v", embedding)
+	}
+}
+
+func TestEmbeddingWithUsage(t *testing.T) {
+	tests := []struct {
+		name     string
+		reported int
+		want     int
+	}{
+		{"tokenized", 0, 4},
+		{"reported by the server", 5, 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mux := http.NewServeMux()
+			mux.Handle("/tokenize", completionHandler())
+			mux.HandleFunc("/embedding", func(w http.ResponseWriter, r *http.Request) {
+				json.NewEncoder(w).Encode(EmbeddingResponse{Embedding: []float64{0.1, 0.2}, TokensEvaluated: tt.reported})
+			})
+
+			llm := newTestLlama(t, mux)
+			input := "why is the sky"
+
+			got, err := llm.EmbeddingWithUsage(context.Background(), input)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tokens, err := llm.Encode(context.Background(), input)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.reported == 0 && got.PromptTokens != len(tokens) {
+				t.Errorf("got %d prompt tokens, Encode returned %d", got.PromptTokens, len(tokens))
+			}
+
+			if got.PromptTokens != tt.want || !reflect.DeepEqual(got.Embedding, []float64{0.1, 0.2}) {
+				t.Errorf("got %+v, want %d prompt tokens", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEmbeddingDim(t *testing.T) {
+	var requests int
+	llm := newTestLlama(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		json.NewEncoder(w).Encode(EmbeddingResponse{Embedding: []float64{0.1, 0.2, 0.3}})
+	}))
+
+	for i := 0; i < 2; i++ {
+		dim, err := llm.EmbeddingDim(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if dim != 3 {
+			t.Errorf("got dimension %d, want 3", dim)
+		}
+	}
+
+	if requests != 1 {
+		t.Errorf("got %d embedding requests, want 1", requests)
+	}
+}
+
+func TestEmbeddingDimSlowProbe(t *testing.T) {
+	unblock := make(chan struct{})
+	var requests atomic.Int32
+	llm := newTestLlama(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			<-unblock
+		}
+
+		json.NewEncoder(w).Encode(EmbeddingResponse{Embedding: []float64{0.1, 0.2, 0.3}})
+	}))
+
+	slow := make(chan error, 1)
+	go func() {
+		_, err := llm.EmbeddingDim(context.Background())
+		slow <- err
+	}()
+
+	for requests.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// another caller doesn't wait on the probe in flight
+	done := make(chan int, 1)
+	go func() {
+		dim, err := llm.EmbeddingDim(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+		done <- dim
+	}()
+
+	select {
+	case dim := <-done:
+		if dim != 3 {
+			t.Errorf("got dimension %d, want 3", dim)
+		}
+	case <-time.After(5 * time.Second):
+		close(unblock)
+		t.Fatal("EmbeddingDim waited on another caller's probe")
+	}
+
+	close(unblock)
+	if err := <-slow; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEmbeddingDimFromModel(t *testing.T) {
+	llm := newTestLlama(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected request to %s", r.URL.Path)
+	}))
+	llm.numEmbd = 4096
+
+	dim, err := llm.EmbeddingDim(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if dim != 4096 {
+		t.Errorf("got dimension %d, want 4096", dim)
+	}
+}
+
+func TestRunnerParamsGroupAttn(t *testing.T) {
+	tests := []struct {
+		name    string
+		factor  int
+		width   int
+		wantN   string
+		wantW   string
+		wantErr bool
+	}{
+		{"disabled", 0, 0, "", "", false},
+		{"factor of one", 1, 1024, "", "", false},
+		{"default width", 4, 0, "4", "512", false},
+		{"explicit", 4, 2048, "4", "2048", false},
+		{"width not a multiple", 3, 1000, "", "", true},
+		{"negative factor", -2, 0, "", "", true},
+		{"negative width", 2, -512, "", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := api.DefaultOptions()
+			opts.GroupAttnFactor = tt.factor
+			opts.GroupAttnWidth = tt.width
+
+			params, err := runnerParams("model.bin", nil, opts)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if got, _ := flagValue(params, "--grp-attn-n"); got != tt.wantN {
+				t.Errorf("got --grp-attn-n %q, want %q", got, tt.wantN)
+			}
+
+			if got, _ := flagValue(params, "--grp-attn-w"); got != tt.wantW {
+				t.Errorf("got --grp-attn-w %q, want %q", got, tt.wantW)
+			}
+		})
+	}
+}
+
+func TestBuildRunnerArgs(t *testing.T) {
+	defer func(orig func(...string) ([]byte, error)) { nvidiaSMI = orig }(nvidiaSMI)
+	nvidiaSMI = func(args ...string) ([]byte, error) {
+		return []byte("0, 4096, 16384\n1, 12288, 16384\n"), nil
+	}
+
+	if _, err := nvmlCheckVRAM(); err == nil {
+		t.Skip("nvml is available, the gpus can't be mocked")
+	}
+
+	defer func(orig string) { cgroupCPUMax = orig }(cgroupCPUMax)
+	cgroupCPUMax = "/does/not/exist"
+
+	opts := api.DefaultOptions()
+	opts.NumGPU = 40
+
+	params, err := BuildRunnerArgs("model.bin", []string{"adapter.bin"}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := flagValue(params, "--port"); ok {
+		t.Error("got --port, want it left to launch")
+	}
+
+	for flag, want := range map[string]string{
+		"--model":        "model.bin",
+		"--lora":         "adapter.bin",
+		"--n-gpu-layers": "40",
+		"--threads":      strconv.Itoa(runtime.GOMAXPROCS(0)),
+		"--main-gpu":     "1",
+		"--tensor-split": "4096,12288",
+	} {
+		if got, _ := flagValue(params, flag); got != want {
+			t.Errorf("got %s %q, want %q", flag, got, want)
+		}
+	}
+}
+
+func TestRunnerParamsEmbedding(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		t.Run(strconv.FormatBool(enabled), func(t *testing.T) {
+			opts := api.DefaultOptions()
+			opts.EmbeddingEnabled = enabled
+
+			params, err := runnerParams("model.bin", nil, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, got := flagValue(params, "--embedding"); got != enabled {
+				t.Errorf("got --embedding %v, want %v", got, enabled)
+			}
+		})
+	}
+}
+
+func TestEmbeddingDisabled(t *testing.T) {
+	llm := newTestLlama(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected request to %s", r.URL.Path)
+	}))
+	llm.EmbeddingEnabled = false
+
+	if _, err := llm.Embedding(context.Background(), "hello"); !errors.Is(err, ErrEmbeddingDisabled) {
+		t.Errorf("got error %v, want %v", err, ErrEmbeddingDisabled)
+	}
+}
+
+func TestRunnerParamsDraft(t *testing.T) {
+	tests := []struct {
+		name       string
+		draftModel string
+		draftN     int
+		wantModel  string
+		wantN      string
+		wantErr    bool
+	}{
+		{"disabled", "", 0, "", "", false},
+		{"draft model", "draft.bin", 0, "draft.bin", "", false},
+		{"draft tokens", "draft.bin", 8, "draft.bin", "8", false},
+		{"tokens without model", "", 8, "", "", true},
+		{"negative tokens", "draft.bin", -1, "", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := api.DefaultOptions()
+			opts.DraftModelPath = tt.draftModel
+			opts.DraftTokens = tt.draftN
+
+			params, err := runnerParams("model.bin", nil, opts)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if got, _ := flagValue(params, "--model-draft"); got != tt.wantModel {
+				t.Errorf("got --model-draft %q, want %q", got, tt.wantModel)
+			}
+
+			if got, _ := flagValue(params, "--draft"); got != tt.wantN {
+				t.Errorf("got --draft %q, want %q", got, tt.wantN)
+			}
+		})
+	}
+}
+
+func TestRunnerParamsSplitMode(t *testing.T) {
+	tests := []struct {
+		name        string
+		splitMode   string
+		kvOffload   bool
+		tensorSplit []float32
+		wantMode    string
+		wantNoKV    bool
+		wantSplit   string
+		wantErr     bool
+	}{
+		{"defaults", "", true, nil, "", false, "", false},
+		{"no kv offload", "", false, nil, "", true, "", false},
+		{"layer", "layer", true, []float32{3, 1}, "layer", false, "3,1", false},
+		{"row", "row", true, []float32{1, 1}, "row", false, "1,1", false},
+		{"row without kv offload", "row", false, nil, "row", true, "", false},
+		{"none", "none", true, nil, "none", false, "", false},
+		{"none without kv offload", "none", false, nil, "none", true, "", false},
+		{"none with tensor split", "none", true, []float32{1, 1}, "", false, "", true},
+		{"invalid", "column", true, nil, "", false, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := api.DefaultOptions()
+			opts.SplitMode = tt.splitMode
+			opts.KVOffload = tt.kvOffload
+			opts.TensorSplit = tt.tensorSplit
+
+			params, err := runnerParams("model.bin", nil, opts)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if got, _ := flagValue(params, "--split-mode"); got != tt.wantMode {
+				t.Errorf("got --split-mode %q, want %q", got, tt.wantMode)
+			}
+
+			if _, got := flagValue(params, "--no-kv-offload"); got != tt.wantNoKV {
+				t.Errorf("got --no-kv-offload %v, want %v", got, tt.wantNoKV)
+			}
+
+			if got, _ := flagValue(params, "--tensor-split"); got != tt.wantSplit {
+				t.Errorf("got --tensor-split %q, want %q", got, tt.wantSplit)
+			}
+		})
+	}
+}
+
+func TestNewLlamaDraftModel(t *testing.T) {
+	runner := filepath.Join(t.TempDir(), "server")
+	if err := os.WriteFile(runner, []byte("#!/bin/sh\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	notModel := filepath.Join(t.TempDir(), "draft.bin")
+	if err := os.WriteFile(notModel, []byte("not a model"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		draft string
+		want  error
+	}{
+		{"missing", filepath.Join(t.TempDir(), "missing.bin"), ErrModelNotFound},
+		{"not a model", notModel, ErrUnsupportedModelFormat},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := api.DefaultOptions()
+			opts.DraftModelPath = tt.draft
+
+			_, err := newLlama(writeGGJT(t, 32, llamaFileTypeQ4_0), nil, ModelRunner{Path: runner}, opts)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("got error %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewLlamaCPUFallback(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the runners are shell scripts")
+	}
+
+	defer func(orig func(time.Duration)) { sleep = orig }(sleep)
+	sleep = func(time.Duration) {}
+
+	tests := []struct {
+		name     string
+		stderr   string
+		fallback bool
+		wantCPU  bool
+	}{
+		{"cuda init failed", "CUDA error 100 at ggml-cuda.cu:5823: no CUDA-capable device is detected", true, true},
+		{"disabled", "CUDA error 100 at ggml-cuda.cu:5823: no CUDA-capable device is detected", false, false},
+		{"other failure", "error loading model: unknown tensor", true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			gpu := filepath.Join(dir, "gpu")
+			script := fmt.Sprintf("#!/bin/sh\necho '%s' >&2\nexit 1\n", tt.stderr)
+			if err := os.WriteFile(gpu, []byte(script), 0o755); err != nil {
+				t.Fatal(err)
+			}
+
+			// the cpu runner records its arguments, then fails too so the test doesn't need a server
+			cpu, args := filepath.Join(dir, "cpu"), filepath.Join(dir, "args")
+			script = fmt.Sprintf("#!/bin/sh\necho \"$@\" > %s\nexit 1\n", args)
+			if err := os.WriteFile(cpu, []byte(script), 0o755); err != nil {
+				t.Fatal(err)
+			}
+
+			opts := api.DefaultOptions()
+			opts.NumGPU = 32
+			opts.RunnerRetries = 1
+			opts.SkipMemoryCheck = true
+			opts.CPUFallback = tt.fallback
+
+			if _, err := newLlama(writeGGJT(t, 32, llamaFileTypeQ4_0), nil, ModelRunner{Path: gpu, CPUPath: cpu}, opts); err == nil {
+				t.Fatal("expected an error")
+			}
+
+			data, err := os.ReadFile(args)
+			if ran := err == nil; ran != tt.wantCPU {
+				t.Fatalf("cpu runner ran: %v, want %v", ran, tt.wantCPU)
+			}
+
+			if tt.wantCPU && !strings.Contains(string(data), "--n-gpu-layers 0") {
+				t.Errorf("got cpu runner args %q, want --n-gpu-layers 0", data)
+			}
+		})
+	}
+}
+
+func TestNewLlamaRunnerCheck(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("runner permissions and exec format errors differ on windows")
+	}
+
+	dir := t.TempDir()
+	write := func(name string, content []byte, perm os.FileMode) string {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, content, perm); err != nil {
+			t.Fatal(err)
+		}
+
+		return p
+	}
+
+	defer func(orig func(int, int) int) { pickPort = orig }(pickPort)
+	var tries int
+	pickPort = func(min, max int) int {
+		tries++
+		return 50200 + tries
+	}
+
+	tests := []struct {
+		name      string
+		runner    string
+		want      error
+		wantTries int
+	}{
+		{"missing", filepath.Join(dir, "missing"), os.ErrNotExist, 0},
+		{"empty", write("empty", nil, 0o755), nil, 0},
+		{"not executable", write("noexec", []byte("#!/bin/sh\n"), 0o644), nil, 0},
+		// neither an executable for this platform nor a script
+		{"bogus binary", write("bogus", []byte("\x7fELF\x02\x01\x01\x00garbage"), 0o755), ErrRunnerMismatch, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tries = 0
+			_, err := newLlama(writeGGJT(t, 32, llamaFileTypeQ4_0), nil, ModelRunner{Path: tt.runner}, api.DefaultOptions())
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Errorf("got error %v, want %v", err, tt.want)
+			}
+
+			if tries != tt.wantTries {
+				t.Errorf("got %d launch attempts, want %d", tries, tt.wantTries)
+			}
+		})
+	}
+}
+
+func TestNewLlamaPortReserved(t *testing.T) {
+	runner, err := exec.LookPath("false")
+	if err != nil {
+		t.Skip("false is not available")
+	}
+
+	defer func(orig func(int, int) int) { pickPort = orig }(pickPort)
+	defer func(orig func(time.Duration)) { sleep = orig }(sleep)
+	sleep = func(time.Duration) {}
+
+	// another model already runs on the first port picked
+	if !reservePort(50100) {
+		t.Fatal("port 50100 is already reserved")
+	}
+	defer releasePort(50100)
+
+	var ports []int
+	pickPort = func(min, max int) int {
+		port := 50100 + len(ports)
+		ports = append(ports, port)
+		return port
+	}
+
+	opts := api.DefaultOptions()
+	opts.RunnerRetries = 2
+
+	_, err = newLlama(writeGGJT(t, 32, llamaFileTypeQ4_0), nil, ModelRunner{Path: runner}, opts)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	if !reflect.DeepEqual(ports, []int{50100, 50101}) {
+		t.Errorf("got ports %v, want [50100 50101]", ports)
+	}
+
+	// the port launched on is released after the launch fails
+	if !reservePort(50101) {
+		t.Error("port 50101 is still reserved")
+	}
+	releasePort(50101)
+}
+
+func TestCloseIdempotent(t *testing.T) {
+	llm := newTestLlama(t, completionHandler(Prediction{Content: "hi"}, Prediction{Stop: true}))
+
+	var cancels, releases int
+	llm.Running.Cancel = func() { cancels++ }
+	llm.releaseVRAM = func() { releases++ }
+
+	if llm.IsClosed() {
+		t.Fatal("closed before Close")
+	}
+
+	llm.Close()
+
+	// another model launched on the port after it was released keeps its reservation
+	if !reservePort(llm.Port()) {
+		t.Fatal("port is still reserved after Close")
+	}
+	defer releasePort(llm.Port())
+
+	llm.Close()
+
+	if cancels != 1 || releases != 1 {
+		t.Errorf("got %d cancels and %d vram releases, want 1 each", cancels, releases)
+	}
+
+	if reservePort(llm.Port()) {
+		t.Error("a second Close released another model's port")
+	}
+
+	if !llm.IsClosed() {
+		t.Error("not closed after Close")
+	}
+
+	select {
+	case <-llm.Closed():
+	default:
+		t.Error("Closed channel is open after Close")
+	}
+
+	if err := llm.Predict(context.Background(), nil, "hello", func(api.GenerateResponse) {}); !errors.Is(err, ErrServerClosed) {
+		t.Errorf("got predict error %v, want %v", err, ErrServerClosed)
+	}
+
+	if _, err := llm.Embedding(context.Background(), "hello"); !errors.Is(err, ErrServerClosed) {
+		t.Errorf("got embedding error %v, want %v", err, ErrServerClosed)
+	}
+
+	if _, err := llm.Encode(context.Background(), "hello"); !errors.Is(err, ErrServerClosed) {
+		t.Errorf("got encode error %v, want %v", err, ErrServerClosed)
+	}
+}
+
+func TestCloseIdleConnections(t *testing.T) {
+	var mu sync.Mutex
+	var open int
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(TokenizeResponse{Tokens: []int{1}})
+	}))
+	srv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		switch state {
+		case http.StateNew:
+			open++
+		case http.StateClosed, http.StateHijacked:
+			open--
+		}
+	}
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	llm := &llama{
+		Options: api.DefaultOptions(),
+		Running: Running{Port: srv.Listener.Addr().(*net.TCPAddr).Port},
+		client:  &http.Client{Transport: http.DefaultTransport.(*http.Transport).Clone()},
+	}
+
+	if _, err := llm.Encode(context.Background(), "hello"); err != nil {
+		t.Fatal(err)
+	}
+
+	llm.Close()
+
+	// the server sees the connection close shortly after the client drops it
+	deadline := time.Now().Add(time.Second)
+	for {
+		mu.Lock()
+		n := open
+		mu.Unlock()
+
+		if n == 0 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d open connections after Close, want 0", n)
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestLlamaPort(t *testing.T) {
+	llm := &llama{Running: Running{Port: 51234}}
+	if llm.Port() != 51234 {
+		t.Errorf("got port %d, want 51234", llm.Port())
+	}
+}
+
+func TestCheckContextLength(t *testing.T) {
+	tests := []struct {
+		name        string
+		numCtx      int
+		numCtxTrain uint32
+		strict      bool
+		ropeScale   float32
+		groupAttn   int
+		want        int
+		wantErr     error
+	}{
+		{"within", 2048, 4096, false, 0, 0, 2048, nil},
+		{"unknown", 8192, 0, false, 0, 0, 8192, nil},
+		{"clamp", 8192, 4096, false, 0, 0, 4096, nil},
+		{"strict", 8192, 4096, true, 0, 0, 0, ErrContextExceedsModelMax},
+		{"rope scaling", 8192, 4096, true, 0.5, 0, 8192, nil},
+		{"self-extend", 16384, 4096, true, 0, 4, 16384, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := api.DefaultOptions()
+			opts.NumCtx = tt.numCtx
+			opts.StrictContext = tt.strict
+			opts.GroupAttnFactor = tt.groupAttn
+			if tt.ropeScale > 0 {
+				opts.RopeFrequencyScale = tt.ropeScale
+			}
+
+			got, err := checkContextLength(opts, tt.numCtxTrain)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+
+			if err == nil && got.NumCtx != tt.want {
+				t.Errorf("got num_ctx %d, want %d", got.NumCtx, tt.want)
+			}
+		})
+	}
+}
+
+func TestModelContextLength(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		path string
+		want uint32
+	}{
+		{"gguf", writeGGUF(t, 2, ggufLlama2...), 4096},
+		{"ggjt", writeGGJT(t, 32, llamaFileTypeQ4_0), 0},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := os.Open(tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			ggml, err := DecodeGGML(f, ModelFamilyLlama)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := modelContextLength(ggml); got != tt.want {
+				t.Errorf("got context length %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPredictStopTokens(t *testing.T) {
+	var got PredictRequest
+	mux := http.NewServeMux()
+	mux.Handle("/tokenize", completionHandler())
+	mux.HandleFunc("/detokenize", func(w http.ResponseWriter, r *http.Request) {
+		var req DetokenizeRequest
+		json.NewDecoder(r.Body).Decode(&req)
+
+		text := map[int]string{2: "", 32000: "<|im_end|>"}
+		json.NewEncoder(w).Encode(DetokenizeResponse{Content: text[req.Tokens[0]]})
+	})
+	mux.HandleFunc("/completion", func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&got)
+		writeEvents(w, Prediction{Content: "hi"}, Prediction{Stop: true})
+	})
+
+	llm := newTestLlama(t, mux)
+	llm.Options.Stop = []string{"User:"}
+	llm.StopTokens = []int{32000, 2}
+
+	if err := llm.Predict(context.Background(), nil, "hello", func(api.GenerateResponse) {}); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"User:", "<|im_end|>"}; !reflect.DeepEqual(got.Stop, want) {
+		t.Errorf("got stop %q, want %q", got.Stop, want)
+	}
+
+	if !reflect.DeepEqual(llm.Options.Stop, []string{"User:"}) {
+		t.Errorf("stop tokens were added to the options: %q", llm.Options.Stop)
+	}
+}
+
+func TestLoadCancel(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the runner is a shell script")
+	}
+
+	// a runner that never starts responding
+	runner := filepath.Join(t.TempDir(), "server")
+	if err := os.WriteFile(runner, []byte("#!/bin/sh\nexec sleep 30\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := api.DefaultOptions()
+	opts.NumGPU = 0
+	opts.SkipMemoryCheck = true
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := Load(ctx, writeGGJT(t, 32, llamaFileTypeQ4_0), nil, ModelRunner{Path: runner}, opts)
+	if !errors.Is(err, ErrContextCanceled) {
+		t.Fatalf("got error %v, want %v", err, ErrContextCanceled)
+	}
+
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("load returned %s after ctx was done", elapsed)
+	}
+}
+
+func TestWaitForServerHung(t *testing.T) {
+	sleepPath, err := exec.LookPath("sleep")
+	if err != nil {
+		t.Skip("sleep is not available")
+	}
+
+	defer func(timeout, interval time.Duration) {
+		startupTimeout, startupPollInterval = timeout, interval
+	}(startupTimeout, startupPollInterval)
+	startupTimeout, startupPollInterval = 200*time.Millisecond, 20*time.Millisecond
+
+	// accepts each ping but never answers it
+	var pings atomic.Int32
+	llm := newTestLlama(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pings.Add(1)
+		<-r.Context().Done()
+	}))
+
+	cmdCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	llm.Cmd = exec.CommandContext(cmdCtx, sleepPath, "30")
+
+	start := time.Now()
+	err = waitForServer(context.Background(), llm)
+	if err == nil || !strings.Contains(err.Error(), "did not start responding") {
+		t.Errorf("got error %v, want a startup timeout", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("waiting took %s, want about %s", elapsed, startupTimeout)
+	}
+
+	// each ping gives up after an interval rather than blocking the loop
+	if pings.Load() < 2 {
+		t.Errorf("got %d pings, want several", pings.Load())
+	}
+}
+
+func TestEndpoint(t *testing.T) {
+	tests := []struct {
+		basePath string
+		path     string
+		want     string
+	}{
+		{"", "/completion", "http://127.0.0.1:8080/completion"},
+		{"", "/", "http://127.0.0.1:8080/"},
+		{"/llama", "/completion", "http://127.0.0.1:8080/llama/completion"},
+		{"llama/", "/tokenize", "http://127.0.0.1:8080/llama/tokenize"},
+		{"/api/v1/llama/", "/slots/1?action=erase", "http://127.0.0.1:8080/api/v1/llama/slots/1?action=erase"},
+		{"/llama", "/", "http://127.0.0.1:8080/llama/"},
+	}
+
+	for _, tt := range tests {
+		r := Running{Port: 8080, BasePath: tt.basePath}
+		if got := r.endpoint(tt.path); got != tt.want {
+			t.Errorf("base path %q, path %q: got %s, want %s", tt.basePath, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestBasePath(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/llama/", http.StripPrefix("/llama", completionHandler(Prediction{Content: "hi"}, Prediction{Stop: true})))
+
+	llm := newTestLlama(t, mux)
+	llm.BasePath = "/llama"
+
+	var c resultCollector
+	if err := llm.Predict(context.Background(), nil, "hello", c.collect); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := c.Result().Response; got != "hi" {
+		t.Errorf("got response %q, want %q", got, "hi")
+	}
+}
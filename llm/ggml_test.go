@@ -0,0 +1,137 @@
+package llm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+// writeGGJT writes a minimal ggjt v3 llama header with the given layer count and file type
+func writeGGJT(t *testing.T, numLayer uint32, fileType llamaFileType) string {
+	t.Helper()
+
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, uint32(FILE_MAGIC_GGJT))
+	binary.Write(&b, binary.LittleEndian, uint32(3))
+	binary.Write(&b, binary.LittleEndian, llamaHyperparameters{
+		NumVocab: 32000,
+		NumEmbd:  4096,
+		NumMult:  256,
+		NumHead:  32,
+		NumLayer: numLayer,
+		NumRot:   128,
+		FileType: fileType,
+	})
+
+	p := filepath.Join(t.TempDir(), "model.bin")
+	if err := os.WriteFile(p, b.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	return p
+}
+
+func TestDecodeGGML(t *testing.T) {
+	f, err := os.Open(writeGGJT(t, 40, llamaFileTypeQ4_0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	ggml, err := DecodeGGML(f, ModelFamilyLlama)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ggml.Name() != "ggjt" {
+		t.Errorf("got container %q, want %q", ggml.Name(), "ggjt")
+	}
+
+	if ggml.ModelFamily() != ModelFamilyLlama {
+		t.Errorf("got family %q, want %q", ggml.ModelFamily(), ModelFamilyLlama)
+	}
+
+	if ggml.ModelType() != ModelType13B {
+		t.Errorf("got type %s, want %s", ggml.ModelType(), ModelType13B)
+	}
+
+	if ggml.FileType().String() != "Q4_0" {
+		t.Errorf("got file type %s, want Q4_0", ggml.FileType())
+	}
+
+	if ggml.NumEmbd() != 4096 {
+		t.Errorf("got embedding length %d, want 4096", ggml.NumEmbd())
+	}
+}
+
+func TestUnsupportedModelFormat(t *testing.T) {
+	tests := []struct {
+		name    string
+		content []byte
+	}{
+		{"empty", []byte{}},
+		{"short", []byte("gg")},
+		{"text", []byte("this is not a model file")},
+		{"gguf", []byte("GGUF\x01\x00\x00\x00")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := filepath.Join(t.TempDir(), "model.bin")
+			if err := os.WriteFile(p, tt.content, 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := newLlama(p, nil, ModelRunner{Path: "/does/not/exist"}, api.DefaultOptions())
+			if !errors.Is(err, ErrUnsupportedModelFormat) {
+				t.Errorf("got error %v, want %v", err, ErrUnsupportedModelFormat)
+			}
+		})
+	}
+}
+
+func TestLlamaFileType(t *testing.T) {
+	// ids from llama.cpp's LLAMA_FTYPE_* enum, which model files store
+	tests := []struct {
+		ft   llamaFileType
+		id   uint32
+		name string
+	}{
+		{llamaFileTypeF32, 0, "F32"},
+		{llamaFileTypeF16, 1, "F16"},
+		{llamaFileTypeQ4_0, 2, "Q4_0"},
+		{llamaFileTypeQ4_1, 3, "Q4_1"},
+		{llamaFileTypeQ4_1_F16, 4, "Q4_1_F16"},
+		{llamaFileType(5), 5, "Unknown"}, // Q4_2, removed
+		{llamaFileType(6), 6, "Unknown"}, // Q4_3, removed
+		{llamaFileTypeQ8_0, 7, "Q8_0"},
+		{llamaFileTypeQ5_0, 8, "Q5_0"},
+		{llamaFileTypeQ5_1, 9, "Q5_1"},
+		{llamaFileTypeQ2_K, 10, "Q2_K"},
+		{llamaFileTypeQ3_K_S, 11, "Q3_K_S"},
+		{llamaFileTypeQ3_K_M, 12, "Q3_K_M"},
+		{llamaFileTypeQ3_K_L, 13, "Q3_K_L"},
+		{llamaFileTypeQ4_K_S, 14, "Q4_K_S"},
+		{llamaFileTypeQ4_K_M, 15, "Q4_K_M"},
+		{llamaFileTypeQ5_K_S, 16, "Q5_K_S"},
+		{llamaFileTypeQ5_K_M, 17, "Q5_K_M"},
+		{llamaFileTypeQ6_K, 18, "Q6_K"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if uint32(tt.ft) != tt.id {
+				t.Errorf("got id %d, want %d", uint32(tt.ft), tt.id)
+			}
+
+			if got := llamaFileType(tt.id).String(); got != tt.name {
+				t.Errorf("id %d: got %q, want %q", tt.id, got, tt.name)
+			}
+		})
+	}
+}
@@ -0,0 +1,280 @@
+package llm
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+type containerGGUF struct {
+	version uint32
+
+	numTensor uint64
+	numKV     uint64
+
+	// kv holds the metadata key value pairs, e.g. general.architecture
+	kv map[string]any
+}
+
+func (c *containerGGUF) Name() string {
+	return "gguf"
+}
+
+func (c *containerGGUF) Decode(r io.Reader) error {
+	binary.Read(r, binary.LittleEndian, &c.version)
+
+	switch c.version {
+	case 1, 2, 3:
+	default:
+		return errors.New("invalid version")
+	}
+
+	var err error
+	if c.numTensor, err = c.readLen(r); err != nil {
+		return err
+	}
+
+	if c.numKV, err = c.readLen(r); err != nil {
+		return err
+	}
+
+	c.kv = make(map[string]any)
+	for i := uint64(0); i < c.numKV; i++ {
+		key, err := c.readString(r)
+		if err != nil {
+			return err
+		}
+
+		var vtype ggufType
+		if err := binary.Read(r, binary.LittleEndian, &vtype); err != nil {
+			return err
+		}
+
+		value, err := c.readValue(r, vtype)
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+
+		c.kv[key] = value
+	}
+
+	return nil
+}
+
+type ggufType uint32
+
+const (
+	ggufTypeUint8 ggufType = iota
+	ggufTypeInt8
+	ggufTypeUint16
+	ggufTypeInt16
+	ggufTypeUint32
+	ggufTypeInt32
+	ggufTypeFloat32
+	ggufTypeBool
+	ggufTypeString
+	ggufTypeArray
+	ggufTypeUint64
+	ggufTypeInt64
+	ggufTypeFloat64
+)
+
+// ggufMaxLen bounds string and array lengths so a corrupt header can't trigger a huge allocation
+const ggufMaxLen = 1 << 24
+
+// readLen reads a count or length, which version 1 stores as 32 bits and later versions as 64
+func (c *containerGGUF) readLen(r io.Reader) (uint64, error) {
+	if c.version == 1 {
+		var n uint32
+		err := binary.Read(r, binary.LittleEndian, &n)
+		return uint64(n), err
+	}
+
+	var n uint64
+	err := binary.Read(r, binary.LittleEndian, &n)
+	return n, err
+}
+
+func (c *containerGGUF) readString(r io.Reader) (string, error) {
+	n, err := c.readLen(r)
+	if err != nil {
+		return "", err
+	}
+
+	if n > ggufMaxLen {
+		return "", fmt.Errorf("string length %d too large", n)
+	}
+
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+func (c *containerGGUF) readValue(r io.Reader, vtype ggufType) (any, error) {
+	switch vtype {
+	case ggufTypeUint8:
+		return readGGUF[uint8](r)
+	case ggufTypeInt8:
+		return readGGUF[int8](r)
+	case ggufTypeUint16:
+		return readGGUF[uint16](r)
+	case ggufTypeInt16:
+		return readGGUF[int16](r)
+	case ggufTypeUint32:
+		return readGGUF[uint32](r)
+	case ggufTypeInt32:
+		return readGGUF[int32](r)
+	case ggufTypeFloat32:
+		return readGGUF[float32](r)
+	case ggufTypeBool:
+		return readGGUF[bool](r)
+	case ggufTypeUint64:
+		return readGGUF[uint64](r)
+	case ggufTypeInt64:
+		return readGGUF[int64](r)
+	case ggufTypeFloat64:
+		return readGGUF[float64](r)
+	case ggufTypeString:
+		return c.readString(r)
+	case ggufTypeArray:
+		return c.readArray(r)
+	default:
+		return nil, fmt.Errorf("invalid value type %d", vtype)
+	}
+}
+
+func readGGUF[T any](r io.Reader) (T, error) {
+	var v T
+	err := binary.Read(r, binary.LittleEndian, &v)
+	return v, err
+}
+
+func (c *containerGGUF) readArray(r io.Reader) ([]any, error) {
+	var vtype ggufType
+	if err := binary.Read(r, binary.LittleEndian, &vtype); err != nil {
+		return nil, err
+	}
+
+	n, err := c.readLen(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if n > ggufMaxLen {
+		return nil, fmt.Errorf("array length %d too large", n)
+	}
+
+	a := make([]any, 0, n)
+	for i := uint64(0); i < n; i++ {
+		v, err := c.readValue(r, vtype)
+		if err != nil {
+			return nil, err
+		}
+
+		a = append(a, v)
+	}
+
+	return a, nil
+}
+
+// ggufModel describes any architecture stored in a gguf file, reading hyperparameters from the
+// metadata keys prefixed with its architecture name, e.g. llama.block_count
+type ggufModel struct {
+	kv map[string]any
+}
+
+func (m *ggufModel) architecture() string {
+	s, _ := m.kv["general.architecture"].(string)
+	return s
+}
+
+func (m *ggufModel) ModelFamily() ModelFamily {
+	return ModelFamily(m.architecture())
+}
+
+func (m *ggufModel) ModelName() string {
+	s, _ := m.kv["general.name"].(string)
+	return s
+}
+
+func (m *ggufModel) ModelType() ModelType {
+	return modelTypeFromLayers(m.uint32(m.architecture() + ".block_count"))
+}
+
+func (m *ggufModel) FileType() FileType {
+	return llamaFileType(m.uint32("general.file_type"))
+}
+
+func (m *ggufModel) NumEmbd() uint32 {
+	return m.uint32(m.architecture() + ".embedding_length")
+}
+
+// uint32 returns an integer metadata value, which writers don't always store with the type the
+// spec suggests
+func (m *ggufModel) uint32(key string) uint32 {
+	switch v := m.kv[key].(type) {
+	case uint8:
+		return uint32(v)
+	case uint16:
+		return uint32(v)
+	case uint32:
+		return v
+	case uint64:
+		return uint32(v)
+	case int32:
+		return uint32(v)
+	case int64:
+		return uint32(v)
+	default:
+		return 0
+	}
+}
+
+// Metadata describes a model from the metadata in its gguf header
+type Metadata struct {
+	Architecture    string // e.g. llama or falcon
+	Name            string
+	ContextLength   int // the context length the model was trained with
+	EmbeddingLength int
+	BlockCount      int    // the number of layers
+	FileType        string // the quantization, e.g. Q4_0
+	ChatTemplate    string // a Jinja template, empty if the file doesn't have one
+}
+
+// ReadGGUFMetadata reads the metadata of a gguf model from its header without reading the tensor
+// data, for tools that list models without loading them
+func ReadGGUFMetadata(r io.ReaderAt) (Metadata, error) {
+	br := bufio.NewReader(io.NewSectionReader(r, 0, 1<<63-1))
+
+	var magic uint32
+	if err := binary.Read(br, binary.LittleEndian, &magic); err != nil {
+		return Metadata{}, fmt.Errorf("%w: %v", ErrUnsupportedModelFormat, err)
+	}
+
+	if magic != FILE_MAGIC_GGUF {
+		return Metadata{}, fmt.Errorf("%w: not a gguf file, magic %#x", ErrUnsupportedModelFormat, magic)
+	}
+
+	var c containerGGUF
+	if err := c.Decode(br); err != nil {
+		return Metadata{}, fmt.Errorf("%w: gguf: %v", ErrUnsupportedModelFormat, err)
+	}
+
+	m := ggufModel{kv: c.kv}
+	arch := m.architecture()
+	template, _ := m.kv["tokenizer.chat_template"].(string)
+	return Metadata{
+		Architecture:    arch,
+		Name:            m.ModelName(),
+		ContextLength:   int(m.uint32(arch + ".context_length")),
+		EmbeddingLength: int(m.uint32(arch + ".embedding_length")),
+		BlockCount:      int(m.uint32(arch + ".block_count")),
+		FileType:        m.FileType().String(),
+		ChatTemplate:    template,
+	}, nil
+}
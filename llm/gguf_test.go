@@ -0,0 +1,378 @@
+package llm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type ggufKV struct {
+	key   string
+	value any
+}
+
+// writeGGUF writes a gguf header with the given metadata and no tensors
+func writeGGUF(t *testing.T, version uint32, kv ...ggufKV) string {
+	t.Helper()
+
+	var b bytes.Buffer
+	writeLen := func(n int) {
+		if version == 1 {
+			binary.Write(&b, binary.LittleEndian, uint32(n))
+		} else {
+			binary.Write(&b, binary.LittleEndian, uint64(n))
+		}
+	}
+
+	writeString := func(s string) {
+		writeLen(len(s))
+		b.WriteString(s)
+	}
+
+	var writeValue func(v any, typed bool)
+	writeValue = func(v any, typed bool) {
+		vtype := func(ggufType ggufType) {
+			if typed {
+				binary.Write(&b, binary.LittleEndian, ggufType)
+			}
+		}
+
+		switch v := v.(type) {
+		case uint32:
+			vtype(ggufTypeUint32)
+			binary.Write(&b, binary.LittleEndian, v)
+		case int32:
+			vtype(ggufTypeInt32)
+			binary.Write(&b, binary.LittleEndian, v)
+		case uint64:
+			vtype(ggufTypeUint64)
+			binary.Write(&b, binary.LittleEndian, v)
+		case float32:
+			vtype(ggufTypeFloat32)
+			binary.Write(&b, binary.LittleEndian, v)
+		case bool:
+			vtype(ggufTypeBool)
+			binary.Write(&b, binary.LittleEndian, v)
+		case string:
+			vtype(ggufTypeString)
+			writeString(v)
+		case []string:
+			vtype(ggufTypeArray)
+			binary.Write(&b, binary.LittleEndian, ggufTypeString)
+			writeLen(len(v))
+			for _, s := range v {
+				writeValue(s, false)
+			}
+		case []float32:
+			vtype(ggufTypeArray)
+			binary.Write(&b, binary.LittleEndian, ggufTypeFloat32)
+			writeLen(len(v))
+			for _, f := range v {
+				writeValue(f, false)
+			}
+		default:
+			t.Fatalf("unsupported gguf value %T", v)
+		}
+	}
+
+	binary.Write(&b, binary.LittleEndian, uint32(FILE_MAGIC_GGUF))
+	binary.Write(&b, binary.LittleEndian, version)
+	writeLen(0)
+	writeLen(len(kv))
+	for _, kv := range kv {
+		writeString(kv.key)
+		writeValue(kv.value, true)
+	}
+
+	p := filepath.Join(t.TempDir(), "model.gguf")
+	if err := os.WriteFile(p, b.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	return p
+}
+
+// the metadata of a few published gguf conversions, minus most of the vocabulary
+var (
+	ggufLlama2 = []ggufKV{
+		{"general.architecture", "llama"},
+		{"general.name", "LLaMA v2"},
+		{"llama.context_length", uint32(4096)},
+		{"llama.embedding_length", uint32(4096)},
+		{"llama.block_count", uint32(32)},
+		{"llama.feed_forward_length", uint32(11008)},
+		{"llama.rope.dimension_count", uint32(128)},
+		{"llama.attention.head_count", uint32(32)},
+		{"llama.attention.head_count_kv", uint32(32)},
+		{"llama.attention.layer_norm_rms_epsilon", float32(1e-5)},
+		{"general.file_type", uint32(2)},
+		{"tokenizer.ggml.model", "llama"},
+		{"tokenizer.ggml.tokens", []string{"<unk>", "<s>", "</s>"}},
+		{"tokenizer.ggml.scores", []float32{0, 0, 0}},
+		{"tokenizer.ggml.bos_token_id", uint32(1)},
+		{"tokenizer.ggml.eos_token_id", uint32(2)},
+	}
+
+	ggufMistral = []ggufKV{
+		{"general.architecture", "llama"},
+		{"general.name", "mistralai_mistral-7b-instruct-v0.1"},
+		{"llama.context_length", uint32(32768)},
+		{"llama.embedding_length", uint32(4096)},
+		{"llama.block_count", uint32(32)},
+		{"llama.feed_forward_length", uint32(14336)},
+		{"llama.rope.dimension_count", uint32(128)},
+		{"llama.attention.head_count", uint32(32)},
+		{"llama.attention.head_count_kv", uint32(8)},
+		{"llama.attention.layer_norm_rms_epsilon", float32(1e-5)},
+		{"llama.rope.freq_base", float32(10000)},
+		{"general.file_type", uint32(15)},
+		{"tokenizer.ggml.model", "llama"},
+		{"tokenizer.ggml.tokens", []string{"<unk>", "<s>", "</s>"}},
+		{"tokenizer.ggml.add_bos_token", true},
+	}
+
+	ggufFalcon = []ggufKV{
+		{"general.architecture", "falcon"},
+		{"general.name", "Falcon"},
+		{"falcon.context_length", uint32(2048)},
+		{"falcon.tensor_data_layout", "jploski"},
+		{"falcon.embedding_length", uint32(4544)},
+		{"falcon.feed_forward_length", uint32(18176)},
+		{"falcon.block_count", uint32(32)},
+		{"falcon.attention.head_count", uint32(71)},
+		{"falcon.attention.head_count_kv", uint32(1)},
+		{"falcon.attention.layer_norm_epsilon", float32(1e-5)},
+		{"general.file_type", uint32(7)},
+		{"tokenizer.ggml.model", "gpt2"},
+	}
+
+	ggufGPT2 = []ggufKV{
+		{"general.architecture", "gpt2"},
+		{"general.name", "gpt2"},
+		{"gpt2.block_count", uint64(12)},
+		{"gpt2.context_length", uint64(1024)},
+		{"gpt2.embedding_length", uint64(768)},
+		{"gpt2.feed_forward_length", uint64(3072)},
+		{"gpt2.attention.head_count", uint64(12)},
+		{"general.file_type", uint32(1)},
+	}
+)
+
+func TestDecodeGGUF(t *testing.T) {
+	tests := []struct {
+		name     string
+		version  uint32
+		kv       []ggufKV
+		family   ModelFamily
+		model    string
+		fileType string
+		numEmbd  uint32
+	}{
+		{"llama2", 2, ggufLlama2, ModelFamilyLlama, "LLaMA v2", "Q4_0", 4096},
+		{"mistral", 3, ggufMistral, ModelFamilyLlama, "mistralai_mistral-7b-instruct-v0.1", "Q4_K_M", 4096},
+		{"falcon", 2, ggufFalcon, "falcon", "Falcon", "Q8_0", 4544},
+		{"gpt2", 1, ggufGPT2, "gpt2", "gpt2", "F16", 768},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := os.Open(writeGGUF(t, tt.version, tt.kv...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			ggml, err := DecodeGGML(f, ModelFamilyLlama)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if ggml.Name() != "gguf" {
+				t.Errorf("got container %q, want %q", ggml.Name(), "gguf")
+			}
+
+			if ggml.ModelFamily() != tt.family {
+				t.Errorf("got family %q, want %q", ggml.ModelFamily(), tt.family)
+			}
+
+			if ggml.ModelName() != tt.model {
+				t.Errorf("got name %q, want %q", ggml.ModelName(), tt.model)
+			}
+
+			if ggml.FileType().String() != tt.fileType {
+				t.Errorf("got file type %s, want %s", ggml.FileType(), tt.fileType)
+			}
+
+			if ggml.NumEmbd() != tt.numEmbd {
+				t.Errorf("got embedding length %d, want %d", ggml.NumEmbd(), tt.numEmbd)
+			}
+		})
+	}
+}
+
+func TestDecodeGGUFInvalid(t *testing.T) {
+	valid, err := os.ReadFile(writeGGUF(t, 2, ggufLlama2...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		content []byte
+	}{
+		{"bad version", []byte("GGUF\x09\x00\x00\x00")},
+		{"no counts", []byte("GGUF\x02\x00\x00\x00")},
+		{"truncated", valid[:len(valid)-3]},
+		{"huge string", append([]byte("GGUF\x02\x00\x00\x00"+
+			"\x00\x00\x00\x00\x00\x00\x00\x00"+
+			"\x01\x00\x00\x00\x00\x00\x00\x00"), bytes.Repeat([]byte{0xff}, 8)...)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := DecodeGGML(bytes.NewReader(tt.content), ModelFamilyLlama)
+			if !errors.Is(err, ErrUnsupportedModelFormat) {
+				t.Errorf("got error %v, want %v", err, ErrUnsupportedModelFormat)
+			}
+		})
+	}
+}
+
+func TestDecodeGGUFMetadata(t *testing.T) {
+	f, err := os.Open(writeGGUF(t, 2, ggufLlama2...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	ggml, err := DecodeGGML(f, ModelFamilyLlama)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kv := ggml.container.(*containerGGUF).kv
+	if len(kv) != len(ggufLlama2) {
+		t.Errorf("got %d keys, want %d", len(kv), len(ggufLlama2))
+	}
+
+	if got := fmt.Sprint(kv["tokenizer.ggml.tokens"]); got != "[<unk> <s> </s>]" {
+		t.Errorf("got tokens %s", got)
+	}
+
+	if got := kv["llama.attention.layer_norm_rms_epsilon"]; got != float32(1e-5) {
+		t.Errorf("got epsilon %v", got)
+	}
+}
+
+func TestReadGGUFMetadata(t *testing.T) {
+	mistralTemplate := "{{ bos_token }}{% for message in messages %}{% if message['role'] == 'user' %}{{ '[INST] ' + message['content'] + ' [/INST]' }}{% else %}{{ message['content'] + eos_token }}{% endif %}{% endfor %}"
+	mistral := append(append([]ggufKV(nil), ggufMistral...), ggufKV{"tokenizer.chat_template", mistralTemplate})
+
+	tests := []struct {
+		name string
+		kv   []ggufKV
+		want Metadata
+	}{
+		{"llama2", ggufLlama2, Metadata{"llama", "LLaMA v2", 4096, 4096, 32, "Q4_0", ""}},
+		{"mistral", mistral, Metadata{"llama", "mistralai_mistral-7b-instruct-v0.1", 32768, 4096, 32, "Q4_K_M", mistralTemplate}},
+		{"falcon", ggufFalcon, Metadata{"falcon", "Falcon", 2048, 4544, 32, "Q8_0", ""}},
+		{"gpt2", ggufGPT2, Metadata{"gpt2", "gpt2", 1024, 768, 12, "F16", ""}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := os.Open(writeGGUF(t, 3, tt.kv...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			got, err := ReadGGUFMetadata(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadGGUFMetadataNotGGUF(t *testing.T) {
+	f, err := os.Open(writeGGJT(t, 32, llamaFileTypeQ4_0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if _, err := ReadGGUFMetadata(f); !errors.Is(err, ErrUnsupportedModelFormat) {
+		t.Errorf("got error %v, want %v", err, ErrUnsupportedModelFormat)
+	}
+}
+
+func TestSpecialTokens(t *testing.T) {
+	chatML := []ggufKV{
+		{"general.architecture", "llama"},
+		{"tokenizer.ggml.model", "llama"},
+		{"tokenizer.ggml.tokens", []string{"<unk>", "<s>", "</s>", "<|im_start|>", "<|im_end|>"}},
+		{"tokenizer.ggml.bos_token_id", uint32(1)},
+		{"tokenizer.ggml.eos_token_id", uint32(4)},
+	}
+
+	ggjt := func(t *testing.T) string { return writeGGJT(t, 32, llamaFileTypeQ4_0) }
+	gguf := func(kv []ggufKV) func(*testing.T) string {
+		return func(t *testing.T) string { return writeGGUF(t, 2, kv...) }
+	}
+
+	tests := []struct {
+		name             string
+		model            func(*testing.T) string
+		bos, eos         int
+		bosText, eosText string
+		wantErr          error
+	}{
+		{"ggjt", ggjt, 1, 2, "<s>", "</s>", nil},
+		{"llama2", gguf(ggufLlama2), 1, 2, "<s>", "</s>", nil},
+		{"chatml", gguf(chatML), 1, 4, "<s>", "<|im_end|>", nil},
+		{"tokenizer defaults", gguf(ggufMistral), 1, 2, "<s>", "</s>", nil},
+		{"no vocabulary", gguf(ggufFalcon), 11, 11, "", "", nil},
+		{"unknown", gguf(ggufGPT2), 0, 0, "", "", ErrUnknownSpecialTokens},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := os.Open(tt.model(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			ggml, err := DecodeGGML(f, ModelFamilyLlama)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var llm llama
+			llm.bos, llm.eos, llm.specialTokens = modelSpecialTokens(ggml)
+
+			bos, eos, err := llm.SpecialTokens()
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+
+			if bos != tt.bos || eos != tt.eos {
+				t.Errorf("got tokens %d, %d, want %d, %d", bos, eos, tt.bos, tt.eos)
+			}
+
+			bosText, eosText, _ := llm.SpecialTokenText()
+			if bosText != tt.bosText || eosText != tt.eosText {
+				t.Errorf("got text %q, %q, want %q, %q", bosText, eosText, tt.bosText, tt.eosText)
+			}
+		})
+	}
+}
@@ -0,0 +1,295 @@
+package llm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+var errNoGPU = errors.New("no nvidia gpu detected")
+
+// GPUInfo describes the memory of a single NVIDIA GPU
+type GPUInfo struct {
+	Index    int
+	FreeMiB  int
+	TotalMiB int
+}
+
+// CheckVRAM returns the memory of each NVIDIA GPU. It queries NVML directly when built with the
+// nvml tag, and otherwise, or when NVML fails to initialize, falls back to parsing the output of
+// nvidia-smi.
+func CheckVRAM() ([]GPUInfo, error) {
+	if gpus, err := nvmlCheckVRAM(); err == nil {
+		return gpus, nil
+	}
+
+	return smiCheckVRAM()
+}
+
+// TotalFreeVRAM returns the free VRAM in MiB summed across all NVIDIA GPUs
+func TotalFreeVRAM() (int, error) {
+	gpus, err := CheckVRAM()
+	if err != nil {
+		return 0, err
+	}
+
+	var free int
+	for _, gpu := range gpus {
+		free += gpu.FreeMiB
+	}
+
+	return free, nil
+}
+
+// nvidiaSMI runs nvidia-smi with args, tests replace it to avoid depending on a gpu
+var nvidiaSMI = func(args ...string) ([]byte, error) {
+	var stdout bytes.Buffer
+	cmd := exec.Command(findNvidiaSMI(), args...)
+	cmd.Stdout = &stdout
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("nvidia-smi: %w", err)
+	}
+
+	return stdout.Bytes(), nil
+}
+
+// nvidiaSMILocations lists where the driver installs nvidia-smi, for when it isn't on PATH. On
+// windows current drivers put it in System32 and older ones under Program Files.
+var nvidiaSMILocations = func() []string {
+	if runtime.GOOS != "windows" {
+		return nil
+	}
+
+	systemRoot := os.Getenv("SystemRoot")
+	if systemRoot == "" {
+		systemRoot = `C:\Windows`
+	}
+
+	programFiles := os.Getenv("ProgramFiles")
+	if programFiles == "" {
+		programFiles = `C:\Program Files`
+	}
+
+	return []string{
+		filepath.Join(systemRoot, "System32", "nvidia-smi.exe"),
+		filepath.Join(programFiles, "NVIDIA Corporation", "NVSMI", "nvidia-smi.exe"),
+	}
+}
+
+// findNvidiaSMI returns the nvidia-smi on PATH, or else the first one found where the driver
+// installs it
+func findNvidiaSMI() string {
+	if p, err := exec.LookPath("nvidia-smi"); err == nil {
+		return p
+	}
+
+	for _, p := range nvidiaSMILocations() {
+		if _, err := os.Stat(p); err == nil {
+			return p
+		}
+	}
+
+	// not found, running it reports the error
+	return "nvidia-smi"
+}
+
+// missingCUDAGPU reports whether the gpu runner on goos needs an NVIDIA GPU and none was found.
+// The windows gpu runner is only built with CUDA, so without a gpu the cpu runner is used and no
+// layers are offloaded.
+func missingCUDAGPU(goos string) bool {
+	if goos != "windows" {
+		return false
+	}
+
+	_, err := CheckVRAM()
+	return err != nil
+}
+
+func smiCheckVRAM() ([]GPUInfo, error) {
+	out, err := nvidiaSMI("--query-gpu=index,memory.free,memory.total", "--format=csv,noheader,nounits")
+	if err != nil {
+		return nil, err
+	}
+
+	return parseVRAM(out)
+}
+
+// parseVRAM parses the "index, free, total" lines reported by nvidia-smi
+func parseVRAM(out []byte) ([]GPUInfo, error) {
+	var gpus []GPUInfo
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		fields := strings.Split(line, ",")
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("failed to parse available VRAM %q", line)
+		}
+
+		var values [3]int
+		for i, field := range fields {
+			v, err := strconv.Atoi(strings.TrimSpace(field))
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse available VRAM %q: %w", line, err)
+			}
+
+			values[i] = v
+		}
+
+		gpus = append(gpus, GPUInfo{Index: values[0], FreeMiB: values[1], TotalMiB: values[2]})
+	}
+
+	if len(gpus) == 0 {
+		return nil, errNoGPU
+	}
+
+	return gpus, nil
+}
+
+// splitByFreeVRAM returns a tensor split proportional to each gpu's free memory and the index of
+// the gpu with the most free memory, so layers aren't pinned to a device that is already full
+func splitByFreeVRAM(gpus []GPUInfo) (split []float32, emptiest int) {
+	split = make([]float32, len(gpus))
+	for _, gpu := range gpus {
+		if gpu.Index < 0 || gpu.Index >= len(gpus) {
+			// indexes aren't contiguous, leave the split to llama.cpp
+			return nil, 0
+		}
+
+		split[gpu.Index] = float32(gpu.FreeMiB)
+		if split[gpu.Index] > split[emptiest] {
+			emptiest = gpu.Index
+		}
+	}
+
+	return split, emptiest
+}
+
+// GPUDriver describes an NVIDIA GPU and the driver it runs under, for diagnosing loads that fail
+// because the driver is too old for the CUDA runtime llama.cpp was built with
+type GPUDriver struct {
+	Index         int
+	Name          string
+	DriverVersion string
+	// CUDAVersion is the newest CUDA version the driver supports, empty if it isn't reported
+	CUDAVersion string
+	FreeMiB     int
+}
+
+// minDriverVersion is the oldest linux driver that runs the CUDA 11 runtime the gpu runner is
+// built against
+const minDriverVersion = "450.80.02"
+
+var cudaVersionRe = regexp.MustCompile(`CUDA Version:\s*([0-9.]+)`)
+
+// CheckGPUDrivers returns the name, driver version and free memory of each NVIDIA GPU as
+// reported by nvidia-smi
+func CheckGPUDrivers() ([]GPUDriver, error) {
+	out, err := nvidiaSMI("--query-gpu=index,name,driver_version,memory.free", "--format=csv,noheader,nounits")
+	if err != nil {
+		return nil, err
+	}
+
+	gpus, err := parseGPUDrivers(out)
+	if err != nil {
+		return nil, err
+	}
+
+	// the supported CUDA version is only printed in the summary header
+	if summary, err := nvidiaSMI(); err == nil {
+		if m := cudaVersionRe.FindSubmatch(summary); m != nil {
+			for i := range gpus {
+				gpus[i].CUDAVersion = string(m[1])
+			}
+		}
+	}
+
+	return gpus, nil
+}
+
+// parseGPUDrivers parses the "index, name, driver_version, free" lines reported by nvidia-smi
+func parseGPUDrivers(out []byte) ([]GPUDriver, error) {
+	var gpus []GPUDriver
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		fields := strings.Split(line, ",")
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("failed to parse gpu driver %q", line)
+		}
+
+		for i := range fields {
+			fields[i] = strings.TrimSpace(fields[i])
+		}
+
+		index, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse gpu driver %q: %w", line, err)
+		}
+
+		free, err := strconv.Atoi(fields[3])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse gpu driver %q: %w", line, err)
+		}
+
+		gpus = append(gpus, GPUDriver{Index: index, Name: fields[1], DriverVersion: fields[2], FreeMiB: free})
+	}
+
+	if len(gpus) == 0 {
+		return nil, errNoGPU
+	}
+
+	return gpus, nil
+}
+
+// warnOldDriver logs a warning for each gpu whose driver is older than the gpu runner needs,
+// which otherwise shows up as the server crashing once the model starts loading
+func warnOldDriver() {
+	gpus, err := CheckGPUDrivers()
+	if err != nil {
+		return
+	}
+
+	for _, gpu := range gpus {
+		if compareVersions(gpu.DriverVersion, minDriverVersion) < 0 {
+			logWarnf("gpu %d (%s) has driver %s, the gpu runner needs %s or newer and may crash", gpu.Index, gpu.Name, gpu.DriverVersion, minDriverVersion)
+		}
+	}
+}
+
+// compareVersions compares dotted numeric versions, returning -1, 0 or 1. Missing parts count as
+// zero and parts that aren't numbers compare as zero.
+func compareVersions(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+	}
+
+	return 0
+}
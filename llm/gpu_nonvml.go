@@ -0,0 +1,9 @@
+//go:build !nvml || !cgo
+
+package llm
+
+import "errors"
+
+func nvmlCheckVRAM() ([]GPUInfo, error) {
+	return nil, errors.New("nvml support not built, rebuild with -tags nvml")
+}
@@ -0,0 +1,53 @@
+//go:build nvml && cgo
+
+package llm
+
+/*
+#cgo LDFLAGS: -lnvidia-ml
+#include <nvml.h>
+*/
+import "C"
+
+import "fmt"
+
+func nvmlError(op string, ret C.nvmlReturn_t) error {
+	return fmt.Errorf("nvml %s: %s", op, C.GoString(C.nvmlErrorString(ret)))
+}
+
+// nvmlCheckVRAM queries free memory through NVML, avoiding an nvidia-smi process per call
+func nvmlCheckVRAM() ([]GPUInfo, error) {
+	if ret := C.nvmlInit_v2(); ret != C.NVML_SUCCESS {
+		return nil, nvmlError("init", ret)
+	}
+	defer C.nvmlShutdown()
+
+	var count C.uint
+	if ret := C.nvmlDeviceGetCount_v2(&count); ret != C.NVML_SUCCESS {
+		return nil, nvmlError("device count", ret)
+	}
+
+	if count == 0 {
+		return nil, errNoGPU
+	}
+
+	gpus := make([]GPUInfo, 0, count)
+	for i := C.uint(0); i < count; i++ {
+		var device C.nvmlDevice_t
+		if ret := C.nvmlDeviceGetHandleByIndex_v2(i, &device); ret != C.NVML_SUCCESS {
+			return nil, nvmlError("device handle", ret)
+		}
+
+		var memory C.nvmlMemory_t
+		if ret := C.nvmlDeviceGetMemoryInfo(device, &memory); ret != C.NVML_SUCCESS {
+			return nil, nvmlError("memory info", ret)
+		}
+
+		gpus = append(gpus, GPUInfo{
+			Index:    int(i),
+			FreeMiB:  int(memory.free / 1024 / 1024),
+			TotalMiB: int(memory.total / 1024 / 1024),
+		})
+	}
+
+	return gpus, nil
+}
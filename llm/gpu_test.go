@@ -0,0 +1,254 @@
+package llm
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+func TestParseVRAM(t *testing.T) {
+	tests := []struct {
+		name    string
+		out     string
+		want    []GPUInfo
+		wantErr bool
+	}{
+		{"single gpu", "0, 24000, 24576\n", []GPUInfo{{0, 24000, 24576}}, false},
+		{"multiple gpus", "0, 1024, 24576\n1, 23000, 24576\n", []GPUInfo{{0, 1024, 24576}, {1, 23000, 24576}}, false},
+		{"no gpus", "", nil, true},
+		{"malformed", "0, N/A, 24576\n", nil, true},
+		{"missing fields", "24000\n", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseVRAM([]byte(tt.out))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error: %v", err, tt.wantErr)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitByFreeVRAM(t *testing.T) {
+	split, emptiest := splitByFreeVRAM([]GPUInfo{{0, 1024, 24576}, {1, 23000, 24576}})
+	if !reflect.DeepEqual(split, []float32{1024, 23000}) {
+		t.Errorf("got split %v, want [1024 23000]", split)
+	}
+
+	if emptiest != 1 {
+		t.Errorf("got main gpu %d, want 1", emptiest)
+	}
+
+	if split, _ := splitByFreeVRAM([]GPUInfo{{0, 1024, 24576}, {3, 23000, 24576}}); split != nil {
+		t.Errorf("got split %v for non-contiguous indexes, want none", split)
+	}
+}
+
+func TestCheckVRAMFallback(t *testing.T) {
+	defer func(orig func(...string) ([]byte, error)) { nvidiaSMI = orig }(nvidiaSMI)
+
+	nvidiaSMI = func(args ...string) ([]byte, error) {
+		return []byte("0, 8192, 16384\n1, 4096, 16384\n"), nil
+	}
+
+	if _, err := nvmlCheckVRAM(); err == nil {
+		t.Skip("nvml is available, the nvidia-smi fallback is not used")
+	}
+
+	got, err := TotalFreeVRAM()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got != 12288 {
+		t.Errorf("got %d, want 12288", got)
+	}
+
+	nvidiaSMI = func(args ...string) ([]byte, error) {
+		return nil, errors.New("nvidia-smi: executable file not found")
+	}
+
+	if _, err := CheckVRAM(); err == nil {
+		t.Error("expected an error when nvidia-smi is unavailable")
+	}
+}
+
+// BenchmarkCheckVRAM compares querying NVML with spawning nvidia-smi, run with -tags nvml to
+// include the NVML path
+func BenchmarkCheckVRAM(b *testing.B) {
+	b.Run("nvml", func(b *testing.B) {
+		if _, err := nvmlCheckVRAM(); err != nil {
+			b.Skip(err)
+		}
+
+		for i := 0; i < b.N; i++ {
+			nvmlCheckVRAM()
+		}
+	})
+
+	b.Run("nvidia-smi", func(b *testing.B) {
+		if _, err := smiCheckVRAM(); err != nil {
+			b.Skip(err)
+		}
+
+		for i := 0; i < b.N; i++ {
+			smiCheckVRAM()
+		}
+	})
+}
+
+func TestParseGPUDrivers(t *testing.T) {
+	tests := []struct {
+		name    string
+		out     string
+		want    []GPUDriver
+		wantErr bool
+	}{
+		{"single gpu", "0, NVIDIA GeForce RTX 4090, 535.104.05, 24000\n", []GPUDriver{{Index: 0, Name: "NVIDIA GeForce RTX 4090", DriverVersion: "535.104.05", FreeMiB: 24000}}, false},
+		{"no gpus", "", nil, true},
+		{"malformed", "0, Tesla T4, 450.80.02, N/A\n", nil, true},
+		{"missing fields", "0, 24000\n", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseGPUDrivers([]byte(tt.out))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error: %v", err, tt.wantErr)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFindNvidiaSMI(t *testing.T) {
+	defer func(orig func() []string) { nvidiaSMILocations = orig }(nvidiaSMILocations)
+
+	// a directory for PATH and one standing in for the driver's install location
+	pathDir, driverDir := t.TempDir(), t.TempDir()
+	installed := filepath.Join(driverDir, "nvidia-smi.exe")
+	if err := os.WriteFile(installed, nil, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	onPath := filepath.Join(pathDir, "nvidia-smi")
+	if runtime.GOOS == "windows" {
+		onPath += ".exe"
+	}
+
+	tests := []struct {
+		name      string
+		path      bool
+		locations []string
+		want      string
+	}{
+		{"on path", true, []string{installed}, onPath},
+		{"driver location", false, []string{filepath.Join(pathDir, "missing.exe"), installed}, installed},
+		{"not found", false, []string{filepath.Join(pathDir, "missing.exe")}, "nvidia-smi"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Remove(onPath)
+			if tt.path {
+				if err := os.WriteFile(onPath, nil, 0o755); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			t.Setenv("PATH", pathDir)
+			nvidiaSMILocations = func() []string { return tt.locations }
+
+			if got := findNvidiaSMI(); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMissingCUDAGPU(t *testing.T) {
+	defer func(orig func(...string) ([]byte, error)) { nvidiaSMI = orig }(nvidiaSMI)
+
+	if _, err := nvmlCheckVRAM(); err == nil {
+		t.Skip("nvml is available, the nvidia-smi fallback is not used")
+	}
+
+	tests := []struct {
+		name string
+		goos string
+		gpu  bool
+		want bool
+	}{
+		{"windows with gpu", "windows", true, false},
+		{"windows without gpu", "windows", false, true},
+		{"linux without gpu", "linux", false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nvidiaSMI = func(args ...string) ([]byte, error) {
+				if !tt.gpu {
+					return nil, errors.New("nvidia-smi: executable file not found")
+				}
+
+				return []byte("0, 8192, 16384\n"), nil
+			}
+
+			if got := missingCUDAGPU(tt.goos); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckGPUDrivers(t *testing.T) {
+	defer func(orig func(...string) ([]byte, error)) { nvidiaSMI = orig }(nvidiaSMI)
+
+	nvidiaSMI = func(args ...string) ([]byte, error) {
+		if len(args) == 0 {
+			return []byte("| NVIDIA-SMI 535.104.05   Driver Version: 535.104.05   CUDA Version: 12.2     |\n"), nil
+		}
+
+		return []byte("0, Tesla T4, 535.104.05, 15000\n"), nil
+	}
+
+	gpus, err := CheckGPUDrivers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []GPUDriver{{Index: 0, Name: "Tesla T4", DriverVersion: "535.104.05", CUDAVersion: "12.2", FreeMiB: 15000}}
+	if !reflect.DeepEqual(gpus, want) {
+		t.Errorf("got %v, want %v", gpus, want)
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"535.104.05", "450.80.02", 1},
+		{"450.80.02", "450.80.02", 0},
+		{"450.80", "450.80.02", -1},
+		{"418.67", "450.80.02", -1},
+		{"450.80.10", "450.80.02", 1},
+	}
+
+	for _, tt := range tests {
+		if got := compareVersions(tt.a, tt.b); got != tt.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
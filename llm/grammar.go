@@ -0,0 +1,404 @@
+package llm
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+// grammarPrimitives are the GBNF rules for json values, each consumes the whitespace following it
+var grammarPrimitives = map[string]string{
+	"boolean": `("true" | "false") space`,
+	"number":  `("-"? ([0-9] | [1-9] [0-9]*)) ("." [0-9]+)? ([eE] [-+]? [0-9]+)? space`,
+	"integer": `("-"? ([0-9] | [1-9] [0-9]*)) space`,
+	"string":  `"\"" ([^"\\] | "\\" (["\\/bfnrt] | "u" [0-9a-fA-F] [0-9a-fA-F] [0-9a-fA-F] [0-9a-fA-F]))* "\"" space`,
+	"null":    `"null" space`,
+	"value":   `object | array | string | number | boolean | null`,
+	"object":  `"{" space ( string ":" space value ("," space string ":" space value)* )? "}" space`,
+	"array":   `"[" space ( value ("," space value)* )? "]" space`,
+}
+
+// grammarPrimitiveDeps are the other primitives a primitive refers to
+var grammarPrimitiveDeps = map[string][]string{
+	"value":  {"object", "array", "string", "number", "boolean", "null"},
+	"object": {"string", "value"},
+	"array":  {"value"},
+}
+
+// unsupportedSchemaKeywords can't be expressed by the converter, ignoring them would let the
+// model generate output the schema rejects
+var unsupportedSchemaKeywords = []string{"$ref", "allOf", "not", "if", "pattern", "patternProperties", "dependencies", "dependentSchemas"}
+
+var grammarRuleNameRe = regexp.MustCompile(`[^a-zA-Z0-9-]+`)
+
+// JSONSchemaToGrammar converts a JSON Schema to a GBNF grammar constraining generation to json
+// matching it. Objects, arrays, enums, const, anyOf/oneOf alternatives and the primitive types are
+// supported; keywords such as $ref and pattern return an error. Length and range constraints like
+// minLength or maximum aren't enforced.
+func JSONSchemaToGrammar(schema []byte) (string, error) {
+	c := grammarConverter{rules: map[string]string{"space": `" "?`}}
+	root, err := c.visit(schema, "root")
+	if err != nil {
+		return "", fmt.Errorf("json schema: %w", err)
+	}
+
+	if root != "root" {
+		c.rules["root"] = root
+	}
+
+	names := make([]string, 0, len(c.rules))
+	for name := range c.rules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&sb, "%s ::= %s\n", name, c.rules[name])
+	}
+
+	return sb.String(), nil
+}
+
+// responseGrammar returns the grammar constraining a prediction's output, if any. A response
+// schema is more specific than the json format, so it's used when both are set.
+func responseGrammar(opts api.Options) (string, error) {
+	switch opts.Format {
+	case "", "json":
+	default:
+		return "", fmt.Errorf("unknown format %q, must be json", opts.Format)
+	}
+
+	if len(opts.ResponseSchema) > 0 {
+		return JSONSchemaToGrammar(opts.ResponseSchema)
+	}
+
+	if opts.Format == "json" {
+		return JSONSchemaToGrammar([]byte(`{"type": "object"}`))
+	}
+
+	return "", nil
+}
+
+type grammarConverter struct {
+	rules map[string]string
+}
+
+// addRule adds rule under name, suffixing the name if a different rule already has it, and
+// returns the name it was added as
+func (c *grammarConverter) addRule(name, rule string) string {
+	name = grammarRuleNameRe.ReplaceAllString(name, "-")
+	key := name
+	for i := 0; ; i++ {
+		if existing, ok := c.rules[key]; !ok || existing == rule {
+			break
+		}
+
+		key = name + strconv.Itoa(i)
+	}
+
+	c.rules[key] = rule
+	return key
+}
+
+// addPrimitive adds a json primitive rule and the rules it depends on
+func (c *grammarConverter) addPrimitive(name string) string {
+	if _, ok := c.rules[name]; ok {
+		// value, object and array refer to each other
+		return name
+	}
+
+	c.rules[name] = grammarPrimitives[name]
+	for _, dep := range grammarPrimitiveDeps[name] {
+		c.addPrimitive(dep)
+	}
+
+	return name
+}
+
+// visit adds the rules for schema and returns the name of the rule matching it
+func (c *grammarConverter) visit(schema []byte, name string) (string, error) {
+	var s map[string]json.RawMessage
+	if err := json.Unmarshal(schema, &s); err != nil {
+		return "", fmt.Errorf("%s: %w", name, err)
+	}
+
+	for _, keyword := range unsupportedSchemaKeywords {
+		if _, ok := s[keyword]; ok {
+			return "", fmt.Errorf("%s: %s is not supported", name, keyword)
+		}
+	}
+
+	if alternatives, ok := s["oneOf"]; ok {
+		return c.visitAlternatives(alternatives, name)
+	}
+
+	if alternatives, ok := s["anyOf"]; ok {
+		return c.visitAlternatives(alternatives, name)
+	}
+
+	if value, ok := s["const"]; ok {
+		literal, err := grammarLiteral(value)
+		if err != nil {
+			return "", fmt.Errorf("%s: const: %w", name, err)
+		}
+
+		return c.addRule(name, literal+" space"), nil
+	}
+
+	if enum, ok := s["enum"]; ok {
+		var values []json.RawMessage
+		if err := json.Unmarshal(enum, &values); err != nil {
+			return "", fmt.Errorf("%s: enum: %w", name, err)
+		}
+
+		literals := make([]string, len(values))
+		for i, value := range values {
+			literal, err := grammarLiteral(value)
+			if err != nil {
+				return "", fmt.Errorf("%s: enum: %w", name, err)
+			}
+
+			literals[i] = literal
+		}
+
+		return c.addRule(name, "("+strings.Join(literals, " | ")+") space"), nil
+	}
+
+	var types []string
+	if t, ok := s["type"]; ok {
+		var single string
+		if err := json.Unmarshal(t, &single); err == nil {
+			types = []string{single}
+		} else if err := json.Unmarshal(t, &types); err != nil {
+			return "", fmt.Errorf("%s: type must be a string or an array of strings", name)
+		}
+	}
+
+	if len(types) > 1 {
+		refs := make([]string, len(types))
+		for i, t := range types {
+			typed := make(map[string]json.RawMessage, len(s))
+			for k, v := range s {
+				typed[k] = v
+			}
+			typed["type"], _ = json.Marshal(t)
+
+			data, _ := json.Marshal(typed)
+			ref, err := c.visit(data, name+"-"+t)
+			if err != nil {
+				return "", err
+			}
+
+			refs[i] = ref
+		}
+
+		return c.addRule(name, strings.Join(refs, " | ")), nil
+	}
+
+	var t string
+	if len(types) == 1 {
+		t = types[0]
+	}
+
+	switch t {
+	case "object":
+		if _, ok := s["properties"]; ok {
+			return c.visitObject(s, name)
+		}
+
+		return c.addPrimitive("object"), nil
+	case "array":
+		if items, ok := s["items"]; ok {
+			item, err := c.visit(items, name+"-item")
+			if err != nil {
+				return "", err
+			}
+
+			return c.addRule(name, fmt.Sprintf(`"[" space ( %[1]s ("," space %[1]s)* )? "]" space`, item)), nil
+		}
+
+		return c.addPrimitive("array"), nil
+	case "string", "number", "integer", "boolean", "null":
+		return c.addPrimitive(t), nil
+	case "":
+		// no type accepts any value
+		return c.addPrimitive("value"), nil
+	default:
+		return "", fmt.Errorf("%s: unknown type %q", name, t)
+	}
+}
+
+func (c *grammarConverter) visitAlternatives(data json.RawMessage, name string) (string, error) {
+	var alternatives []json.RawMessage
+	if err := json.Unmarshal(data, &alternatives); err != nil {
+		return "", fmt.Errorf("%s: %w", name, err)
+	}
+
+	refs := make([]string, len(alternatives))
+	for i, alternative := range alternatives {
+		ref, err := c.visit(alternative, fmt.Sprintf("%s-%d", name, i))
+		if err != nil {
+			return "", err
+		}
+
+		refs[i] = ref
+	}
+
+	return c.addRule(name, strings.Join(refs, " | ")), nil
+}
+
+// visitObject adds the rule for an object with properties. Properties are generated in the order
+// the schema lists them, required ones first, and each optional property may be left out.
+func (c *grammarConverter) visitObject(s map[string]json.RawMessage, name string) (string, error) {
+	keys, props, err := orderedProperties(s["properties"])
+	if err != nil {
+		return "", fmt.Errorf("%s: properties: %w", name, err)
+	}
+
+	var required []string
+	if r, ok := s["required"]; ok {
+		if err := json.Unmarshal(r, &required); err != nil {
+			return "", fmt.Errorf("%s: required: %w", name, err)
+		}
+	}
+
+	isRequired := make(map[string]bool, len(required))
+	for _, k := range required {
+		if _, ok := props[k]; !ok {
+			return "", fmt.Errorf("%s: required property %q is not defined", name, k)
+		}
+
+		isRequired[k] = true
+	}
+
+	kvRules := make(map[string]string, len(keys))
+	var requiredKeys, optionalKeys []string
+	for _, k := range keys {
+		value, err := c.visit(props[k], name+"-"+k)
+		if err != nil {
+			return "", err
+		}
+
+		kname, err := grammarLiteralOf(k)
+		if err != nil {
+			return "", err
+		}
+
+		kvRules[k] = c.addRule(name+"-"+k+"-kv", fmt.Sprintf(`%s space ":" space %s`, kname, value))
+		if isRequired[k] {
+			requiredKeys = append(requiredKeys, k)
+		} else {
+			optionalKeys = append(optionalKeys, k)
+		}
+	}
+
+	// optionalRefs matches the properties in keys in order, each of them optional except the
+	// first when it isn't preceded by a comma
+	var optionalRefs func(keys []string, leadingComma bool) string
+	optionalRefs = func(keys []string, leadingComma bool) string {
+		ref := kvRules[keys[0]]
+		if leadingComma {
+			ref = fmt.Sprintf(`( "," space %s )?`, ref)
+		}
+
+		if len(keys) > 1 {
+			ref += " " + c.addRule(name+"-"+keys[0]+"-rest", optionalRefs(keys[1:], true))
+		}
+
+		return ref
+	}
+
+	var sb strings.Builder
+	sb.WriteString(`"{" space`)
+	for i, k := range requiredKeys {
+		if i > 0 {
+			sb.WriteString(` "," space`)
+		}
+
+		sb.WriteString(" " + kvRules[k])
+	}
+
+	if len(optionalKeys) > 0 {
+		sb.WriteString(" (")
+		if len(requiredKeys) > 0 {
+			sb.WriteString(` "," space (`)
+		}
+
+		alternatives := make([]string, len(optionalKeys))
+		for i := range optionalKeys {
+			alternatives[i] = optionalRefs(optionalKeys[i:], false)
+		}
+
+		sb.WriteString(" " + strings.Join(alternatives, " | "))
+		if len(requiredKeys) > 0 {
+			sb.WriteString(" )")
+		}
+
+		sb.WriteString(" )?")
+	}
+
+	sb.WriteString(` "}" space`)
+	return c.addRule(name, sb.String()), nil
+}
+
+// orderedProperties decodes a properties object keeping the order its keys are written in, which
+// a map would lose
+func orderedProperties(data json.RawMessage) ([]string, map[string]json.RawMessage, error) {
+	d := json.NewDecoder(bytes.NewReader(data))
+	if t, err := d.Token(); err != nil || t != json.Delim('{') {
+		return nil, nil, fmt.Errorf("must be an object")
+	}
+
+	var keys []string
+	props := make(map[string]json.RawMessage)
+	for d.More() {
+		t, err := d.Token()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		key := t.(string)
+		var value json.RawMessage
+		if err := d.Decode(&value); err != nil {
+			return nil, nil, err
+		}
+
+		if _, ok := props[key]; !ok {
+			keys = append(keys, key)
+		}
+		props[key] = value
+	}
+
+	return keys, props, nil
+}
+
+// grammarLiteral returns a GBNF string literal matching the json encoding of value
+func grammarLiteral(value json.RawMessage) (string, error) {
+	var v any
+	if err := json.Unmarshal(value, &v); err != nil {
+		return "", err
+	}
+
+	return grammarLiteralOf(v)
+}
+
+// grammarLiteralOf returns a GBNF string literal matching the compact json encoding of v
+func grammarLiteralOf(v any) (string, error) {
+	// the model writes <, > and & as they are, not escaped the way encoding/json does by default
+	var b bytes.Buffer
+	e := json.NewEncoder(&b)
+	e.SetEscapeHTML(false)
+	if err := e.Encode(v); err != nil {
+		return "", err
+	}
+
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`)
+	return `"` + r.Replace(strings.TrimSuffix(b.String(), "\n")) + `"`, nil
+}
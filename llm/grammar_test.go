@@ -0,0 +1,184 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+func TestJSONSchemaToGrammar(t *testing.T) {
+	schema := `{
+		"type": "object",
+		"properties": {
+			"name": {"type": "string"},
+			"age": {"type": "integer"},
+			"color": {"enum": ["red", "green"]},
+			"tags": {"type": "array", "items": {"type": "string"}}
+		},
+		"required": ["name", "age"]
+	}`
+
+	want := `integer ::= ("-"? ([0-9] | [1-9] [0-9]*)) space
+root ::= "{" space root-name-kv "," space root-age-kv ( "," space ( root-color-kv root-color-rest | root-tags-kv ) )? "}" space
+root-age-kv ::= "\"age\"" space ":" space integer
+root-color ::= ("\"red\"" | "\"green\"") space
+root-color-kv ::= "\"color\"" space ":" space root-color
+root-color-rest ::= ( "," space root-tags-kv )?
+root-name-kv ::= "\"name\"" space ":" space string
+root-tags ::= "[" space ( string ("," space string)* )? "]" space
+root-tags-kv ::= "\"tags\"" space ":" space root-tags
+space ::= " "?
+string ::= "\"" ([^"\\] | "\\" (["\\/bfnrt] | "u" [0-9a-fA-F] [0-9a-fA-F] [0-9a-fA-F] [0-9a-fA-F]))* "\"" space
+`
+
+	got, err := JSONSchemaToGrammar([]byte(schema))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got != want {
+		t.Errorf("got grammar\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestJSONSchemaToGrammarRoot(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema string
+		want   string
+	}{
+		{"primitive", `{"type": "boolean"}`, `root ::= boolean`},
+		{"nullable", `{"type": ["string", "null"]}`, `root ::= string | null`},
+		{"any", `{}`, `root ::= value`},
+		{"one of", `{"oneOf": [{"type": "number"}, {"const": 1}]}`, `root ::= number | root-1`},
+		{"const escaping", `{"const": "say \"hi\" <b>"}`, `root ::= "\"say \\\"hi\\\" <b>\"" space`},
+		{"all optional", `{"type": "object", "properties": {"a": {"type": "string"}, "b": {"type": "number"}}}`, `root ::= "{" space ( root-a-kv root-a-rest | root-b-kv )? "}" space`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := JSONSchemaToGrammar([]byte(tt.schema))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !strings.Contains(got, tt.want+"\n") {
+				t.Errorf("got grammar\n%s\nwant it to contain %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJSONSchemaToGrammarUnsupported(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema string
+		want   string
+	}{
+		{"ref", `{"$ref": "#/definitions/thing"}`, "$ref is not supported"},
+		{"nested ref", `{"type": "object", "properties": {"a": {"$ref": "#/a"}}}`, "root-a: $ref is not supported"},
+		{"pattern", `{"type": "string", "pattern": "^a+$"}`, "pattern is not supported"},
+		{"unknown type", `{"type": "date"}`, `unknown type "date"`},
+		{"undefined required", `{"type": "object", "properties": {}, "required": ["a"]}`, `required property "a" is not defined`},
+		{"not json", `{"type": `, "unexpected end of JSON input"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := JSONSchemaToGrammar([]byte(tt.schema))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got error %v, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestPredictResponseSchema(t *testing.T) {
+	var got PredictRequest
+	mux := http.NewServeMux()
+	mux.Handle("/tokenize", completionHandler())
+	mux.HandleFunc("/completion", func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&got)
+		writeEvents(w, Prediction{Content: `{"ok": true}`}, Prediction{Stop: true})
+	})
+
+	llm := newTestLlama(t, mux)
+
+	var opts api.Options
+	if err := opts.FromMap(map[string]interface{}{
+		"response_schema": map[string]interface{}{
+			"type":       "object",
+			"properties": map[string]interface{}{"ok": map[string]interface{}{"type": "boolean"}},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	llm.ResponseSchema = opts.ResponseSchema
+
+	if err := llm.Predict(context.Background(), nil, "is it ok?", func(api.GenerateResponse) {}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(got.Grammar, `root-ok-kv ::= "\"ok\"" space ":" space boolean`) {
+		t.Errorf("got grammar %q", got.Grammar)
+	}
+}
+
+func TestPredictFormat(t *testing.T) {
+	tests := []struct {
+		name        string
+		format      string
+		schema      string
+		wantGrammar string
+		wantErr     bool
+	}{
+		{"unset", "", "", "", false},
+		{"json", "json", "", "root ::= object\n", false},
+		{"schema takes precedence", "json", `{"type": "boolean"}`, "root ::= boolean\n", false},
+		{"unknown", "yaml", "", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got map[string]any
+			mux := http.NewServeMux()
+			mux.Handle("/tokenize", completionHandler())
+			mux.HandleFunc("/completion", func(w http.ResponseWriter, r *http.Request) {
+				json.NewDecoder(r.Body).Decode(&got)
+				writeEvents(w, Prediction{Content: "{}"}, Prediction{Stop: true})
+			})
+
+			llm := newTestLlama(t, mux)
+			llm.Format = tt.format
+			if tt.schema != "" {
+				llm.ResponseSchema = json.RawMessage(tt.schema)
+			}
+
+			err := llm.Predict(context.Background(), nil, "give me json", func(api.GenerateResponse) {})
+			if tt.wantErr {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			grammar, ok := got["grammar"].(string)
+			if tt.wantGrammar == "" {
+				if ok {
+					t.Errorf("got grammar %q, want none", grammar)
+				}
+				return
+			}
+
+			if !strings.Contains(grammar, tt.wantGrammar) {
+				t.Errorf("got grammar %q, want it to contain %q", grammar, tt.wantGrammar)
+			}
+		})
+	}
+}
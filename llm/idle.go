@@ -0,0 +1,108 @@
+package llm
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+var errIdleUnloaded = fmt.Errorf("model was unloaded after being idle: %w", ErrServerClosed)
+
+// activity tracks in-flight requests so an idle model can be unloaded without interrupting one
+type activity struct {
+	mu       sync.Mutex
+	inflight int
+	lastUsed time.Time
+	unloaded bool
+	closed   bool
+}
+
+// begin marks the start of a request, failing if the model has already been unloaded or closed
+func (a *activity) begin() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.unloaded {
+		return errIdleUnloaded
+	}
+
+	if a.closed {
+		return ErrServerClosed
+	}
+
+	a.inflight++
+	return nil
+}
+
+// end marks the end of a request started with begin
+func (a *activity) end() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.inflight--
+	a.lastUsed = time.Now()
+}
+
+// unloadIfIdle marks the model unloaded if no request is in flight and none finished within d
+func (a *activity) unloadIfIdle(d time.Duration) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.unloaded || a.inflight > 0 || time.Since(a.lastUsed) < d {
+		return false
+	}
+
+	a.unloaded = true
+	return true
+}
+
+// close makes later requests fail with ErrServerClosed
+func (a *activity) close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.closed = true
+}
+
+func (a *activity) isUnloaded() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.unloaded
+}
+
+// StartIdleReaper closes the model once it has not been used for d. Requests that arrive after the
+// model is unloaded fail instead of waiting on a stopped server, and the reaper never closes the
+// model while a request is in flight. The caller is expected to load the model again on demand. A
+// d of 0 or less keeps the model loaded.
+func (llm *llama) StartIdleReaper(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+
+	llm.activity.mu.Lock()
+	if llm.activity.lastUsed.IsZero() {
+		llm.activity.lastUsed = time.Now()
+	}
+	llm.activity.mu.Unlock()
+
+	go func() {
+		interval := d / 4
+		if interval <= 0 {
+			interval = d
+		}
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if llm.activity.isUnloaded() {
+				return
+			}
+
+			if llm.activity.unloadIfIdle(d) {
+				logInfof("unloading model after %s idle", d)
+				llm.Close()
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,121 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+// startTestProcess gives llm a long running subprocess to close
+func startTestProcess(t *testing.T, llm *llama) {
+	t.Helper()
+
+	sleep, err := exec.LookPath("sleep")
+	if err != nil {
+		t.Skip("sleep is not available")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	llm.Cmd = exec.CommandContext(ctx, sleep, "60")
+	llm.Cancel = cancel
+	if err := llm.Cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	go llm.Cmd.Wait()
+}
+
+func TestIdleReaper(t *testing.T) {
+	llm := newTestLlama(t, completionHandler(Prediction{Content: "hi"}, Prediction{Stop: true}))
+	startTestProcess(t, llm)
+
+	if err := llm.Predict(context.Background(), nil, "hello", func(api.GenerateResponse) {}); err != nil {
+		t.Fatal(err)
+	}
+
+	llm.StartIdleReaper(50 * time.Millisecond)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !llm.activity.isUnloaded() {
+		if time.Now().After(deadline) {
+			t.Fatal("model was not unloaded after being idle")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	err := llm.Predict(context.Background(), nil, "hello", func(api.GenerateResponse) {})
+	if !errors.Is(err, errIdleUnloaded) {
+		t.Errorf("got error %v, want %v", err, errIdleUnloaded)
+	}
+}
+
+func TestIdleReaperDuration(t *testing.T) {
+	tests := []struct {
+		name       string
+		d          time.Duration
+		wantUnload bool
+	}{
+		{"zero keeps loaded", 0, false},
+		{"negative keeps loaded", -time.Second, false},
+		{"nanosecond", time.Nanosecond, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			llm := newTestLlama(t, completionHandler())
+			startTestProcess(t, llm)
+
+			llm.StartIdleReaper(tt.d)
+
+			deadline := time.Now().Add(200 * time.Millisecond)
+			for !llm.activity.isUnloaded() && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			if got := llm.activity.isUnloaded(); got != tt.wantUnload {
+				t.Errorf("got unloaded %v, want %v", got, tt.wantUnload)
+			}
+		})
+	}
+}
+
+func TestIdleReaperWaitsForInflight(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/tokenize", completionHandler())
+	mux.HandleFunc("/completion", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		writeEvents(w, Prediction{Content: "hi"}, Prediction{Stop: true})
+	})
+
+	llm := newTestLlama(t, mux)
+	startTestProcess(t, llm)
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- llm.Predict(context.Background(), nil, "hello", func(api.GenerateResponse) {})
+	}()
+
+	// start reaping only once the request is in flight
+	for {
+		llm.activity.mu.Lock()
+		inflight := llm.activity.inflight
+		llm.activity.mu.Unlock()
+		if inflight > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	llm.StartIdleReaper(20 * time.Millisecond)
+
+	if err := <-errCh; err != nil {
+		t.Fatalf("request was interrupted by the idle reaper: %v", err)
+	}
+}
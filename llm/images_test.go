@@ -0,0 +1,95 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+func TestImagePrompt(t *testing.T) {
+	tests := []struct {
+		name   string
+		prompt string
+		images int
+		want   string
+	}{
+		{"no images", "describe this", 0, "describe this"},
+		{"unreferenced", "describe this", 2, "[img-0][img-1]describe this"},
+		{"referenced", "compare [img-1] to [img-0]", 2, "compare [img-1] to [img-0]"},
+		{"partly referenced", "what is in [img-1]?", 2, "[img-0]what is in [img-1]?"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			images := make([][]byte, tt.images)
+			for i := range images {
+				images[i] = []byte{byte(i)}
+			}
+
+			got, data := imagePrompt(tt.prompt, images)
+			if got != tt.want {
+				t.Errorf("got prompt %q, want %q", got, tt.want)
+			}
+
+			if len(data) != tt.images {
+				t.Errorf("got %d images, want %d", len(data), tt.images)
+			}
+		})
+	}
+}
+
+func TestPredictWithImages(t *testing.T) {
+	var got PredictRequest
+	mux := http.NewServeMux()
+	mux.Handle("/tokenize", completionHandler())
+	mux.HandleFunc("/completion", func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&got)
+		writeEvents(w, Prediction{Content: "a cat"}, Prediction{Stop: true})
+	})
+
+	llm := newTestLlama(t, mux)
+
+	image := []byte("\x89PNG")
+	err := llm.PredictWithImages(context.Background(), nil, "what is this?", [][]byte{image}, func(api.GenerateResponse) {})
+	if err == nil {
+		t.Fatal("expected an error without a projector")
+	}
+
+	llm.MMProjPath = "mmproj.bin"
+	if err := llm.PredictWithImages(context.Background(), nil, "what is this?", [][]byte{image}, func(api.GenerateResponse) {}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got.Prompt != "[img-0]what is this?" {
+		t.Errorf("got prompt %q", got.Prompt)
+	}
+
+	want := []ImageData{{Data: "iVBORw==", ID: 0}}
+	if !reflect.DeepEqual(got.ImageData, want) {
+		t.Errorf("got image data %v, want %v", got.ImageData, want)
+	}
+}
+
+func TestMMProj(t *testing.T) {
+	opts := api.DefaultOptions()
+	opts.MMProjPath = "mmproj.bin"
+
+	params, err := runnerParams("model.bin", nil, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, _ := flagValue(params, "--mmproj"); got != "mmproj.bin" {
+		t.Errorf("got --mmproj %q, want mmproj.bin", got)
+	}
+
+	opts.MMProjPath = filepath.Join(t.TempDir(), "missing.bin")
+	if _, err := newLlama(writeGGJT(t, 32, llamaFileTypeQ4_0), nil, ModelRunner{Path: writeGGJT(t, 32, llamaFileTypeQ4_0)}, opts); err == nil {
+		t.Error("expected an error for a missing projector")
+	}
+}
@@ -3,8 +3,8 @@ package llm
 import (
 	"context"
 	"fmt"
-	"log"
 	"os"
+	"runtime"
 
 	"github.com/pbnjay/memory"
 
@@ -16,13 +16,14 @@ type LLM interface {
 	Embedding(context.Context, string) ([]float64, error)
 	Encode(context.Context, string) ([]int, error)
 	Decode(context.Context, []int) (string, error)
-	SetOptions(api.Options)
+	SetOptions(api.Options) error
 	Close()
 	Ping(context.Context) error
+	Port() int
 }
 
 func New(model string, adapters []string, opts api.Options) (LLM, error) {
-	if _, err := os.Stat(model); err != nil {
+	if err := statModel(model); err != nil {
 		return nil, err
 	}
 
@@ -42,11 +43,17 @@ func New(model string, adapters []string, opts api.Options) (LLM, error) {
 		if opts.NumGPU != 0 {
 			// F32, F16, Q5_0, Q5_1, and Q8_0 do not support Metal API and will
 			// cause the runner to segmentation fault so disable GPU
-			log.Printf("WARNING: GPU disabled for F32, Q5_0, Q5_1, and Q8_0")
+			logWarnf("GPU disabled for F32, Q5_0, Q5_1, and Q8_0")
 			opts.NumGPU = 0
 		}
 	}
 
+	if opts.NumGPU != 0 && missingCUDAGPU(runtime.GOOS) {
+		// the cpu runner is used, so check the model fits in system memory instead
+		logInfof("no nvidia gpu detected, running on the cpu")
+		opts.NumGPU = 0
+	}
+
 	totalResidentMemory := memory.TotalMemory()
 	switch ggml.ModelType() {
 	case ModelType3B, ModelType7B:
@@ -77,7 +84,12 @@ func New(model string, adapters []string, opts api.Options) (LLM, error) {
 
 	switch ggml.ModelFamily() {
 	case ModelFamilyLlama:
-		return newLlama(model, adapters, ggmlRunner(), opts)
+		runner, err := defaultRunner()
+		if err != nil {
+			return nil, err
+		}
+
+		return newLlama(model, adapters, runner, opts)
 	default:
 		return nil, fmt.Errorf("unknown ggml type: %s", ggml.ModelFamily())
 	}
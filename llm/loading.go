@@ -0,0 +1,168 @@
+package llm
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/jmorganca/ollama/version"
+)
+
+// httpClient returns the client for requests to the server, which has its own connection pool so
+// Close can release it
+func (llm *llama) httpClient() *http.Client {
+	if llm.client != nil {
+		return llm.client
+	}
+
+	return http.DefaultClient
+}
+
+// MaxResponseSize caps the size of a response body read from the server, so a broken server can't
+// exhaust memory. Streamed completions are read line by line instead.
+var MaxResponseSize int64 = 8 << 20
+
+// readBody reads a response body, returning ErrResponseTooLarge if it's larger than
+// MaxResponseSize
+func readBody(r io.Reader) ([]byte, error) {
+	body, err := io.ReadAll(io.LimitReader(r, MaxResponseSize+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(body)) > MaxResponseSize {
+		return nil, fmt.Errorf("%w: more than %d bytes", ErrResponseTooLarge, MaxResponseSize)
+	}
+
+	return body, nil
+}
+
+// userAgent identifies this process in the server's logs, in the same format as the api client
+var userAgent = fmt.Sprintf("ollama/%s (%s %s) Go/%s", version.Version, runtime.GOARCH, runtime.GOOS, runtime.Version())
+
+type requestIDKey struct{}
+
+// WithRequestID returns a copy of ctx that sends id in the X-Request-ID header of the requests
+// made to the server with it, to find a request in the server's logs when several components
+// share the server
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// setHeaders adds the user agent and the request id from req's context to req
+func setHeaders(req *http.Request) {
+	req.Header.Set("User-Agent", userAgent)
+	if id, ok := req.Context().Value(requestIDKey{}).(string); ok && id != "" {
+		req.Header.Set("X-Request-ID", id)
+	}
+}
+
+// doRequest sends req to the server. The server can still answer 503 "loading model" right after
+// it first responded to a ping, so that status is retried by the model's request retry policy
+// until ctx is done or the attempts run out. Any other response, including other 503s, is returned
+// as it is.
+func (llm *llama) doRequest(ctx context.Context, req *http.Request) (*http.Response, error) {
+	setHeaders(req)
+	retry := requestRetryPolicy(llm.Options)
+	for try := 1; ; try++ {
+		resp, err := llm.httpClient().Do(req)
+		if err != nil || resp.StatusCode != http.StatusServiceUnavailable || try >= retry.MaxAttempts {
+			return resp, err
+		}
+
+		if req.Body != nil && req.GetBody == nil {
+			// the body was consumed and can't be sent again
+			return resp, nil
+		}
+
+		body, err := readBody(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		if !bytes.Contains(bytes.ToLower(body), []byte("loading")) {
+			resp.Body = io.NopCloser(bytes.NewReader(body))
+			return resp, nil
+		}
+
+		t := time.NewTimer(retry.Delay(try))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil, ctx.Err()
+		case <-t.C:
+		}
+
+		if req.GetBody != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// readyTimeout bounds how long the first request after a load waits for the server to answer
+// pings, and readyPollInterval is how often it pings; tests shorten them
+var (
+	readyTimeout      = 30 * time.Second
+	readyPollInterval = 100 * time.Millisecond
+)
+
+// readyGate holds the first requests after a load until the server answers a ping, then lets every
+// request through without checking again. The zero value is open.
+type readyGate struct {
+	mu      sync.Mutex
+	pending bool
+}
+
+// reset closes the gate so the next request waits for the server again
+func (g *readyGate) reset() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.pending = true
+}
+
+// waitReady blocks until the server answers a ping if it hasn't since the model was loaded. Only
+// one request pings at a time, the others wait for its result.
+func (llm *llama) waitReady(ctx context.Context) error {
+	llm.ready.mu.Lock()
+	defer llm.ready.mu.Unlock()
+
+	if !llm.ready.pending {
+		return nil
+	}
+
+	// pings share the deadline, so a server that accepts connections but hangs can't hold the
+	// request past it
+	readyCtx, cancel := context.WithTimeout(ctx, readyTimeout)
+	defer cancel()
+
+	for {
+		err := llm.Ping(readyCtx)
+		if err == nil {
+			llm.ready.pending = false
+			return nil
+		} else if errors.Is(err, ErrServerClosed) {
+			return err
+		}
+
+		t := time.NewTimer(readyPollInterval)
+		select {
+		case <-readyCtx.Done():
+			t.Stop()
+			if ctx.Err() != nil {
+				return fmt.Errorf("waiting for the server to be ready: %w: %w", ErrContextCanceled, ctx.Err())
+			}
+
+			return fmt.Errorf("%w: not ready after %s: %w", ErrServerUnavailable, readyTimeout, err)
+		case <-t.C:
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+func TestRetryWhileLoading(t *testing.T) {
+	defer func(orig RetryPolicy) { LoadingRetry = orig }(LoadingRetry)
+	LoadingRetry.BaseDelay = time.Millisecond
+
+	loading := `{"error":{"code":503,"message":"Loading model","type":"unavailable_error"}}`
+
+	tests := []struct {
+		name      string
+		failures  int
+		body      string
+		wantCalls int
+		wantErr   error
+	}{
+		{"ready", 0, loading, 1, nil},
+		{"loading once", 1, loading, 2, nil},
+		{"old server status", 1, `{"status": "loading model"}`, 2, nil},
+		{"still loading", LoadingRetry.MaxAttempts + 4, loading, LoadingRetry.MaxAttempts, ErrServerError},
+		{"unavailable", 1, "slots busy", 1, ErrServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int
+			mux := http.NewServeMux()
+			mux.HandleFunc("/tokenize", func(w http.ResponseWriter, r *http.Request) {
+				calls++
+
+				var req TokenizeRequest
+				if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Content != "hello" {
+					t.Errorf("got request %+v, error %v", req, err)
+				}
+
+				if calls <= tt.failures {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					w.Write([]byte(tt.body))
+					return
+				}
+
+				json.NewEncoder(w).Encode(TokenizeResponse{Tokens: []int{1}})
+			})
+
+			llm := newTestLlama(t, mux)
+			_, err := llm.Encode(context.Background(), "hello")
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("got error %v, want %v", err, tt.wantErr)
+			}
+
+			if calls != tt.wantCalls {
+				t.Errorf("got %d requests, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestRetryWhileLoadingDeadline(t *testing.T) {
+	var calls int
+	llm := newTestLlama(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(`{"status": "loading model"}`))
+	}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), LoadingRetry.BaseDelay/4)
+	defer cancel()
+
+	if _, err := llm.Embedding(ctx, "hello"); !errors.Is(err, ErrContextCanceled) {
+		t.Errorf("got error %v, want %v", err, ErrContextCanceled)
+	}
+
+	if calls != 1 {
+		t.Errorf("got %d requests, want 1", calls)
+	}
+}
+
+func TestWaitReady(t *testing.T) {
+	defer func(orig time.Duration) { readyPollInterval = orig }(readyPollInterval)
+	readyPollInterval = time.Millisecond
+
+	var pings, embeddings int
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		pings++
+		if pings < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+	mux.HandleFunc("/embedding", func(w http.ResponseWriter, r *http.Request) {
+		if pings < 3 {
+			t.Error("embedding requested before the server was ready")
+		}
+
+		embeddings++
+		json.NewEncoder(w).Encode(EmbeddingResponse{Embedding: []float64{0.1}})
+	})
+
+	llm := newTestLlama(t, mux)
+	llm.ready.reset()
+
+	for i := 0; i < 3; i++ {
+		if _, err := llm.Embedding(context.Background(), "hello"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if pings != 3 {
+		t.Errorf("got %d pings, want 3", pings)
+	}
+
+	if embeddings != 3 {
+		t.Errorf("got %d embedding requests, want 3", embeddings)
+	}
+
+	// a reload waits again
+	llm.ready.reset()
+	if _, err := llm.Embedding(context.Background(), "hello"); err != nil {
+		t.Fatal(err)
+	}
+
+	if pings != 4 {
+		t.Errorf("got %d pings after reset, want 4", pings)
+	}
+}
+
+func TestWaitReadyTimeout(t *testing.T) {
+	defer func(interval, timeout time.Duration) {
+		readyPollInterval, readyTimeout = interval, timeout
+	}(readyPollInterval, readyTimeout)
+	readyPollInterval, readyTimeout = time.Millisecond, 20*time.Millisecond
+
+	llm := newTestLlama(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead {
+			t.Errorf("unexpected request to %s", r.URL.Path)
+		}
+
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	llm.ready.reset()
+
+	if _, err := llm.Embedding(context.Background(), "hello"); !errors.Is(err, ErrServerUnavailable) {
+		t.Errorf("got error %v, want %v", err, ErrServerUnavailable)
+	}
+}
+
+func TestWaitReadyHung(t *testing.T) {
+	defer func(interval, timeout time.Duration) {
+		readyPollInterval, readyTimeout = interval, timeout
+	}(readyPollInterval, readyTimeout)
+	readyPollInterval, readyTimeout = time.Millisecond, 50*time.Millisecond
+
+	// accepts the ping but never answers it
+	llm := newTestLlama(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	llm.ready.reset()
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := llm.Embedding(context.Background(), "hello")
+		errc <- err
+	}()
+
+	select {
+	case err := <-errc:
+		if !errors.Is(err, ErrServerUnavailable) {
+			t.Errorf("got error %v, want %v", err, ErrServerUnavailable)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiting for a hung server overshot the ready timeout")
+	}
+}
+
+func TestResponseTooLarge(t *testing.T) {
+	defer func(orig int64) { MaxResponseSize = orig }(MaxResponseSize)
+	MaxResponseSize = 1024
+
+	tests := []struct {
+		name    string
+		dim     int
+		wantErr error
+	}{
+		{"within limit", 10, nil},
+		{"oversized", 1000, ErrResponseTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			llm := newTestLlama(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				json.NewEncoder(w).Encode(EmbeddingResponse{Embedding: make([]float64, tt.dim)})
+			}))
+
+			embedding, err := llm.Embedding(context.Background(), "hello")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+
+			if err == nil && len(embedding) != tt.dim {
+				t.Errorf("got %d dimensions, want %d", len(embedding), tt.dim)
+			}
+		})
+	}
+}
+
+func TestRequestHeaders(t *testing.T) {
+	tests := []struct {
+		name string
+		id   string
+	}{
+		{"request id", "req-42"},
+		{"no request id", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			headers := make(map[string]http.Header)
+			handler := completionHandler(Prediction{Content: "hi"}, Prediction{Stop: true})
+			llm := newTestLlama(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				headers[r.URL.Path] = r.Header.Clone()
+				mu.Unlock()
+				handler.ServeHTTP(w, r)
+			}))
+
+			ctx := context.Background()
+			if tt.id != "" {
+				ctx = WithRequestID(ctx, tt.id)
+			}
+
+			if err := llm.Predict(ctx, nil, "hello", func(api.GenerateResponse) {}); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, path := range []string{"/completion", "/tokenize"} {
+				h, ok := headers[path]
+				if !ok {
+					t.Fatalf("no request to %s", path)
+				}
+
+				if ua := h.Get("User-Agent"); !strings.HasPrefix(ua, "ollama/") {
+					t.Errorf("%s: got user agent %q", path, ua)
+				}
+
+				if id := h.Get("X-Request-ID"); id != tt.id {
+					t.Errorf("%s: got request id %q, want %q", path, id, tt.id)
+				}
+			}
+		})
+	}
+}
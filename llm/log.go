@@ -0,0 +1,60 @@
+package llm
+
+import (
+	"log"
+	"os"
+	"sync"
+)
+
+// Logger receives the package's log messages, so an application embedding it can filter them or
+// send them to its own logging
+type Logger interface {
+	Debugf(format string, v ...any)
+	Infof(format string, v ...any)
+	Warnf(format string, v ...any)
+	Errorf(format string, v ...any)
+}
+
+var (
+	loggerMu sync.RWMutex
+	logger   Logger = stdLogger{}
+)
+
+// SetLogger replaces the logger, which defaults to the standard library's logger. Debug messages
+// go to the default logger only when OLLAMA_DEBUG is set.
+func SetLogger(l Logger) {
+	loggerMu.Lock()
+	defer loggerMu.Unlock()
+
+	if l == nil {
+		l = stdLogger{}
+	}
+
+	logger = l
+}
+
+func getLogger() Logger {
+	loggerMu.RLock()
+	defer loggerMu.RUnlock()
+	return logger
+}
+
+func logDebugf(format string, v ...any) { getLogger().Debugf(format, v...) }
+func logInfof(format string, v ...any)  { getLogger().Infof(format, v...) }
+func logWarnf(format string, v ...any)  { getLogger().Warnf(format, v...) }
+func logErrorf(format string, v ...any) { getLogger().Errorf(format, v...) }
+
+// stdLogger writes to the standard library's logger
+type stdLogger struct{}
+
+func (stdLogger) Debugf(format string, v ...any) {
+	if os.Getenv("OLLAMA_DEBUG") != "" {
+		log.Printf(format, v...)
+	}
+}
+
+func (stdLogger) Infof(format string, v ...any) { log.Printf(format, v...) }
+
+func (stdLogger) Warnf(format string, v ...any) { log.Printf("warning: "+format, v...) }
+
+func (stdLogger) Errorf(format string, v ...any) { log.Printf(format, v...) }
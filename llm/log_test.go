@@ -0,0 +1,73 @@
+package llm
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+type recordingLogger struct {
+	messages []string
+}
+
+func (l *recordingLogger) record(level, format string, v ...any) {
+	l.messages = append(l.messages, level+" "+fmt.Sprintf(format, v...))
+}
+
+func (l *recordingLogger) Debugf(format string, v ...any) { l.record("debug", format, v...) }
+func (l *recordingLogger) Infof(format string, v ...any)  { l.record("info", format, v...) }
+func (l *recordingLogger) Warnf(format string, v ...any)  { l.record("warn", format, v...) }
+func (l *recordingLogger) Errorf(format string, v ...any) { l.record("error", format, v...) }
+
+func TestSetLogger(t *testing.T) {
+	var rec recordingLogger
+	SetLogger(&rec)
+	defer SetLogger(nil)
+
+	opts := api.DefaultOptions()
+	opts.NumCtx = 8192
+	if _, err := checkContextLength(opts, 4096); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "warn num_ctx 8192 exceeds the model's trained context length 4096, using 4096"
+	if len(rec.messages) != 1 || rec.messages[0] != want {
+		t.Errorf("got messages %q, want %q", rec.messages, want)
+	}
+}
+
+func TestStdLogger(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	defer func(flags int) { log.SetFlags(flags) }(log.Flags())
+	log.SetFlags(0)
+
+	tests := []struct {
+		name  string
+		debug string
+		want  string
+	}{
+		{"default", "", "starting\nwarning: slow\n"},
+		{"debug", "1", "waiting\nstarting\nwarning: slow\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("OLLAMA_DEBUG", tt.debug)
+			buf.Reset()
+
+			logDebugf("waiting")
+			logInfof("starting")
+			logWarnf("slow")
+
+			if got := buf.String(); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
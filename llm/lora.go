@@ -0,0 +1,222 @@
+package llm
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// loraAdapter is the header of a ggla file written by llama.cpp's convert-lora-to-ggml.py
+type loraAdapter struct {
+	rank    uint32
+	alpha   uint32
+	tensors []loraTensor
+}
+
+type loraTensor struct {
+	name string
+	// dims are in ggml order, the reverse of the pytorch shape
+	dims []uint32
+}
+
+// loraTensorFileTypes are the tensor data types the converter writes, and their size in bytes
+var loraTensorFileTypes = map[uint32]int64{0: 4, 1: 2}
+
+const loraMaxName = 1024
+
+// decodeLoRA reads the header and tensor descriptions of a ggla file, skipping the tensor data
+func decodeLoRA(r io.ReadSeeker) (*loraAdapter, error) {
+	var header struct {
+		Magic, Version, Rank, Alpha uint32
+	}
+
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return nil, fmt.Errorf("read header: %w", err)
+	}
+
+	if header.Magic != FILE_MAGIC_GGLA {
+		return nil, fmt.Errorf("not a ggla lora adapter, magic %#x", header.Magic)
+	}
+
+	if header.Version != 1 {
+		return nil, fmt.Errorf("unsupported ggla version %d", header.Version)
+	}
+
+	adapter := loraAdapter{rank: header.Rank, alpha: header.Alpha}
+	for {
+		var th struct {
+			NumDims, NameLen, FileType uint32
+		}
+
+		if err := binary.Read(r, binary.LittleEndian, &th); errors.Is(err, io.EOF) {
+			return &adapter, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("read tensor header: %w", err)
+		}
+
+		size, ok := loraTensorFileTypes[th.FileType]
+		if th.NumDims == 0 || th.NumDims > 4 || th.NameLen > loraMaxName || !ok {
+			return nil, fmt.Errorf("invalid tensor header %+v", th)
+		}
+
+		t := loraTensor{dims: make([]uint32, th.NumDims)}
+		if err := binary.Read(r, binary.LittleEndian, t.dims); err != nil {
+			return nil, fmt.Errorf("read tensor dims: %w", err)
+		}
+
+		name := make([]byte, th.NameLen)
+		if _, err := io.ReadFull(r, name); err != nil {
+			return nil, fmt.Errorf("read tensor name: %w", err)
+		}
+		t.name = string(name)
+
+		for _, d := range t.dims {
+			size *= int64(d)
+		}
+
+		// tensor data starts at the next multiple of 32 bytes
+		offset, err := r.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := r.Seek((offset+31)&^31+size, io.SeekStart); err != nil {
+			return nil, err
+		}
+
+		adapter.tensors = append(adapter.tensors, t)
+	}
+}
+
+var loraLayerRe = regexp.MustCompile(`^(?:layers|blk)\.(\d+)\.`)
+
+// checkAdapter makes sure adapter is a lora adapter that fits base, the server crashes on ones
+// that don't
+func checkAdapter(adapter string, base *GGML) error {
+	info, err := os.Stat(adapter)
+	if err != nil {
+		return fmt.Errorf("lora adapter: %w", err)
+	}
+
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("lora adapter %s is not a file", adapter)
+	}
+
+	f, err := os.Open(adapter)
+	if err != nil {
+		return fmt.Errorf("lora adapter: %w", err)
+	}
+	defer f.Close()
+
+	lora, err := decodeLoRA(f)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %w", ErrIncompatibleAdapter, adapter, err)
+	}
+
+	numLayer, numEmbd := modelNumLayer(base), base.NumEmbd()
+	for _, t := range lora.tensors {
+		if m := loraLayerRe.FindStringSubmatch(t.name); m != nil && numLayer > 0 {
+			if layer, _ := strconv.ParseUint(m[1], 10, 32); uint32(layer) >= numLayer {
+				return fmt.Errorf("%w: %s: tensor %s is for layer %d, but the model has %d layers", ErrIncompatibleAdapter, adapter, t.name, layer, numLayer)
+			}
+		}
+
+		// the A matrices of the attention projections take the embedding as input
+		if strings.Contains(t.name, ".attention.") && strings.HasSuffix(t.name, ".loraA") && numEmbd > 0 && t.dims[0] != numEmbd {
+			return fmt.Errorf("%w: %s: tensor %s has input size %d, but the model's embedding size is %d", ErrIncompatibleAdapter, adapter, t.name, t.dims[0], numEmbd)
+		}
+	}
+
+	return nil
+}
+
+// modelNumLayer returns the number of layers in the model, or 0 if it's unknown. ModelType can't
+// be used as it guesses 7B for unusual layer counts.
+func modelNumLayer(ggml *GGML) uint32 {
+	switch m := ggml.model.(type) {
+	case *llamaModel:
+		return m.hyperparameters.NumLayer
+	case *ggufModel:
+		return m.uint32(m.architecture() + ".block_count")
+	default:
+		return 0
+	}
+}
+
+// loraAdapterResponse is an entry of the server's /lora-adapters list, the adapters it was started
+// with
+type loraAdapterResponse struct {
+	ID    int     `json:"id"`
+	Path  string  `json:"path"`
+	Scale float32 `json:"scale"`
+}
+
+type loraScale struct {
+	ID    int     `json:"id"`
+	Scale float32 `json:"scale"`
+}
+
+// SetAdapter switches to the lora adapter at path, applied with scale, and stops applying any other
+// adapter, without reloading the model. The server can only switch between the adapters it was
+// started with, so path must be one of the model's adapters; switching to another file needs a
+// reload. Servers built without runtime lora support return ErrAdapterSwapUnsupported.
+func (llm *llama) SetAdapter(ctx context.Context, path string, scale float32) error {
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("lora adapter: %w", err)
+	}
+
+	return llm.applyAdapter(ctx, path, scale)
+}
+
+// ClearAdapters stops applying the model's lora adapters, leaving the base model, without
+// reloading it. Servers built without runtime lora support return ErrAdapterSwapUnsupported.
+func (llm *llama) ClearAdapters(ctx context.Context) error {
+	return llm.applyAdapter(ctx, "", 0)
+}
+
+// applyAdapter sets the scale of the server's adapter loaded from path and zeroes the others, or
+// all of them when path is empty
+func (llm *llama) applyAdapter(ctx context.Context, path string, scale float32) error {
+	if err := llm.activity.begin(); err != nil {
+		return err
+	}
+	defer llm.activity.end()
+
+	if err := llm.waitReady(ctx); err != nil {
+		return err
+	}
+
+	var adapters []loraAdapterResponse
+	if err := llm.getJSON(ctx, "/lora-adapters", &adapters); err != nil {
+		var serr *ServerError
+		if errors.As(err, &serr) && (serr.StatusCode == http.StatusNotFound || serr.StatusCode == http.StatusNotImplemented) {
+			return ErrAdapterSwapUnsupported
+		}
+
+		return err
+	}
+
+	scales := make([]loraScale, len(adapters))
+	var found bool
+	for i, a := range adapters {
+		scales[i] = loraScale{ID: a.ID}
+		if path != "" && filepath.Clean(a.Path) == filepath.Clean(path) {
+			scales[i].Scale = scale
+			found = true
+		}
+	}
+
+	if path != "" && !found {
+		return fmt.Errorf("lora adapter %s wasn't loaded with the model, reload the model with it", path)
+	}
+
+	return llm.postJSON(ctx, "/lora-adapters", scales)
+}
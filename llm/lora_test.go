@@ -0,0 +1,212 @@
+package llm
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+// writeGGLA writes a lora adapter with f32 tensors of the given names and ggml order dims
+func writeGGLA(t *testing.T, rank uint32, tensors ...loraTensor) string {
+	t.Helper()
+
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, []uint32{FILE_MAGIC_GGLA, 1, rank, rank * 2})
+	for _, tensor := range tensors {
+		binary.Write(&b, binary.LittleEndian, []uint32{uint32(len(tensor.dims)), uint32(len(tensor.name)), 0})
+		binary.Write(&b, binary.LittleEndian, tensor.dims)
+		b.WriteString(tensor.name)
+		b.Write(make([]byte, (b.Len()+31)&^31-b.Len()))
+
+		size := 4
+		for _, d := range tensor.dims {
+			size *= int(d)
+		}
+		b.Write(make([]byte, size))
+	}
+
+	p := filepath.Join(t.TempDir(), "adapter.bin")
+	if err := os.WriteFile(p, b.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	return p
+}
+
+func TestDecodeLoRA(t *testing.T) {
+	f, err := os.Open(writeGGLA(t, 8,
+		loraTensor{"layers.0.attention.wq.weight.loraA", []uint32{64, 8}},
+		loraTensor{"layers.0.attention.wq.weight.loraB", []uint32{8, 64}},
+		loraTensor{"layers.1.attention.wv.weight.loraA", []uint32{64, 8}},
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	lora, err := decodeLoRA(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if lora.rank != 8 || lora.alpha != 16 {
+		t.Errorf("got rank %d alpha %d, want 8 and 16", lora.rank, lora.alpha)
+	}
+
+	if len(lora.tensors) != 3 || lora.tensors[2].name != "layers.1.attention.wv.weight.loraA" {
+		t.Errorf("got tensors %+v", lora.tensors)
+	}
+}
+
+func TestCheckAdapter(t *testing.T) {
+	f, err := os.Open(writeGGJT(t, 32, llamaFileTypeQ4_0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	base, err := DecodeGGML(f, ModelFamilyLlama)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		adapter string
+		want    error
+	}{
+		{"compatible", writeGGLA(t, 8,
+			loraTensor{"layers.31.attention.wq.weight.loraA", []uint32{4096, 8}},
+			loraTensor{"layers.31.attention.wq.weight.loraB", []uint32{8, 4096}},
+			loraTensor{"layers.31.feed_forward.w2.weight.loraA", []uint32{11008, 8}},
+		), nil},
+		{"missing", filepath.Join(t.TempDir(), "missing.bin"), fs.ErrNotExist},
+		{"a model", writeGGJT(t, 32, llamaFileTypeQ4_0), ErrIncompatibleAdapter},
+		{"too many layers", writeGGLA(t, 8,
+			loraTensor{"layers.39.attention.wq.weight.loraA", []uint32{4096, 8}},
+		), ErrIncompatibleAdapter},
+		{"embedding size", writeGGLA(t, 8,
+			loraTensor{"layers.0.attention.wq.weight.loraA", []uint32{5120, 8}},
+		), ErrIncompatibleAdapter},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkAdapter(tt.adapter, base); !errors.Is(err, tt.want) {
+				t.Errorf("got error %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewLlamaIncompatibleAdapter(t *testing.T) {
+	runner := filepath.Join(t.TempDir(), "server")
+	if err := os.WriteFile(runner, []byte("#!/bin/sh\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	adapter := writeGGLA(t, 8, loraTensor{"layers.0.attention.wq.weight.loraA", []uint32{5120, 8}})
+	_, err := newLlama(writeGGJT(t, 32, llamaFileTypeQ4_0), []string{adapter}, ModelRunner{Path: runner}, api.DefaultOptions())
+	if !errors.Is(err, ErrIncompatibleAdapter) {
+		t.Errorf("got error %v, want %v", err, ErrIncompatibleAdapter)
+	}
+}
+
+func TestSetAdapter(t *testing.T) {
+	persona := writeGGLA(t, 8, loraTensor{name: "layers.0.attention.wq.weight.loraA", dims: []uint32{4096, 8}})
+	task := writeGGLA(t, 8, loraTensor{name: "layers.0.attention.wq.weight.loraA", dims: []uint32{4096, 8}})
+	other := writeGGLA(t, 8, loraTensor{name: "layers.0.attention.wq.weight.loraA", dims: []uint32{4096, 8}})
+
+	tests := []struct {
+		name    string
+		apply   func(*llama) error
+		want    []loraScale
+		wantErr error
+	}{
+		{
+			name:  "switch adapter",
+			apply: func(llm *llama) error { return llm.SetAdapter(context.Background(), task, 0.5) },
+			want:  []loraScale{{ID: 0}, {ID: 1, Scale: 0.5}},
+		},
+		{
+			name:  "clear",
+			apply: func(llm *llama) error { return llm.ClearAdapters(context.Background()) },
+			want:  []loraScale{{ID: 0}, {ID: 1}},
+		},
+		{
+			name:    "not loaded with the model",
+			apply:   func(llm *llama) error { return llm.SetAdapter(context.Background(), other, 1) },
+			wantErr: errors.New("wasn't loaded"),
+		},
+		{
+			name: "missing file",
+			apply: func(llm *llama) error {
+				return llm.SetAdapter(context.Background(), filepath.Join(t.TempDir(), "missing.bin"), 1)
+			},
+			wantErr: fs.ErrNotExist,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []loraScale
+			llm := newTestLlama(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/lora-adapters" {
+					http.NotFound(w, r)
+					return
+				}
+
+				if r.Method == http.MethodPost {
+					if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+						t.Error(err)
+					}
+					return
+				}
+
+				json.NewEncoder(w).Encode([]loraAdapterResponse{{ID: 0, Path: persona, Scale: 1}, {ID: 1, Path: task}})
+			}))
+
+			err := tt.apply(llm)
+			if tt.wantErr != nil {
+				if err == nil || (!errors.Is(err, tt.wantErr) && !strings.Contains(err.Error(), tt.wantErr.Error())) {
+					t.Fatalf("got error %v, want %v", err, tt.wantErr)
+				}
+
+				if got != nil {
+					t.Errorf("scales were changed to %v", got)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got scales %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetAdapterUnsupported(t *testing.T) {
+	adapter := writeGGLA(t, 8, loraTensor{name: "layers.0.attention.wq.weight.loraA", dims: []uint32{4096, 8}})
+	llm := newTestLlama(t, http.NotFoundHandler())
+
+	if err := llm.SetAdapter(context.Background(), adapter, 1); !errors.Is(err, ErrAdapterSwapUnsupported) {
+		t.Errorf("got error %v, want %v", err, ErrAdapterSwapUnsupported)
+	}
+
+	if err := llm.ClearAdapters(context.Background()); !errors.Is(err, ErrAdapterSwapUnsupported) {
+		t.Errorf("got error %v, want %v", err, ErrAdapterSwapUnsupported)
+	}
+}
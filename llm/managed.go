@@ -0,0 +1,235 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+// ManagedRunner serves a single model, loading it on the first request and unloading it once it
+// has been idle, then loading it again on the next request. Callers use it like a loaded model
+// and never see the unloads; requests that arrive while the model is loading wait for that one
+// load rather than starting their own.
+type ManagedRunner struct {
+	model    string
+	adapters []string
+	idle     time.Duration
+
+	// load loads the model with opts, it's a field so tests can fake loading
+	load func(opts api.Options) (*llama, error)
+
+	mu      sync.Mutex
+	opts    api.Options
+	llm     *llama
+	loading *managedLoad
+	closed  bool
+}
+
+// managedLoad is a load in progress, done is closed once llm or err is set
+type managedLoad struct {
+	done chan struct{}
+	llm  *llama
+	err  error
+}
+
+// NewManagedRunner returns a runner for model that unloads it after it's been idle for idle, or
+// keeps it loaded once it is when idle is 0. Nothing is loaded until the first request.
+func NewManagedRunner(model string, adapters []string, opts api.Options, idle time.Duration) *ManagedRunner {
+	return &ManagedRunner{
+		model:    model,
+		adapters: adapters,
+		idle:     idle,
+		opts:     opts,
+		load: func(opts api.Options) (*llama, error) {
+			loaded, err := New(model, adapters, opts)
+			if err != nil {
+				return nil, err
+			}
+
+			llm, ok := loaded.(*llama)
+			if !ok {
+				loaded.Close()
+				return nil, fmt.Errorf("unsupported model %s", model)
+			}
+
+			return llm, nil
+		},
+	}
+}
+
+// current returns the loaded model, loading it first if it isn't
+func (m *ManagedRunner) current(ctx context.Context) (*llama, error) {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil, ErrServerClosed
+	}
+
+	if m.llm != nil && !m.llm.activity.isUnloaded() && !m.llm.IsClosed() {
+		llm := m.llm
+		m.mu.Unlock()
+		return llm, nil
+	}
+
+	load := m.loading
+	if load == nil {
+		load = &managedLoad{done: make(chan struct{})}
+		m.loading = load
+		m.llm = nil
+
+		// the load is shared by every request waiting on it, so one giving up doesn't cancel it
+		go m.finishLoad(load, m.opts)
+	}
+	m.mu.Unlock()
+
+	select {
+	case <-load.done:
+		return load.llm, load.err
+	case <-ctx.Done():
+		return nil, fmt.Errorf("loading %s: %w: %w", m.model, ErrContextCanceled, ctx.Err())
+	}
+}
+
+// finishLoad loads the model for load and makes it the current one
+func (m *ManagedRunner) finishLoad(load *managedLoad, opts api.Options) {
+	start := time.Now()
+	llm, err := m.load(opts)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.loading = nil
+	switch {
+	case err != nil:
+		load.err = fmt.Errorf("loading %s: %w", m.model, err)
+	case m.closed:
+		llm.Close()
+		load.err = ErrServerClosed
+	default:
+		logInfof("loaded %s in %s", m.model, time.Since(start).Round(time.Millisecond))
+		m.llm, load.llm = llm, llm
+		if m.idle > 0 {
+			llm.StartIdleReaper(m.idle)
+		}
+	}
+
+	close(load.done)
+}
+
+// do runs fn with the loaded model. The idle reaper can unload the model between it being looked
+// up and fn starting its request, which then fails without doing anything, so fn is retried on a
+// fresh load.
+func (m *ManagedRunner) do(ctx context.Context, fn func(*llama) error) error {
+	for {
+		llm, err := m.current(ctx)
+		if err != nil {
+			return err
+		}
+
+		if err := fn(llm); !errors.Is(err, errIdleUnloaded) {
+			return err
+		}
+	}
+}
+
+func (m *ManagedRunner) Predict(ctx context.Context, prevContext []int, prompt string, fn func(api.GenerateResponse)) error {
+	return m.do(ctx, func(llm *llama) error {
+		return llm.Predict(ctx, prevContext, prompt, fn)
+	})
+}
+
+func (m *ManagedRunner) Embedding(ctx context.Context, input string) (embedding []float64, err error) {
+	err = m.do(ctx, func(llm *llama) error {
+		embedding, err = llm.Embedding(ctx, input)
+		return err
+	})
+
+	return embedding, err
+}
+
+func (m *ManagedRunner) Encode(ctx context.Context, prompt string) (tokens []int, err error) {
+	err = m.do(ctx, func(llm *llama) error {
+		tokens, err = llm.Encode(ctx, prompt)
+		return err
+	})
+
+	return tokens, err
+}
+
+func (m *ManagedRunner) Decode(ctx context.Context, tokens []int) (text string, err error) {
+	err = m.do(ctx, func(llm *llama) error {
+		text, err = llm.Decode(ctx, tokens)
+		return err
+	})
+
+	return text, err
+}
+
+// Ping checks the model's server is responding, loading the model if it isn't loaded
+func (m *ManagedRunner) Ping(ctx context.Context) error {
+	return m.do(ctx, func(llm *llama) error {
+		if llm.activity.isUnloaded() {
+			return errIdleUnloaded
+		}
+
+		return llm.Ping(ctx)
+	})
+}
+
+// SetOptions sets the options for later requests and loads. Like for a loaded model it returns
+// ErrReloadRequired when launch options changed; they take effect the next time the model is
+// loaded, which Unload brings forward.
+func (m *ManagedRunner) SetOptions(opts api.Options) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.opts = opts
+	if m.llm == nil || m.llm.activity.isUnloaded() {
+		return nil
+	}
+
+	return m.llm.SetOptions(opts)
+}
+
+// Port returns the port of the loaded model's server, or 0 when the model isn't loaded
+func (m *ManagedRunner) Port() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.llm == nil || m.llm.activity.isUnloaded() {
+		return 0
+	}
+
+	return m.llm.Port()
+}
+
+// Loaded reports whether the model is currently loaded
+func (m *ManagedRunner) Loaded() bool {
+	return m.Port() != 0
+}
+
+// Unload closes the loaded model, ending requests in flight, and the next request loads it again
+func (m *ManagedRunner) Unload() {
+	m.mu.Lock()
+	llm := m.llm
+	m.llm = nil
+	m.mu.Unlock()
+
+	if llm != nil {
+		llm.Close()
+	}
+}
+
+// Close unloads the model, and a load in progress once it finishes. Requests after Close fail
+// with ErrServerClosed.
+func (m *ManagedRunner) Close() {
+	m.mu.Lock()
+	m.closed = true
+	m.mu.Unlock()
+
+	m.Unload()
+}
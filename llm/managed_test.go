@@ -0,0 +1,131 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+// newTestManagedRunner returns a runner whose loads are test servers, counting them in loads
+func newTestManagedRunner(t *testing.T, idle time.Duration, loads *int, loadErr error) *ManagedRunner {
+	m := NewManagedRunner("model.bin", nil, api.DefaultOptions(), idle)
+
+	var mu sync.Mutex
+	m.load = func(opts api.Options) (*llama, error) {
+		mu.Lock()
+		*loads++
+		mu.Unlock()
+
+		// slow enough for concurrent requests to pile up behind the load
+		time.Sleep(20 * time.Millisecond)
+		if loadErr != nil {
+			return nil, loadErr
+		}
+
+		llm := newTestLlama(t, completionHandler(Prediction{Content: "hi"}, Prediction{Stop: true}))
+		llm.Options = opts
+		startTestProcess(t, llm)
+		return llm, nil
+	}
+
+	t.Cleanup(m.Close)
+	return m
+}
+
+func TestManagedRunnerCoalescesLoads(t *testing.T) {
+	var loads int
+	m := newTestManagedRunner(t, 0, &loads, nil)
+
+	if m.Loaded() {
+		t.Fatal("model loaded before the first request")
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := m.Predict(context.Background(), nil, "hello", func(api.GenerateResponse) {}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if loads != 1 {
+		t.Errorf("got %d loads, want 1", loads)
+	}
+
+	if !m.Loaded() {
+		t.Error("model isn't loaded after a request")
+	}
+}
+
+func TestManagedRunnerReloadsAfterIdle(t *testing.T) {
+	var loads int
+	m := newTestManagedRunner(t, 50*time.Millisecond, &loads, nil)
+
+	if _, err := m.Encode(context.Background(), "hello there"); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for m.Loaded() {
+		if time.Now().After(deadline) {
+			t.Fatal("model was not unloaded after being idle")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	tokens, err := m.Encode(context.Background(), "hello there")
+	if err != nil {
+		t.Fatalf("request after the idle unload: %v", err)
+	}
+
+	if len(tokens) != 2 {
+		t.Errorf("got tokens %v", tokens)
+	}
+
+	if loads != 2 {
+		t.Errorf("got %d loads, want 2", loads)
+	}
+}
+
+func TestManagedRunnerLoadError(t *testing.T) {
+	var loads int
+	errLoad := errors.New("out of memory")
+	m := newTestManagedRunner(t, 0, &loads, errLoad)
+
+	for i := 1; i <= 2; i++ {
+		// a failed load isn't remembered, the next request tries again
+		if _, err := m.Embedding(context.Background(), "hello"); !errors.Is(err, errLoad) {
+			t.Errorf("got error %v, want %v", err, errLoad)
+		}
+
+		if loads != i {
+			t.Errorf("got %d loads, want %d", loads, i)
+		}
+	}
+}
+
+func TestManagedRunnerClose(t *testing.T) {
+	var loads int
+	m := newTestManagedRunner(t, 0, &loads, nil)
+
+	if _, err := m.Encode(context.Background(), "hello"); err != nil {
+		t.Fatal(err)
+	}
+
+	m.Close()
+	if err := m.Predict(context.Background(), nil, "hello", func(api.GenerateResponse) {}); !errors.Is(err, ErrServerClosed) {
+		t.Errorf("got error %v, want %v", err, ErrServerClosed)
+	}
+
+	if loads != 1 {
+		t.Errorf("got %d loads, want 1", loads)
+	}
+}
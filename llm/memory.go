@@ -0,0 +1,251 @@
+package llm
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+// procMeminfo is read for the memory available to new processes on Linux
+var procMeminfo = "/proc/meminfo"
+
+// memAvailable returns the MemAvailable estimate from /proc/meminfo in bytes, or false where it
+// can't be read
+func memAvailable() (uint64, bool) {
+	f, err := os.Open(procMeminfo)
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// e.g. "MemAvailable:   12345678 kB"
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 || fields[0] != "MemAvailable:" || fields[2] != "kB" {
+			continue
+		}
+
+		kb, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return 0, false
+		}
+
+		return kb * 1024, true
+	}
+
+	return 0, false
+}
+
+// modelTypeParams are the approximate parameter counts of each model size
+var modelTypeParams = map[ModelType]float64{
+	ModelType3B:  3.4e9,
+	ModelType7B:  6.7e9,
+	ModelType13B: 13e9,
+	ModelType30B: 32.5e9,
+	ModelType34B: 33.7e9,
+	ModelType65B: 65.2e9,
+}
+
+// fileTypeBits are the average bits per weight of each quantization, including block scales
+var fileTypeBits = map[string]float64{
+	"F32":      32,
+	"F16":      16,
+	"Q4_0":     4.5,
+	"Q4_1":     5,
+	"Q4_1_F16": 5,
+	"Q8_0":     8.5,
+	"Q5_0":     5.5,
+	"Q5_1":     6,
+	"Q2_K":     2.63,
+	"Q3_K_S":   3.44,
+	"Q3_K_M":   3.91,
+	"Q3_K_L":   4.27,
+	"Q4_K_S":   4.5,
+	"Q4_K_M":   4.83,
+	"Q5_K_S":   5.5,
+	"Q5_K_M":   5.67,
+	"Q6_K":     6.56,
+}
+
+// estimateModelMemory returns the approximate size of the model weights in bytes, or 0 if the
+// size or quantization is unknown
+func estimateModelMemory(modelType ModelType, fileType FileType) uint64 {
+	params, ok := modelTypeParams[modelType]
+	if !ok {
+		return 0
+	}
+
+	bits, ok := fileTypeBits[fileType.String()]
+	if !ok {
+		return 0
+	}
+
+	return uint64(params * bits / 8)
+}
+
+// checkAvailableMemory returns ErrInsufficientMemory when a model that runs entirely on the cpu
+// needs more memory than the system has available, which would otherwise get the server killed
+// by the OOM killer part way through loading
+func checkAvailableMemory(ggml *GGML, opts api.Options) error {
+	if opts.NumGPU != 0 || opts.SkipMemoryCheck {
+		return nil
+	}
+
+	available, ok := memAvailable()
+	if !ok {
+		return nil
+	}
+
+	required := estimateModelMemory(ggml.ModelType(), ggml.FileType())
+	if required > available {
+		return fmt.Errorf("%w: %s %s model needs about %.1f GiB, %.1f GiB available (set skip_memory_check to load it anyway)",
+			ErrInsufficientMemory, ggml.ModelType(), ggml.FileType(), float64(required)/(1<<30), float64(available)/(1<<30))
+	}
+
+	return nil
+}
+
+// MemoryEstimate breaks down the memory a loaded model needs, in bytes
+type MemoryEstimate struct {
+	Weights uint64 // the model's tensors, about the size of its file
+	KVCache uint64 // keys and values for num_ctx tokens in each of the num_parallel slots
+	Total   uint64
+
+	// GPU is the part of Total offloaded with num_gpu layers and CPU the part left in system memory
+	GPU uint64
+	CPU uint64
+}
+
+// EstimateMemory estimates the memory model needs when loaded with opts from its file size and
+// the dimensions in its header, without loading it, for placing models before loading them. It
+// leaves out the server's compute buffers, which grow with num_batch and are usually a few hundred
+// MiB.
+func EstimateMemory(model string, opts api.Options) (MemoryEstimate, error) {
+	if err := statModel(model); err != nil {
+		return MemoryEstimate{}, err
+	}
+
+	f, err := os.Open(model)
+	if err != nil {
+		return MemoryEstimate{}, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return MemoryEstimate{}, err
+	}
+
+	ggml, err := DecodeGGML(f, ModelFamilyLlama)
+	if err != nil {
+		return MemoryEstimate{}, err
+	}
+
+	return estimateMemory(ggml, uint64(fi.Size()), opts)
+}
+
+// estimateMemory estimates the memory of a model with the decoded header ggml and a file of size
+// bytes
+func estimateMemory(ggml *GGML, size uint64, opts api.Options) (MemoryEstimate, error) {
+	// the context is capped at the trained length when loading, so estimate the same
+	var err error
+	if opts, err = checkContextLength(opts, modelContextLength(ggml)); err != nil {
+		return MemoryEstimate{}, err
+	}
+
+	numLayer, embdKV := attentionDims(ggml, opts)
+
+	numCtx := uint64(opts.NumCtx)
+	if opts.NumParallel > 1 {
+		numCtx *= uint64(opts.NumParallel)
+	}
+
+	k, v := kvCacheBytes(opts)
+	est := MemoryEstimate{
+		Weights: size,
+		KVCache: uint64(float64(numLayer*numCtx*embdKV) * (k + v)),
+	}
+	est.Total = est.Weights + est.KVCache
+
+	if numLayer > 0 && opts.NumGPU > 0 {
+		offloaded := uint64(opts.NumGPU)
+		if offloaded > numLayer {
+			offloaded = numLayer
+		}
+
+		est.GPU = est.Weights * offloaded / numLayer
+		if opts.KVOffload {
+			est.GPU += est.KVCache * offloaded / numLayer
+		}
+	}
+	est.CPU = est.Total - est.GPU
+
+	return est, nil
+}
+
+// attentionDims returns the number of layers and the width of the keys, or values, a layer caches
+// for each token. Models with grouped-query attention cache fewer heads than they attend with. gguf
+// files record their kv heads, ggjt ones rely on num_gqa; only the ggjt case is reached for models
+// that load, as the bundled llama.cpp can't load gguf.
+func attentionDims(ggml *GGML, opts api.Options) (numLayer, embdKV uint64) {
+	switch m := ggml.model.(type) {
+	case *ggufModel:
+		arch := m.architecture()
+		numLayer = uint64(m.uint32(arch + ".block_count"))
+		embd := uint64(m.uint32(arch + ".embedding_length"))
+		heads := uint64(m.uint32(arch + ".attention.head_count"))
+		headsKV := uint64(m.uint32(arch + ".attention.head_count_kv"))
+		if heads == 0 {
+			return numLayer, embd
+		} else if headsKV == 0 {
+			headsKV = heads
+		}
+
+		return numLayer, embd / heads * headsKV
+	case *llamaModel:
+		// ggjt files don't record the kv heads, they're set with num_gqa
+		embdKV = uint64(m.hyperparameters.NumEmbd)
+		if opts.NumGQA > 1 {
+			embdKV /= uint64(opts.NumGQA)
+		}
+
+		return uint64(m.hyperparameters.NumLayer), embdKV
+	default:
+		return 0, 0
+	}
+}
+
+// cacheTypeBytes are the bytes per cached element of each kv cache type, including block scales
+var cacheTypeBytes = map[string]float64{
+	"f32":  4,
+	"f16":  2,
+	"q8_0": 34.0 / 32,
+	"q4_0": 18.0 / 32,
+	"q4_1": 20.0 / 32,
+	"q5_0": 22.0 / 32,
+	"q5_1": 24.0 / 32,
+}
+
+// kvCacheBytes returns the bytes per cached key and value element with the cache types in opts,
+// which the server defaults to f16
+func kvCacheBytes(opts api.Options) (k, v float64) {
+	if opts.CacheTypeK == "" && opts.CacheTypeV == "" && !opts.F16KV {
+		return 4, 4
+	}
+
+	k, v = 2, 2
+	if b, ok := cacheTypeBytes[opts.CacheTypeK]; ok {
+		k = b
+	}
+
+	if b, ok := cacheTypeBytes[opts.CacheTypeV]; ok {
+		v = b
+	}
+
+	return k, v
+}
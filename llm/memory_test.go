@@ -0,0 +1,180 @@
+package llm
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+const testMeminfo = `MemTotal:       16303424 kB
+MemFree:          734112 kB
+MemAvailable:    4194304 kB
+Buffers:          412128 kB
+Cached:          3954004 kB
+`
+
+func mockMeminfo(t *testing.T, content string) {
+	t.Helper()
+
+	p := filepath.Join(t.TempDir(), "meminfo")
+	if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	orig := procMeminfo
+	t.Cleanup(func() { procMeminfo = orig })
+	procMeminfo = p
+}
+
+func TestMemAvailable(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    uint64
+		wantOK  bool
+	}{
+		{"available", testMeminfo, 4 << 30, true},
+		{"missing", "MemTotal:       16303424 kB\n", 0, false},
+		{"malformed", "MemAvailable:    lots kB\n", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockMeminfo(t, tt.content)
+
+			got, ok := memAvailable()
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("got %d, %v, want %d, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestEstimateModelMemory(t *testing.T) {
+	// a 7B Q4_0 model file is about 3.8GB
+	if got := estimateModelMemory(ModelType7B, llamaFileTypeQ4_0); got < 3.5e9 || got > 4e9 {
+		t.Errorf("got %d bytes for 7B Q4_0", got)
+	}
+
+	if got := estimateModelMemory(ModelType(0), llamaFileTypeQ4_0); got != 0 {
+		t.Errorf("got %d bytes for an unknown model type", got)
+	}
+}
+
+func TestInsufficientMemory(t *testing.T) {
+	mockMeminfo(t, testMeminfo)
+
+	// 13B at Q4_0 needs about 7GB
+	model := writeGGJT(t, 40, llamaFileTypeQ4_0)
+
+	tests := []struct {
+		name    string
+		numGPU  int
+		skip    bool
+		wantErr bool
+	}{
+		{"cpu only", 0, false, true},
+		{"skip check", 0, true, false},
+		{"gpu offload", 1, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := api.DefaultOptions()
+			opts.NumGPU = tt.numGPU
+			opts.SkipMemoryCheck = tt.skip
+
+			_, err := newLlama(model, nil, ModelRunner{Path: "/does/not/exist"}, opts)
+			if got := errors.Is(err, ErrInsufficientMemory); got != tt.wantErr {
+				t.Errorf("got error %v, want insufficient memory %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestEstimateMemory(t *testing.T) {
+	const mib = 1 << 20
+
+	tests := []struct {
+		name   string
+		model  func(t *testing.T) string
+		opts   func(*api.Options)
+		wantKV uint64
+	}{
+		// kv cache sizes llama.cpp reports when loading these models
+		{"llama2 7b", func(t *testing.T) string { return writeGGUF(t, 2, ggufLlama2...) }, func(o *api.Options) { o.NumCtx = 4096 }, 2048 * mib},
+		{"mistral 7b gqa", func(t *testing.T) string { return writeGGUF(t, 3, ggufMistral...) }, func(o *api.Options) { o.NumCtx = 8192 }, 1024 * mib},
+		{"falcon 7b", func(t *testing.T) string { return writeGGUF(t, 2, ggufFalcon...) }, func(o *api.Options) { o.NumCtx = 2048 }, 16 * mib},
+		{"capped at trained context", func(t *testing.T) string { return writeGGUF(t, 2, ggufLlama2...) }, func(o *api.Options) { o.NumCtx = 8192 }, 2048 * mib},
+		{"parallel slots", func(t *testing.T) string { return writeGGUF(t, 2, ggufLlama2...) }, func(o *api.Options) { o.NumCtx = 2048; o.NumParallel = 2 }, 2048 * mib},
+		{"f32 cache", func(t *testing.T) string { return writeGGUF(t, 2, ggufLlama2...) }, func(o *api.Options) { o.NumCtx = 2048; o.F16KV = false }, 2048 * mib},
+		{"q8_0 cache", func(t *testing.T) string { return writeGGUF(t, 2, ggufLlama2...) }, func(o *api.Options) { o.NumCtx = 4096; o.CacheTypeK = "q8_0"; o.CacheTypeV = "q8_0" }, 1088 * mib},
+		{"ggjt llama 7b", func(t *testing.T) string { return writeGGJT(t, 32, llamaFileTypeQ4_0) }, func(o *api.Options) { o.NumCtx = 2048 }, 1024 * mib},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			model := tt.model(t)
+			opts := api.DefaultOptions()
+			opts.NumGPU = 0
+			tt.opts(&opts)
+
+			got, err := EstimateMemory(model, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			fi, err := os.Stat(model)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := MemoryEstimate{
+				Weights: uint64(fi.Size()),
+				KVCache: tt.wantKV,
+				Total:   uint64(fi.Size()) + tt.wantKV,
+				CPU:     uint64(fi.Size()) + tt.wantKV,
+			}
+			if got != want {
+				t.Errorf("got %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestEstimateMemoryOffload(t *testing.T) {
+	model := writeGGUF(t, 2, ggufLlama2...)
+	opts := api.DefaultOptions()
+	opts.NumCtx = 4096
+
+	tests := []struct {
+		numGPU    int
+		kvOffload bool
+		offloaded uint64 // layers, the count is capped at the model's 32
+		wantKV    uint64
+	}{
+		{0, true, 0, 0},
+		{16, true, 16, 1 << 30},
+		{16, false, 16, 0},
+		{99, true, 32, 2 << 30},
+	}
+
+	for _, tt := range tests {
+		opts.NumGPU = tt.numGPU
+		opts.KVOffload = tt.kvOffload
+
+		got, err := EstimateMemory(model, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the header-only file's weights are a few bytes, so only the kv cache is compared
+		wantGPU := tt.wantKV + got.Weights*tt.offloaded/32
+		if got.GPU != wantGPU || got.GPU+got.CPU != got.Total {
+			t.Errorf("num_gpu %d kv_offload %v: got gpu %d cpu %d, want gpu %d", tt.numGPU, tt.kvOffload, got.GPU, got.CPU, wantGPU)
+		}
+	}
+}
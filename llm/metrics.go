@@ -0,0 +1,49 @@
+package llm
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Metrics is a snapshot of the usage counters of a loaded model. The counters are cumulative since
+// the model was loaded so they can be exported as-is to any metrics system.
+type Metrics struct {
+	Predictions        int64
+	Errors             int64
+	PromptTokens       int64
+	CachedPromptTokens int64 // prompt tokens reused from the kv cache rather than evaluated
+	GeneratedTokens    int64
+	PromptEvalDuration time.Duration
+	EvalDuration       time.Duration
+}
+
+type metrics struct {
+	predictions        atomic.Int64
+	errors             atomic.Int64
+	promptTokens       atomic.Int64
+	cachedPromptTokens atomic.Int64
+	generatedTokens    atomic.Int64
+	promptEvalDuration atomic.Int64
+	evalDuration       atomic.Int64
+}
+
+func (m *metrics) observe(p Prediction) {
+	m.predictions.Add(1)
+	m.promptTokens.Add(int64(p.PromptN))
+	m.cachedPromptTokens.Add(int64(p.TokensCached))
+	m.generatedTokens.Add(int64(p.PredictedN))
+	m.promptEvalDuration.Add(int64(parseDurationMs(p.PromptMS)))
+	m.evalDuration.Add(int64(parseDurationMs(p.PredictedMS)))
+}
+
+func (m *metrics) snapshot() Metrics {
+	return Metrics{
+		Predictions:        m.predictions.Load(),
+		Errors:             m.errors.Load(),
+		PromptTokens:       m.promptTokens.Load(),
+		CachedPromptTokens: m.cachedPromptTokens.Load(),
+		GeneratedTokens:    m.generatedTokens.Load(),
+		PromptEvalDuration: time.Duration(m.promptEvalDuration.Load()),
+		EvalDuration:       time.Duration(m.evalDuration.Load()),
+	}
+}
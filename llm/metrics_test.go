@@ -0,0 +1,56 @@
+package llm
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+func TestMetrics(t *testing.T) {
+	llm := newTestLlama(t, completionHandler(
+		Prediction{Content: "hi"},
+		Prediction{Stop: true, Timings: Timings{PromptN: 3, PromptMS: 10, PredictedN: 1, PredictedMS: 20}},
+	))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := llm.Predict(context.Background(), nil, "hello", func(api.GenerateResponse) {}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	want := Metrics{
+		Predictions:        10,
+		PromptTokens:       30,
+		GeneratedTokens:    10,
+		PromptEvalDuration: 100 * time.Millisecond,
+		EvalDuration:       200 * time.Millisecond,
+	}
+
+	if got := llm.Metrics(); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestMetricsErrors(t *testing.T) {
+	llm := newTestLlama(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "boom", http.StatusInternalServerError)
+	}))
+
+	if err := llm.Predict(context.Background(), nil, "hello", func(api.GenerateResponse) {}); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	if got := llm.Metrics(); got.Errors != 1 || got.Predictions != 0 {
+		t.Errorf("got %+v, want 1 error and no predictions", got)
+	}
+}
@@ -0,0 +1,59 @@
+package llm
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+// windowsMMapLimit is the model size above which mmap is disabled on windows, where mapping large
+// files fails on some file systems
+const windowsMMapLimit = 4 << 30
+
+// networkFileSystems are the statfs magic numbers of network file systems, where a mapped model is
+// paged in over the network as it's read instead of in one pass when loading
+var networkFileSystems = map[uint32]string{
+	0x6969:     "nfs",
+	0x517b:     "smb",
+	0xfe534d42: "smb2",
+	0xff534d42: "cifs",
+	0x01021997: "9p",
+}
+
+// fsType returns the statfs magic number of the file system holding path, it's a variable so
+// tests can fake the file system
+var fsType = statfsType
+
+// noMMapReason returns why mmap should be disabled for model on goos, or an empty string when it
+// shouldn't be
+func noMMapReason(goos, model string) string {
+	if magic, err := fsType(model); err == nil {
+		if name, ok := networkFileSystems[magic]; ok {
+			return fmt.Sprintf("the model is on a network file system (%s)", name)
+		}
+	}
+
+	if goos == "windows" {
+		if info, err := os.Stat(model); err == nil && info.Size() > windowsMMapLimit {
+			return fmt.Sprintf("the model is larger than %d GiB", windowsMMapLimit>>30)
+		}
+	}
+
+	return ""
+}
+
+// withMMapDefault disables mmap for model on goos where it's unreliable or slow, unless force_mmap
+// is set
+func withMMapDefault(goos, model string, opts api.Options) api.Options {
+	if !opts.UseMMap || opts.ForceMMap {
+		return opts
+	}
+
+	if reason := noMMapReason(goos, model); reason != "" {
+		logInfof("disabling mmap, %s; set force_mmap to keep it", reason)
+		opts.UseMMap = false
+	}
+
+	return opts
+}
@@ -0,0 +1,13 @@
+package llm
+
+import "syscall"
+
+// statfsType returns the statfs magic number of the file system holding path
+func statfsType(path string) (uint32, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+
+	return uint32(st.Type), nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package llm
+
+import "errors"
+
+// statfsType returns the statfs magic number of the file system holding path, which is only read
+// on linux
+func statfsType(path string) (uint32, error) {
+	return 0, errors.New("file system type is only detected on linux")
+}
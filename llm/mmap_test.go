@@ -0,0 +1,110 @@
+package llm
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+func TestNoMMap(t *testing.T) {
+	defer func(orig func(string) (uint32, error)) { fsType = orig }(fsType)
+
+	const ext4, nfs, cifs = 0xef53, 0x6969, 0xff534d42
+
+	tests := []struct {
+		name      string
+		goos      string
+		fsType    uint32
+		size      int64
+		useMMap   bool
+		forceMMap bool
+		wantMMap  bool
+	}{
+		{"local", "linux", ext4, 1 << 20, true, false, true},
+		{"nfs", "linux", nfs, 1 << 20, true, false, false},
+		{"cifs", "linux", cifs, 1 << 20, true, false, false},
+		{"nfs forced", "linux", nfs, 1 << 20, true, true, true},
+		{"disabled", "linux", ext4, 1 << 20, false, false, false},
+		{"windows small", "windows", 0, 1 << 20, true, false, true},
+		{"windows large", "windows", 0, windowsMMapLimit + 1, true, false, false},
+		{"windows large forced", "windows", 0, windowsMMapLimit + 1, true, true, true},
+		{"darwin large", "darwin", 0, windowsMMapLimit + 1, true, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fsType = func(string) (uint32, error) {
+				if tt.fsType == 0 {
+					return 0, errors.New("not linux")
+				}
+
+				return tt.fsType, nil
+			}
+
+			// a sparse file, so the large cases don't write gigabytes
+			model := filepath.Join(t.TempDir(), "model.bin")
+			f, err := os.Create(model)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := f.Truncate(tt.size); err != nil {
+				t.Fatal(err)
+			}
+			f.Close()
+
+			opts := api.DefaultOptions()
+			opts.UseMMap = tt.useMMap
+			opts.ForceMMap = tt.forceMMap
+
+			mmap := withMMapDefault(tt.goos, model, opts).UseMMap
+			if mmap != tt.wantMMap {
+				t.Errorf("got mmap %t, want %t", mmap, tt.wantMMap)
+			}
+		})
+	}
+}
+
+func TestSetOptionsNoMMap(t *testing.T) {
+	loaded := api.DefaultOptions()
+	loaded.NumThread = 4
+	loaded.UseMMap = false
+
+	llm := &llama{Options: loaded, status: LoadStatus{NumThread: 4, NoMMap: true}}
+
+	// mmap was turned off at load, asking for the default isn't a change
+	if err := llm.SetOptions(api.DefaultOptions()); err != nil {
+		t.Errorf("got error %v, want none", err)
+	}
+
+	opts := api.DefaultOptions()
+	opts.ForceMMap = true
+	if err := llm.SetOptions(opts); !errors.Is(err, ErrReloadRequired) {
+		t.Errorf("got error %v, want %v", err, ErrReloadRequired)
+	}
+}
+
+func TestSetOptionsAdjustedAtLoad(t *testing.T) {
+	loaded := api.DefaultOptions()
+	loaded.NumThread = 4
+	loaded.NumGPU = 0
+	loaded.NumCtx = 2048
+
+	llm := &llama{Options: loaded, status: LoadStatus{NumThread: 4, NumCtx: 2048, NumCtxTrain: 2048}}
+
+	// the options the model was loaded with, before the gpu was disabled and num_ctx clamped
+	opts := api.DefaultOptions()
+	opts.NumGPU = 33
+	opts.NumCtx = 8192
+	if err := llm.SetOptions(opts); err != nil {
+		t.Errorf("got error %v, want none", err)
+	}
+
+	opts.StrictContext = true
+	if err := llm.SetOptions(opts); !errors.Is(err, ErrReloadRequired) {
+		t.Errorf("got error %v, want %v", err, ErrReloadRequired)
+	}
+}
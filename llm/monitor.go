@@ -0,0 +1,72 @@
+package llm
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	// monitorDebounce is how many pings in a row must agree before the health changes, so a
+	// single slow or dropped ping isn't reported
+	monitorDebounce = 2
+
+	// monitorMaxBackoff caps how far the ping interval grows while the server is unhealthy
+	monitorMaxBackoff = 8
+)
+
+// Monitor pings the server every interval and reports changes in its health: an error when it
+// becomes unhealthy and nil when it recovers. The server is assumed healthy when Monitor starts.
+// A change is only reported once monitorDebounce pings in a row agree. While the server is
+// unhealthy the interval doubles after each failed ping, up to monitorMaxBackoff times interval,
+// and returns to interval once it recovers. The channel is closed when ctx is done.
+func (llm *llama) Monitor(ctx context.Context, interval time.Duration) <-chan error {
+	ch := make(chan error)
+
+	go func() {
+		defer close(ch)
+
+		healthy := true
+		var streak int
+		delay := interval
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-timer.C:
+			}
+
+			pingCtx, cancel := context.WithTimeout(ctx, interval)
+			err := llm.Ping(pingCtx)
+			cancel()
+
+			if ctx.Err() != nil {
+				return
+			}
+
+			if (err == nil) == healthy {
+				streak = 0
+			} else if streak++; streak >= monitorDebounce {
+				healthy, streak = err == nil, 0
+				select {
+				case ch <- err:
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			switch {
+			case err == nil:
+				delay = interval
+			case delay < interval*monitorMaxBackoff:
+				delay *= 2
+			}
+
+			timer.Reset(delay)
+		}
+	}()
+
+	return ch
+}
@@ -0,0 +1,75 @@
+package llm
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMonitor(t *testing.T) {
+	var healthy atomic.Bool
+	healthy.Store(true)
+	llm := newTestLlama(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch := llm.Monitor(ctx, 5*time.Millisecond)
+
+	receive := func() (error, bool) {
+		select {
+		case err, ok := <-ch:
+			return err, ok
+		case <-time.After(5 * time.Second):
+			t.Fatal("no health change reported")
+			return nil, false
+		}
+	}
+
+	healthy.Store(false)
+	if err, ok := receive(); !ok || err == nil {
+		t.Fatalf("got %v, want an error for the unhealthy server", err)
+	}
+
+	healthy.Store(true)
+	if err, ok := receive(); !ok || err != nil {
+		t.Fatalf("got %v, want nil once the server recovers", err)
+	}
+
+	cancel()
+	if _, ok := receive(); ok {
+		t.Error("channel is still open after ctx is done")
+	}
+}
+
+func TestMonitorDebounce(t *testing.T) {
+	var pings atomic.Int32
+	llm := newTestLlama(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// a single failure among successful pings
+		if pings.Add(1) == 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := llm.Monitor(ctx, 5*time.Millisecond)
+
+	for pings.Load() < 6 {
+		select {
+		case err := <-ch:
+			t.Fatalf("got health change %v from a single failed ping", err)
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	cancel()
+	for err := range ch {
+		t.Errorf("got health change %v from a single failed ping", err)
+	}
+}
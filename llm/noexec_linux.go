@@ -0,0 +1,16 @@
+package llm
+
+import "syscall"
+
+// stNoExec is the statfs mount flag for noexec file systems
+const stNoExec = 0x8
+
+// isNoExec reports whether dir is on a file system mounted noexec, where the runner can't run
+func isNoExec(dir string) bool {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return false
+	}
+
+	return st.Flags&stNoExec != 0
+}
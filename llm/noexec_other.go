@@ -0,0 +1,8 @@
+//go:build !linux
+
+package llm
+
+// isNoExec reports whether dir is on a file system mounted noexec, which is only detected on linux
+func isNoExec(dir string) bool {
+	return false
+}
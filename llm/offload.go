@@ -0,0 +1,144 @@
+package llm
+
+import (
+	"bytes"
+	"regexp"
+	"strconv"
+	"sync"
+)
+
+// OffloadStatus is what the server logged about splitting the model between gpu and cpu as it
+// started, for diagnosing a slow model, e.g. one with only some of its layers offloaded. Fields
+// the server's version doesn't log are zero.
+type OffloadStatus struct {
+	Layers      int // layers offloaded to the gpu
+	TotalLayers int
+
+	// Buffers are the sizes in bytes of the buffers the server allocated, by device and kind,
+	// e.g. "CUDA0 model", "CUDA0 KV", "CUDA0 compute" or "CPU model"
+	Buffers map[string]int64
+
+	// VRAMUsed is the total vram the server reported using, only older servers log it
+	VRAMUsed int64
+}
+
+// Partial reports whether some but not all of the model's layers were offloaded
+func (s OffloadStatus) Partial() bool {
+	return s.Layers > 0 && s.Layers < s.TotalLayers
+}
+
+var (
+	// llama_model_load_internal: offloaded 20/43 layers to GPU
+	// llm_load_tensors: offloaded 33/33 layers to GPU
+	offloadedLayersRe = regexp.MustCompile(`offloaded (\d+)/(\d+) layers to GPU`)
+
+	// llm_load_tensors:      CUDA0 buffer size =  3847.55 MiB
+	// llama_kv_cache_init:      CUDA0 KV buffer size =  1024.00 MiB
+	// llama_new_context_with_model:  CUDA_Host compute buffer size =    12.01 MiB
+	bufferSizeRe = regexp.MustCompile(`:\s+([\w.-]+)\s+(?:(\w+)\s+)?buffer size\s*=\s*([\d.]+)\s*([KMG]i?B|B)\b`)
+
+	// llama_model_load_internal: total VRAM used: 3719 MB
+	// llm_load_tensors: VRAM used: 3719.00 MiB
+	vramUsedRe = regexp.MustCompile(`VRAM used:\s*([\d.]+)\s*([KMG]i?B|B)\b`)
+)
+
+// logSizeUnits are the multipliers of the units llama.cpp logs sizes in; it means binary units
+// even where it writes MB
+var logSizeUnits = map[string]float64{
+	"B":   1,
+	"KB":  1 << 10,
+	"KiB": 1 << 10,
+	"MB":  1 << 20,
+	"MiB": 1 << 20,
+	"GB":  1 << 30,
+	"GiB": 1 << 30,
+}
+
+func logSize(value, unit string) (int64, bool) {
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return int64(f * logSizeUnits[unit]), true
+}
+
+// offloadParser is written the server's output and picks out the lines about offloading. The
+// server logs a draft model after the main one, so only the first of each line counts.
+type offloadParser struct {
+	mu      sync.Mutex
+	partial []byte
+	status  OffloadStatus
+}
+
+// maxLogLine bounds the unterminated output kept while waiting for the end of a line
+const maxLogLine = 64 << 10
+
+func (p *offloadParser) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.partial = append(p.partial, b...)
+	for {
+		i := bytes.IndexByte(p.partial, '\n')
+		if i < 0 {
+			break
+		}
+
+		p.parseLine(string(p.partial[:i]))
+		p.partial = p.partial[i+1:]
+	}
+
+	if len(p.partial) > maxLogLine {
+		p.partial = nil
+	}
+
+	return len(b), nil
+}
+
+func (p *offloadParser) parseLine(line string) {
+	if m := offloadedLayersRe.FindStringSubmatch(line); m != nil && p.status.TotalLayers == 0 {
+		p.status.Layers, _ = strconv.Atoi(m[1])
+		p.status.TotalLayers, _ = strconv.Atoi(m[2])
+		return
+	}
+
+	if m := bufferSizeRe.FindStringSubmatch(line); m != nil {
+		kind := m[2]
+		if kind == "" {
+			kind = "model"
+		}
+
+		name := m[1] + " " + kind
+		if size, ok := logSize(m[3], m[4]); ok {
+			if p.status.Buffers == nil {
+				p.status.Buffers = make(map[string]int64)
+			}
+
+			if _, seen := p.status.Buffers[name]; !seen {
+				p.status.Buffers[name] = size
+			}
+		}
+		return
+	}
+
+	if m := vramUsedRe.FindStringSubmatch(line); m != nil && p.status.VRAMUsed == 0 {
+		p.status.VRAMUsed, _ = logSize(m[1], m[2])
+	}
+}
+
+// Status returns what was parsed so far
+func (p *offloadParser) Status() OffloadStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	status := p.status
+	if status.Buffers != nil {
+		status.Buffers = make(map[string]int64, len(p.status.Buffers))
+		for k, v := range p.status.Buffers {
+			status.Buffers[k] = v
+		}
+	}
+
+	return status
+}
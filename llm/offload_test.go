@@ -0,0 +1,89 @@
+package llm
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestOffloadParser(t *testing.T) {
+	mib := func(f float64) int64 { return int64(f * (1 << 20)) }
+
+	tests := []struct {
+		name string
+		log  string
+		want OffloadStatus
+	}{
+		{
+			"ggml",
+			`llama_model_load_internal: format     = ggjt v3 (latest)
+llama_model_load_internal: mem required  = 2381.32 MB (+ 1026.00 MB per state)
+llama_model_load_internal: offloading 20 repeating layers to GPU
+llama_model_load_internal: offloaded 20/35 layers to GPU
+llama_model_load_internal: total VRAM used: 3719 MB
+llama_new_context_with_model: kv self size  = 1024.00 MB
+`,
+			OffloadStatus{Layers: 20, TotalLayers: 35, VRAMUsed: 3719 << 20},
+		},
+		{
+			"gguf",
+			`llm_load_tensors: ggml ctx size =    0.11 MiB
+llm_load_tensors: offloading 32 repeating layers to GPU
+llm_load_tensors: offloading non-repeating layers to GPU
+llm_load_tensors: offloaded 33/33 layers to GPU
+llm_load_tensors:        CPU buffer size =    70.31 MiB
+llm_load_tensors:      CUDA0 buffer size =  3847.55 MiB
+llama_kv_cache_init:      CUDA0 KV buffer size =  1024.00 MiB
+llama_new_context_with_model:  CUDA_Host  output buffer size =     0.12 MiB
+llama_new_context_with_model:      CUDA0 compute buffer size =   164.00 MiB
+`,
+			OffloadStatus{Layers: 33, TotalLayers: 33, Buffers: map[string]int64{
+				"CPU model":        mib(70.31),
+				"CUDA0 model":      mib(3847.55),
+				"CUDA0 KV":         1024 << 20,
+				"CUDA_Host output": mib(0.12),
+				"CUDA0 compute":    164 << 20,
+			}},
+		},
+		{
+			"cpu only",
+			`load_tensors: loading model tensors, this can take a while... (mmap = true)
+load_tensors:   CPU_Mapped model buffer size =  4165.37 MiB
+`,
+			OffloadStatus{Buffers: map[string]int64{"CPU_Mapped model": mib(4165.37)}},
+		},
+		{
+			"draft model",
+			`llm_load_tensors: offloaded 20/41 layers to GPU
+llm_load_tensors:      CUDA0 buffer size =  2048.00 MiB
+llm_load_tensors: offloaded 23/23 layers to GPU
+llm_load_tensors:      CUDA0 buffer size =   256.00 MiB
+`,
+			OffloadStatus{Layers: 20, TotalLayers: 41, Buffers: map[string]int64{"CUDA0 model": 2048 << 20}},
+		},
+		{
+			"unrelated",
+			"{\"timestamp\":1700000000,\"level\":\"INFO\",\"message\":\"HTTP server listening\"}\nno newline at the end",
+			OffloadStatus{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var p offloadParser
+
+			// the server's output arrives in arbitrary chunks
+			for i := 0; i < len(tt.log); i += 7 {
+				end := i + 7
+				if end > len(tt.log) {
+					end = len(tt.log)
+				}
+
+				p.Write([]byte(tt.log[i:end]))
+			}
+
+			if got := p.Status(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package llm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// ModelProps is the configuration the server reports for the loaded model, which can differ from
+// the requested options when the server clamps them. Fields the server doesn't report are zero.
+type ModelProps struct {
+	Model        string
+	NumCtx       int // the context of each slot
+	NumCtxTrain  int
+	NumEmbd      int
+	NumVocab     int
+	NumParams    int64
+	Size         int64 // bytes of model weights
+	TotalSlots   int
+	ChatTemplate string
+}
+
+type propsResponse struct {
+	DefaultGenerationSettings struct {
+		NCtx  int    `json:"n_ctx"`
+		Model string `json:"model"`
+	} `json:"default_generation_settings"`
+	TotalSlots   int    `json:"total_slots"`
+	ChatTemplate string `json:"chat_template"`
+}
+
+type modelsResponse struct {
+	Data []struct {
+		ID   string `json:"id"`
+		Meta struct {
+			NCtxTrain int   `json:"n_ctx_train"`
+			NEmbd     int   `json:"n_embd"`
+			NVocab    int   `json:"n_vocab"`
+			NParams   int64 `json:"n_params"`
+			Size      int64 `json:"size"`
+		} `json:"meta"`
+	} `json:"data"`
+}
+
+// ModelProps returns the properties the server reports for the loaded model. Servers that don't
+// describe the model's dimensions leave those fields zero.
+func (llm *llama) ModelProps(ctx context.Context) (ModelProps, error) {
+	if err := llm.activity.begin(); err != nil {
+		return ModelProps{}, err
+	}
+	defer llm.activity.end()
+
+	if err := llm.waitReady(ctx); err != nil {
+		return ModelProps{}, err
+	}
+
+	var props propsResponse
+	if err := llm.getJSON(ctx, "/props", &props); err != nil {
+		return ModelProps{}, err
+	}
+
+	mp := ModelProps{
+		Model:        props.DefaultGenerationSettings.Model,
+		NumCtx:       props.DefaultGenerationSettings.NCtx,
+		TotalSlots:   props.TotalSlots,
+		ChatTemplate: props.ChatTemplate,
+	}
+
+	var models modelsResponse
+	if err := llm.getJSON(ctx, "/v1/models", &models); err != nil {
+		// older servers only have /props
+		var serr *ServerError
+		if !errors.As(err, &serr) || serr.StatusCode != http.StatusNotFound {
+			return ModelProps{}, err
+		}
+	}
+
+	if len(models.Data) > 0 {
+		m := models.Data[0]
+		if mp.Model == "" {
+			mp.Model = m.ID
+		}
+
+		mp.NumCtxTrain = m.Meta.NCtxTrain
+		mp.NumEmbd = m.Meta.NEmbd
+		mp.NumVocab = m.Meta.NVocab
+		mp.NumParams = m.Meta.NParams
+		mp.Size = m.Meta.Size
+	}
+
+	return mp, nil
+}
+
+// getJSON decodes the response to a GET of path on the server into v
+func (llm *llama) getJSON(ctx context.Context, path string, v any) error {
+	endpoint := llm.endpoint(path)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return fmt.Errorf("%s request: %w", path, err)
+	}
+
+	resp, err := llm.doRequest(ctx, req)
+	if err != nil {
+		return requestError(ctx, "GET "+path, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := readBody(resp.Body)
+	if err != nil {
+		return fmt.Errorf("read %s response: %w", path, err)
+	}
+
+	if resp.StatusCode >= 400 {
+		logErrorf("llm %s error: %s", path, body)
+		return &ServerError{StatusCode: resp.StatusCode, Body: string(body), Endpoint: path}
+	}
+
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("unmarshal %s response: %w", path, err)
+	}
+
+	return nil
+}
+
+// postJSON sends v as json to path on the server, discarding the response
+func (llm *llama) postJSON(ctx context.Context, path string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("marshal %s request: %w", path, err)
+	}
+
+	endpoint := llm.endpoint(path)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("%s request: %w", path, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := llm.doRequest(ctx, req)
+	if err != nil {
+		return requestError(ctx, "POST "+path, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := readBody(resp.Body)
+	if err != nil {
+		return fmt.Errorf("read %s response: %w", path, err)
+	}
+
+	if resp.StatusCode >= 400 {
+		logErrorf("llm %s error: %s", path, body)
+		return &ServerError{StatusCode: resp.StatusCode, Body: string(body), Endpoint: path}
+	}
+
+	return nil
+}
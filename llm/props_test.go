@@ -0,0 +1,84 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestModelProps(t *testing.T) {
+	props := `{
+		"default_generation_settings": {"n_ctx": 4096, "model": "/models/llama2.bin", "seed": -1},
+		"total_slots": 2,
+		"chat_template": "{{ messages }}"
+	}`
+
+	models := `{"object": "list", "data": [{"id": "llama2", "meta": {
+		"n_ctx_train": 4096, "n_embd": 4096, "n_vocab": 32000, "n_params": 6738415616, "size": 3825065984
+	}}]}`
+
+	tests := []struct {
+		name    string
+		props   string
+		models  string
+		want    ModelProps
+		wantErr error
+	}{
+		{"full", props, models, ModelProps{
+			Model:        "/models/llama2.bin",
+			NumCtx:       4096,
+			NumCtxTrain:  4096,
+			NumEmbd:      4096,
+			NumVocab:     32000,
+			NumParams:    6738415616,
+			Size:         3825065984,
+			TotalSlots:   2,
+			ChatTemplate: "{{ messages }}",
+		}, nil},
+		{"no models endpoint", props, "", ModelProps{
+			Model:        "/models/llama2.bin",
+			NumCtx:       4096,
+			TotalSlots:   2,
+			ChatTemplate: "{{ messages }}",
+		}, nil},
+		{"missing fields", `{"default_generation_settings": {}}`, `{"data": []}`, ModelProps{}, nil},
+		{"model from models", `{}`, models, ModelProps{
+			Model:       "llama2",
+			NumCtxTrain: 4096,
+			NumEmbd:     4096,
+			NumVocab:    32000,
+			NumParams:   6738415616,
+			Size:        3825065984,
+		}, nil},
+		{"no props endpoint", "", models, ModelProps{}, ErrServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mux := http.NewServeMux()
+			if tt.props != "" {
+				mux.HandleFunc("/props", func(w http.ResponseWriter, r *http.Request) {
+					fmt.Fprint(w, tt.props)
+				})
+			}
+
+			if tt.models != "" {
+				mux.HandleFunc("/v1/models", func(w http.ResponseWriter, r *http.Request) {
+					fmt.Fprint(w, tt.models)
+				})
+			}
+
+			llm := newTestLlama(t, mux)
+			got, err := llm.ModelProps(context.Background())
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,161 @@
+package llm
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// QuantizeProgress reports a tensor written by Quantize
+type QuantizeProgress struct {
+	Tensor    string
+	Completed int
+	Total     int
+}
+
+// quantizeProgressRe matches the line quantize logs for each tensor, e.g.
+// [  12/ 291]                  blk.1.attn_k.weight - [ 4096,  4096,     1,     1], type =    f16, ...
+var quantizeProgressRe = regexp.MustCompile(`^\[\s*(\d+)/\s*(\d+)\]\s+(\S+)`)
+
+// ParseFileType returns the file type named name, e.g. Q4_K_M, for passing to Quantize
+func ParseFileType(name string) (llamaFileType, error) {
+	for ft := llamaFileTypeF32; ft <= llamaFileTypeQ6_K; ft++ {
+		if ft.String() != "Unknown" && strings.EqualFold(ft.String(), name) {
+			return ft, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown file type %q", name)
+}
+
+// quantizable reports whether models can be quantized to ft
+func (ft llamaFileType) quantizable() bool {
+	switch ft {
+	case llamaFileTypeF32, llamaFileTypeF16, llamaFileTypeQ4_1_F16:
+		return false
+	}
+
+	return ft.String() != "Unknown"
+}
+
+// Quantize converts the F32 or F16 model at inputPath to ftype, writing it to outputPath, with the
+// quantize tool built alongside the llama.cpp server. fn, if not nil, is called as each tensor is
+// written. The bundled llama.cpp predates gguf, so inputPath must be a ggjt model. A partly written
+// output is removed when quantizing fails or ctx is cancelled.
+func Quantize(ctx context.Context, inputPath, outputPath string, ftype llamaFileType, fn func(QuantizeProgress)) error {
+	if !ftype.quantizable() {
+		return fmt.Errorf("can't quantize to %s, it isn't a quantization type", ftype)
+	}
+
+	if err := statModel(inputPath); err != nil {
+		return err
+	}
+
+	ggml, err := checkModelFormat(inputPath)
+	if err != nil {
+		return err
+	}
+
+	if ft := ggml.FileType().String(); ft != "F32" && ft != "F16" {
+		return fmt.Errorf("%s is already quantized to %s, quantize an F32 or F16 model instead", inputPath, ft)
+	}
+
+	if abs, err := filepath.Abs(outputPath); err == nil {
+		if in, err := filepath.Abs(inputPath); err == nil && in == abs {
+			return errors.New("quantize: the output would overwrite the input")
+		}
+	}
+
+	quantize, err := extractQuantize(RunnerFS)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(filepath.Dir(quantize))
+
+	var stderr tailBuffer
+	cmd := exec.CommandContext(ctx, quantize, inputPath, outputPath, strconv.Itoa(int(ftype)))
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("quantize: %w", err)
+	}
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("quantize: %w", err)
+	}
+
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		m := quantizeProgressRe.FindStringSubmatch(scanner.Text())
+		if m == nil || fn == nil {
+			continue
+		}
+
+		completed, _ := strconv.Atoi(m[1])
+		total, _ := strconv.Atoi(m[2])
+		fn(QuantizeProgress{Tensor: m[3], Completed: completed, Total: total})
+	}
+
+	if err := cmd.Wait(); err != nil {
+		os.Remove(outputPath)
+		if ctx.Err() != nil {
+			return fmt.Errorf("quantize: %w: %w", ErrContextCanceled, ctx.Err())
+		}
+
+		return fmt.Errorf("quantize %s to %s: %w: %s", inputPath, ftype, err, strings.TrimSpace(stderr.String()))
+	}
+
+	return nil
+}
+
+// extractQuantize extracts the quantize tool from fsys to a temporary directory and returns its
+// path. It's built with the cpu runners, or the gpu runner on apple silicon which has no cpu build.
+func extractQuantize(fsys fs.FS) (string, error) {
+	name := "quantize"
+	if runtime.GOOS == "windows" {
+		name = "quantize.exe"
+	}
+
+	variants, _ := RunnerVariants(fsys)
+	dirs := []string{ggmlCPU, ggmlGPU}
+	if variant := cpuVariant(variants); variant != "" {
+		dirs = append([]string{path.Join("llama.cpp", "ggml", "build", variant, "bin")}, dirs...)
+	}
+
+	for _, dir := range dirs {
+		src := path.Join(osPath(dir), name)
+		if _, err := fs.Stat(fsys, src); err != nil {
+			continue
+		}
+
+		tmpDir, err := os.MkdirTemp(runnerTmpDir(), "quantize-*")
+		if err != nil {
+			return "", fmt.Errorf("quantize: failed to create temp dir: %w", err)
+		}
+
+		if isNoExec(tmpDir) {
+			os.RemoveAll(tmpDir)
+			return "", fmt.Errorf("quantize: %s is on a file system mounted noexec, set OLLAMA_TMPDIR to a directory the tool can be executed from", filepath.Dir(tmpDir))
+		}
+
+		dest := filepath.Join(tmpDir, name)
+		if err := extractFile(fsys, src, dest); err != nil {
+			os.RemoveAll(tmpDir)
+			return "", err
+		}
+
+		return dest, nil
+	}
+
+	return "", errors.New("quantize executable not found")
+}
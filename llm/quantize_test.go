@@ -0,0 +1,125 @@
+package llm
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// fakeQuantize logs a line for each of two tensors like llama.cpp's quantize and copies its input
+// to its output, or fails when the file type is 18
+const fakeQuantize = `#!/bin/sh
+echo "main: quantizing '$1' to '$2' as $3"
+if [ "$3" = 18 ]; then
+	echo "failed to quantize" >&2
+	: > "$2"
+	exit 1
+fi
+echo "[   1/   2]                    tok_embeddings.weight - [ 4096, 32000], type =    f16, quantizing .. size =   250.00 MB ->    70.31 MB"
+echo "[   2/   2]                           output.weight - [ 4096, 32000], type =    f16, quantizing .. size =   250.00 MB ->   102.54 MB"
+cp "$1" "$2"
+`
+
+func TestQuantize(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake quantize tool is a shell script")
+	}
+
+	defer func(orig string) { RunnerTmpDir = orig }(RunnerTmpDir)
+	RunnerTmpDir = t.TempDir()
+
+	defer func(orig fs.FS) { RunnerFS = orig }(RunnerFS)
+	RunnerFS = fstest.MapFS{
+		path.Join(ggmlCPU, "quantize"): &fstest.MapFile{Data: []byte(fakeQuantize)},
+	}
+
+	f16 := writeGGJT(t, 32, llamaFileTypeF16)
+
+	tests := []struct {
+		name     string
+		input    string
+		ftype    llamaFileType
+		wantErr  string
+		progress []QuantizeProgress
+	}{
+		{"q4_k_m", f16, llamaFileTypeQ4_K_M, "", []QuantizeProgress{
+			{"tok_embeddings.weight", 1, 2},
+			{"output.weight", 2, 2},
+		}},
+		{"f32 target", f16, llamaFileTypeF32, "isn't a quantization type", nil},
+		{"f16 target", f16, llamaFileTypeF16, "isn't a quantization type", nil},
+		{"unknown target", f16, llamaFileType(5), "isn't a quantization type", nil},
+		{"quantized input", writeGGJT(t, 32, llamaFileTypeQ4_0), llamaFileTypeQ4_K_M, "already quantized to Q4_0", nil},
+		{"gguf input", writeGGUF(t, 2, ggufLlama2...), llamaFileTypeQ4_K_M, "gguf models are not supported", nil},
+		{"tool fails", f16, llamaFileTypeQ6_K, "failed to quantize", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output := filepath.Join(t.TempDir(), "model-quantized.bin")
+
+			var progress []QuantizeProgress
+			err := Quantize(context.Background(), tt.input, output, tt.ftype, func(p QuantizeProgress) {
+				progress = append(progress, p)
+			})
+
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want one containing %q", err, tt.wantErr)
+				}
+
+				if _, err := os.Stat(output); !os.IsNotExist(err) {
+					t.Errorf("output was left behind after a failure: %v", err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(progress, tt.progress) {
+				t.Errorf("got progress %+v, want %+v", progress, tt.progress)
+			}
+
+			if _, err := os.Stat(output); err != nil {
+				t.Errorf("no output written: %v", err)
+			}
+		})
+	}
+}
+
+func TestParseFileType(t *testing.T) {
+	tests := []struct {
+		name string
+		want llamaFileType
+		ok   bool
+	}{
+		{"Q4_K_M", llamaFileTypeQ4_K_M, true},
+		{"q8_0", llamaFileTypeQ8_0, true},
+		{"F16", llamaFileTypeF16, true},
+		{"Q4_2", 0, false},
+		{"Unknown", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseFileType(tt.name)
+			if (err == nil) != tt.ok {
+				t.Fatalf("got error %v", err)
+			}
+
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
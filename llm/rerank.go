@@ -0,0 +1,46 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"math"
+)
+
+// Rerank scores how relevant each of docs is to query by the cosine similarity of their
+// embeddings, returning the scores in the order of docs. The query and documents are embedded with
+// EmbeddingBatch, so they're spread across the server's slots. The model must be loaded with
+// embeddings enabled, and scores are only meaningful for models trained to produce embeddings.
+func (llm *llama) Rerank(ctx context.Context, query string, docs []string) ([]float64, error) {
+	results, err := llm.EmbeddingBatch(ctx, append([]string{query}, docs...), BatchFailFast)
+	if err != nil {
+		return nil, fmt.Errorf("rerank: %w", err)
+	}
+
+	q := results[0].Embedding
+	scores := make([]float64, len(docs))
+	for i, r := range results[1:] {
+		if len(r.Embedding) != len(q) {
+			return nil, fmt.Errorf("embed document %d: got %d dimensions, want %d", i, len(r.Embedding), len(q))
+		}
+
+		scores[i] = cosineSimilarity(q, r.Embedding)
+	}
+
+	return scores, nil
+}
+
+// cosineSimilarity returns the cosine of the angle between a and b, or 0 if either is all zeros
+func cosineSimilarity(a, b []float64) float64 {
+	var dot, na, nb float64
+	for i := range a {
+		dot += a[i] * b[i]
+		na += a[i] * a[i]
+		nb += b[i] * b[i]
+	}
+
+	if na == 0 || nb == 0 {
+		return 0
+	}
+
+	return dot / (math.Sqrt(na) * math.Sqrt(nb))
+}
@@ -0,0 +1,117 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRerank(t *testing.T) {
+	vectors := map[string][]float64{
+		"query":      {1, 0, 0},
+		"same":       {2, 0, 0},
+		"orthogonal": {0, 1, 0},
+		"opposite":   {-1, 0, 0},
+		"diagonal":   {1, 1, 0},
+		"empty":      {0, 0, 0},
+	}
+
+	llm := newTestLlama(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req EmbeddingRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Fatal(err)
+		}
+
+		json.NewEncoder(w).Encode(EmbeddingResponse{Embedding: vectors[req.Content]})
+	}))
+
+	scores, err := llm.Rerank(context.Background(), "query", []string{"same", "orthogonal", "opposite", "diagonal", "empty"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []float64{1, 0, -1, 1 / math.Sqrt2, 0}
+	if len(scores) != len(want) {
+		t.Fatalf("got %d scores, want %d", len(scores), len(want))
+	}
+
+	for i := range want {
+		if math.Abs(scores[i]-want[i]) > 1e-9 {
+			t.Errorf("score %d: got %f, want %f", i, scores[i], want[i])
+		}
+	}
+}
+
+func TestRerankEmbeddingDisabled(t *testing.T) {
+	llm := newTestLlama(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected request to %s", r.URL.Path)
+	}))
+	llm.EmbeddingEnabled = false
+
+	if _, err := llm.Rerank(context.Background(), "query", []string{"doc"}); !errors.Is(err, ErrEmbeddingDisabled) {
+		t.Errorf("got error %v, want %v", err, ErrEmbeddingDisabled)
+	}
+}
+
+func TestRerankParallel(t *testing.T) {
+	var mu sync.Mutex
+	var active, maxActive int
+	release := make(chan struct{})
+
+	llm := newTestLlama(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		active++
+		if active > maxActive {
+			maxActive = active
+		}
+		if active == 3 {
+			close(release)
+		}
+		mu.Unlock()
+
+		select {
+		case <-release:
+		case <-time.After(time.Second):
+		}
+
+		mu.Lock()
+		active--
+		mu.Unlock()
+
+		json.NewEncoder(w).Encode(EmbeddingResponse{Embedding: []float64{1, 0}})
+	}))
+	llm.NumParallel = 3
+
+	if _, err := llm.Rerank(context.Background(), "query", []string{"a", "b", "c", "d"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if maxActive != 3 {
+		t.Errorf("got %d embedding requests at once, want 3", maxActive)
+	}
+}
+
+func TestRerankDimensionMismatch(t *testing.T) {
+	llm := newTestLlama(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req EmbeddingRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+			return
+		}
+
+		embedding := []float64{1, 0}
+		if req.Content == "short" {
+			embedding = []float64{1}
+		}
+		json.NewEncoder(w).Encode(EmbeddingResponse{Embedding: embedding})
+	}))
+
+	if _, err := llm.Rerank(context.Background(), "query", []string{"doc", "short"}); err == nil {
+		t.Error("expected an error")
+	}
+}
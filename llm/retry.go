@@ -0,0 +1,79 @@
+package llm
+
+import (
+	"math"
+	mrand "math/rand"
+	"time"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+// RetryPolicy is how an operation that can fail for a while is retried
+type RetryPolicy struct {
+	MaxAttempts int           // attempts including the first
+	BaseDelay   time.Duration // delay before the first retry, doubled for each retry after it
+	MaxDelay    time.Duration // caps the delay, 0 leaves it uncapped
+
+	// Jitter picks each delay at random between half of it and all of it, so concurrent operations
+	// don't retry in lockstep
+	Jitter bool
+}
+
+var (
+	// StartupRetry is how starting the llama.cpp server is retried, e.g. when another process
+	// takes its port first. The runner_retries and runner_retry_delay options override it.
+	StartupRetry = RetryPolicy{MaxAttempts: 3, BaseDelay: 250 * time.Millisecond, MaxDelay: 10 * time.Second, Jitter: true}
+
+	// LoadingRetry is how a request is retried while the server answers that it's still loading
+	// the model. The request_retries and request_retry_delay options override it.
+	LoadingRetry = RetryPolicy{MaxAttempts: 6, BaseDelay: 100 * time.Millisecond, MaxDelay: 10 * time.Second, Jitter: true}
+)
+
+// Delay returns the delay before retry n, counting the first retry as 1
+func (p RetryPolicy) Delay(n int) time.Duration {
+	if n < 1 || p.BaseDelay <= 0 {
+		return 0
+	}
+
+	d := p.BaseDelay
+	for i := 1; i < n && d < math.MaxInt64/2 && (p.MaxDelay <= 0 || d < p.MaxDelay); i++ {
+		d *= 2
+	}
+
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+
+	if p.Jitter {
+		d = d/2 + time.Duration(mrand.Int63n(int64(d/2)+1))
+	}
+
+	return d
+}
+
+// withOptions returns p with the attempts and delays, in milliseconds, that are set
+func (p RetryPolicy) withOptions(attempts, delay, maxDelay int) RetryPolicy {
+	if attempts > 0 {
+		p.MaxAttempts = attempts
+	}
+
+	if delay > 0 {
+		p.BaseDelay = time.Duration(delay) * time.Millisecond
+	}
+
+	if maxDelay > 0 {
+		p.MaxDelay = time.Duration(maxDelay) * time.Millisecond
+	}
+
+	return p
+}
+
+// startupRetryPolicy returns how starting the server is retried with opts
+func startupRetryPolicy(opts api.Options) RetryPolicy {
+	return StartupRetry.withOptions(opts.RunnerRetries, opts.RunnerRetryDelay, opts.RetryMaxDelay)
+}
+
+// requestRetryPolicy returns how requests are retried while the server is loading with opts
+func requestRetryPolicy(opts api.Options) RetryPolicy {
+	return LoadingRetry.withOptions(opts.RequestRetries, opts.RequestRetryDelay, opts.RetryMaxDelay)
+}
@@ -0,0 +1,76 @@
+package llm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy RetryPolicy
+		want   []time.Duration // before retries 1, 2, 3...
+	}{
+		{"doubles", RetryPolicy{BaseDelay: 100 * time.Millisecond}, []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond}},
+		{"capped", RetryPolicy{BaseDelay: 100 * time.Millisecond, MaxDelay: 250 * time.Millisecond}, []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 250 * time.Millisecond, 250 * time.Millisecond}},
+		{"no delay", RetryPolicy{}, []time.Duration{0, 0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i, want := range tt.want {
+				if got := tt.policy.Delay(i + 1); got != want {
+					t.Errorf("retry %d: got %s, want %s", i+1, got, want)
+				}
+
+				// jitter picks between half the delay and all of it
+				jittered := tt.policy
+				jittered.Jitter = true
+				if got := jittered.Delay(i + 1); got < want/2 || got > want {
+					t.Errorf("retry %d: got %s with jitter, want between %s and %s", i+1, got, want/2, want)
+				}
+			}
+		})
+	}
+
+	// the delay doesn't overflow after many retries
+	if d := (RetryPolicy{BaseDelay: time.Second}).Delay(100); d <= 0 {
+		t.Errorf("got delay %s after 100 retries", d)
+	}
+
+	// the default policies cap the delay however many retries are configured
+	for _, p := range []RetryPolicy{StartupRetry, LoadingRetry} {
+		if d := p.Delay(100); d > 10*time.Second {
+			t.Errorf("got delay %s after 100 retries, want at most 10s", d)
+		}
+	}
+}
+
+func TestRetryPolicyOptions(t *testing.T) {
+	opts := api.DefaultOptions()
+	if got := startupRetryPolicy(opts); got != StartupRetry || got.MaxAttempts != 3 {
+		t.Errorf("got startup policy %+v, want the default 3 attempts", got)
+	}
+
+	if got := requestRetryPolicy(opts); got != LoadingRetry {
+		t.Errorf("got request policy %+v, want %+v", got, LoadingRetry)
+	}
+
+	opts.RunnerRetries = 5
+	opts.RunnerRetryDelay = 10
+	opts.RequestRetries = 2
+	opts.RequestRetryDelay = 20
+	opts.RetryMaxDelay = 1000
+
+	want := RetryPolicy{MaxAttempts: 5, BaseDelay: 10 * time.Millisecond, MaxDelay: time.Second, Jitter: true}
+	if got := startupRetryPolicy(opts); got != want {
+		t.Errorf("got startup policy %+v, want %+v", got, want)
+	}
+
+	want = RetryPolicy{MaxAttempts: 2, BaseDelay: 20 * time.Millisecond, MaxDelay: time.Second, Jitter: true}
+	if got := requestRetryPolicy(opts); got != want {
+		t.Errorf("got request policy %+v, want %+v", got, want)
+	}
+}
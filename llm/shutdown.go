@@ -0,0 +1,86 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"syscall"
+)
+
+// loaded tracks the models loaded by this process, in load order, for Shutdown
+var loaded struct {
+	mu     sync.Mutex
+	models []*llama
+}
+
+// track adds llm to the models Shutdown closes
+func track(llm *llama) {
+	loaded.mu.Lock()
+	defer loaded.mu.Unlock()
+	loaded.models = append(loaded.models, llm)
+}
+
+// untrack removes llm from the models Shutdown closes
+func untrack(llm *llama) {
+	loaded.mu.Lock()
+	defer loaded.mu.Unlock()
+
+	for i, m := range loaded.models {
+		if m == llm {
+			loaded.models = append(loaded.models[:i], loaded.models[i+1:]...)
+			return
+		}
+	}
+}
+
+// Shutdown closes every model loaded by this process, for when it's exiting. Models are closed one
+// at a time, the most recently loaded first, so their gpu memory is freed in the reverse order it
+// was taken. Each server is asked to exit and waited for until ctx is done; the servers still
+// running then are killed, and Shutdown returns an error saying how many. It returns once every
+// server has exited. Detached servers are left running, as Close leaves them.
+func Shutdown(ctx context.Context) error {
+	loaded.mu.Lock()
+	models := append([]*llama(nil), loaded.models...)
+	loaded.mu.Unlock()
+
+	var killed int
+	for i := len(models) - 1; i >= 0; i-- {
+		if !models[i].terminate(ctx) {
+			killed++
+		}
+	}
+
+	if killed > 0 {
+		return fmt.Errorf("shutdown: killed %d llama.cpp servers that didn't exit in time: %w", killed, ctx.Err())
+	}
+
+	return nil
+}
+
+// terminate asks the server to exit, waiting until ctx is done before killing it, then closes
+// llm. It returns false if the server had to be killed.
+func (llm *llama) terminate(ctx context.Context) bool {
+	// refuse new requests while the server shuts down
+	llm.activity.close()
+
+	graceful := true
+	if cmd := llm.Running.Cmd; cmd != nil && cmd.Process != nil && llm.exited != nil && !llm.detached {
+		// windows can't send SIGTERM, so the server is killed there straight away
+		if err := cmd.Process.Signal(syscall.SIGTERM); err == nil {
+			select {
+			case <-llm.exited:
+			case <-ctx.Done():
+				graceful = false
+			}
+		}
+	}
+
+	llm.Close()
+
+	// wait for the killed server to be reaped, so none outlive this process
+	if llm.exited != nil && !llm.detached {
+		<-llm.exited
+	}
+
+	return graceful
+}
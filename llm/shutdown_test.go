@@ -0,0 +1,87 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+// startShutdownProcess starts script as the server process of a llama tracked for Shutdown
+func startShutdownProcess(t *testing.T, script string) *llama {
+	t.Helper()
+
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("sh is not available")
+	}
+
+	llm := newTestLlama(t, completionHandler())
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	llm.Cmd = exec.CommandContext(ctx, sh, "-c", script)
+	llm.Cancel = cancel
+	if err := llm.Cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	llm.exited = make(chan struct{})
+	go func() {
+		llm.exitErr = llm.Cmd.Wait()
+		close(llm.exited)
+	}()
+
+	track(llm)
+	t.Cleanup(func() { untrack(llm) })
+	return llm
+}
+
+func TestShutdown(t *testing.T) {
+	tests := []struct {
+		name    string
+		scripts []string
+		wantErr error
+	}{
+		{"exits", []string{"exec sleep 60", "exec sleep 60"}, nil},
+		{"straggler", []string{"exec sleep 60", "trap '' TERM; while :; do sleep 0.05; done"}, context.DeadlineExceeded},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var models []*llama
+			for _, script := range tt.scripts {
+				models = append(models, startShutdownProcess(t, script))
+			}
+
+			// give the shells time to set their traps
+			time.Sleep(100 * time.Millisecond)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+			defer cancel()
+
+			if err := Shutdown(ctx); !errors.Is(err, tt.wantErr) {
+				t.Errorf("got error %v, want %v", err, tt.wantErr)
+			}
+
+			for i, llm := range models {
+				select {
+				case <-llm.exited:
+				default:
+					t.Errorf("server %d wasn't reaped", i)
+				}
+
+				if llm.Cmd.ProcessState == nil {
+					t.Errorf("server %d has no exit status", i)
+				}
+			}
+
+			loaded.mu.Lock()
+			defer loaded.mu.Unlock()
+			if len(loaded.models) != 0 {
+				t.Errorf("got %d models still tracked, want 0", len(loaded.models))
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+)
+
+// SummarizeFunc condenses the text of the turns dropped from a chat's context into a summary that
+// takes their place
+type SummarizeFunc func(dropped string) (summary string)
+
+// SlideContext makes room in prevContext for reserve more tokens, the next prompt and its
+// response, so a long chat can keep going once its context nears num_ctx. While it fits it's
+// returned as it is. Otherwise the first num_keep tokens are kept, like the server keeps them when
+// its context fills up, along with the most recent tokens filling half of what's left, and the
+// ones in between are dropped. summarize is given the text dropped and its summary is put in its
+// place as it is, so it should carry its own formatting, such as being a turn of the chat format.
+// The new context is tokenized again from its text. A summary too long to fit is left out, and a
+// nil summarize drops the turns without one.
+func (llm *llama) SlideContext(ctx context.Context, prevContext []int, reserve int, summarize SummarizeFunc) ([]int, error) {
+	if reserve < 0 {
+		return nil, fmt.Errorf("slide context: reserve must not be negative, got %d", reserve)
+	}
+
+	budget := llm.NumCtx - reserve
+	if budget <= 0 {
+		return nil, fmt.Errorf("slide context: reserving %d tokens leaves no room in a %d token context", reserve, llm.NumCtx)
+	}
+
+	if len(prevContext) <= budget {
+		return prevContext, nil
+	}
+
+	keep := llm.NumKeep
+	if keep < 0 {
+		keep = 0
+	}
+
+	if keep >= budget {
+		return nil, fmt.Errorf("slide context: num_keep %d leaves no room in %d tokens", keep, budget)
+	}
+
+	retain := (budget - keep) / 2
+	cut := len(prevContext) - retain
+
+	head, err := llm.Decode(ctx, prevContext[:keep])
+	if err != nil {
+		return nil, fmt.Errorf("slide context: %w", err)
+	}
+
+	dropped, err := llm.Decode(ctx, prevContext[keep:cut])
+	if err != nil {
+		return nil, fmt.Errorf("slide context: %w", err)
+	}
+
+	tail, err := llm.Decode(ctx, prevContext[cut:])
+	if err != nil {
+		return nil, fmt.Errorf("slide context: %w", err)
+	}
+
+	var summary string
+	if summarize != nil {
+		summary = summarize(dropped)
+	}
+
+	logInfof("sliding the context window: dropping %d of %d tokens", cut-keep, len(prevContext))
+
+	next, err := llm.Encode(ctx, head+summary+tail)
+	if err != nil {
+		return nil, fmt.Errorf("slide context: %w", err)
+	}
+
+	if len(next) > budget && summary != "" {
+		logWarnf("the summary of the dropped turns doesn't fit in the context window, leaving it out")
+		if next, err = llm.Encode(ctx, head+tail); err != nil {
+			return nil, fmt.Errorf("slide context: %w", err)
+		}
+	}
+
+	return next, nil
+}
@@ -0,0 +1,155 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// vocabHandler serves /tokenize and /detokenize with a token for each word and the space before
+// it, numbering words as they're first seen, so decoding and encoding again round trips
+func vocabHandler() http.Handler {
+	var mu sync.Mutex
+	ids := make(map[string]int)
+	var pieces []string
+	words := regexp.MustCompile(`\s*\S+`)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/tokenize", func(w http.ResponseWriter, r *http.Request) {
+		var req TokenizeRequest
+		json.NewDecoder(r.Body).Decode(&req)
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		tokens := []int{}
+		for _, piece := range words.FindAllString(req.Content, -1) {
+			id, ok := ids[piece]
+			if !ok {
+				id = len(pieces)
+				ids[piece] = id
+				pieces = append(pieces, piece)
+			}
+
+			tokens = append(tokens, id)
+		}
+
+		json.NewEncoder(w).Encode(TokenizeResponse{Tokens: tokens})
+	})
+	mux.HandleFunc("/detokenize", func(w http.ResponseWriter, r *http.Request) {
+		var req DetokenizeRequest
+		json.NewDecoder(r.Body).Decode(&req)
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		var sb strings.Builder
+		for _, id := range req.Tokens {
+			sb.WriteString(pieces[id])
+		}
+
+		json.NewEncoder(w).Encode(DetokenizeResponse{Content: sb.String()})
+	})
+	return mux
+}
+
+func TestSlideContext(t *testing.T) {
+	const chat = "system: be brief user: one assistant: two user: three assistant: four user: five"
+
+	tests := []struct {
+		name        string
+		numKeep     int
+		reserve     int
+		summary     string
+		want        string
+		wantDropped string
+	}{
+		{name: "fits", reserve: 4, want: chat},
+		{
+			name: "summarized", numKeep: 3, reserve: 8, summary: " summary: counted to three",
+			want:        "system: be brief summary: counted to three assistant: four user: five",
+			wantDropped: " user: one assistant: two user: three",
+		},
+		{
+			name: "no summary", numKeep: 3, reserve: 8,
+			want:        "system: be brief assistant: four user: five",
+			wantDropped: " user: one assistant: two user: three",
+		},
+		{
+			name: "summary too long", numKeep: 3, reserve: 8, summary: " summary: a b c d e f g h",
+			want:        "system: be brief assistant: four user: five",
+			wantDropped: " user: one assistant: two user: three",
+		},
+		{
+			name: "nothing kept", reserve: 8, summary: " summary: earlier",
+			want:        " summary: earlier user: three assistant: four user: five",
+			wantDropped: "system: be brief user: one assistant: two",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			llm := newTestLlama(t, vocabHandler())
+			llm.NumCtx = 20
+			llm.NumKeep = tt.numKeep
+
+			ctx := context.Background()
+			prev, err := llm.Encode(ctx, chat)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var dropped string
+			var called bool
+			summarize := func(s string) string {
+				called = true
+				dropped = s
+				return tt.summary
+			}
+
+			next, err := llm.SlideContext(ctx, prev, tt.reserve, summarize)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(next) > llm.NumCtx-tt.reserve {
+				t.Errorf("got %d tokens, want at most %d", len(next), llm.NumCtx-tt.reserve)
+			}
+
+			got, err := llm.Decode(ctx, next)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got != tt.want {
+				t.Errorf("got context %q, want %q", got, tt.want)
+			}
+
+			if called != (tt.wantDropped != "") || dropped != tt.wantDropped {
+				t.Errorf("summarized %q, want %q", dropped, tt.wantDropped)
+			}
+
+			if tt.wantDropped == "" && !reflect.DeepEqual(next, prev) {
+				t.Errorf("got context %v, want it unchanged %v", next, prev)
+			}
+		})
+	}
+}
+
+func TestSlideContextNoRoom(t *testing.T) {
+	llm := newTestLlama(t, vocabHandler())
+	llm.NumCtx = 8
+	llm.NumKeep = 4
+
+	prev := []int{0, 1, 2, 3, 4, 5, 6, 7}
+	for _, reserve := range []int{-1, 4, 8} {
+		if _, err := llm.SlideContext(context.Background(), prev, reserve, nil); err == nil {
+			t.Errorf("reserve %d: got no error", reserve)
+		}
+	}
+}
@@ -0,0 +1,373 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+func newSlots(n int) chan int {
+	slots := make(chan int, n)
+	for i := 0; i < n; i++ {
+		slots <- i
+	}
+
+	return slots
+}
+
+// acquireSlot waits for an idle server slot so concurrent requests don't share one. It returns -1,
+// letting the server choose, when the server was started without parallel slots.
+func (llm *llama) acquireSlot(ctx context.Context) (int, error) {
+	if llm.slots == nil {
+		return -1, nil
+	}
+
+	select {
+	case slot := <-llm.slots:
+		return slot, nil
+	case <-ctx.Done():
+		return -1, fmt.Errorf("waiting for a slot: %w: %w", ErrContextCanceled, ctx.Err())
+	}
+}
+
+// acquireCachedSlot waits for an idle slot like acquireSlot, then trades it for whichever idle slot
+// last evaluated the longest prefix of prompt, so the server can reuse that slot's cache
+func (llm *llama) acquireCachedSlot(ctx context.Context, prompt string) (int, error) {
+	slot, err := llm.acquireSlot(ctx)
+	if err != nil || llm.slots == nil {
+		return slot, err
+	}
+
+	llm.slotMu.Lock()
+	defer llm.slotMu.Unlock()
+
+	best := sharedPrefixLen(llm.slotPrompts[slot], prompt)
+	for n := len(llm.slots); n > 0; n-- {
+		select {
+		case other := <-llm.slots:
+			if shared := sharedPrefixLen(llm.slotPrompts[other], prompt); shared > best {
+				slot, other, best = other, slot, shared
+			}
+
+			llm.slots <- other
+		default:
+			// another request took the remaining idle slots
+			return slot, nil
+		}
+	}
+
+	return slot, nil
+}
+
+// setSlotPrompt records the text a slot has in its cache after a prediction
+func (llm *llama) setSlotPrompt(slot int, prompt string) {
+	if llm.slots == nil || slot < 0 {
+		return
+	}
+
+	llm.slotMu.Lock()
+	defer llm.slotMu.Unlock()
+
+	if llm.slotPrompts == nil {
+		llm.slotPrompts = make(map[int]string)
+	}
+
+	llm.slotPrompts[slot] = prompt
+}
+
+// sharedPrefixLen returns the length in bytes of the prefix a and b have in common
+func sharedPrefixLen(a, b string) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+
+	return n
+}
+
+func (llm *llama) releaseSlot(slot int) {
+	if llm.slots != nil && slot >= 0 {
+		llm.slots <- slot
+	}
+}
+
+// cancelledSlotWait bounds how long the slot of a cancelled request is held back waiting for the
+// server to stop its task
+var cancelledSlotWait = 5 * time.Second
+
+// releaseCancelledSlot returns the slot of a cancelled request once the server has stopped its
+// task. Closing the request's connection cancels the task on that slot only, leaving the server and
+// the other slots running, but the server doesn't notice until it next writes a token, so handing
+// the slot straight to another request could find it still busy. Servers without /slots get the
+// slot back right away.
+func (llm *llama) releaseCancelledSlot(slot int) {
+	if llm.slots == nil || slot < 0 {
+		return
+	}
+
+	go func() {
+		defer llm.releaseSlot(slot)
+
+		ctx, cancel := context.WithTimeout(context.Background(), cancelledSlotWait)
+		defer cancel()
+
+		for {
+			var slots []slotResponse
+			if err := llm.getJSON(ctx, "/slots", &slots); err != nil || !slotBusy(slots, slot) {
+				return
+			}
+
+			t := time.NewTimer(readyPollInterval)
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				logWarnf("slot %d is still busy %s after its request was cancelled", slot, cancelledSlotWait)
+				return
+			case <-t.C:
+			}
+		}
+	}()
+}
+
+// resetGate lets Reset wait for the predictions in flight and hold new ones until it's done. Its
+// zero value is ready to use.
+type resetGate struct {
+	mu      sync.Mutex
+	running int
+
+	// resetting is closed when the reset in progress is done, it's nil when none is. idle is closed
+	// when the last prediction leaves while a reset waits for it.
+	resetting chan struct{}
+	idle      chan struct{}
+}
+
+// wait waits for the reset in progress, if any; callers hold mu, which is held again on return
+func (g *resetGate) wait(ctx context.Context) error {
+	for g.resetting != nil {
+		resetting := g.resetting
+		g.mu.Unlock()
+		select {
+		case <-resetting:
+			g.mu.Lock()
+		case <-ctx.Done():
+			g.mu.Lock()
+			return fmt.Errorf("waiting for a reset: %w: %w", ErrContextCanceled, ctx.Err())
+		}
+	}
+
+	return nil
+}
+
+// enter starts a prediction once no reset is in progress
+func (g *resetGate) enter(ctx context.Context) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if err := g.wait(ctx); err != nil {
+		return err
+	}
+
+	g.running++
+	return nil
+}
+
+// leave ends a prediction started with enter
+func (g *resetGate) leave() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.running--
+	if g.running == 0 && g.idle != nil {
+		close(g.idle)
+		g.idle = nil
+	}
+}
+
+// begin starts a reset once any other reset is done, holds new predictions and waits for the
+// running ones to leave. Every successful begin is followed by end.
+func (g *resetGate) begin(ctx context.Context) error {
+	g.mu.Lock()
+	if err := g.wait(ctx); err != nil {
+		g.mu.Unlock()
+		return err
+	}
+
+	g.resetting = make(chan struct{})
+	if g.running == 0 {
+		g.mu.Unlock()
+		return nil
+	}
+
+	g.idle = make(chan struct{})
+	idle := g.idle
+	g.mu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		g.end()
+		return fmt.Errorf("waiting for predictions: %w: %w", ErrContextCanceled, ctx.Err())
+	}
+}
+
+// end lets the predictions held by begin run
+func (g *resetGate) end() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	close(g.resetting)
+	g.resetting = nil
+	g.idle = nil
+}
+
+// Reset erases the kv cache of every server slot so the next prediction starts from an empty
+// context without reloading the model. Predict already resends the whole conversation through
+// prevContext, so switching between conversations doesn't need a Reset; it's for releasing the
+// cache a long earlier session left behind and making sure none of it is reused. Reset waits for
+// running predictions to finish and holds new ones until the slots are erased; concurrent Resets
+// run one at a time.
+func (llm *llama) Reset(ctx context.Context) error {
+	if err := llm.activity.begin(); err != nil {
+		return err
+	}
+	defer llm.activity.end()
+
+	if err := llm.waitReady(ctx); err != nil {
+		return err
+	}
+
+	if err := llm.resets.begin(ctx); err != nil {
+		return fmt.Errorf("reset: %w", err)
+	}
+	defer llm.resets.end()
+
+	slots := []int{0}
+	if llm.slots != nil {
+		slots = slots[:0]
+		defer func() {
+			for _, slot := range slots {
+				llm.releaseSlot(slot)
+			}
+		}()
+
+		// the slots of cancelled predictions come back once the server has stopped their tasks
+		for i := 0; i < cap(llm.slots); i++ {
+			slot, err := llm.acquireSlot(ctx)
+			if err != nil {
+				return fmt.Errorf("reset: %w", err)
+			}
+
+			slots = append(slots, slot)
+		}
+	}
+
+	for _, slot := range slots {
+		if err := llm.eraseSlot(ctx, slot); err != nil {
+			return err
+		}
+
+		llm.setSlotPrompt(slot, "")
+	}
+
+	return nil
+}
+
+func (llm *llama) eraseSlot(ctx context.Context, slot int) error {
+	endpoint := llm.endpoint(fmt.Sprintf("/slots/%d?action=erase", slot))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, nil)
+	if err != nil {
+		return fmt.Errorf("erase slot request: %w", err)
+	}
+
+	resp, err := llm.doRequest(ctx, req)
+	if err != nil {
+		return requestError(ctx, "do erase slot request", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := readBody(resp.Body)
+	if err != nil {
+		return fmt.Errorf("read erase slot response: %w", err)
+	}
+
+	if resp.StatusCode >= 400 {
+		logErrorf("llm erase slot error: %s", body)
+		return &ServerError{StatusCode: resp.StatusCode, Body: string(body), Endpoint: "/slots"}
+	}
+
+	return nil
+}
+
+// slotResponse is an entry of the server's /slots list. Older servers report a numeric state that's
+// 0 when idle, newer ones is_processing.
+type slotResponse struct {
+	ID           int   `json:"id"`
+	State        *int  `json:"state"`
+	IsProcessing *bool `json:"is_processing"`
+}
+
+func (s slotResponse) busy() bool {
+	return (s.IsProcessing != nil && *s.IsProcessing) || (s.State != nil && *s.State != 0)
+}
+
+// slotBusy reports whether the slot with id is running a request
+func slotBusy(slots []slotResponse, id int) bool {
+	for _, s := range slots {
+		if s.ID == id {
+			return s.busy()
+		}
+	}
+
+	return false
+}
+
+// SlotStatus returns the number of server slots and how many of them are running a request, for
+// routing requests to the least busy model or deciding to load another. Servers without a /slots
+// endpoint, or with it disabled, are answered from the requests this process has in flight.
+func (llm *llama) SlotStatus(ctx context.Context) (total, busy int, err error) {
+	if err := llm.activity.begin(); err != nil {
+		return 0, 0, err
+	}
+	defer llm.activity.end()
+
+	if err := llm.waitReady(ctx); err != nil {
+		return 0, 0, err
+	}
+
+	var slots []slotResponse
+	if err := llm.getJSON(ctx, "/slots", &slots); err != nil {
+		var serr *ServerError
+		if !errors.As(err, &serr) || (serr.StatusCode != http.StatusNotFound && serr.StatusCode != http.StatusNotImplemented) {
+			return 0, 0, err
+		}
+
+		total, busy = llm.localSlotStatus()
+		return total, busy, nil
+	}
+
+	for _, slot := range slots {
+		if slot.busy() {
+			busy++
+		}
+	}
+
+	return len(slots), busy, nil
+}
+
+// localSlotStatus counts the slots handed out to requests, which misses requests from other
+// clients of the same server
+func (llm *llama) localSlotStatus() (total, busy int) {
+	if llm.slots == nil {
+		if llm.generations.count() > 0 {
+			return 1, 1
+		}
+
+		return 1, 0
+	}
+
+	return cap(llm.slots), cap(llm.slots) - len(llm.slots)
+}
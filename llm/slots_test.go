@@ -0,0 +1,580 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+func TestRunnerParamsParallel(t *testing.T) {
+	opts := api.DefaultOptions()
+	opts.NumParallel = 4
+
+	params, err := runnerParams("model.bin", nil, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, _ := flagValue(params, "--parallel"); got != "4" {
+		t.Errorf("got --parallel %q, want 4", got)
+	}
+
+	if _, ok := flagValue(params, "--cont-batching"); !ok {
+		t.Error("expected --cont-batching")
+	}
+
+	if got, _ := flagValue(params, "--ctx-size"); got != "8192" {
+		t.Errorf("got --ctx-size %q, want 8192", got)
+	}
+}
+
+func TestParallelSlots(t *testing.T) {
+	var mu sync.Mutex
+	active := make(map[int]bool)
+	var maxActive int
+
+	mux := http.NewServeMux()
+	mux.Handle("/tokenize", completionHandler())
+	mux.HandleFunc("/completion", func(w http.ResponseWriter, r *http.Request) {
+		var req PredictRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+			return
+		}
+
+		mu.Lock()
+		if active[req.SlotID] {
+			t.Errorf("slot %d was used by two requests at once", req.SlotID)
+		}
+		active[req.SlotID] = true
+		if len(active) > maxActive {
+			maxActive = len(active)
+		}
+		mu.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+
+		mu.Lock()
+		delete(active, req.SlotID)
+		mu.Unlock()
+
+		writeEvents(w, Prediction{Content: "hi"}, Prediction{Stop: true})
+	})
+
+	llm := newTestLlama(t, mux)
+	llm.slots = newSlots(2)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := llm.Predict(context.Background(), nil, "hello", func(api.GenerateResponse) {}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if maxActive > 2 {
+		t.Errorf("got %d concurrent requests, want at most 2", maxActive)
+	}
+
+	if len(llm.slots) != 2 {
+		t.Errorf("got %d idle slots after all requests finished, want 2", len(llm.slots))
+	}
+}
+
+func TestReset(t *testing.T) {
+	tests := []struct {
+		name     string
+		parallel int
+		status   int
+		want     []string
+		wantErr  bool
+	}{
+		{"single slot", 0, http.StatusOK, []string{"/slots/0?action=erase"}, false},
+		{"parallel", 3, http.StatusOK, []string{"/slots/0?action=erase", "/slots/1?action=erase", "/slots/2?action=erase"}, false},
+		{"server error", 0, http.StatusNotImplemented, []string{"/slots/0?action=erase"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			llm := newTestLlama(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodPost {
+					t.Errorf("got method %s, want POST", r.Method)
+				}
+
+				got = append(got, r.URL.RequestURI())
+				w.WriteHeader(tt.status)
+			}))
+
+			if tt.parallel > 1 {
+				llm.slots = newSlots(tt.parallel)
+			}
+
+			err := llm.Reset(context.Background())
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got requests %v, want %v", got, tt.want)
+			}
+
+			if llm.slots != nil && len(llm.slots) != tt.parallel {
+				t.Errorf("got %d idle slots after reset, want %d", len(llm.slots), tt.parallel)
+			}
+		})
+	}
+}
+
+func TestResetWaitsForSlots(t *testing.T) {
+	llm := newTestLlama(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected request %s", r.URL)
+	}))
+	llm.slots = newSlots(2)
+
+	// a prediction holding a slot keeps the reset waiting until ctx expires
+	slot, err := llm.acquireSlot(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	if err := llm.Reset(ctx); !errors.Is(err, ErrContextCanceled) {
+		t.Errorf("got error %v, want %v", err, ErrContextCanceled)
+	}
+
+	llm.releaseSlot(slot)
+	if len(llm.slots) != 2 {
+		t.Errorf("got %d idle slots, want 2", len(llm.slots))
+	}
+}
+
+func TestResetWaitsForPredictions(t *testing.T) {
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var got []string
+
+	mux := http.NewServeMux()
+	mux.Handle("/tokenize", completionHandler())
+	mux.HandleFunc("/completion", func(w http.ResponseWriter, r *http.Request) {
+		var req PredictRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+			return
+		}
+
+		mu.Lock()
+		got = append(got, req.Prompt)
+		mu.Unlock()
+
+		writeEvents(w, Prediction{Content: req.Prompt})
+		if req.Prompt == "running" {
+			<-release
+		}
+		writeEvents(w, Prediction{Stop: true})
+	})
+	mux.HandleFunc("/slots/", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		got = append(got, "erase")
+		mu.Unlock()
+	})
+
+	// without parallel slots the reset still waits for the prediction on the server's only slot
+	llm := newTestLlama(t, mux)
+
+	started := make(chan struct{})
+	running := make(chan error, 1)
+	go func() {
+		running <- llm.Predict(context.Background(), nil, "running", func(r api.GenerateResponse) {
+			if r.Response == "running" {
+				close(started)
+			}
+		})
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := llm.Reset(ctx); !errors.Is(err, ErrContextCanceled) {
+		t.Errorf("got error %v, want %v", err, ErrContextCanceled)
+	}
+
+	reset := make(chan error, 1)
+	go func() { reset <- llm.Reset(context.Background()) }()
+
+	for {
+		llm.resets.mu.Lock()
+		waiting := llm.resets.resetting != nil
+		llm.resets.mu.Unlock()
+		if waiting {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// a prediction that starts while the reset waits runs after it
+	held := make(chan error, 1)
+	go func() { held <- llm.Predict(context.Background(), nil, "held", func(api.GenerateResponse) {}) }()
+
+	close(release)
+	for _, ch := range []chan error{running, reset, held} {
+		if err := <-ch; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if want := []string{"running", "erase", "held"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got requests %v, want %v", got, want)
+	}
+}
+
+func TestConcurrentResets(t *testing.T) {
+	llm := newTestLlama(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	llm.slots = newSlots(3)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := llm.Reset(ctx); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(llm.slots) != 3 {
+		t.Errorf("got %d idle slots after the resets, want 3", len(llm.slots))
+	}
+}
+
+func TestCachePromptSlot(t *testing.T) {
+	var mu sync.Mutex
+	var got []PredictRequest
+	mux := http.NewServeMux()
+	mux.Handle("/tokenize", completionHandler())
+	mux.HandleFunc("/completion", func(w http.ResponseWriter, r *http.Request) {
+		var req PredictRequest
+		json.NewDecoder(r.Body).Decode(&req)
+
+		mu.Lock()
+		got = append(got, req)
+		mu.Unlock()
+
+		writeEvents(w, Prediction{Content: " hi"}, Prediction{Stop: true, TokensCached: 3})
+	})
+
+	llm := newTestLlama(t, mux)
+	llm.slots = newSlots(2)
+	llm.CachePrompt = true
+
+	prompts := []string{"you are a helpful assistant. hello", "you are a helpful assistant. hello hi again"}
+	for _, prompt := range prompts {
+		if err := llm.Predict(context.Background(), nil, prompt, func(api.GenerateResponse) {}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(got) != 2 {
+		t.Fatalf("got %d requests, want 2", len(got))
+	}
+
+	// the first slot is queued behind the second after it's released, the second request takes it
+	// back since it holds the shared prefix
+	for i, req := range got {
+		if !req.CachePrompt {
+			t.Errorf("request %d: cache_prompt not set", i)
+		}
+
+		if req.SlotID != 0 {
+			t.Errorf("request %d: got slot %d, want 0", i, req.SlotID)
+		}
+	}
+
+	if got := llm.Metrics().CachedPromptTokens; got != 6 {
+		t.Errorf("got %d cached prompt tokens, want 6", got)
+	}
+}
+
+func TestSharedPrefixLen(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "hello", 0},
+		{"hello", "hello world", 5},
+		{"hello world", "hello there", 6},
+		{"abc", "xyz", 0},
+	}
+
+	for _, tt := range tests {
+		if got := sharedPrefixLen(tt.a, tt.b); got != tt.want {
+			t.Errorf("sharedPrefixLen(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestSlotStatus(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		body      string
+		wantTotal int
+		wantBusy  int
+		wantErr   bool
+	}{
+		{"state", http.StatusOK, `[{"id": 0, "state": 1}, {"id": 1, "state": 0}, {"id": 2, "state": 1}]`, 3, 2, false},
+		{"is_processing", http.StatusOK, `[{"id": 0, "is_processing": false}, {"id": 1, "is_processing": true}]`, 2, 1, false},
+		{"no state", http.StatusOK, `[{"id": 0}]`, 1, 0, false},
+		{"disabled", http.StatusNotImplemented, `{"error": {"code": 501, "message": "This server does not support slots endpoint."}}`, 4, 1, false},
+		{"not found", http.StatusNotFound, "", 4, 1, false},
+		{"malformed", http.StatusOK, `{"slots": 4}`, 0, 0, true},
+		{"server error", http.StatusInternalServerError, "", 0, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			llm := newTestLlama(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/slots" {
+					t.Errorf("got request to %s, want /slots", r.URL.Path)
+				}
+
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			llm.slots = newSlots(4)
+
+			// one slot is held by a request from this process
+			slot, err := llm.acquireSlot(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer llm.releaseSlot(slot)
+
+			total, busy, err := llm.SlotStatus(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error: %v", err, tt.wantErr)
+			}
+
+			if total != tt.wantTotal || busy != tt.wantBusy {
+				t.Errorf("got %d of %d slots busy, want %d of %d", busy, total, tt.wantBusy, tt.wantTotal)
+			}
+		})
+	}
+}
+
+func TestCancelOneSlot(t *testing.T) {
+	defer func(orig time.Duration) { readyPollInterval = orig }(readyPollInterval)
+	readyPollInterval = time.Millisecond
+
+	cancelled := make(chan struct{})
+	var mu sync.Mutex
+	busy := make(map[int]bool)
+
+	mux := http.NewServeMux()
+	mux.Handle("/tokenize", completionHandler())
+	mux.HandleFunc("/completion", func(w http.ResponseWriter, r *http.Request) {
+		var req PredictRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+			return
+		}
+
+		mu.Lock()
+		busy[req.SlotID] = true
+		mu.Unlock()
+
+		writeEvents(w, Prediction{Content: req.Prompt})
+		if req.Prompt == "cancel" {
+			// generate until the client goes away, then stop this slot only
+			<-r.Context().Done()
+			mu.Lock()
+			busy[req.SlotID] = false
+			mu.Unlock()
+			close(cancelled)
+			return
+		}
+
+		// keep generating past the other request's cancellation
+		<-cancelled
+		writeEvents(w, Prediction{Content: " done"}, Prediction{Stop: true})
+
+		mu.Lock()
+		busy[req.SlotID] = false
+		mu.Unlock()
+	})
+	mux.HandleFunc("/slots", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		slots := []map[string]any{}
+		for id, b := range busy {
+			slots = append(slots, map[string]any{"id": id, "is_processing": b})
+		}
+		json.NewEncoder(w).Encode(slots)
+	})
+
+	llm := newTestLlama(t, mux)
+	llm.slots = newSlots(2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	started := make(chan struct{})
+	cancelErr := make(chan error, 1)
+	go func() {
+		cancelErr <- llm.Predict(ctx, nil, "cancel", func(r api.GenerateResponse) {
+			if r.Response != "" {
+				close(started)
+			}
+		})
+	}()
+
+	var sb strings.Builder
+	var final bool
+	otherErr := make(chan error, 1)
+	go func() {
+		otherErr <- llm.Predict(context.Background(), nil, "keep", func(r api.GenerateResponse) {
+			sb.WriteString(r.Response)
+			final = final || r.Done
+		})
+	}()
+
+	<-started
+	cancel()
+
+	if err := <-cancelErr; !errors.Is(err, ErrContextCanceled) {
+		t.Errorf("got error %v for the cancelled request, want %v", err, ErrContextCanceled)
+	}
+
+	if err := <-otherErr; err != nil {
+		t.Fatalf("the other request failed: %v", err)
+	}
+
+	if sb.String() != "keep done" || !final {
+		t.Errorf("got response %q, done %v, want the other request to finish", sb.String(), final)
+	}
+
+	if llm.IsClosed() {
+		t.Error("cancelling a request closed the server")
+	}
+
+	// the cancelled slot is returned once the server reports it idle
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < 2; i++ {
+		if _, err := llm.acquireSlot(ctx); err != nil {
+			t.Fatalf("slot %d wasn't returned: %v", i, err)
+		}
+	}
+}
+
+func TestStopHoldsSlot(t *testing.T) {
+	defer func(orig time.Duration) { readyPollInterval = orig }(readyPollInterval)
+	readyPollInterval = time.Millisecond
+
+	idle := make(chan struct{})
+	var mu sync.Mutex
+	busy := make(map[int]bool)
+
+	mux := http.NewServeMux()
+	mux.Handle("/tokenize", completionHandler())
+	mux.HandleFunc("/completion", func(w http.ResponseWriter, r *http.Request) {
+		var req PredictRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+			return
+		}
+
+		mu.Lock()
+		busy[req.SlotID] = true
+		mu.Unlock()
+
+		writeEvents(w, Prediction{Content: req.Prompt})
+		if req.Prompt == "stop" {
+			// the server keeps running the task after the client goes away until idle is closed
+			<-r.Context().Done()
+			<-idle
+		} else {
+			writeEvents(w, Prediction{Stop: true})
+		}
+
+		mu.Lock()
+		busy[req.SlotID] = false
+		mu.Unlock()
+	})
+	mux.HandleFunc("/slots", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		slots := []map[string]any{}
+		for id, b := range busy {
+			slots = append(slots, map[string]any{"id": id, "is_processing": b})
+		}
+		json.NewEncoder(w).Encode(slots)
+	})
+
+	llm := newTestLlama(t, mux)
+	llm.slots = newSlots(2)
+
+	// another request holds the other slot
+	other, err := llm.acquireSlot(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer llm.releaseSlot(other)
+
+	started := make(chan struct{})
+	stopErr := make(chan error, 1)
+	go func() {
+		stopErr <- llm.Predict(context.Background(), nil, "stop", func(r api.GenerateResponse) {
+			if r.Response == "stop" {
+				close(started)
+			}
+		})
+	}()
+
+	<-started
+	if err := llm.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-stopErr; err != nil {
+		t.Fatalf("got error %v for the stopped request", err)
+	}
+
+	// the server still reports the stopped slot busy, so the next request waits for it
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := llm.Predict(ctx, nil, "next", func(api.GenerateResponse) {}); !errors.Is(err, ErrContextCanceled) {
+		t.Errorf("got error %v while the slot is busy, want %v", err, ErrContextCanceled)
+	}
+
+	close(idle)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := llm.Predict(ctx, nil, "next", func(api.GenerateResponse) {}); err != nil {
+		t.Errorf("got error %v once the slot is idle", err)
+	}
+}
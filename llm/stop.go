@@ -0,0 +1,104 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// generation is a prediction in flight that Stop can end early
+type generation struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+// stopped reports whether Stop was called while g was running
+func (g *generation) stopped() bool {
+	select {
+	case <-g.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// signal tells g to stop; callers hold the generations lock so stop is only closed once
+func (g *generation) signal() {
+	if !g.stopped() {
+		close(g.stop)
+	}
+}
+
+// generations tracks the predictions in flight
+type generations struct {
+	mu     sync.Mutex
+	active map[*generation]bool
+}
+
+func (gs *generations) start() *generation {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+
+	if gs.active == nil {
+		gs.active = make(map[*generation]bool)
+	}
+
+	g := &generation{stop: make(chan struct{}), done: make(chan struct{})}
+	gs.active[g] = true
+	return g
+}
+
+func (gs *generations) finish(g *generation) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+
+	delete(gs.active, g)
+	close(g.done)
+}
+
+// count returns the number of generations in flight
+func (gs *generations) count() int {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	return len(gs.active)
+}
+
+// stopOne signals g to stop, like Stop does for every generation
+func (gs *generations) stopOne(g *generation) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	g.signal()
+}
+
+// stopAll signals every generation in flight to stop and returns them
+func (gs *generations) stopAll() []*generation {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+
+	stopped := make([]*generation, 0, len(gs.active))
+	for g := range gs.active {
+		g.signal()
+		stopped = append(stopped, g)
+	}
+
+	return stopped
+}
+
+// Stop ends the predictions in flight as if the model had finished generating: each one stops
+// reading from the server, sends what it generated so far followed by a final response with Done
+// set and the context to continue from, and returns no error. Cancelling a prediction's ctx
+// instead abandons it, returning ErrContextCanceled without a final response.
+//
+// Stop waits for the predictions to return, or for ctx to be done. Predictions that start after
+// Stop returns aren't affected.
+func (llm *llama) Stop(ctx context.Context) error {
+	for _, g := range llm.generations.stopAll() {
+		select {
+		case <-g.done:
+		case <-ctx.Done():
+			return fmt.Errorf("stop: %w: %w", ErrContextCanceled, ctx.Err())
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,140 @@
+package llm
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+func TestStop(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/tokenize", completionHandler())
+	mux.HandleFunc("/completion", func(w http.ResponseWriter, r *http.Request) {
+		writeEvents(w, Prediction{Content: "why", Timings: Timings{PromptN: 3}}, Prediction{Content: " is the"})
+
+		// keep generating until the client goes away
+		<-r.Context().Done()
+	})
+
+	llm := newTestLlama(t, mux)
+
+	generating := make(chan struct{})
+	errc := make(chan error, 1)
+	var sb strings.Builder
+	var final *api.GenerateResponse
+	go func() {
+		errc <- llm.Predict(context.Background(), nil, "hello there", func(resp api.GenerateResponse) {
+			sb.WriteString(resp.Response)
+			if resp.Response == " is the" {
+				close(generating)
+			}
+
+			if resp.Done {
+				final = &resp
+			}
+		})
+	}()
+
+	select {
+	case <-generating:
+	case <-time.After(5 * time.Second):
+		t.Fatal("prediction didn't start")
+	}
+
+	if err := llm.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Stop waits for the prediction to return
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Fatalf("got error %v, want a clean stop", err)
+		}
+	default:
+		t.Fatal("Stop returned before the prediction")
+	}
+
+	if sb.String() != "why is the" {
+		t.Errorf("got response %q", sb.String())
+	}
+
+	if final == nil {
+		t.Fatal("no final response")
+	}
+
+	// one token per word of "hello therewhy is the"
+	if len(final.Context) != 4 {
+		t.Errorf("got context %v, want 4 tokens", final.Context)
+	}
+
+	if final.PromptEvalCount != 3 || final.EvalCount != 2 {
+		t.Errorf("got counts %d, %d, want 3, 2", final.PromptEvalCount, final.EvalCount)
+	}
+
+	if final.StopReason != api.StopReasonStopped {
+		t.Errorf("got stop reason %q, want %q", final.StopReason, api.StopReasonStopped)
+	}
+}
+
+func TestStopIdle(t *testing.T) {
+	llm := newTestLlama(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected request %s", r.URL)
+	}))
+
+	if err := llm.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPredictMaxDuration(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/tokenize", completionHandler())
+	mux.HandleFunc("/completion", func(w http.ResponseWriter, r *http.Request) {
+		writeEvents(w, Prediction{Content: "why", Timings: Timings{PromptN: 3}}, Prediction{Content: " is the"})
+
+		// keep generating until the client goes away
+		<-r.Context().Done()
+	})
+
+	llm := newTestLlama(t, mux)
+	opts := api.DefaultOptions()
+	opts.MaxDurationMs = 50
+
+	var sb strings.Builder
+	var final *api.GenerateResponse
+	errc := make(chan error, 1)
+	go func() {
+		errc <- llm.PredictWithOptions(context.Background(), nil, "hello there", opts, func(resp api.GenerateResponse) {
+			sb.WriteString(resp.Response)
+			if resp.Done {
+				final = &resp
+			}
+		})
+	}()
+
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Fatalf("got error %v, want a clean stop", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("prediction didn't stop after max_duration")
+	}
+
+	if sb.String() != "why is the" {
+		t.Errorf("got response %q", sb.String())
+	}
+
+	if final == nil {
+		t.Fatal("no final response")
+	}
+
+	if final.EvalCount != 2 {
+		t.Errorf("got eval count %d, want 2", final.EvalCount)
+	}
+}
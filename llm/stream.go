@@ -0,0 +1,44 @@
+package llm
+
+import (
+	"context"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+// predictChanSize is how many responses PredictChan buffers for a consumer that falls behind
+const predictChanSize = 64
+
+// PredictChan runs a prediction like Predict but delivers responses on a channel instead of
+// calling a function from the loop reading the server's stream.
+//
+// Up to predictChanSize responses are buffered, so the stream keeps being read while the consumer
+// is busy; once the buffer is full reading pauses until the consumer catches up. The response
+// channel is closed when the prediction ends, after which the error channel yields the error, if
+// any, and is closed too.
+//
+// Cancelling ctx stops the prediction even if the consumer has stopped receiving. Responses
+// already buffered can still be read and the error is ErrContextCanceled. A consumer that stops
+// early must cancel ctx, otherwise the prediction stays blocked on the full buffer.
+func (llm *llama) PredictChan(ctx context.Context, prevContext []int, prompt string) (<-chan api.GenerateResponse, <-chan error) {
+	responses := make(chan api.GenerateResponse, predictChanSize)
+	errc := make(chan error, 1)
+
+	go func() {
+		defer close(errc)
+
+		err := llm.Predict(ctx, prevContext, prompt, func(resp api.GenerateResponse) {
+			select {
+			case responses <- resp:
+			case <-ctx.Done():
+			}
+		})
+
+		close(responses)
+		if err != nil {
+			errc <- err
+		}
+	}()
+
+	return responses, errc
+}
@@ -0,0 +1,241 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+func TestPredictChan(t *testing.T) {
+	written := make(chan struct{})
+	handler := completionHandler()
+	mux := http.NewServeMux()
+	mux.Handle("/tokenize", handler)
+	mux.HandleFunc("/completion", func(w http.ResponseWriter, r *http.Request) {
+		writeEvents(w, Prediction{Content: "why"}, Prediction{Content: " is the sky"}, Prediction{Content: " blue"}, Prediction{Stop: true})
+		close(written)
+	})
+
+	llm := newTestLlama(t, mux)
+	responses, errc := llm.PredictChan(context.Background(), nil, "hello")
+
+	// the whole stream is read before anything is received
+	select {
+	case <-written:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream was not read ahead of the consumer")
+	}
+
+	var sb strings.Builder
+	var done bool
+	for resp := range responses {
+		sb.WriteString(resp.Response)
+		done = resp.Done
+	}
+
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+
+	if sb.String() != "why is the sky blue" {
+		t.Errorf("got response %q", sb.String())
+	}
+
+	if !done {
+		t.Error("last response is not done")
+	}
+}
+
+func TestPredictChanCancel(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/completion", func(w http.ResponseWriter, r *http.Request) {
+		// more than the buffer holds, then wait for the client to go away
+		for i := 0; i < predictChanSize*2; i++ {
+			writeEvents(w, Prediction{Content: "token"})
+		}
+		<-r.Context().Done()
+	})
+
+	llm := newTestLlama(t, mux)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	responses, errc := llm.PredictChan(ctx, nil, "hello")
+
+	// wait for the buffer to fill before cancelling without having received anything
+	deadline := time.Now().Add(5 * time.Second)
+	for len(responses) < predictChanSize {
+		if time.Now().After(deadline) {
+			t.Fatalf("buffered %d responses, want %d", len(responses), predictChanSize)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+
+	var n int
+	for range responses {
+		n++
+	}
+
+	// the response that was waiting for space may or may not get in after the cancel
+	if n < predictChanSize || n > predictChanSize+1 {
+		t.Errorf("got %d buffered responses, want %d", n, predictChanSize)
+	}
+
+	if err := <-errc; !errors.Is(err, ErrContextCanceled) {
+		t.Errorf("got error %v, want %v", err, ErrContextCanceled)
+	}
+}
+
+func TestPredictPromptProcessed(t *testing.T) {
+	llm := newTestLlama(t, completionHandler(
+		Prediction{Content: "why", Timings: Timings{PromptN: 5}},
+		Prediction{Content: " is"},
+		Prediction{Content: " the sky"},
+		Prediction{Stop: true},
+	))
+
+	var events []string
+	err := llm.Predict(context.Background(), nil, "hello", func(resp api.GenerateResponse) {
+		switch {
+		case resp.PromptProcessed:
+			if resp.Response != "" {
+				t.Errorf("got content %q with the prompt processed event", resp.Response)
+			}
+
+			if resp.PromptEvalCount != 5 {
+				t.Errorf("got prompt eval count %d, want 5", resp.PromptEvalCount)
+			}
+
+			events = append(events, "processed")
+		case resp.Done:
+			events = append(events, "done")
+		default:
+			events = append(events, "content")
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"processed", "content", "content", "content", "done"}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("got events %v, want %v", events, want)
+	}
+}
+
+func TestPredictTokens(t *testing.T) {
+	tests := []struct {
+		name       string
+		wantTokens bool
+		want       [][]int
+	}{
+		{"requested", true, [][]int{{1}, {2}, {3, 4}, {5}}},
+		{"not requested", false, [][]int{nil, nil, nil, nil}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mux := http.NewServeMux()
+			mux.Handle("/tokenize", completionHandler())
+			mux.HandleFunc("/completion", func(w http.ResponseWriter, r *http.Request) {
+				var req PredictRequest
+				if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+					t.Error(err)
+				}
+
+				if req.ReturnTokens != tt.wantTokens {
+					t.Errorf("got return_tokens %v, want %v", req.ReturnTokens, tt.wantTokens)
+				}
+
+				if !req.ReturnTokens {
+					writeEvents(w, Prediction{Content: "why"}, Prediction{Content: " is"}, Prediction{Content: "😀"}, Prediction{Content: "!"}, Prediction{Stop: true})
+					return
+				}
+
+				writeEvents(w, Prediction{Content: "why", Tokens: []int{1}}, Prediction{Content: " is", Tokens: []int{2}})
+				// the bytes of 😀 split between two tokens
+				fmt.Fprint(w, "data: {\"content\":\"\xf0\x9f\",\"tokens\":[3]}\n\n")
+				fmt.Fprint(w, "data: {\"content\":\"\x98\x80\",\"tokens\":[4]}\n\n")
+				writeEvents(w, Prediction{Content: "!", Tokens: []int{5}}, Prediction{Stop: true})
+			})
+
+			llm := newTestLlama(t, mux)
+			llm.WantTokens = tt.wantTokens
+
+			var got [][]int
+			var sb strings.Builder
+			err := llm.Predict(context.Background(), nil, "hello", func(resp api.GenerateResponse) {
+				if resp.Response != "" {
+					got = append(got, resp.Tokens)
+					sb.WriteString(resp.Response)
+				}
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if sb.String() != "why is😀!" {
+				t.Errorf("got response %q", sb.String())
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got tokens %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPredictPromptProgress(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/tokenize", completionHandler())
+	mux.HandleFunc("/completion", func(w http.ResponseWriter, r *http.Request) {
+		var req PredictRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+
+		if !req.ReturnProgress {
+			t.Error("progress wasn't requested")
+		}
+
+		writeEvents(w,
+			Prediction{PromptProgress: &PromptProgress{Total: 3000, Processed: 1024}},
+			Prediction{PromptProgress: &PromptProgress{Total: 3000, Processed: 2048}},
+			Prediction{PromptProgress: &PromptProgress{Total: 3000, Processed: 3000}},
+			Prediction{Content: "why", Timings: Timings{PromptN: 3000}},
+			Prediction{Stop: true},
+		)
+	})
+
+	llm := newTestLlama(t, mux)
+
+	var events []string
+	err := llm.Predict(context.Background(), nil, "hello", func(resp api.GenerateResponse) {
+		switch {
+		case resp.PromptProgress != nil:
+			events = append(events, fmt.Sprintf("%d/%d", resp.PromptProgress.Processed, resp.PromptProgress.Total))
+		case resp.PromptProcessed:
+			events = append(events, "processed")
+		case resp.Done:
+			events = append(events, "done")
+		default:
+			events = append(events, resp.Response)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"1024/3000", "2048/3000", "3000/3000", "processed", "why", "done"}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("got events %v, want %v", events, want)
+	}
+}
@@ -0,0 +1,32 @@
+package llm
+
+import "sync"
+
+// stderrTailSize is how much of the end of the server's stderr is kept for error messages
+const stderrTailSize = 4096
+
+// tailBuffer keeps the last stderrTailSize bytes written to it, it is safe to read while the
+// process is still writing
+type tailBuffer struct {
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.buf = append(b.buf, p...)
+	if len(b.buf) > stderrTailSize {
+		b.buf = append(b.buf[:0], b.buf[len(b.buf)-stderrTailSize:]...)
+	}
+
+	return len(p), nil
+}
+
+func (b *tailBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return string(b.buf)
+}
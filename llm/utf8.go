@@ -0,0 +1,147 @@
+package llm
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// decodePrediction unmarshals a server event. The server can split a multi-byte character across
+// events, and encoding/json would replace the partial bytes with U+FFFD, so when the event isn't
+// valid UTF-8 the content is decoded again keeping its bytes as they are.
+func decodePrediction(evt []byte) (Prediction, error) {
+	var p Prediction
+	if err := json.Unmarshal(evt, &p); err != nil {
+		return p, err
+	}
+
+	if !utf8.Valid(evt) {
+		var raw struct {
+			Content json.RawMessage `json:"content"`
+		}
+
+		if err := json.Unmarshal(evt, &raw); err != nil {
+			return p, err
+		}
+
+		content, err := unquoteBytes(raw.Content)
+		if err != nil {
+			return p, err
+		}
+
+		p.Content = content
+	}
+
+	return p, nil
+}
+
+// unquoteBytes decodes a json string without replacing invalid UTF-8
+func unquoteBytes(s []byte) (string, error) {
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return "", errors.New("invalid json string")
+	}
+	s = s[1 : len(s)-1]
+
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b = append(b, s[i])
+			continue
+		}
+
+		i++
+		if i == len(s) {
+			return "", errors.New("invalid json string escape")
+		}
+
+		switch s[i] {
+		case '"', '\\', '/':
+			b = append(b, s[i])
+		case 'b':
+			b = append(b, '\b')
+		case 'f':
+			b = append(b, '\f')
+		case 'n':
+			b = append(b, '\n')
+		case 'r':
+			b = append(b, '\r')
+		case 't':
+			b = append(b, '\t')
+		case 'u':
+			r, n, err := unquoteRune(s[i+1:])
+			if err != nil {
+				return "", err
+			}
+
+			b = utf8.AppendRune(b, r)
+			i += n
+		default:
+			return "", errors.New("invalid json string escape")
+		}
+	}
+
+	return string(b), nil
+}
+
+// unquoteRune decodes the hex digits of a \u escape, combining a following escape when the two
+// are a surrogate pair, and returns the rune and the number of bytes read
+func unquoteRune(s []byte) (rune, int, error) {
+	hex := func(s []byte) (rune, error) {
+		if len(s) < 4 {
+			return 0, errors.New("invalid json unicode escape")
+		}
+
+		n, err := strconv.ParseUint(string(s[:4]), 16, 16)
+		return rune(n), err
+	}
+
+	r, err := hex(s)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if utf16.IsSurrogate(r) && len(s) >= 10 && s[4] == '\\' && s[5] == 'u' {
+		if r2, err := hex(s[6:]); err == nil {
+			if dec := utf16.DecodeRune(r, r2); dec != utf8.RuneError {
+				return dec, 10, nil
+			}
+		}
+	}
+
+	return r, 4, nil
+}
+
+// utf8Buffer holds back a multi-byte character split across streamed chunks until the rest of it
+// arrives, so only complete characters are passed on
+type utf8Buffer struct {
+	pending []byte
+}
+
+// next returns s after any bytes held back from the previous chunk, minus an incomplete character
+// at its end
+func (b *utf8Buffer) next(s string) string {
+	buf := append(b.pending, s...)
+
+	// a character is at most utf8.UTFMax bytes, look for the start of the last one
+	cut := len(buf)
+	for i := len(buf) - 1; i >= 0 && i >= len(buf)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(buf[i]) {
+			if !utf8.FullRune(buf[i:]) {
+				cut = i
+			}
+			break
+		}
+	}
+
+	b.pending = append([]byte(nil), buf[cut:]...)
+	return string(buf[:cut])
+}
+
+// flush returns the bytes still held back, such as a character the stream ended in the middle of
+func (b *utf8Buffer) flush() string {
+	s := string(b.pending)
+	b.pending = nil
+	return s
+}
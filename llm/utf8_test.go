@@ -0,0 +1,111 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+func TestUTF8Buffer(t *testing.T) {
+	tests := []struct {
+		name   string
+		chunks []string
+		want   []string
+		flush  string
+	}{
+		{"ascii", []string{"hello", " world"}, []string{"hello", " world"}, ""},
+		{"split emoji", []string{"hi \xf0\x9f", "\x98\x80!"}, []string{"hi ", "😀!"}, ""},
+		{"one byte at a time", []string{"\xe4", "\xb8", "\xad"}, []string{"", "", "中"}, ""},
+		{"split across three", []string{"a\xf0", "\x9f\x98", "\x80"}, []string{"a", "", "😀"}, ""},
+		{"ends mid character", []string{"ok\xe4\xb8"}, []string{"ok"}, "\xe4\xb8"},
+		{"invalid byte passes through", []string{"a\xffb"}, []string{"a\xffb"}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b utf8Buffer
+
+			var got []string
+			for _, chunk := range tt.chunks {
+				got = append(got, b.next(chunk))
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+
+			if flush := b.flush(); flush != tt.flush {
+				t.Errorf("got flush %q, want %q", flush, tt.flush)
+			}
+		})
+	}
+}
+
+func TestUnquoteBytes(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{`"plain"`, "plain", false},
+		{`"a\"b\\c\/d\n\t"`, "a\"b\\c/d\n\t", false},
+		{`"中"`, "中", false},
+		{`"😀"`, "😀", false},
+		{"\"\xf0\x9f\"", "\xf0\x9f", false},
+		{`"\x"`, "", true},
+		{`"\u12"`, "", true},
+		{`unquoted`, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := unquoteBytes([]byte(tt.in))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPredictSplitRune(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/tokenize", completionHandler())
+	mux.HandleFunc("/completion", func(w http.ResponseWriter, r *http.Request) {
+		// the bytes of 😀 split between two events, as the server sends them
+		fmt.Fprint(w, "data: {\"content\":\"smile \xf0\x9f\"}\n\n")
+		fmt.Fprint(w, "data: {\"content\":\"\x98\x80 done\"}\n\n")
+		writeEvents(w, Prediction{Stop: true})
+	})
+
+	llm := newTestLlama(t, mux)
+
+	var got []string
+	err := llm.Predict(context.Background(), nil, "hello", func(resp api.GenerateResponse) {
+		if resp.Response != "" {
+			got = append(got, resp.Response)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"smile ", "😀 done"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	for _, s := range got {
+		if !utf8.ValidString(s) {
+			t.Errorf("got invalid UTF-8 %q", s)
+		}
+	}
+}
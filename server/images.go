@@ -797,8 +797,43 @@ func formatParams(params map[string][]string) (map[string]interface{}, error) {
 				case reflect.String:
 					out[key] = vals[0]
 				case reflect.Slice:
-					// TODO: only string slices are supported right now
-					out[key] = vals
+					switch field.Type().Elem().Kind() {
+					case reflect.Uint8:
+						// a json document, such as a response schema
+						var v interface{}
+						if err := json.Unmarshal([]byte(vals[0]), &v); err != nil {
+							return nil, fmt.Errorf("invalid json value %s", vals)
+						}
+
+						out[key] = v
+					case reflect.Float32:
+						floatVals := make([]float64, len(vals))
+						for i, val := range vals {
+							floatVal, err := strconv.ParseFloat(val, 32)
+							if err != nil {
+								return nil, fmt.Errorf("invalid float value %s", vals)
+							}
+
+							floatVals[i] = floatVal
+						}
+
+						out[key] = floatVals
+					case reflect.Int:
+						intVals := make([]int64, len(vals))
+						for i, val := range vals {
+							intVal, err := strconv.ParseInt(val, 10, 0)
+							if err != nil {
+								return nil, fmt.Errorf("invalid int value %s", vals)
+							}
+
+							intVals[i] = intVal
+						}
+
+						out[key] = intVals
+					default:
+						// TODO: only string and float slices are supported right now
+						out[key] = vals
+					}
 				default:
 					return nil, fmt.Errorf("unknown type %s for %s", field.Kind(), key)
 				}
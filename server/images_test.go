@@ -1,6 +1,8 @@
 package server
 
 import (
+	"encoding/json"
+	"reflect"
 	"testing"
 
 	"github.com/jmorganca/ollama/api"
@@ -21,3 +23,34 @@ func TestModelPrompt(t *testing.T) {
 		t.Errorf("got %q, want %q", s, want)
 	}
 }
+
+func TestFormatParamsStopTokens(t *testing.T) {
+	out, err := formatParams(map[string][]string{"stop_tokens": {"2", "32000"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the params are stored as json, which is how FromMap gets them back
+	data, err := json.Marshal(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var m map[string]interface{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		t.Fatal(err)
+	}
+
+	var opts api.Options
+	if err := opts.FromMap(m); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []int{2, 32000}; !reflect.DeepEqual(opts.StopTokens, want) {
+		t.Errorf("got stop tokens %v, want %v", opts.StopTokens, want)
+	}
+
+	if _, err := formatParams(map[string][]string{"stop_tokens": {"eos"}}); err == nil {
+		t.Error("got no error for a stop token that isn't a number")
+	}
+}
@@ -3,6 +3,7 @@ package server
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -56,6 +57,25 @@ var loaded struct {
 
 var defaultSessionDuration = 5 * time.Minute
 
+// modelfileOnlyOptions can only be set in a Modelfile, not in the options of a request, since they
+// pass flags to the llama.cpp server, open local files or leave processes running
+var modelfileOnlyOptions = []string{
+	"extra_runner_args",
+	"mmproj_path",
+	"draft_model_path",
+	"detach",
+}
+
+var (
+	errModelfileOnlyOption = errors.New("option can only be set in a Modelfile")
+	errInvalidOptions      = errors.New("invalid options")
+)
+
+// isOptionsError reports whether err from load is a problem with the request's options
+func isOptionsError(err error) bool {
+	return errors.Is(err, errModelfileOnlyOption) || errors.Is(err, errInvalidOptions)
+}
+
 // load a model into memory if it is not already loaded, it is up to the caller to lock loaded.mu before calling this function
 func load(ctx context.Context, model *Model, reqOpts map[string]interface{}, sessionDuration time.Duration) error {
 	opts := api.DefaultOptions()
@@ -64,9 +84,19 @@ func load(ctx context.Context, model *Model, reqOpts map[string]interface{}, ses
 		return err
 	}
 
+	for _, key := range modelfileOnlyOptions {
+		if _, ok := reqOpts[key]; ok {
+			return fmt.Errorf("%s: %w", key, errModelfileOnlyOption)
+		}
+	}
+
 	if err := opts.FromMap(reqOpts); err != nil {
 		log.Printf("could not merge model options: %v", err)
-		return err
+		return fmt.Errorf("%w: %w", errInvalidOptions, err)
+	}
+
+	if err := opts.Validate(); err != nil {
+		return fmt.Errorf("%w: %w", errInvalidOptions, err)
 	}
 
 	// check if the loaded model is still running in a subprocess, in case something unexpected happened
@@ -90,6 +120,7 @@ func load(ctx context.Context, model *Model, reqOpts map[string]interface{}, ses
 
 		if model.Embeddings != nil && len(model.Embeddings) > 0 {
 			opts.EmbeddingOnly = true // this is requried to generate embeddings, completions will still work
+			opts.EmbeddingEnabled = true
 			loaded.Embeddings = model.Embeddings
 		}
 
@@ -126,7 +157,9 @@ func load(ctx context.Context, model *Model, reqOpts map[string]interface{}, ses
 
 			opts.NumKeep = len(tokensWithSystem) - len(tokensNoSystem)
 
-			llmModel.SetOptions(opts)
+			if err := llmModel.SetOptions(opts); err != nil {
+				return err
+			}
 		}
 	}
 	loaded.expireAt = time.Now().Add(sessionDuration)
@@ -172,7 +205,10 @@ func GenerateHandler(c *gin.Context) {
 	}
 
 	sessionDuration := defaultSessionDuration // TODO: set this duration from the request if specified
-	if err := load(c.Request.Context(), model, req.Options, sessionDuration); err != nil {
+	if err := load(c.Request.Context(), model, req.Options, sessionDuration); isOptionsError(err) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
@@ -251,7 +287,10 @@ func EmbeddingHandler(c *gin.Context) {
 	}
 
 	embedding, err := loaded.llm.Embedding(c.Request.Context(), req.Prompt)
-	if err != nil {
+	if errors.Is(err, llm.ErrEmbeddingDisabled) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
 		log.Printf("embedding generation failed: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate embedding"})
 		return
@@ -536,13 +575,15 @@ func Serve(ln net.Listener, origins []string) error {
 		Handler: r,
 	}
 
-	// listen for a ctrl+c and stop any loaded llm
+	// listen for a ctrl+c or termination and stop the loaded llama.cpp servers
 	signals := make(chan os.Signal, 1)
-	signal.Notify(signals, syscall.SIGINT)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
 		<-signals
-		if loaded.llm != nil {
-			loaded.llm.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := llm.Shutdown(ctx); err != nil {
+			log.Print(err)
 		}
 		os.Exit(0)
 	}()
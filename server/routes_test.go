@@ -0,0 +1,181 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/jmorganca/ollama/llm"
+)
+
+// TestHelperLlamaServer stands in for the llama.cpp server when a test's runner executes the test
+// binary, answering pings and tokenizing one token per word
+func TestHelperLlamaServer(t *testing.T) {
+	if os.Getenv("OLLAMA_TEST_LLAMA_SERVER") != "1" {
+		t.Skip("only run as a runner")
+	}
+
+	var port string
+	for i, arg := range os.Args {
+		if arg == "--port" && i+1 < len(os.Args) {
+			port = os.Args[i+1]
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/tokenize", func(w http.ResponseWriter, r *http.Request) {
+		var req llm.TokenizeRequest
+		json.NewDecoder(r.Body).Decode(&req)
+
+		tokens := make([]int, len(strings.Fields(req.Content)))
+		json.NewEncoder(w).Encode(llm.TokenizeResponse{Tokens: tokens})
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:"+port)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	http.Serve(ln, mux)
+	os.Exit(0)
+}
+
+// writeQ8Model writes the header of a Q8_0 ggjt model, a quantization the gpu is disabled for
+func writeQ8Model(t *testing.T) string {
+	t.Helper()
+
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, []uint32{
+		0x67676a74, // ggjt
+		3,
+		32000, // vocab
+		4096,  // embd
+		256,   // mult
+		32,    // head
+		32,    // layer
+		128,   // rot
+		7,     // Q8_0
+	})
+
+	p := filepath.Join(t.TempDir(), "model.bin")
+	if err := os.WriteFile(p, b.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	return p
+}
+
+func TestLoadAdjustedOptions(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the runner is a shell script")
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("OLLAMA_TEST_LLAMA_SERVER", "1")
+	defer func(orig string) { llm.RunnerTmpDir = orig }(llm.RunnerTmpDir)
+	llm.RunnerTmpDir = t.TempDir()
+	llm.RunnerFS = fstest.MapFS{
+		"llama.cpp/ggml/build/cpu/bin/server": {
+			Data: []byte(fmt.Sprintf("#!/bin/sh\nexec %q -test.run='^TestHelperLlamaServer$' -- \"$@\"\n", exe)),
+		},
+	}
+
+	model := &Model{
+		ModelPath: writeQ8Model(t),
+		Template:  "{{ .System }} {{ .Prompt }}",
+		System:    "be brief",
+		Digest:    "sha256:test",
+		Options:   map[string]interface{}{"num_gpu": float64(33), "skip_memory_check": true},
+	}
+
+	loaded.mu.Lock()
+	defer loaded.mu.Unlock()
+	defer func() {
+		if loaded.llm != nil {
+			loaded.llm.Close()
+		}
+		loaded.llm, loaded.digest = nil, ""
+		if loaded.expireTimer != nil {
+			loaded.expireTimer.Stop()
+			loaded.expireTimer = nil
+		}
+	}()
+
+	// the gpu is disabled for the model, which isn't a change of options to reload for
+	if err := load(context.Background(), model, nil, time.Minute); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+
+	if loaded.llm == nil {
+		t.Fatal("no model loaded")
+	}
+
+	if err := load(context.Background(), model, nil, time.Minute); err != nil {
+		t.Fatalf("load again: %v", err)
+	}
+}
+
+func TestLoadModelfileOnlyOptions(t *testing.T) {
+	model := &Model{ModelPath: writeQ8Model(t), Digest: "sha256:test"}
+
+	for _, key := range modelfileOnlyOptions {
+		t.Run(key, func(t *testing.T) {
+			loaded.mu.Lock()
+			defer loaded.mu.Unlock()
+
+			err := load(context.Background(), model, map[string]interface{}{key: "x"}, time.Minute)
+			if !errors.Is(err, errModelfileOnlyOption) {
+				t.Errorf("got error %v, want %v", err, errModelfileOnlyOption)
+			}
+
+			if loaded.llm != nil {
+				t.Error("the model was loaded")
+			}
+		})
+	}
+}
+
+func TestLoadInvalidOptions(t *testing.T) {
+	model := &Model{ModelPath: writeQ8Model(t), Digest: "sha256:test"}
+
+	tests := []struct {
+		name string
+		opts map[string]interface{}
+	}{
+		{"out of range", map[string]interface{}{"top_p": 1.5}},
+		{"not an integer", map[string]interface{}{"stop_tokens": []interface{}{1.5}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loaded.mu.Lock()
+			defer loaded.mu.Unlock()
+
+			if err := load(context.Background(), model, tt.opts, time.Minute); !isOptionsError(err) {
+				t.Errorf("got error %v, want %v", err, errInvalidOptions)
+			}
+
+			if loaded.llm != nil {
+				t.Error("the model was loaded")
+			}
+		})
+	}
+}